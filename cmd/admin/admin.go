@@ -0,0 +1,135 @@
+// Command admin does administration that cannot be done through the API, such as creating the first admin user and
+// managing client app keys. It uses the same env vars as the server to open the datastore.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/34South/envr"
+	"github.com/mikedonnici/rtcl-api/datastore"
+)
+
+const usage = `usage: admin [-c cfg] <command> [args]
+
+commands:
+  role <email> <role>              set the role of a user, eg "admin" or "user"
+  key add <name> <scope>...        register a client app and print its key
+  key list                         list client apps
+  key revoke <id>                  revoke the key of a client app
+  purge                            delete users whose deletion grace period has passed, eg from cron
+  migrate                          give an id to saved searches from before searches had ids
+
+scopes: users:create users:read users:notify
+`
+
+func main() {
+
+	cfgFlag := flag.String("c", "", "Specify cfg file (optional - will override env vars)")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+
+	e := envr.New("rtclAdminEnv", []string{})
+	if *cfgFlag != "" {
+		e.Files = []string{*cfgFlag}
+	}
+	e.Auto()
+
+	ds, err := datastore.OpenFromEnv()
+	if err != nil {
+		log.Fatalf("Datastore could not be opened - %s", err)
+	}
+	defer ds.Close()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "role":
+		if len(args) != 3 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		err = setRole(ds, args[1], args[2])
+	case "key":
+		err = key(ds, args[1:])
+	case "purge":
+		var n int
+		n, err = ds.PurgeDeletedUsers()
+		fmt.Printf("Deleted %d users\n", n)
+	case "migrate":
+		var n int
+		n, err = ds.MigrateSearches()
+		fmt.Printf("Migrated searches for %d users\n", n)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// setRole sets the role for the user with the email
+func setRole(ds *datastore.Datastore, email, role string) error {
+	u, err := ds.UserByEmail(email)
+	if err != nil {
+		return fmt.Errorf("could not find user %s - %s", email, err)
+	}
+	err = u.SetRole(role)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s (%s) now has role %s\n", u.Email, u.ID.Hex(), role)
+	return nil
+}
+
+// key runs the client key sub commands
+func key(ds *datastore.Datastore, args []string) error {
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	switch {
+	case args[0] == "add" && len(args) >= 3:
+		c, k, err := ds.NewClient(args[1], args[2:])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Added client %s (%s) with scopes %s\n", c.Name, c.ID.Hex(), strings.Join(c.Scopes, " "))
+		fmt.Printf("Key: %s\n", k)
+		fmt.Println("The key is not stored so copy it now, it cannot be shown again.")
+		return nil
+	case args[0] == "list" && len(args) == 1:
+		xc, err := ds.ListClients()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tKEY\tSCOPES\tCREATED\tREVOKED")
+		for _, c := range xc {
+			fmt.Fprintf(w, "%s\t%s\t%s...\t%s\t%s\t%t\n", c.ID.Hex(), c.Name, c.KeyPrefix,
+				strings.Join(c.Scopes, " "), c.Created.Format("2006-01-02"), c.Revoked)
+		}
+		return w.Flush()
+	case args[0] == "revoke" && len(args) == 2:
+		err := ds.RevokeClient(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Revoked client %s\n", args[1])
+		return nil
+	}
+
+	flag.Usage()
+	os.Exit(2)
+	return nil
+}
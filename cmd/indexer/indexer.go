@@ -8,8 +8,9 @@ import (
 	"strconv"
 
 	"github.com/34South/envr"
-	"github.com/algolia/algoliasearch-client-go/algoliasearch"
 	"github.com/mikedonnici/pubmed"
+	"github.com/mikedonnici/rtcl-api/datastore"
+	"github.com/mikedonnici/rtcl-api/search"
 )
 
 const batchSize = 500
@@ -28,23 +29,48 @@ type article struct {
 	pubmed.Article
 }
 
-var algoliaClient algoliasearch.Client
+func main() {
 
-func init() {
+	// SEARCH_INDEX="local" writes the articles to the built-in index in the datastore, instead of Algolia. The
+	// datastore needs BOLTDB_PATH or the MONGODB_* vars, see datastore.OpenFromEnv().
+	local := os.Getenv("SEARCH_INDEX") == "local"
+	required := []string{"ALGOLIA_APP_ID", "ALGOLIA_ADMIN_KEY"}
+	if local {
+		required = nil
+	}
+	envr.New("indexerEnv", required).Auto()
 
-	envr.New("algoliaEnv", []string{
-		"ALGOLIA_APP_ID",
-		"ALGOLIA_ADMIN_KEY",
-	}).Auto()
+	d, err := datastore.OpenFromEnv()
+	if err != nil {
+		log.Fatalf("Datastore could not be opened - %s", err)
+	}
+	defer d.Close()
 
-	algoliaClient = algoliasearch.NewClient(os.Getenv("ALGOLIA_APP_ID"), os.Getenv("ALGOLIA_ADMIN_KEY"))
-}
+	var ix search.SearchIndex = search.NewAlgolia(os.Getenv("ALGOLIA_APP_ID"), os.Getenv("ALGOLIA_ADMIN_KEY"),
+		search.AlgoliaIndexName)
+	if local {
+		store, err := search.NewStore(d)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		ix, err = search.Open(store)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
 
-func main() {
-	add()
+	err = ix.SetSettings(search.DefaultSettings)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = add(ix, d)
+	if err != nil {
+		log.Fatalln(err)
+	}
 }
 
-func add() {
+// add fetches the recent articles for each category from PubMed, and saves them to the datastore and the index
+func add(ix search.SearchIndex, d *datastore.Datastore) error {
 
 	for category, term := range pubmedQueries {
 
@@ -53,7 +79,7 @@ func add() {
 		p.BackDays = backDays
 		err := p.Search()
 		if err != nil {
-			log.Fatalln(err)
+			return err
 		}
 
 		for i := 0; i < p.ResultCount; i++ {
@@ -62,47 +88,55 @@ func add() {
 				fmt.Println(err)
 			}
 
-			var indexObjects []algoliasearch.Object
-			for _, a := range xa.Articles {
-				rtcl := article{category, a}
-				indexObjects = append(indexObjects, searchObject(rtcl))
-			}
-
-			index := algoliaClient.InitIndex("articles")
-			res, err := index.AddObjects(indexObjects)
+			err = indexArticles(ix, d, category, xa.Articles)
 			if err != nil {
-				fmt.Println(err)
-				os.Exit(1)
+				return err
 			}
-			fmt.Println(res)
+			fmt.Printf("Indexed %d %s articles\n", len(xa.Articles), category)
 
 			i += batchSize
 		}
 	}
+	return nil
 }
 
-// convert a pubmed.Article to map[string]interface{} which is same as algoliasearch.Object
-func searchObject(a article) algoliasearch.Object {
-
-	so := algoliasearch.Object{}
-	so["category"] = a.category
-	so["objectID"] = strconv.Itoa(a.ID)
-	so["title"] = a.Title
-	so["url"] = a.URL
-	so["keywords"] = a.Keywords
-	so["pubName"] = a.Journal
-	so["pubNameAbbr"] = a.JournalAbbrev
-	so["pubVolume"] = a.Volume
-	so["pubIssue"] = a.Issue
-	so["pubPageRef"] = a.Pages
-	so["pubTime"] = a.PubDate.Unix()
-	so["pubDate"] = a.PubDate.Format("2006-01-02")
-
-	// Must have a summary field for snippets to work
-	so["summary"] = ""
+// indexArticles upserts the articles in the category to the articles collection, by PMID, and then to the index.
+// The datastore is saved first so that any article that can be found has a stored copy.
+func indexArticles(ix search.SearchIndex, d *datastore.Datastore, category string, xa []pubmed.Article) error {
+	docs := make([]search.Document, len(xa))
+	articles := make([]datastore.Article, len(xa))
+	for i, a := range xa {
+		docs[i] = searchDocument(article{category, a})
+		articles[i] = docs[i].Article()
+	}
+	err := d.SaveArticles(articles...)
+	if err != nil {
+		return err
+	}
+	return ix.Upsert(docs...)
+}
+
+// searchDocument converts a pubmed.Article to a search.Document, which is sent to Algolia as an object with the same
+// fields
+func searchDocument(a article) search.Document {
+
+	d := search.Document{
+		Category:    a.category,
+		ObjectID:    strconv.Itoa(a.ID),
+		Title:       a.Title,
+		URL:         a.URL,
+		Keywords:    a.Keywords,
+		PubName:     a.Journal,
+		PubNameAbbr: a.JournalAbbrev,
+		PubVolume:   a.Volume,
+		PubIssue:    a.Issue,
+		PubPageRef:  a.Pages,
+		PubTime:     a.PubDate.Unix(),
+		PubDate:     a.PubDate.Format("2006-01-02"),
+	}
 	if len(a.Abstract) > 0 {
-		so["summary"] = a.Abstract[0].Value
+		d.Summary = a.Abstract[0].Value
 	}
 
-	return so
+	return d
 }
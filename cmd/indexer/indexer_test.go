@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/mikedonnici/pubmed"
+	"github.com/mikedonnici/rtcl-api/datastore"
+	"github.com/mikedonnici/rtcl-api/search"
+	"github.com/mikedonnici/rtcl-api/testdata"
+)
+
+var testArticles = []pubmed.Article{
+	{
+		ID:            29747859,
+		Title:         "Comparison of Long-Term Mortality in Patients",
+		URL:           "https://doi.org/10.1097/MD.0000000000002896",
+		Keywords:      []string{"Nakamura Y", "Asaumi Y"},
+		Journal:       "The American journal of cardiology",
+		JournalAbbrev: "Am J Cardiol",
+		Volume:        "122",
+		Issue:         "2",
+		Pages:         "206-212",
+		PubDate:       time.Date(2018, 7, 15, 0, 0, 0, 0, time.UTC),
+		Abstract:      []pubmed.Abstract{{Value: "Although current guidelines have highlighted the mortality"}},
+	},
+	{
+		ID:      29747860,
+		Title:   "No abstract",
+		PubDate: time.Date(2018, 7, 16, 0, 0, 0, 0, time.UTC),
+	},
+}
+
+var indexerTestDS *datastore.Datastore
+
+func TestIndexer(t *testing.T) {
+
+	var err error
+
+	indexerTestDS, err = testdata.NewMemoryStore()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	t.Run("testIndexArticles", testIndexArticles)
+	t.Run("testIndexArticlesError", testIndexArticlesError)
+}
+
+func testIndexArticles(t *testing.T) {
+	is := is.New(t)
+	fake := search.NewFake()
+	is.NoErr(indexArticles(fake, indexerTestDS, "cardiology", testArticles))
+	is.Equal(len(fake.Upserts), 1)    // expected one upsert for the batch
+	is.Equal(len(fake.Upserts[0]), 2) // expected both articles in the upsert
+
+	d, ok := fake.Document("29747859")
+	is.True(ok)
+	is.Equal(d, search.Document{
+		ObjectID:    "29747859",
+		Category:    "cardiology",
+		Title:       "Comparison of Long-Term Mortality in Patients",
+		URL:         "https://doi.org/10.1097/MD.0000000000002896",
+		Keywords:    []string{"Nakamura Y", "Asaumi Y"},
+		PubName:     "The American journal of cardiology",
+		PubNameAbbr: "Am J Cardiol",
+		PubVolume:   "122",
+		PubIssue:    "2",
+		PubPageRef:  "206-212",
+		PubTime:     1531612800,
+		PubDate:     "2018-07-15",
+		Summary:     "Although current guidelines have highlighted the mortality",
+	})
+	d, ok = fake.Document("29747860")
+	is.True(ok)
+	is.Equal(d.Summary, "") // expected an empty summary with no abstract
+
+	// the articles are stored too
+	a, err := indexerTestDS.ArticleByPMID("29747859")
+	is.NoErr(err)
+	is.Equal(a.Title, "Comparison of Long-Term Mortality in Patients")
+	is.Equal(a.Category, "cardiology")
+	is.Equal(a.SourceNameAbbrev, "Am J Cardiol")
+	is.True(a.Published.Equal(time.Date(2018, 7, 15, 0, 0, 0, 0, time.UTC)))
+	is.Equal(a.Source(), "Am J Cardiol 2018-07-15; 122(2): 206-212")
+
+	// indexing again replaces the articles
+	is.NoErr(indexArticles(fake, indexerTestDS, "oncology", testArticles[:1]))
+	is.Equal(fake.Len(), 2)
+	d, _ = fake.Document("29747859")
+	is.Equal(d.Category, "oncology")
+	a, err = indexerTestDS.ArticleByPMID("29747859")
+	is.NoErr(err)
+	is.Equal(a.Category, "oncology")
+
+	r, err := fake.Search(search.Query{Text: "mortality", Categories: []string{"oncology"}})
+	is.NoErr(err)
+	is.Equal(r.NbHits, 1)
+}
+
+func testIndexArticlesError(t *testing.T) {
+	is := is.New(t)
+	fake := search.NewFake()
+	fake.Err = errors.New("index is down")
+	is.Equal(indexArticles(fake, indexerTestDS, "cardiology", testArticles[1:]), fake.Err)
+	is.Equal(fake.Len(), 0)
+}
@@ -1,10 +1,88 @@
-package notifier
+// Command notifier emails the users that have a notification due. It uses the same env vars as the server to open
+// the datastore and sign the unsubscribe links, and is run regularly, eg from cron or the Heroku scheduler.
+package main
 
 import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/34South/envr"
 	"github.com/mikedonnici/rtcl-api/datastore"
+	"github.com/mikedonnici/rtcl-api/emailer"
 )
 
+func main() {
+
+	cfgFlag := flag.String("c", "", "Specify cfg file (optional - will override env vars)")
+	flag.Parse()
+
+	// the datastore needs either MONGODB_* or BOLTDB_PATH, see datastore.OpenFromEnv()
+	e := envr.New("rtclNotifierEnv", []string{
+		"API_URL",
+		"APP_URL",
+		"TOKEN_SIGNINGKEY",
+	})
+	if *cfgFlag != "" {
+		e.Files = []string{*cfgFlag}
+	}
+	e.Auto()
+
+	n, err := run(os.Getenv("TOKEN_SIGNINGKEY"), emailer.Notification)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("Sent %d notifications", n)
+}
+
+// run opens the datastore from the env vars and sends the notifications that are due with deliver, moving each user
+// on to their next notification. It returns the number of notifications sent.
+func run(signingKey string, deliver func(u datastore.User, token string) error) (int, error) {
+	ds, err := datastore.OpenFromEnv()
+	if err != nil {
+		return 0, err
+	}
+	defer ds.Close()
+	return sendNotifications(ds, emailNotification(signingKey, deliver))
+}
+
 // notificationsDue fetches returns a set of User that have the notification field value in the past
 func notificationsDue(ds *datastore.Datastore) ([]datastore.User, error) {
 	return ds.UsersDueNotification()
 }
+
+// sendNotifications calls send for each user that has a notification due, and then moves their notification date on
+// to the next one in their schedule. A user whose notification could not be sent stays due, so they are tried again
+// on the next run. It returns the number of notifications sent.
+func sendNotifications(ds *datastore.Datastore, send func(u datastore.User) error) (int, error) {
+	xu, err := notificationsDue(ds)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, u := range xu {
+		err = send(u)
+		if err != nil {
+			log.Printf("Notification for user %s was not sent: %s", u.ID.Hex(), err)
+			continue
+		}
+		n++
+		err = u.AdvanceNotification()
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// emailNotification returns a send func for sendNotifications that passes deliver, usually emailer.Notification, an
+// unsubscribe token signed with the server signing key for the link in the email
+func emailNotification(signingKey string, deliver func(u datastore.User, token string) error) func(u datastore.User) error {
+	return func(u datastore.User) error {
+		tk, err := u.ActionToken(datastore.ActionUnsubscribe, signingKey)
+		if err != nil {
+			return err
+		}
+		return deliver(u, tk)
+	}
+}
@@ -1,45 +1,35 @@
-package notifier
+package main
 
 import (
+	"errors"
+	"io/ioutil"
 	"log"
+	"os"
 	"testing"
+	"time"
 
 	"github.com/matryer/is"
 	"github.com/mikedonnici/rtcl-api/datastore"
-	"github.com/mikedonnici/rtcl-api/datastore/mongo"
 	"github.com/mikedonnici/rtcl-api/testdata"
 )
 
-var notificationTestDB = testdata.New()
-var notificationTestDS = datastore.New()
+var notificationTestDS *datastore.Datastore
 
 func TestNotification(t *testing.T) {
 
 	var err error
 
-	err = notificationTestDB.SetupMongoDB()
-	if err != nil {
-		log.Fatalln(err)
-	}
-	defer cleanupUserTest()
-
-	notificationTestDS.Mongo, err = mongo.NewConnection(testdata.MongoDSN, notificationTestDB.DBName, "test")
+	notificationTestDS, err = testdata.NewMemoryStore()
 	if err != nil {
 		log.Fatalln(err)
 	}
 
 	t.Run("user", func(t *testing.T) {
 		t.Run("testUserByID", testNotificationsDue)
+		t.Run("testSendNotifications", testSendNotifications)
 	})
 }
 
-func cleanupUserTest() {
-	err := notificationTestDB.TearDownMongoDB()
-	if err != nil {
-		log.Println(err)
-	}
-}
-
 // Tests fetching a list of users that have notifications due. Note this test is really covered by the user tests.
 func testNotificationsDue(t *testing.T) {
 	is := is.New(t)
@@ -48,4 +38,66 @@ func testNotificationsDue(t *testing.T) {
 	is.Equal(len(xu), 2) // expected 2 users with notifications due
 }
 
+// Tests that sending moves the notification date on, so users are no longer due, unless the send failed
+func testSendNotifications(t *testing.T) {
+	is := is.New(t)
+	n, err := sendNotifications(notificationTestDS, func(u datastore.User) error {
+		return errors.New("mail server down")
+	})
+	is.NoErr(err)
+	is.Equal(n, 0)
+	xu, err := notificationsDue(notificationTestDS)
+	is.NoErr(err)
+	is.Equal(len(xu), 2) // expected users to stay due when the send fails
 
+	var sent []string
+	n, err = sendNotifications(notificationTestDS, func(u datastore.User) error {
+		sent = append(sent, u.Email)
+		return nil
+	})
+	is.NoErr(err)
+	is.Equal(n, 2)
+	is.Equal(len(sent), 2)
+	xu, err = notificationsDue(notificationTestDS)
+	is.NoErr(err)
+	is.Equal(len(xu), 0) // expected no users due once their notifications are sent
+}
+
+// Tests the command end to end against a bolt file set in the env, as it is run in production. Each user that is due
+// gets an unsubscribe token for their link, and is moved on to their next notification.
+func TestRun(t *testing.T) {
+	is := is.New(t)
+	f, err := ioutil.TempFile("", "rtcl_notifier_*.db")
+	is.NoErr(err)
+	f.Close()
+	defer os.Remove(f.Name())
+	ds, err := datastore.NewBoltStore(f.Name())
+	is.NoErr(err)
+	is.NoErr(testdata.Populate(ds))
+	is.NoErr(ds.Close()) // the command opens the file itself
+	os.Setenv("BOLTDB_PATH", f.Name())
+	defer os.Unsetenv("BOLTDB_PATH")
+
+	const signingKey = "notifierKey"
+	sent := map[string]string{}
+	n, err := run(signingKey, func(u datastore.User, token string) error {
+		sent[u.ID.Hex()] = token
+		return nil
+	})
+	is.NoErr(err)
+	is.Equal(n, 2)         // expected 2 notifications sent
+	is.Equal(len(sent), 2) // expected each due user to be sent a notification
+	for id, token := range sent {
+		a, err := datastore.DecodeActionToken(token, datastore.ActionUnsubscribe, signingKey, time.Now())
+		is.NoErr(err)                // expected an unsubscribe token
+		is.Equal(a.UserID.Hex(), id) // token is for the wrong user
+	}
+
+	n, err = run(signingKey, func(u datastore.User, token string) error {
+		sent[u.ID.Hex()] = token
+		return nil
+	})
+	is.NoErr(err)
+	is.Equal(n, 0)         // expected no users due once their notifications are sent
+	is.Equal(len(sent), 2) // expected no more notifications sent
+}
@@ -0,0 +1,39 @@
+package datastore
+
+import (
+	"time"
+)
+
+// ScheduleDeletion ends all of the user's sessions and deletes the user after the grace period, during which they
+// can log in and call CancelDeletion. With no grace period the user is deleted straight away.
+func (u *User) ScheduleDeletion(grace time.Duration) error {
+	if grace <= 0 {
+		return u.ds.DeleteUser(u.ID.Hex())
+	}
+	u.DeleteAt = u.ds.now().Add(grace)
+	return u.EndSessions() // saves the user
+}
+
+// CancelDeletion cancels a deletion scheduled by ScheduleDeletion
+func (u *User) CancelDeletion() error {
+	u.DeleteAt = time.Time{}
+	return u.update()
+}
+
+// PurgeDeletedUsers deletes the users whose grace period has passed, and returns the number deleted. It is run
+// from a scheduled job.
+func (ds *Datastore) PurgeDeletedUsers() (int, error) {
+	xu, err := ds.Users.DueDeletion(ds.now())
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, u := range xu {
+		err = ds.DeleteUser(u.ID.Hex())
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
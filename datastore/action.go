@@ -0,0 +1,171 @@
+package datastore
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Purposes for action tokens. A token can only be used for the purpose it was issued for.
+const (
+	ActionConfirmEmail  = "confirm-email"
+	ActionResetPassword = "reset-password"
+	ActionChangeEmail   = "change-email"
+	ActionUnsubscribe   = "unsubscribe" // link in notification emails, see User.Unsubscribe
+	ActionMFA           = "mfa"         // second step of a login, see MFAAuth
+	ActionMagicLink     = "magic-link"
+)
+
+// ActionTokenTTL is the lifetime of a new action token for each purpose
+var ActionTokenTTL = map[string]time.Duration{
+	ActionConfirmEmail:  7 * 24 * time.Hour,
+	ActionResetPassword: time.Hour,
+	ActionChangeEmail:   24 * time.Hour,
+	ActionUnsubscribe:   30 * 24 * time.Hour,
+	ActionMFA:           5 * time.Minute,
+	ActionMagicLink:     15 * time.Minute,
+}
+
+// Action token errors
+var (
+	ErrActionTokenInvalid = errors.New("action token is not valid")
+	ErrActionTokenExpired = errors.New("action token has expired")
+	ErrActionTokenUsed    = errors.New("action token has already been used")
+)
+
+// ActionToken authorises a single action for a user, such as confirming their email or resetting their password,
+// and is sent to the user in an emailed link. It is a JWT signed with a key derived from the server signing key, so
+// it can never be mistaken for an access token. Each token has a unique ID so it can be consumed, after which it
+// cannot be used again.
+type ActionToken struct {
+	ID      string
+	UserID  bson.ObjectId
+	Purpose string
+	Data    string // optional value for the action, eg the new address for an email change
+	Issued  time.Time
+	Expires time.Time
+}
+
+type actionClaims struct {
+	Purpose string `json:"purpose"`
+	Data    string `json:"data,omitempty"`
+	jwt.StandardClaims
+}
+
+// NewActionToken returns an ActionToken for the user and purpose issued at now, which expires after the
+// ActionTokenTTL
+func NewActionToken(userID bson.ObjectId, purpose string, now time.Time) ActionToken {
+	return ActionToken{
+		ID:      randomID(),
+		UserID:  userID,
+		Purpose: purpose,
+		Issued:  now,
+		Expires: now.Add(ActionTokenTTL[purpose]),
+	}
+}
+
+// Encode returns the signed token string
+func (a ActionToken) Encode(signingKey string) (string, error) {
+	if len(signingKey) == 0 {
+		return "", errors.New("Signing key cannot be blank")
+	}
+	if _, ok := ActionTokenTTL[a.Purpose]; !ok {
+		return "", errors.New("unknown action token purpose " + a.Purpose)
+	}
+	c := actionClaims{
+		Purpose: a.Purpose,
+		Data:    a.Data,
+		StandardClaims: jwt.StandardClaims{
+			Id:        a.ID,
+			Subject:   a.UserID.Hex(),
+			IssuedAt:  a.Issued.Unix(),
+			ExpiresAt: a.Expires.Unix(),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString(actionKey(signingKey))
+}
+
+// DecodeActionToken checks the signature, purpose and expiry at now of the token string and returns the
+// ActionToken. It does not check whether the token has been consumed - see Datastore.CheckActionToken.
+func DecodeActionToken(token, purpose, signingKey string, now time.Time) (ActionToken, error) {
+	var a ActionToken
+	var c actionClaims
+
+	// the times are checked below against now, rather than the system clock
+	p := jwt.Parser{SkipClaimsValidation: true}
+	_, err := p.ParseWithClaims(token, &c, func(tok *jwt.Token) (interface{}, error) {
+		if tok.Method != jwt.SigningMethodHS256 {
+			return nil, ErrActionTokenInvalid
+		}
+		return actionKey(signingKey), nil
+	})
+	if err != nil {
+		return a, ErrActionTokenInvalid
+	}
+	if c.Purpose != purpose || len(c.Id) == 0 || !bson.IsObjectIdHex(c.Subject) || now.Unix() < c.IssuedAt {
+		return a, ErrActionTokenInvalid
+	}
+	if now.Unix() > c.ExpiresAt {
+		return a, ErrActionTokenExpired
+	}
+
+	a.ID = c.Id
+	a.UserID = bson.ObjectIdHex(c.Subject)
+	a.Purpose = c.Purpose
+	a.Data = c.Data
+	a.Issued = time.Unix(c.IssuedAt, 0)
+	a.Expires = time.Unix(c.ExpiresAt, 0)
+	return a, nil
+}
+
+// ActionToken returns a signed action token string for the user
+func (u *User) ActionToken(purpose, signingKey string) (string, error) {
+	return NewActionToken(u.ID, purpose, u.ds.now()).Encode(signingKey)
+}
+
+// CheckActionToken decodes the token string at the datastore time and checks that it has not been used. The token
+// is not consumed, so this can be used to validate a link before the action is carried out.
+func (ds *Datastore) CheckActionToken(token, purpose, signingKey string) (ActionToken, error) {
+	a, err := DecodeActionToken(token, purpose, signingKey, ds.now())
+	if err != nil {
+		return a, err
+	}
+	used, err := ds.ConsumedTokens.Exists(a.ID)
+	if err != nil {
+		return a, err
+	}
+	if used {
+		return a, ErrActionTokenUsed
+	}
+	return a, nil
+}
+
+// ConsumeActionToken marks the token as used. It returns ErrActionTokenUsed if the token was already consumed, so
+// the caller should only carry out the action when this succeeds.
+func (ds *Datastore) ConsumeActionToken(a ActionToken) error {
+	err := ds.ConsumedTokens.Add(a.ID, a.Expires)
+	if err == ErrDuplicate {
+		return ErrActionTokenUsed
+	}
+	return err
+}
+
+// actionKey derives the key for signing action tokens from the server signing key
+func actionKey(signingKey string) []byte {
+	h := hmac.New(sha256.New, []byte(signingKey))
+	h.Write([]byte("rtcl action token"))
+	return h.Sum(nil)
+}
+
+// randomID returns a random 128 bit hex string
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,118 @@
+package datastore_test
+
+import (
+	"log"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/mikedonnici/rtcl-api/datastore"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var actionTestDS *datastore.Datastore
+
+func TestActionToken(t *testing.T) {
+
+	backends, err := testBackends()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	for _, b := range backends {
+		actionTestDS = b.ds
+		t.Run(b.name, func(t *testing.T) {
+			t.Run("testActionTokenDecode", testActionTokenDecode)
+			t.Run("testActionTokenWrongPurpose", testActionTokenWrongPurpose)
+			t.Run("testActionTokenWrongKey", testActionTokenWrongKey)
+			t.Run("testActionTokenExpired", testActionTokenExpired)
+			t.Run("testActionTokenSingleUse", testActionTokenSingleUse)
+			t.Run("testActionTokenClock", testActionTokenClock)
+		})
+		b.cleanup()
+	}
+}
+
+func testActionTokenDecode(t *testing.T) {
+	is := is.New(t)
+	a := datastore.NewActionToken(bson.ObjectIdHex(userID), datastore.ActionChangeEmail, time.Now())
+	a.Data = "new@rtcl.io"
+	tk, err := a.Encode(signingKey)
+	is.NoErr(err) // error encoding action token
+
+	a2, err := datastore.DecodeActionToken(tk, datastore.ActionChangeEmail, signingKey, time.Now())
+	is.NoErr(err)                                 // error decoding action token
+	is.Equal(a2.ID, a.ID)                         // id mismatch
+	is.Equal(a2.UserID, a.UserID)                 // user id mismatch
+	is.Equal(a2.Data, "new@rtcl.io")              // data mismatch
+	is.Equal(a2.Expires.Unix(), a.Expires.Unix()) // expiry mismatch
+}
+
+func testActionTokenWrongPurpose(t *testing.T) {
+	is := is.New(t)
+	tk, err := datastore.NewActionToken(bson.ObjectIdHex(userID), datastore.ActionConfirmEmail, time.Now()).Encode(signingKey)
+	is.NoErr(err) // error encoding action token
+	_, err = datastore.DecodeActionToken(tk, datastore.ActionResetPassword, signingKey, time.Now())
+	is.Equal(err, datastore.ErrActionTokenInvalid) // confirm token should not work for a password reset
+}
+
+func testActionTokenWrongKey(t *testing.T) {
+	is := is.New(t)
+	tk, err := datastore.NewActionToken(bson.ObjectIdHex(userID), datastore.ActionResetPassword, time.Now()).Encode("dodgeyKey")
+	is.NoErr(err) // error encoding action token
+	_, err = datastore.DecodeActionToken(tk, datastore.ActionResetPassword, signingKey, time.Now())
+	is.Equal(err, datastore.ErrActionTokenInvalid) // token signed with a different key should be invalid
+
+	// an access token signed with the same key is not an action token
+	at, err := datastore.NewToken(issuer, signingKey, ttlHours).Encode()
+	is.NoErr(err) // error encoding access token
+	_, err = datastore.DecodeActionToken(at.String(), datastore.ActionResetPassword, signingKey, time.Now())
+	is.Equal(err, datastore.ErrActionTokenInvalid) // access token should be invalid
+}
+
+func testActionTokenExpired(t *testing.T) {
+	is := is.New(t)
+	a := datastore.NewActionToken(bson.ObjectIdHex(userID), datastore.ActionResetPassword, time.Now())
+	a.Expires = time.Now().Add(-time.Minute)
+	tk, err := a.Encode(signingKey)
+	is.NoErr(err) // error encoding action token
+	_, err = datastore.DecodeActionToken(tk, datastore.ActionResetPassword, signingKey, time.Now())
+	is.Equal(err, datastore.ErrActionTokenExpired) // expected expired error
+}
+
+func testActionTokenSingleUse(t *testing.T) {
+	is := is.New(t)
+	tk, err := datastore.NewActionToken(bson.ObjectIdHex(userID), datastore.ActionResetPassword, time.Now()).Encode(signingKey)
+	is.NoErr(err) // error encoding action token
+
+	a, err := actionTestDS.CheckActionToken(tk, datastore.ActionResetPassword, signingKey)
+	is.NoErr(err)                                // token should be valid before use
+	is.NoErr(actionTestDS.ConsumeActionToken(a)) // error consuming token
+	err = actionTestDS.ConsumeActionToken(a)
+	is.Equal(err, datastore.ErrActionTokenUsed) // token should only be consumed once
+	_, err = actionTestDS.CheckActionToken(tk, datastore.ActionResetPassword, signingKey)
+	is.Equal(err, datastore.ErrActionTokenUsed) // token should be rejected after use
+}
+
+// testActionTokenClock tests that user action tokens are issued and checked at the datastore time
+func testActionTokenClock(t *testing.T) {
+	is := is.New(t)
+	now := time.Date(2018, 10, 1, 9, 0, 0, 0, time.UTC)
+	actionTestDS.Now = func() time.Time { return now }
+	defer func() { actionTestDS.Now = nil }()
+
+	u, err := actionTestDS.UserByID(userID)
+	is.NoErr(err)
+	tk, err := u.ActionToken(datastore.ActionResetPassword, signingKey)
+	is.NoErr(err) // error issuing action token
+	a, err := actionTestDS.CheckActionToken(tk, datastore.ActionResetPassword, signingKey)
+	is.NoErr(err) // token should be valid at the datastore time
+	is.True(a.Issued.Equal(now))
+	is.True(a.Expires.Equal(now.Add(time.Hour)))
+
+	_, err = datastore.DecodeActionToken(tk, datastore.ActionResetPassword, signingKey, time.Now())
+	is.Equal(err, datastore.ErrActionTokenExpired) // expected the token to expire an hour after the datastore time
+	now = now.Add(-time.Minute)
+	_, err = actionTestDS.CheckActionToken(tk, datastore.ActionResetPassword, signingKey)
+	is.Equal(err, datastore.ErrActionTokenInvalid) // expected a token issued later to be invalid
+}
@@ -0,0 +1,103 @@
+package datastore
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// MaxArticleIDs is the most articles that can be fetched at once by ArticlesByPMID
+const MaxArticleIDs = 100
+
+// ErrTooManyArticleIDs is returned when more than MaxArticleIDs articles are requested at once
+var ErrTooManyArticleIDs = errors.New("too many article ids")
+
+// Article is an article from PubMed, keyed by its PMID. Articles are added by the indexer, so that logs, bookmarks
+// and digests have a copy that does not depend on the search backend.
+type Article struct {
+	PMID             string    `json:"sourceId" bson:"_id"`
+	Category         string    `json:"category" bson:"category"`
+	Created          time.Time `json:"created" bson:"created"`
+	Updated          time.Time `json:"updated" bson:"updated"`
+	Published        time.Time `json:"published" bson:"published"`
+	Title            string    `json:"title" bson:"title"`
+	Summary          string    `json:"summary" bson:"summary"`
+	Keywords         []string  `json:"keywords" bson:"keywords"`
+	URL              string    `json:"url" bson:"url"`
+	SourceName       string    `json:"sourceName" bson:"sourceName"`
+	SourceNameAbbrev string    `json:"sourceNameAbbrev" bson:"sourceNameAbbrev"`
+	SourceVolume     string    `json:"sourceVolume" bson:"sourceVolume"`
+	SourceIssue      string    `json:"sourceIssue" bson:"sourceIssue"`
+	SourcePages      string    `json:"sourcePages" bson:"sourcePages"`
+	SourcePubDate    string    `json:"sourcePubDate" bson:"sourcePubDate"`
+}
+
+// Source returns the journal reference of the article in the format of Log.Source, eg
+// "Atherosclerosis 2018-08-27; 277: 53-59"
+func (a Article) Source() string {
+	s := strings.TrimSpace(a.SourceNameAbbrev + " " + a.SourcePubDate)
+	if a.SourceVolume == "" {
+		return s
+	}
+	s += "; " + a.SourceVolume
+	if a.SourceIssue != "" {
+		s += "(" + a.SourceIssue + ")"
+	}
+	if a.SourcePages != "" {
+		s += ": " + a.SourcePages
+	}
+	return s
+}
+
+// ArticleByPMID returns the article with the PMID, or ErrNotFound
+func (ds *Datastore) ArticleByPMID(pmid string) (Article, error) {
+	return ds.Articles.ByPMID(pmid)
+}
+
+// ArticlesByPMID returns the articles with the PMIDs, in the same order. PMIDs that are not stored are skipped, as
+// are duplicates. It returns ErrTooManyArticleIDs for more than MaxArticleIDs distinct PMIDs.
+func (ds *Datastore) ArticlesByPMID(pmids []string) ([]Article, error) {
+	seen := map[string]bool{}
+	var ids []string
+	for _, id := range pmids {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > MaxArticleIDs {
+		return nil, ErrTooManyArticleIDs
+	}
+	xa, err := ds.Articles.ByPMIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]Article, len(xa))
+	for _, a := range xa {
+		byID[a.PMID] = a
+	}
+	sorted := make([]Article, 0, len(xa))
+	for _, id := range ids {
+		if a, ok := byID[id]; ok {
+			sorted = append(sorted, a)
+		}
+	}
+	return sorted, nil
+}
+
+// SaveArticles adds or replaces articles by PMID. Created is set for new articles and kept for existing ones, and
+// Updated is set to now. Categories are stored in lower case, as they are for users in SavePartial.
+func (ds *Datastore) SaveArticles(xa ...Article) error {
+	now := ds.now()
+	xs := make([]Article, len(xa))
+	for i, a := range xa {
+		if a.PMID == "" {
+			return errors.New("article has no PMID")
+		}
+		a.Category = strings.ToLower(strings.TrimSpace(a.Category))
+		a.Created = now
+		a.Updated = now
+		xs[i] = a
+	}
+	return ds.Articles.Upsert(xs...)
+}
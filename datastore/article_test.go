@@ -0,0 +1,112 @@
+package datastore_test
+
+import (
+	"log"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/mikedonnici/rtcl-api/datastore"
+)
+
+var articleTestDS *datastore.Datastore
+
+func TestArticle(t *testing.T) {
+
+	backends, err := testBackends()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	for _, b := range backends {
+		articleTestDS = b.ds
+		t.Run(b.name, func(t *testing.T) {
+			t.Run("testArticleByPMID", testArticleByPMID)
+			t.Run("testArticlesByPMID", testArticlesByPMID)
+			t.Run("testSaveArticles", testSaveArticles)
+			t.Run("testArticleSource", testArticleSource)
+		})
+		b.cleanup()
+	}
+}
+
+func testArticleByPMID(t *testing.T) {
+	is := is.New(t)
+	a, err := articleTestDS.ArticleByPMID("30173079")
+	is.NoErr(err)
+	is.Equal(a.Title, "Direct observation of cargo transfer from HDL particles to the plasma membrane")
+	is.Equal(a.SourceNameAbbrev, "Atherosclerosis")
+	is.Equal(a.Keywords, []string{"Plochberger B", "Röhrl C", "Zhang L"})
+	is.True(a.Published.Equal(time.Date(2018, 8, 27, 0, 0, 0, 0, time.UTC)))
+
+	_, err = articleTestDS.ArticleByPMID("1")
+	is.Equal(err, datastore.ErrNotFound)
+}
+
+func testArticlesByPMID(t *testing.T) {
+	is := is.New(t)
+	xa, err := articleTestDS.ArticlesByPMID([]string{"30180002", "1", "30173671", "30180002", ""})
+	is.NoErr(err)
+	is.Equal(len(xa), 2) // expected missing and duplicate ids to be skipped
+	is.Equal(xa[0].PMID, "30180002")
+	is.Equal(xa[1].PMID, "30173671")
+
+	xa, err = articleTestDS.ArticlesByPMID(nil)
+	is.NoErr(err)
+	is.Equal(len(xa), 0)
+
+	ids := make([]string, datastore.MaxArticleIDs+1)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i + 1)
+	}
+	_, err = articleTestDS.ArticlesByPMID(ids)
+	is.Equal(err, datastore.ErrTooManyArticleIDs)
+	_, err = articleTestDS.ArticlesByPMID(ids[1:])
+	is.NoErr(err)
+}
+
+func testSaveArticles(t *testing.T) {
+	is := is.New(t)
+	created := time.Date(2018, 10, 1, 0, 0, 0, 0, time.UTC)
+	articleTestDS.Now = func() time.Time { return created }
+	defer func() { articleTestDS.Now = nil }()
+
+	err := articleTestDS.SaveArticles(datastore.Article{PMID: "30190001", Title: "New", Category: " Oncology"})
+	is.NoErr(err)
+	a, err := articleTestDS.ArticleByPMID("30190001")
+	is.NoErr(err)
+	is.Equal(a.Title, "New")
+	is.Equal(a.Category, "oncology") // expected the category in lower case
+	is.True(a.Created.Equal(created))
+	is.True(a.Updated.Equal(created))
+
+	// saving again replaces the article but keeps the time it was created
+	updated := created.Add(24 * time.Hour)
+	articleTestDS.Now = func() time.Time { return updated }
+	err = articleTestDS.SaveArticles(
+		datastore.Article{PMID: "30190001", Title: "Updated", Category: "oncology"},
+		datastore.Article{PMID: "30190002", Title: "Another", Category: "oncology"},
+	)
+	is.NoErr(err)
+	a, err = articleTestDS.ArticleByPMID("30190001")
+	is.NoErr(err)
+	is.Equal(a.Title, "Updated")
+	is.True(a.Created.Equal(created)) // expected the created time to be kept
+	is.True(a.Updated.Equal(updated))
+	a, err = articleTestDS.ArticleByPMID("30190002")
+	is.NoErr(err)
+	is.True(a.Created.Equal(updated))
+
+	err = articleTestDS.SaveArticles(datastore.Article{Title: "No PMID"})
+	is.True(err != nil) // expected an error for an article with no PMID
+}
+
+func testArticleSource(t *testing.T) {
+	is := is.New(t)
+	xa, err := articleTestDS.ArticlesByPMID([]string{"30173671", "30173079", "30171974"})
+	is.NoErr(err)
+	is.Equal(xa[0].Source(), "J Cardiovasc Magn Reson 2018-09-03; 20(1): 60")
+	is.Equal(xa[1].Source(), "Atherosclerosis 2018-08-27; 277: 53-59")
+	is.Equal(xa[2].Source(), "Resuscitation 2018-08-29")
+}
@@ -0,0 +1,151 @@
+package datastore
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"go.etcd.io/bbolt"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrStoreInUse is returned by NewBoltStore when another process, such as the server, has the bolt database file open
+var ErrStoreInUse = errors.New("datastore is in use by another process")
+
+// NewBoltStore returns a pointer to a Datastore with repositories stored in a single bolt database file, which is
+// created if it does not exist. This needs no database server so it suits small deployments and development.
+// Each repository is a bucket of bson documents, keyed by id. The file is locked while it is open, so only one
+// process can use it at a time.
+func NewBoltStore(path string) (*Datastore, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err == bbolt.ErrTimeout {
+		return nil, ErrStoreInUse
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open bolt database")
+	}
+
+	users, err := newBoltCollection(db, usersCollection)
+	if err != nil {
+		return nil, err
+	}
+	logs, err := newBoltCollection(db, logsCollection)
+	if err != nil {
+		return nil, err
+	}
+	articles, err := newBoltCollection(db, articlesCollection)
+	if err != nil {
+		return nil, err
+	}
+	bookmarks, err := newBoltCollection(db, bookmarksCollection)
+	if err != nil {
+		return nil, err
+	}
+	shares, err := newBoltCollection(db, sharesCollection)
+	if err != nil {
+		return nil, err
+	}
+	consumedTokens, err := newBoltCollection(db, consumedTokensCollection)
+	if err != nil {
+		return nil, err
+	}
+	revokedTokens, err := newBoltCollection(db, revokedTokensCollection)
+	if err != nil {
+		return nil, err
+	}
+	refreshTokens, err := newBoltCollection(db, refreshTokensCollection)
+	if err != nil {
+		return nil, err
+	}
+	clients, err := newBoltCollection(db, clientsCollection)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Datastore{
+		Bolt:           db,
+		Users:          &docUsers{c: users},
+		Logs:           &docLogs{c: logs},
+		Articles:       &docArticles{c: articles},
+		Bookmarks:      &docBookmarks{c: bookmarks},
+		Shares:         &docShares{c: shares},
+		ConsumedTokens: &docTokenIDs{c: consumedTokens},
+		RevokedTokens:  &docTokenIDs{c: revokedTokens},
+		RefreshTokens:  &docRefreshTokens{c: refreshTokens},
+		Clients:        &docClients{c: clients},
+	}, nil
+}
+
+// boltCollection is a collection stored in a bolt bucket
+type boltCollection struct {
+	db     *bbolt.DB
+	bucket []byte
+}
+
+func newBoltCollection(db *bbolt.DB, name string) (*boltCollection, error) {
+	err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(name))
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create bucket "+name)
+	}
+	return &boltCollection{db: db, bucket: []byte(name)}, nil
+}
+
+func (c *boltCollection) get(id string, v interface{}) error {
+	var data []byte
+	err := c.db.View(func(tx *bbolt.Tx) error {
+		d := tx.Bucket(c.bucket).Get([]byte(id))
+		if d == nil {
+			return ErrNotFound
+		}
+		data = append([]byte{}, d...) // only valid for the life of the transaction
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, v)
+}
+
+func (c *boltCollection) put(id string, v interface{}) error {
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(c.bucket).Put([]byte(id), data)
+	})
+}
+
+func (c *boltCollection) remove(id string) error {
+	return c.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(c.bucket)
+		if b.Get([]byte(id)) == nil {
+			return ErrNotFound
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+// each calls fn for every document in key order. Documents are copied out of the transaction first because fn
+// may write to the database, which would deadlock inside a read transaction.
+func (c *boltCollection) each(fn func(data []byte) error) error {
+	var xd [][]byte
+	err := c.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(c.bucket).ForEach(func(k, v []byte) error {
+			xd = append(xd, append([]byte{}, v...))
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	for _, data := range xd {
+		err := fn(data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
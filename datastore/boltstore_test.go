@@ -0,0 +1,29 @@
+package datastore_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/mikedonnici/rtcl-api/datastore"
+)
+
+// Tests that a bolt file that is already open, eg by the server, cannot be opened again until it is closed
+func TestBoltStoreInUse(t *testing.T) {
+	is := is.New(t)
+	f, err := ioutil.TempFile("", "rtcl_test_*.db")
+	is.NoErr(err)
+	f.Close()
+	defer os.Remove(f.Name())
+
+	ds, err := datastore.NewBoltStore(f.Name())
+	is.NoErr(err) // error opening bolt store
+	_, err = datastore.NewBoltStore(f.Name())
+	is.Equal(err, datastore.ErrStoreInUse) // expected the file to be locked
+
+	is.NoErr(ds.Close())
+	ds, err = datastore.NewBoltStore(f.Name())
+	is.NoErr(err) // file should open once it is closed
+	is.NoErr(ds.Close())
+}
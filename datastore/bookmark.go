@@ -0,0 +1,266 @@
+package datastore
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Bookmark statuses, in reading order
+const (
+	BookmarkToRead  = "to-read"
+	BookmarkReading = "reading"
+	BookmarkDone    = "done"
+)
+
+// Bookmark priorities run from 1, the highest, to 5. A bookmark saved without one gets the default.
+const (
+	MinBookmarkPriority     = 1
+	MaxBookmarkPriority     = 5
+	DefaultBookmarkPriority = 3
+)
+
+// ErrBookmarkExists is returned when bookmarking an article the user has already bookmarked
+var ErrBookmarkExists = errors.New("article is already bookmarked")
+
+// ErrBookmarkLogged is returned when logging a bookmark that already has a log
+var ErrBookmarkLogged = errors.New("bookmark has already been logged")
+
+// Bookmark is an article the user plans to read. Article is a snapshot of the article when it was bookmarked, so
+// the bookmark does not change if the stored copy does. Done is the time the status was set to done, and LogID is
+// the log created from the bookmark, if there is one.
+type Bookmark struct {
+	ID       bson.ObjectId `json:"id" bson:"_id"`
+	UserID   bson.ObjectId `json:"userId" bson:"userId"`
+	PMID     string        `json:"pmid" bson:"pmid"`
+	Article  Article       `json:"article" bson:"article"`
+	Status   string        `json:"status" bson:"status"`
+	Tags     []string      `json:"tags" bson:"tags"`
+	Priority int           `json:"priority" bson:"priority"`
+	Created  time.Time     `json:"created" bson:"created"`
+	Updated  time.Time     `json:"updated" bson:"updated"`
+	Done     time.Time     `json:"done" bson:"done"`
+	LogID    bson.ObjectId `json:"logId,omitempty" bson:"logId,omitempty"`
+}
+
+// BookmarkError is returned for a bookmark that is not valid
+type BookmarkError struct {
+	Reason string
+}
+
+func (e *BookmarkError) Error() string {
+	return "invalid bookmark: " + e.Reason
+}
+
+// check validates the bookmark fields that can be set by the user, and tidies them up
+func (b *Bookmark) check() error {
+	switch b.Status {
+	case "":
+		b.Status = BookmarkToRead
+	case BookmarkToRead, BookmarkReading, BookmarkDone:
+	default:
+		return &BookmarkError{"status must be to-read, reading or done"}
+	}
+	if b.Priority == 0 {
+		b.Priority = DefaultBookmarkPriority
+	}
+	if b.Priority < MinBookmarkPriority || b.Priority > MaxBookmarkPriority {
+		return &BookmarkError{"priority must be from 1 to 5"}
+	}
+	b.Tags = tidyLowerList(b.Tags)
+	return nil
+}
+
+// HasTag returns true if the bookmark has the tag, ignoring case
+func (b Bookmark) HasTag(tag string) bool {
+	for _, t := range b.Tags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Log returns a log pre-filled from the bookmark, dated today. It is not saved - see LogBookmark.
+func (b Bookmark) Log(now time.Time) Log {
+	return Log{
+		UserID: b.UserID,
+		Date:   now.Format("2006-01-02"),
+		PMID:   b.PMID,
+		Title:  b.Article.Title,
+		Source: b.Article.Source(),
+		URL:    b.Article.URL,
+	}
+}
+
+// AddBookmark adds a bookmark for the user, and returns it with its id. The article snapshot is taken from the
+// stored article with the PMID when there is one, otherwise the article sent with the bookmark is kept, and needs
+// a title. It returns ErrBookmarkExists if the user has already bookmarked the article.
+func (ds *Datastore) AddBookmark(userID string, b Bookmark) (Bookmark, error) {
+	if !bson.IsObjectIdHex(userID) {
+		return b, errors.New("object id is not valid")
+	}
+	b.PMID = strings.TrimSpace(b.PMID)
+	if b.PMID == "" {
+		return b, &BookmarkError{"pmid is missing"}
+	}
+	err := b.check()
+	if err != nil {
+		return b, err
+	}
+
+	xb, err := ds.Bookmarks.ByUserID(bson.ObjectIdHex(userID))
+	if err != nil {
+		return b, err
+	}
+	for _, x := range xb {
+		if x.PMID == b.PMID {
+			return b, ErrBookmarkExists
+		}
+	}
+
+	a, err := ds.ArticleByPMID(b.PMID)
+	switch {
+	case err == nil:
+		b.Article = a
+	case err == ErrNotFound && strings.TrimSpace(b.Article.Title) != "":
+		b.Article.PMID = b.PMID
+	case err == ErrNotFound:
+		return b, &BookmarkError{"article is not stored so a title is needed"}
+	default:
+		return b, err
+	}
+
+	b.ID = bson.NewObjectId()
+	b.UserID = bson.ObjectIdHex(userID)
+	b.Created = ds.now()
+	b.Updated = b.Created
+	b.Done = time.Time{}
+	if b.Status == BookmarkDone {
+		b.Done = b.Created
+	}
+	b.LogID = ""
+	return b, ds.Bookmarks.Save(b)
+}
+
+// BookmarksByUserID returns the user's bookmarks, highest priority first and then newest first. If status or tag
+// are not empty only the bookmarks with that status, or tag, are returned.
+func (ds *Datastore) BookmarksByUserID(userID, status, tag string) ([]Bookmark, error) {
+	if !bson.IsObjectIdHex(userID) {
+		return nil, errors.New("object id is not valid")
+	}
+	xb, err := ds.Bookmarks.ByUserID(bson.ObjectIdHex(userID))
+	if err != nil {
+		return nil, err
+	}
+	var filtered []Bookmark
+	for _, b := range xb {
+		if status != "" && b.Status != status {
+			continue
+		}
+		if tag != "" && !b.HasTag(tag) {
+			continue
+		}
+		filtered = append(filtered, b)
+	}
+	sort.SliceStable(filtered, func(i, j int) bool {
+		if filtered[i].Priority != filtered[j].Priority {
+			return filtered[i].Priority < filtered[j].Priority
+		}
+		return filtered[i].Created.After(filtered[j].Created)
+	})
+	return filtered, nil
+}
+
+// BookmarkByID returns the user's bookmark with the id, or ErrNotFound if it does not exist or belongs to another
+// user
+func (ds *Datastore) BookmarkByID(userID, id string) (Bookmark, error) {
+	if !bson.IsObjectIdHex(id) {
+		return Bookmark{}, ErrNotFound
+	}
+	b, err := ds.Bookmarks.ByID(bson.ObjectIdHex(id))
+	if err != nil {
+		return Bookmark{}, err
+	}
+	if b.UserID.Hex() != userID {
+		return Bookmark{}, ErrNotFound
+	}
+	return b, nil
+}
+
+// UpdateBookmark replaces the status, tags and priority of the user's bookmark with the same id. The article
+// snapshot is kept. Done is set when the status changes to done, and cleared if it changes back.
+func (ds *Datastore) UpdateBookmark(userID string, b Bookmark) (Bookmark, error) {
+	old, err := ds.BookmarkByID(userID, b.ID.Hex())
+	if err != nil {
+		return b, err
+	}
+	err = b.check()
+	if err != nil {
+		return b, err
+	}
+
+	old.Status = b.Status
+	old.Tags = b.Tags
+	old.Priority = b.Priority
+	old.Updated = ds.now()
+	switch {
+	case old.Status != BookmarkDone:
+		old.Done = time.Time{}
+	case old.Done.IsZero():
+		old.Done = old.Updated
+	}
+	return old, ds.Bookmarks.Save(old)
+}
+
+// RemoveBookmark deletes the user's bookmark with the id, or returns ErrNotFound. A log created from it is kept.
+func (ds *Datastore) RemoveBookmark(userID, id string) error {
+	b, err := ds.BookmarkByID(userID, id)
+	if err != nil {
+		return err
+	}
+	return ds.Bookmarks.Delete(b.ID)
+}
+
+// LogBookmark saves a log for the user's bookmark, and marks the bookmark done. The log is pre-filled from the
+// bookmark, and the date, minutes and comment of l are used if they are set. It returns ErrBookmarkLogged if the
+// bookmark already has a log that exists.
+func (ds *Datastore) LogBookmark(userID, id string, l Log) (*Log, error) {
+	b, err := ds.BookmarkByID(userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if b.LogID.Valid() {
+		_, err = ds.Logs.ByID(b.LogID)
+		if err == nil {
+			return nil, ErrBookmarkLogged
+		}
+		if err != ErrNotFound {
+			return nil, err
+		}
+	}
+
+	now := ds.now()
+	nl := b.Log(now)
+	if l.Date != "" {
+		nl.Date = l.Date
+	}
+	nl.Minutes = l.Minutes
+	nl.Comment = l.Comment
+	nl.ds = ds
+	err = nl.Save()
+	if err != nil {
+		return nil, err
+	}
+
+	b.LogID = nl.ID
+	b.Updated = now
+	if b.Status != BookmarkDone {
+		b.Status = BookmarkDone
+		b.Done = now
+	}
+	return &nl, ds.Bookmarks.Save(b)
+}
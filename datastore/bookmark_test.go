@@ -0,0 +1,235 @@
+package datastore_test
+
+import (
+	"log"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/mikedonnici/rtcl-api/datastore"
+)
+
+var bookmarkTestDS *datastore.Datastore
+
+// bookmarkUser is oj, who has no logs
+const bookmarkUser = "5b3bcd72463cd6029e04de1a"
+
+func TestBookmark(t *testing.T) {
+
+	backends, err := testBackends()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	for _, b := range backends {
+		bookmarkTestDS = b.ds
+		t.Run(b.name, func(t *testing.T) {
+			t.Run("testAddBookmark", testAddBookmark)
+			t.Run("testAddBookmarkErrors", testAddBookmarkErrors)
+			t.Run("testBookmarksByUserID", testBookmarksByUserID)
+			t.Run("testBookmarkByID", testBookmarkByID)
+			t.Run("testUpdateBookmark", testUpdateBookmark)
+			t.Run("testLogBookmark", testLogBookmark)
+			t.Run("testRemoveBookmark", testRemoveBookmark)
+		})
+		b.cleanup()
+	}
+}
+
+func testAddBookmark(t *testing.T) {
+	is := is.New(t)
+	now := time.Date(2018, 10, 1, 9, 0, 0, 0, time.UTC)
+	bookmarkTestDS.Now = func() time.Time { return now }
+	defer func() { bookmarkTestDS.Now = nil }()
+
+	b, err := bookmarkTestDS.AddBookmark(bookmarkUser, datastore.Bookmark{
+		PMID:    " 30180001 ",
+		Tags:    []string{"HDL", " lipids ", "hdl", ""},
+		Article: datastore.Article{Title: "ignored for a stored article"},
+	})
+	is.NoErr(err)
+	is.True(b.ID.Valid())
+	is.Equal(b.UserID.Hex(), bookmarkUser)
+	is.Equal(b.PMID, "30180001")
+	is.Equal(b.Status, datastore.BookmarkToRead)               // expected the default status
+	is.Equal(b.Priority, datastore.DefaultBookmarkPriority)    // expected the default priority
+	is.Equal(b.Tags, []string{"hdl", "lipids"})                // expected tags to be tidied
+	is.Equal(b.Article.SourceNameAbbrev, "Atherosclerosis")    // expected the stored article
+	is.True(b.Article.Title != "ignored for a stored article") // expected the stored title
+	is.True(b.Created.Equal(now))
+	is.True(b.Done.IsZero())
+
+	// an article that is not stored is kept as sent
+	b, err = bookmarkTestDS.AddBookmark(bookmarkUser, datastore.Bookmark{
+		PMID:     "1",
+		Status:   datastore.BookmarkDone,
+		Priority: 1,
+		Article:  datastore.Article{Title: "Not indexed", URL: "https://example.com/1"},
+	})
+	is.NoErr(err)
+	is.Equal(b.Article.PMID, "1")
+	is.Equal(b.Article.Title, "Not indexed")
+	is.True(b.Done.Equal(now)) // expected done to be set for a done bookmark
+}
+
+func testAddBookmarkErrors(t *testing.T) {
+	is := is.New(t)
+	_, err := bookmarkTestDS.AddBookmark(bookmarkUser, datastore.Bookmark{PMID: "30180001"})
+	is.Equal(err, datastore.ErrBookmarkExists)
+
+	for _, b := range []datastore.Bookmark{
+		{},
+		{PMID: "2"},
+		{PMID: "30180002", Status: "skimmed"},
+		{PMID: "30180002", Priority: 6},
+	} {
+		_, err = bookmarkTestDS.AddBookmark(bookmarkUser, b)
+		if _, ok := err.(*datastore.BookmarkError); !ok {
+			t.Errorf("expected a BookmarkError for %v, got %v", b, err)
+		}
+	}
+	_, err = bookmarkTestDS.AddBookmark("bad", datastore.Bookmark{PMID: "30180002"})
+	is.True(err != nil)
+}
+
+func testBookmarksByUserID(t *testing.T) {
+	is := is.New(t)
+	_, err := bookmarkTestDS.AddBookmark(bookmarkUser, datastore.Bookmark{PMID: "30180002", Tags: []string{"hcm"}})
+	is.NoErr(err)
+
+	xb, err := bookmarkTestDS.BookmarksByUserID(bookmarkUser, "", "")
+	is.NoErr(err)
+	is.Equal(len(xb), 3)
+	is.Equal(xb[0].PMID, "1")        // expected the highest priority first
+	is.Equal(xb[1].PMID, "30180002") // then the newest
+	is.Equal(xb[2].PMID, "30180001")
+
+	xb, err = bookmarkTestDS.BookmarksByUserID(bookmarkUser, datastore.BookmarkToRead, "")
+	is.NoErr(err)
+	is.Equal(len(xb), 2)
+
+	xb, err = bookmarkTestDS.BookmarksByUserID(bookmarkUser, "", "LIPIDS")
+	is.NoErr(err)
+	is.Equal(len(xb), 1)
+	is.Equal(xb[0].PMID, "30180001")
+
+	xb, err = bookmarkTestDS.BookmarksByUserID("5b3bcd72463cd6029e04de1c", "", "")
+	is.NoErr(err)
+	is.Equal(len(xb), 0) // expected no bookmarks for another user
+}
+
+func testBookmarkByID(t *testing.T) {
+	is := is.New(t)
+	xb, err := bookmarkTestDS.BookmarksByUserID(bookmarkUser, "", "hcm")
+	is.NoErr(err)
+	b, err := bookmarkTestDS.BookmarkByID(bookmarkUser, xb[0].ID.Hex())
+	is.NoErr(err)
+	is.Equal(b.PMID, "30180002")
+
+	_, err = bookmarkTestDS.BookmarkByID("5b3bcd72463cd6029e04de1c", xb[0].ID.Hex())
+	is.Equal(err, datastore.ErrNotFound) // expected another user's bookmark not to be found
+	_, err = bookmarkTestDS.BookmarkByID(bookmarkUser, "bad")
+	is.Equal(err, datastore.ErrNotFound)
+}
+
+func testUpdateBookmark(t *testing.T) {
+	is := is.New(t)
+	now := time.Date(2018, 10, 2, 9, 0, 0, 0, time.UTC)
+	bookmarkTestDS.Now = func() time.Time { return now }
+	defer func() { bookmarkTestDS.Now = nil }()
+
+	xb, err := bookmarkTestDS.BookmarksByUserID(bookmarkUser, "", "hcm")
+	is.NoErr(err)
+	old := xb[0]
+
+	b, err := bookmarkTestDS.UpdateBookmark(bookmarkUser, datastore.Bookmark{
+		ID:       old.ID,
+		PMID:     "ignored",
+		Status:   datastore.BookmarkDone,
+		Tags:     []string{"Cardiomyopathy"},
+		Priority: 2,
+	})
+	is.NoErr(err)
+	is.Equal(b.PMID, "30180002")                 // expected the pmid to be kept
+	is.Equal(b.Article.Title, old.Article.Title) // expected the snapshot to be kept
+	is.Equal(b.Tags, []string{"cardiomyopathy"})
+	is.Equal(b.Priority, 2)
+	is.True(b.Created.Equal(old.Created))
+	is.True(b.Updated.Equal(now))
+	is.True(b.Done.Equal(now)) // expected done to be set
+
+	b.Status = datastore.BookmarkReading
+	b, err = bookmarkTestDS.UpdateBookmark(bookmarkUser, b)
+	is.NoErr(err)
+	is.True(b.Done.IsZero()) // expected done to be cleared
+
+	b.Status = "skimmed"
+	_, err = bookmarkTestDS.UpdateBookmark(bookmarkUser, b)
+	if _, ok := err.(*datastore.BookmarkError); !ok {
+		t.Errorf("expected a BookmarkError, got %v", err)
+	}
+	_, err = bookmarkTestDS.UpdateBookmark("5b3bcd72463cd6029e04de1c", old)
+	is.Equal(err, datastore.ErrNotFound)
+}
+
+func testLogBookmark(t *testing.T) {
+	is := is.New(t)
+	now := time.Date(2018, 10, 3, 9, 0, 0, 0, time.UTC)
+	bookmarkTestDS.Now = func() time.Time { return now }
+	defer func() { bookmarkTestDS.Now = nil }()
+
+	xb, err := bookmarkTestDS.BookmarksByUserID(bookmarkUser, "", "lipids")
+	is.NoErr(err)
+	b := xb[0]
+
+	draft := b.Log(now)
+	is.Equal(draft.PMID, "30180001")
+	is.Equal(draft.Date, "2018-10-03")
+	is.Equal(draft.Title, b.Article.Title)
+	is.Equal(draft.Source, b.Article.Source())
+	is.Equal(draft.URL, b.Article.URL)
+
+	l, err := bookmarkTestDS.LogBookmark(bookmarkUser, b.ID.Hex(), datastore.Log{Minutes: 15, Comment: "Good"})
+	is.NoErr(err)
+	is.Equal(l.UserID.Hex(), bookmarkUser)
+	is.Equal(l.PMID, "30180001")
+	is.Equal(l.Date, "2018-10-03")
+	is.Equal(l.Minutes, 15)
+	is.Equal(l.Comment, "Good")
+	is.Equal(l.Source, b.Article.Source())
+
+	xl, err := bookmarkTestDS.LogsByUserID(bookmarkUser)
+	is.NoErr(err)
+	is.Equal(len(xl), 1) // expected the log to be saved
+
+	b, err = bookmarkTestDS.BookmarkByID(bookmarkUser, b.ID.Hex())
+	is.NoErr(err)
+	is.Equal(b.Status, datastore.BookmarkDone) // expected logging to mark the bookmark done
+	is.Equal(b.LogID, l.ID)
+	is.True(b.Done.Equal(now))
+
+	_, err = bookmarkTestDS.LogBookmark(bookmarkUser, b.ID.Hex(), datastore.Log{})
+	is.Equal(err, datastore.ErrBookmarkLogged)
+
+	// the bookmark can be logged again once the log is deleted
+	is.NoErr(l.Delete())
+	l, err = bookmarkTestDS.LogBookmark(bookmarkUser, b.ID.Hex(), datastore.Log{Date: "2018-10-01"})
+	is.NoErr(err)
+	is.Equal(l.Date, "2018-10-01")
+	is.NoErr(l.Delete())
+}
+
+func testRemoveBookmark(t *testing.T) {
+	is := is.New(t)
+	xb, err := bookmarkTestDS.BookmarksByUserID(bookmarkUser, "", "")
+	is.NoErr(err)
+
+	is.Equal(bookmarkTestDS.RemoveBookmark("5b3bcd72463cd6029e04de1c", xb[0].ID.Hex()), datastore.ErrNotFound)
+	for _, b := range xb {
+		is.NoErr(bookmarkTestDS.RemoveBookmark(bookmarkUser, b.ID.Hex()))
+	}
+	is.Equal(bookmarkTestDS.RemoveBookmark(bookmarkUser, xb[0].ID.Hex()), datastore.ErrNotFound)
+	xb, err = bookmarkTestDS.BookmarksByUserID(bookmarkUser, "", "")
+	is.NoErr(err)
+	is.Equal(len(xb), 0)
+}
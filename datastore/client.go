@@ -0,0 +1,129 @@
+package datastore
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Scopes that can be granted to a client app. Each of the public user endpoints requires one of these.
+const (
+	ScopeUsersCreate = "users:create"
+	ScopeUsersRead   = "users:read"
+	ScopeUsersNotify = "users:notify"
+)
+
+// Scopes is the set of valid scopes
+var Scopes = []string{ScopeUsersCreate, ScopeUsersRead, ScopeUsersNotify}
+
+// clientKeyPrefix starts every client key so that keys are easy to recognise, eg in a leaked config file
+const clientKeyPrefix = "rtcl_"
+
+// ErrClientKeyInvalid is returned for a client key that does not exist or has been revoked
+var ErrClientKeyInvalid = errors.New("client key is invalid")
+
+// Client is an app that is allowed to call the public user endpoints, such as the web front end. The key is only
+// shown when the client is created - just a hash of it is stored.
+type Client struct {
+	ID        bson.ObjectId `json:"id" bson:"_id"`
+	Name      string        `json:"name" bson:"name"`
+	KeyHash   string        `json:"-" bson:"keyHash"`
+	KeyPrefix string        `json:"keyPrefix" bson:"keyPrefix"` // the start of the key, to identify it
+	Scopes    []string      `json:"scopes" bson:"scopes"`
+	Created   time.Time     `json:"created" bson:"created"`
+	Revoked   bool          `json:"revoked" bson:"revoked"`
+}
+
+// HasScope returns true if the client has been granted the scope
+func (c Client) HasScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidScope returns true if scope is one of the defined scopes
+func ValidScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientKeyHash returns the hash of a client key, as stored in Client.KeyHash. Keys are long and random so a
+// single round of SHA-256 is enough, and allows the client to be looked up by the hash.
+func ClientKeyHash(key string) string {
+	return hash(key)
+}
+
+// NewClient registers a client app with the scopes, and returns the client and its key
+func (ds *Datastore) NewClient(name string, scopes []string) (Client, string, error) {
+	if name == "" {
+		return Client{}, "", errors.New("client name is missing")
+	}
+	for _, s := range scopes {
+		if !ValidScope(s) {
+			return Client{}, "", errors.New("invalid scope: " + s)
+		}
+	}
+
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return Client{}, "", err
+	}
+	key := clientKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	c := Client{
+		ID:        bson.NewObjectId(),
+		Name:      name,
+		KeyHash:   ClientKeyHash(key),
+		KeyPrefix: key[:len(clientKeyPrefix)+6],
+		Scopes:    scopes,
+		Created:   ds.now(),
+	}
+	return c, key, ds.Clients.Save(c)
+}
+
+// ClientByKey returns the client with the key, or ErrClientKeyInvalid if there isn't one or it has been revoked
+func (ds *Datastore) ClientByKey(key string) (Client, error) {
+	if key == "" {
+		return Client{}, ErrClientKeyInvalid
+	}
+	c, err := ds.Clients.ByKeyHash(ClientKeyHash(key))
+	if err == ErrNotFound {
+		return c, ErrClientKeyInvalid
+	}
+	if err != nil {
+		return c, err
+	}
+	if c.Revoked {
+		return c, ErrClientKeyInvalid
+	}
+	return c, nil
+}
+
+// ListClients returns all of the registered client apps, including revoked ones
+func (ds *Datastore) ListClients() ([]Client, error) {
+	return ds.Clients.All()
+}
+
+// RevokeClient revokes the key for the client with the id. The record is kept so that it still shows in lists.
+func (ds *Datastore) RevokeClient(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return errors.New("object id is not valid")
+	}
+	c, err := ds.Clients.ByID(bson.ObjectIdHex(id))
+	if err != nil {
+		return err
+	}
+	c.Revoked = true
+	return ds.Clients.Save(c)
+}
@@ -0,0 +1,79 @@
+package datastore_test
+
+import (
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/mikedonnici/rtcl-api/datastore"
+)
+
+var clientTestDS *datastore.Datastore
+
+func TestClient(t *testing.T) {
+
+	backends, err := testBackends()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	for _, b := range backends {
+		clientTestDS = b.ds
+		t.Run(b.name, func(t *testing.T) {
+			t.Run("testClientNew", testClientNew)
+			t.Run("testClientInvalidScope", testClientInvalidScope)
+			t.Run("testClientByKey", testClientByKey)
+			t.Run("testClientRevoke", testClientRevoke)
+		})
+		b.cleanup()
+	}
+}
+
+func testClientNew(t *testing.T) {
+	is := is.New(t)
+	c, key, err := clientTestDS.NewClient("Web App", []string{datastore.ScopeUsersRead})
+	is.NoErr(err)                                     // error creating client
+	is.True(strings.HasPrefix(key, "rtcl_"))          // key should have the rtcl_ prefix
+	is.True(strings.HasPrefix(key, c.KeyPrefix))      // key prefix should be the start of the key
+	is.Equal(c.KeyHash, datastore.ClientKeyHash(key)) // key should be stored as a hash
+	is.True(c.HasScope(datastore.ScopeUsersRead))     // client should have the scope
+	is.True(!c.HasScope(datastore.ScopeUsersCreate))  // client should not have other scopes
+
+	xc, err := clientTestDS.ListClients()
+	is.NoErr(err)        // error listing clients
+	is.True(len(xc) > 0) // expected the new client in the list
+}
+
+func testClientInvalidScope(t *testing.T) {
+	is := is.New(t)
+	_, _, err := clientTestDS.NewClient("Web App", []string{"users:everything"})
+	is.True(err != nil) // expected an error for an invalid scope
+	_, _, err = clientTestDS.NewClient("", nil)
+	is.True(err != nil) // expected an error for a missing name
+}
+
+func testClientByKey(t *testing.T) {
+	is := is.New(t)
+	c, key, err := clientTestDS.NewClient("Mobile App", []string{datastore.ScopeUsersCreate})
+	is.NoErr(err) // error creating client
+
+	c2, err := clientTestDS.ClientByKey(key)
+	is.NoErr(err)         // error fetching client by key
+	is.Equal(c2.ID, c.ID) // wrong client
+
+	_, err = clientTestDS.ClientByKey(key + "x")
+	is.Equal(err, datastore.ErrClientKeyInvalid) // expected invalid key error
+	_, err = clientTestDS.ClientByKey("")
+	is.Equal(err, datastore.ErrClientKeyInvalid) // expected invalid key error for an empty key
+}
+
+func testClientRevoke(t *testing.T) {
+	is := is.New(t)
+	c, key, err := clientTestDS.NewClient("Old App", datastore.Scopes)
+	is.NoErr(err) // error creating client
+
+	is.NoErr(clientTestDS.RevokeClient(c.ID.Hex())) // error revoking client
+	_, err = clientTestDS.ClientByKey(key)
+	is.Equal(err, datastore.ErrClientKeyInvalid) // revoked key should be invalid
+}
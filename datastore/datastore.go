@@ -3,23 +3,69 @@ package datastore
 
 import (
 	"errors"
+	"os"
+	"time"
+
 	"github.com/mikedonnici/rtcl-api/datastore/mongo"
-	"gopkg.in/mgo.v2"
+	"go.etcd.io/bbolt"
 	"gopkg.in/mgo.v2/bson"
-	"time"
 )
 
-const usersCollection = "users"
-const logsCollection = "logs"
-
-// Datastore contains connections to the data sources required for the service
+// Datastore contains the repositories for the data required by the service. The repositories are interfaces so
+// the service can run against any backend that implements them - see NewMongoStore, NewBoltStore and NewMemoryStore.
 type Datastore struct {
-	Mongo *mongo.Connection
+	Mongo          *mongo.Connection // only set for a Mongo backed store
+	Bolt           *bbolt.DB         // only set for a bolt backed store
+	Users          UserRepository
+	Logs           LogRepository
+	Articles       ArticleRepository
+	Bookmarks      BookmarkRepository
+	Shares         ShareRepository
+	ConsumedTokens TokenIDRepository // action tokens that have been used
+	RevokedTokens  TokenIDRepository // access tokens revoked before they expire
+	RefreshTokens  RefreshTokenRepository
+	Clients        ClientRepository
+
+	// Now returns the current time for time-based rules such as login lockouts. It is time.Now unless replaced,
+	// eg with a fake clock in tests.
+	Now func() time.Time
 }
 
-// New returns a pointer to a Datastore
-func New() *Datastore {
-	return &Datastore{}
+// now returns the current time from the datastore clock
+func (ds *Datastore) now() time.Time {
+	if ds.Now == nil {
+		return time.Now()
+	}
+	return ds.Now()
+}
+
+// Close releases the resources held by the backend
+func (ds *Datastore) Close() error {
+	if ds.Mongo != nil {
+		ds.Mongo.Session.Close()
+	}
+	if ds.Bolt != nil {
+		return ds.Bolt.Close()
+	}
+	return nil
+}
+
+// OpenFromEnv opens the backend set by the env vars, so the server and the commands all open the datastore the same
+// way. An embedded bolt database file is used if BOLTDB_PATH is set, otherwise it connects to Mongo with the
+// MONGODB_* vars.
+func OpenFromEnv() (*Datastore, error) {
+	if os.Getenv("BOLTDB_PATH") != "" {
+		return NewBoltStore(os.Getenv("BOLTDB_PATH"))
+	}
+	m, err := mongo.NewConnection(
+		os.Getenv("MONGODB_URI"),
+		os.Getenv("MONGODB_NAME"),
+		os.Getenv("MONGODB_DESC"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return NewMongoStore(m), nil
 }
 
 // NewUser returns a pointer to a new User value with the datastore attached.
@@ -36,18 +82,16 @@ func (ds *Datastore) NewLog() *Log {
 
 // UserByID queries user by id and returns a pointer to a User with fields populated from the database
 func (ds *Datastore) UserByID(id string) (*User, error) {
-	u := &User{}
 	if !bson.IsObjectIdHex(id) {
 		return nil, errors.New("object id is not valid")
 	}
-	q := bson.M{"_id": bson.ObjectIdHex(id)}
-	err := ds.usersCollection().Find(q).One(&u)
+	u, err := ds.Users.ByID(bson.ObjectIdHex(id))
 	if err != nil {
 		return nil, err
 	}
 
 	u.ds = ds // attach datastore!
-	return u, nil
+	return &u, u.saveMigrated()
 }
 
 // UserUpdate updates a user doc
@@ -55,20 +99,17 @@ func (ds *Datastore) UserByID(id string) (*User, error) {
 
 // UserByEmail queries user by email and returns a pointer to a User with fields populated from the database
 func (ds *Datastore) UserByEmail(email string) (*User, error) {
-	u := &User{}
-	q := bson.M{"email": email}
-	err := ds.usersCollection().Find(q).One(&u)
+	u, err := ds.Users.ByEmail(email)
 	if err != nil {
 		return nil, err
 	}
 
 	u.ds = ds // attach datastore!
-	return u, nil
+	return &u, u.saveMigrated()
 }
 
 // UserByIDOrEmail queries user by id first, and then email
 func (ds *Datastore) UserByIDOrEmail(idOrEmail string) (*User, error) {
-	u := &User{}
 	u, err := ds.UserByID(idOrEmail)
 	if err == nil {
 		return u, err
@@ -82,85 +123,97 @@ func (ds *Datastore) UserEmailExists(email string) bool {
 	return err == nil
 }
 
-// UserAuth authenticates the user and return a populated User on success
+// UserAuth authenticates the user and return a populated User on success. The user is fetched by email and the
+// password is verified here, rather than in the query, so that legacy hashes can be upgraded on a successful login.
+// Failed logins are recorded against the user, and a *LockoutError is returned while the account is locked out -
+// even if the password is correct. ErrAccountDisabled is returned for a disabled user with the correct password.
 func (ds *Datastore) UserAuth(email, password string) (*User, error) {
 	u, err := ds.UserByEmail(email)
 	if err != nil {
+		hashPassword(password) // spend the same time as a real check so unknown emails are not obvious
 		return nil, err
 	}
-	q := bson.M{"email": u.Email, "password": u.hashPass(password)}
-	err = ds.usersCollection().Find(q).One(&u)
-	return u, err
-}
 
-// FreshUserToken returns a fresh JWT for the user identified by ID
-func (ds *Datastore) FreshUserToken(userID, issuer, signingkey string, hoursttl int) (string, error) {
+	now := ds.now()
+	wait := u.LoginRetryAfter(now)
+	if wait > 0 {
+		return nil, &LockoutError{RetryAfter: wait}
+	}
 
-	u := ds.NewUser()
-	err := u.ByID(userID)
-	if err != nil {
-		return "", errors.New("could not fetch user to re-issue token")
+	match, needsRehash := u.CheckPassword(password)
+	if !match {
+		err = u.RecordFailedLogin(now)
+		if err != nil {
+			return nil, err
+		}
+		return nil, errors.New("password does not match")
+	}
+	if u.Disabled {
+		return nil, ErrAccountDisabled
 	}
 
-	t, err := u.Token(issuer, signingkey, hoursttl)
-	if err != nil {
-		return "", errors.New("could not issue token")
+	if needsRehash {
+		err = u.SetPassword(password)
+		if err != nil {
+			return nil, err
+		}
+		err = u.update()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if u.FailedLogins > 0 {
+		err = u.ClearLoginFailures()
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return t.String(), nil
+	return u, nil
 }
 
 // LogByID returns a pointer to a Log value with fields populated from the database
 func (ds *Datastore) LogByID(id string) (*Log, error) {
-	l := &Log{}
 	if !bson.IsObjectIdHex(id) {
 		return nil, errors.New("object id is not valid")
 	}
-	q := bson.M{"_id": bson.ObjectIdHex(id)}
-	err := ds.logsCollection().Find(q).One(&l)
+	l, err := ds.Logs.ByID(bson.ObjectIdHex(id))
 	if err != nil {
 		return nil, err
 	}
 
 	l.ds = ds // attach datastore!
-	return l, nil
+	return &l, nil
 }
 
 // LogsByUserID fetches all log records for the specified user id
 func (ds *Datastore) LogsByUserID(userID string) ([]Log, error) {
-	var xl []Log
-	q := bson.M{"user_id": bson.ObjectIdHex(userID)}
-	err := ds.logsCollection().Find(q).All(&xl)
-	if err != nil {
-		return nil, err
+	if !bson.IsObjectIdHex(userID) {
+		return nil, errors.New("object id is not valid")
 	}
-	return xl, nil
+	return ds.Logs.ByUserID(bson.ObjectIdHex(userID))
 }
 
-// UsersDueNotification returns Users with notifications due - that is, with a notification field value in the past.
-// Note that this needs to exclude dates that are zero, null or missing, hence the check for values greater than epoch.
+// UsersDueNotification returns Users with notifications due - that is, with a notification field value in the past
+// and a schedule that is not paused. Users waiting to be deleted are left out.
 func (ds *Datastore) UsersDueNotification() ([]User, error) {
-	var xu []User
-	epoch := time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
-	q := bson.M{
-		"notification": bson.M{
-			"$gt": epoch,
-			"$lt": time.Now(),
-		},
-	}
-	err := ds.usersCollection().Find(q).All(&xu)
+	now := ds.now()
+	xu, err := ds.Users.DueNotification(now)
 	if err != nil {
 		return nil, err
 	}
-	return xu, err
-}
-
-// returns the users collection
-func (ds *Datastore) usersCollection() *mgo.Collection {
-	return ds.Mongo.Session.DB(ds.Mongo.DBName).C(usersCollection)
-}
-
-// returns the logs collection
-func (ds *Datastore) logsCollection() *mgo.Collection {
-	return ds.Mongo.Session.DB(ds.Mongo.DBName).C(logsCollection)
+	due := []User{}
+	for _, u := range xu {
+		if u.Schedule.Paused(now) || !u.DeleteAt.IsZero() {
+			continue
+		}
+		u.ds = ds
+		err = u.saveMigrated()
+		if err != nil {
+			return nil, err
+		}
+		due = append(due, u)
+	}
+	return due, nil
 }
@@ -1,76 +1,86 @@
 package datastore_test
 
-//import (
-//	"log"
-//	"testing"
-//
-//	"github.com/mikedonnici/dev/go/code-organisation/httpservice/testdata"
-//)
-//
-//var store = testdata.New()
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
 
-// TestMain sets up test databases against which subsequent datastore tests can be run. These are torn
-// down once all of the tests have completed.
-//func TestMain(m *testing.M) {
-//
-//	err := store.SetupMySQL()
-//	if err != nil {
-//		log.Fatalln(err)
-//	}
-//	defer store.TearDownMySQL()
-//
-//	err = store.SetupMongoDB()
-//	if err != nil {
-//		log.Fatalln(err)
-//	}
-//	defer store.TearDownMongoDB()
-//
-//	m.Run()
-//}
+	"github.com/mikedonnici/rtcl-api/datastore"
+	"github.com/mikedonnici/rtcl-api/testdata"
+	"gopkg.in/mgo.v2/bson"
+)
 
-//// Test a direct query
-//func TestFetchMySQL(t *testing.T) {
-//	is := is.New(t)
-//
-//	cases := []struct {
-//		id        string
-//		firstName string
-//	}{
-//		{id: "1", firstName: "Broderick"},
-//		{id: "5", firstName: "Declan"},
-//	}
-//
-//	for _, c := range cases {
-//		q := `select firstname from people where id = ?`
-//		var name string
-//		store.MySQLSession.QueryRow(q, c.id).Scan(&name)
-//		is.Equal(name, c.firstName)
-//	}
-//}
-//
-//// Test a direct query
-//func TestFetchMongoDB(t *testing.T) {
-//	is := is.New(t)
-//
-//	cases := []struct {
-//		id        int
-//		firstName string
-//	}{
-//		{id: 1, firstName: "Broderick"},
-//		{id: 5, firstName: "Declan"},
-//	}
-//
-//	type person struct {
-//		FirstName string `bson:"firstname"`
-//	}
-//
-//	for _, c := range cases {
-//		var p person
-//		q := bson.M{"id": c.id}
-//		s := bson.M{"_id": 0, "firstname": 1}
-//		col := store.MongoDBSession.DB(store.DBName).C(testdata.MONGO_COLLECTION)
-//		err := col.Find(q).Select(s).One(&p)
-//		is.NoErr(err)                      // error fetching from Mongo
-//		is.Equal(p.FirstName, c.firstName) // incorrect name
-//	}
-//}
+// testBackend is a Datastore, populated with the test data, for one of the storage backends
+type testBackend struct {
+	name    string
+	ds      *datastore.Datastore
+	cleanup func()
+}
+
+// testBackends returns a populated Datastore for each backend so the same tests can be run against all of them.
+// The Mongo backend is only included when a Mongo server is available.
+func testBackends() ([]testBackend, error) {
+	var xb []testBackend
+
+	mem, err := testdata.NewMemoryStore()
+	if err != nil {
+		return nil, err
+	}
+	xb = append(xb, testBackend{name: "memory", ds: mem, cleanup: func() {}})
+
+	f, err := ioutil.TempFile("", "rtcl_test_*.db")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	bolt, err := datastore.NewBoltStore(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	err = testdata.Populate(bolt)
+	if err != nil {
+		return nil, err
+	}
+	boltCleanup := func() {
+		bolt.Close()
+		os.Remove(f.Name())
+	}
+	xb = append(xb, testBackend{name: "bolt", ds: bolt, cleanup: boltCleanup})
+
+	if !testdata.MongoAvailable() {
+		log.Println("Mongo server not available - skipping Mongo backend")
+		return xb, nil
+	}
+	db := testdata.New()
+	err = db.SetupMongoDB()
+	if err != nil {
+		return nil, err
+	}
+	ds, err := db.Datastore()
+	if err != nil {
+		return nil, err
+	}
+	cleanup := func() {
+		err := db.TearDownMongoDB()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	xb = append(xb, testBackend{name: "mongo", ds: ds, cleanup: cleanup})
+
+	return xb, nil
+}
+
+// newTestUser returns a new user, with a unique email, saved to the datastore
+func newTestUser(t *testing.T, ds *datastore.Datastore) *datastore.User {
+	u := ds.NewUser()
+	u.FirstName = "Test"
+	u.LastName = "User"
+	u.Email = bson.NewObjectId().Hex() + "@rtcl.io"
+	err := u.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
@@ -0,0 +1,622 @@
+package datastore
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// collection is a minimal store of bson documents keyed by id. It is used to build repositories for backends that
+// have no query language of their own, so queries are done by scanning the documents. Documents are bson encoded,
+// as they are in Mongo, so that field names and value handling (eg time precision) are the same for every backend.
+type collection interface {
+	get(id string, v interface{}) error
+	put(id string, v interface{}) error
+	remove(id string) error
+	each(fn func(data []byte) error) error
+}
+
+// docUsers is a UserRepository built on a collection
+type docUsers struct {
+	mu sync.Mutex // serialises read-modify-write operations
+	c  collection
+}
+
+func (r *docUsers) ByID(id bson.ObjectId) (User, error) {
+	var u User
+	err := r.c.get(string(id), &u)
+	return u, err
+}
+
+func (r *docUsers) ByEmail(email string) (User, error) {
+	xu, err := r.find(func(u User) bool {
+		return u.Email == email
+	})
+	if err != nil {
+		return User{}, err
+	}
+	if len(xu) == 0 {
+		return User{}, ErrNotFound
+	}
+	return xu[0], nil
+}
+
+func (r *docUsers) Save(u User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	xu, err := r.find(func(x User) bool {
+		return x.Email == u.Email && x.ID != u.ID
+	})
+	if err != nil {
+		return err
+	}
+	if len(xu) > 0 {
+		return ErrEmailExists
+	}
+	return r.c.put(string(u.ID), u)
+}
+
+// AddSearch has the same semantics as $addToSet - the search is not added if an identical one exists
+func (r *docUsers) AddSearch(id bson.ObjectId, s Search) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var u User
+	err := r.c.get(string(id), &u)
+	if err != nil {
+		return err
+	}
+	for _, x := range u.Searches {
+		if reflect.DeepEqual(x, s) {
+			return nil
+		}
+	}
+	u.Searches = append(u.Searches, s)
+	return r.c.put(string(id), u)
+}
+
+func (r *docUsers) UpdateSearch(id bson.ObjectId, s Search) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var u User
+	err := r.c.get(string(id), &u)
+	if err != nil {
+		return err
+	}
+	for i, x := range u.Searches {
+		if x.ID == s.ID {
+			u.Searches[i] = s
+			return r.c.put(string(id), u)
+		}
+	}
+	return ErrNotFound
+}
+
+func (r *docUsers) RemoveSearch(id, searchID bson.ObjectId) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var u User
+	err := r.c.get(string(id), &u)
+	if err != nil {
+		return err
+	}
+	var xs []Search
+	for _, s := range u.Searches {
+		if s.ID != searchID {
+			xs = append(xs, s)
+		}
+	}
+	u.Searches = xs
+	return r.c.put(string(id), u)
+}
+
+func (r *docUsers) RecordFailedLogin(id bson.ObjectId, now time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var u User
+	err := r.c.get(string(id), &u)
+	if err != nil {
+		return 0, err
+	}
+	u.FailedLogins++
+	d := Backoff(u.FailedLogins, LoginFreeAttempts, LoginBaseLockout, LoginMaxLockout)
+	if d > 0 && now.Add(d).After(u.LoginLockout) {
+		u.LoginLockout = now.Add(d)
+	}
+	return u.FailedLogins, r.c.put(string(id), u)
+}
+
+func (r *docUsers) ClearLoginFailures(id bson.ObjectId) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var u User
+	err := r.c.get(string(id), &u)
+	if err != nil {
+		return err
+	}
+	u.FailedLogins = 0
+	u.LoginLockout = time.Time{}
+	return r.c.put(string(id), u)
+}
+
+// DueNotification excludes zero notification dates, the same as the Mongo query
+func (r *docUsers) DueNotification(now time.Time) ([]User, error) {
+	epoch := time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+	return r.find(func(u User) bool {
+		return u.Notification.After(epoch) && u.Notification.Before(now)
+	})
+}
+
+func (r *docUsers) DueDeletion(now time.Time) ([]User, error) {
+	return r.find(func(u User) bool {
+		return !u.DeleteAt.IsZero() && !u.DeleteAt.After(now)
+	})
+}
+
+func (r *docUsers) List(filter string, skip, limit int) ([]User, error) {
+	filter = strings.ToLower(filter)
+	xu, err := r.find(func(u User) bool {
+		return strings.Contains(strings.ToLower(u.Email), filter) ||
+			strings.Contains(strings.ToLower(u.FirstName), filter) ||
+			strings.Contains(strings.ToLower(u.LastName), filter)
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(xu, func(i, j int) bool {
+		return xu[i].Email < xu[j].Email
+	})
+	if skip >= len(xu) {
+		return nil, nil
+	}
+	xu = xu[skip:]
+	if limit > 0 && limit < len(xu) {
+		xu = xu[:limit]
+	}
+	return xu, nil
+}
+
+func (r *docUsers) Delete(id bson.ObjectId) error {
+	return r.c.remove(string(id))
+}
+
+// find returns all users for which match returns true
+func (r *docUsers) find(match func(u User) bool) ([]User, error) {
+	var xu []User
+	err := r.c.each(func(data []byte) error {
+		var u User
+		err := bson.Unmarshal(data, &u)
+		if err != nil {
+			return err
+		}
+		if match(u) {
+			xu = append(xu, u)
+		}
+		return nil
+	})
+	return xu, err
+}
+
+// docLogs is a LogRepository built on a collection
+type docLogs struct {
+	c collection
+}
+
+func (r *docLogs) ByID(id bson.ObjectId) (Log, error) {
+	var l Log
+	err := r.c.get(string(id), &l)
+	return l, err
+}
+
+func (r *docLogs) ByUserID(userID bson.ObjectId) ([]Log, error) {
+	var xl []Log
+	err := r.c.each(func(data []byte) error {
+		var l Log
+		err := bson.Unmarshal(data, &l)
+		if err != nil {
+			return err
+		}
+		if l.UserID == userID {
+			xl = append(xl, l)
+		}
+		return nil
+	})
+	return xl, err
+}
+
+func (r *docLogs) Save(l Log) error {
+	return r.c.put(string(l.ID), l)
+}
+
+func (r *docLogs) Delete(id bson.ObjectId) error {
+	return r.c.remove(string(id))
+}
+
+// docBookmarks is a BookmarkRepository built on a collection
+type docBookmarks struct {
+	c collection
+}
+
+func (r *docBookmarks) ByID(id bson.ObjectId) (Bookmark, error) {
+	var b Bookmark
+	err := r.c.get(string(id), &b)
+	return b, err
+}
+
+func (r *docBookmarks) ByUserID(userID bson.ObjectId) ([]Bookmark, error) {
+	var xb []Bookmark
+	err := r.c.each(func(data []byte) error {
+		var b Bookmark
+		err := bson.Unmarshal(data, &b)
+		if err != nil {
+			return err
+		}
+		if b.UserID == userID {
+			xb = append(xb, b)
+		}
+		return nil
+	})
+	return xb, err
+}
+
+func (r *docBookmarks) Save(b Bookmark) error {
+	return r.c.put(string(b.ID), b)
+}
+
+func (r *docBookmarks) Delete(id bson.ObjectId) error {
+	return r.c.remove(string(id))
+}
+
+// docShares is a ShareRepository built on a collection
+type docShares struct {
+	mu sync.Mutex // serialises read-modify-write operations
+	c  collection
+}
+
+func (r *docShares) ByID(id string) (Share, error) {
+	var sh Share
+	err := r.c.get(id, &sh)
+	return sh, err
+}
+
+func (r *docShares) BySearchID(searchID bson.ObjectId) ([]Share, error) {
+	return r.find(func(sh Share) bool {
+		return sh.SearchID == searchID
+	})
+}
+
+func (r *docShares) ByOwnerID(ownerID bson.ObjectId) ([]Share, error) {
+	return r.find(func(sh Share) bool {
+		return sh.OwnerID == ownerID
+	})
+}
+
+func (r *docShares) ByEmail(email string) ([]Share, error) {
+	return r.find(func(sh Share) bool {
+		for _, e := range sh.Emails {
+			if e == email {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (r *docShares) Save(sh Share) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.c.put(sh.ID, sh)
+}
+
+// AddSubscriber has the same semantics as $addToSet
+func (r *docShares) AddSubscriber(id string, userID bson.ObjectId) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var sh Share
+	err := r.c.get(id, &sh)
+	if err != nil {
+		return err
+	}
+	for _, s := range sh.Subscribers {
+		if s == userID {
+			return nil
+		}
+	}
+	sh.Subscribers = append(sh.Subscribers, userID)
+	return r.c.put(id, sh)
+}
+
+func (r *docShares) RemoveSubscriber(id string, userID bson.ObjectId) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var sh Share
+	err := r.c.get(id, &sh)
+	if err != nil {
+		return err
+	}
+	var xs []bson.ObjectId
+	for _, s := range sh.Subscribers {
+		if s != userID {
+			xs = append(xs, s)
+		}
+	}
+	sh.Subscribers = xs
+	return r.c.put(id, sh)
+}
+
+func (r *docShares) Delete(id string) error {
+	return r.c.remove(id)
+}
+
+// find returns all shares for which match returns true, oldest first
+func (r *docShares) find(match func(sh Share) bool) ([]Share, error) {
+	var xs []Share
+	err := r.c.each(func(data []byte) error {
+		var sh Share
+		err := bson.Unmarshal(data, &sh)
+		if err != nil {
+			return err
+		}
+		if match(sh) {
+			xs = append(xs, sh)
+		}
+		return nil
+	})
+	sort.SliceStable(xs, func(i, j int) bool {
+		if !xs[i].Created.Equal(xs[j].Created) {
+			return xs[i].Created.Before(xs[j].Created)
+		}
+		return xs[i].Seq < xs[j].Seq
+	})
+	return xs, err
+}
+
+// docArticles is an ArticleRepository built on a collection
+type docArticles struct {
+	mu sync.Mutex // serialises read-modify-write operations
+	c  collection
+}
+
+func (r *docArticles) ByPMID(pmid string) (Article, error) {
+	var a Article
+	err := r.c.get(pmid, &a)
+	return a, err
+}
+
+func (r *docArticles) ByPMIDs(pmids []string) ([]Article, error) {
+	var xa []Article
+	for _, id := range pmids {
+		a, err := r.ByPMID(id)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		xa = append(xa, a)
+	}
+	return xa, nil
+}
+
+func (r *docArticles) ByCategories(categories []string, since time.Time) ([]Article, error) {
+	in := map[string]bool{}
+	for _, c := range categories {
+		in[strings.ToLower(c)] = true
+	}
+	var xa []Article
+	err := r.c.each(func(data []byte) error {
+		var a Article
+		err := bson.Unmarshal(data, &a)
+		if err != nil {
+			return err
+		}
+		if in[strings.ToLower(a.Category)] && !a.Published.Before(since) {
+			xa = append(xa, a)
+		}
+		return nil
+	})
+	return xa, err
+}
+
+func (r *docArticles) Upsert(xa ...Article) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, a := range xa {
+		existing, err := r.ByPMID(a.PMID)
+		if err == nil {
+			a.Created = existing.Created
+		}
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		err = r.c.put(a.PMID, a)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// docTokenIDs is a TokenIDRepository built on a collection
+type docTokenIDs struct {
+	mu sync.Mutex
+	c  collection
+}
+
+type tokenID struct {
+	ID      string    `bson:"_id"`
+	Expires time.Time `bson:"expires"`
+}
+
+func (r *docTokenIDs) Add(id string, expires time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	exists, err := r.Exists(id)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return ErrDuplicate
+	}
+	err = r.removeExpired(time.Now())
+	if err != nil {
+		return err
+	}
+	return r.c.put(id, tokenID{ID: id, Expires: expires})
+}
+
+// removeExpired deletes the ids of tokens that expired before now, as the Mongo TTL index does, so the collection
+// only grows with the tokens that are still valid
+func (r *docTokenIDs) removeExpired(now time.Time) error {
+	var expired []string
+	err := r.c.each(func(data []byte) error {
+		var t tokenID
+		err := bson.Unmarshal(data, &t)
+		if err != nil {
+			return err
+		}
+		if t.Expires.Before(now) {
+			expired = append(expired, t.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range expired {
+		err = r.c.remove(id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *docTokenIDs) Exists(id string) (bool, error) {
+	var t tokenID
+	err := r.c.get(id, &t)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// docRefreshTokens is a RefreshTokenRepository built on a collection
+type docRefreshTokens struct {
+	mu sync.Mutex // serialises read-modify-write operations
+	c  collection
+}
+
+func (r *docRefreshTokens) ByID(id string) (RefreshToken, error) {
+	var t RefreshToken
+	err := r.c.get(id, &t)
+	return t, err
+}
+
+func (r *docRefreshTokens) Save(t RefreshToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.c.put(t.ID, t)
+}
+
+func (r *docRefreshTokens) Use(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var t RefreshToken
+	err := r.c.get(id, &t)
+	if err != nil {
+		return err
+	}
+	if t.Used {
+		return ErrNotFound
+	}
+	t.Used = true
+	return r.c.put(id, t)
+}
+
+func (r *docRefreshTokens) RevokeFamily(family string) error {
+	return r.revoke(func(t RefreshToken) bool {
+		return t.Family == family
+	})
+}
+
+func (r *docRefreshTokens) RevokeUser(userID bson.ObjectId) error {
+	return r.revoke(func(t RefreshToken) bool {
+		return t.UserID == userID
+	})
+}
+
+// revoke sets Revoked on all tokens for which match returns true
+func (r *docRefreshTokens) revoke(match func(t RefreshToken) bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var xt []RefreshToken
+	err := r.c.each(func(data []byte) error {
+		var t RefreshToken
+		err := bson.Unmarshal(data, &t)
+		if err != nil {
+			return err
+		}
+		if match(t) && !t.Revoked {
+			xt = append(xt, t)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, t := range xt {
+		t.Revoked = true
+		err = r.c.put(t.ID, t)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// docClients is a ClientRepository built on a collection
+type docClients struct {
+	c collection
+}
+
+func (r *docClients) ByID(id bson.ObjectId) (Client, error) {
+	var c Client
+	err := r.c.get(string(id), &c)
+	return c, err
+}
+
+func (r *docClients) ByKeyHash(keyHash string) (Client, error) {
+	xc, err := r.All()
+	if err != nil {
+		return Client{}, err
+	}
+	for _, c := range xc {
+		if c.KeyHash == keyHash {
+			return c, nil
+		}
+	}
+	return Client{}, ErrNotFound
+}
+
+func (r *docClients) Save(c Client) error {
+	return r.c.put(string(c.ID), c)
+}
+
+// All returns clients in the order they were added
+func (r *docClients) All() ([]Client, error) {
+	var xc []Client
+	err := r.c.each(func(data []byte) error {
+		var c Client
+		err := bson.Unmarshal(data, &c)
+		if err != nil {
+			return err
+		}
+		xc = append(xc, c)
+		return nil
+	})
+	return xc, err
+}
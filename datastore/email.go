@@ -0,0 +1,60 @@
+package datastore
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+)
+
+// ErrEmailInvalid is returned when a new email is not a bare address, eg "Name <name@rtcl.io>"
+var ErrEmailInvalid = errors.New("email address is not valid")
+
+// RequestEmailChange holds the new email as pending, so that a typo or a hijacked session cannot change the
+// address until it has been confirmed with the link from EmailChangeToken. Requesting the current email cancels a
+// pending change. The email is lower case, and must be a bare address or ErrEmailInvalid is returned. It does not
+// save the user.
+func (u *User) RequestEmailChange(email string) error {
+	email = strings.ToLower(strings.TrimSpace(email))
+	a, err := mail.ParseAddress(email)
+	if err != nil || a.Name != "" || a.Address != email {
+		return ErrEmailInvalid
+	}
+	if strings.EqualFold(email, u.Email) {
+		u.PendingEmail = ""
+		return nil
+	}
+	if u.ds.UserEmailExists(email) {
+		return ErrEmailExists
+	}
+	u.PendingEmail = email
+	return nil
+}
+
+// EmailChangeToken returns a change-email action token for the pending email, to be sent to the new address. The
+// token carries the address so that a link for an earlier request cannot confirm a later one.
+func (u *User) EmailChangeToken(signingKey string) (string, error) {
+	if u.PendingEmail == "" {
+		return "", errors.New("there is no pending email change")
+	}
+	a := NewActionToken(u.ID, ActionChangeEmail, u.ds.now())
+	a.Data = u.PendingEmail
+	return a.Encode(signingKey)
+}
+
+// ConfirmEmailChange replaces the email with the pending one, which must match the email from the change-email
+// token. It returns ErrEmailExists if another user has taken the address since the change was requested.
+func (u *User) ConfirmEmailChange(email string) error {
+	if email == "" || email != u.PendingEmail {
+		return ErrActionTokenInvalid
+	}
+	old := u.Email
+	u.Email = email
+	u.PendingEmail = ""
+	err := u.update()
+	if err != nil {
+		u.Email = old
+		u.PendingEmail = email
+		return err
+	}
+	return nil
+}
@@ -9,12 +9,12 @@ import (
 )
 
 type Token struct {
-	signingKey []byte
-	ttlHours   int
-	Encoded    string      `json:"token"`
-	IssuedAt   time.Time   `json:"issuedAt"`
-	ExpiresAt  time.Time   `json:"expiresAt"`
-	Claims     TokenClaims `json:"claims"`
+	key       SigningKey
+	ttlHours  int
+	Encoded   string      `json:"token"`
+	IssuedAt  time.Time   `json:"issuedAt"`
+	ExpiresAt time.Time   `json:"expiresAt"`
+	Claims    TokenClaims `json:"claims"`
 }
 
 type TokenClaims struct {
@@ -24,16 +24,22 @@ type TokenClaims struct {
 	jwt.StandardClaims
 }
 
-// New returns a pointer to a Token
+// New returns a pointer to a Token signed with HS256 and the shared secret signingKey
 func NewToken(issuer, signingKey string, ttlHours int) *Token {
+	return NewSignedToken(issuer, HMACKey(signingKey), ttlHours)
+}
+
+// NewSignedToken returns a pointer to a Token signed with the key, usually the active key from a Keyring
+func NewSignedToken(issuer string, key SigningKey, ttlHours int) *Token {
 
 	var t Token
 
-	t.signingKey = []byte(signingKey)
+	t.key = key
 	t.ttlHours = ttlHours
 
-	// Initialise standard claims
+	// Initialise standard claims, the jti identifies the token so it can be revoked before it expires
 	t.Claims.StandardClaims = jwt.StandardClaims{
+		Id:     randomID(),
 		Issuer: issuer,
 	}
 
@@ -62,43 +68,50 @@ func (t *Token) Encode() (Token, error) {
 	if t.Claims.Issuer == "" {
 		return *t, errors.New("Issuer cannot be blank")
 	}
-	if len(t.signingKey) < 1 {
+	if t.key.empty() {
 		return *t, errors.New("Signing key cannot be blank")
 	}
 	if t.ttlHours < 1 {
 		return *t, errors.New("TTL hours must be a positive integer")
 	}
 
+	tok := jwt.NewWithClaims(t.key.Method, t.Claims)
+	if t.key.ID != "" {
+		tok.Header["kid"] = t.key.ID
+	}
+
 	var err error
-	t.Encoded, err = jwt.NewWithClaims(jwt.SigningMethodHS256, t.Claims).SignedString([]byte(t.signingKey))
+	t.Encoded, err = tok.SignedString(t.key.sign)
 	return *t, err
 }
 
 // CustomClaims sets custom claims
 func (t *Token) CustomClaims(claims map[string]interface{}) *Token {
 
-	if id, ok := claims["id"]; ok {
-		t.Claims.ID = id.(string)
+	if id, ok := claims["id"].(string); ok {
+		t.Claims.ID = id
 	}
-	if name, ok := claims["name"]; ok {
-		t.Claims.Name = name.(string)
+	if name, ok := claims["name"].(string); ok {
+		t.Claims.Name = name
 	}
-	if role, ok := claims["role"]; ok {
-		t.Claims.Role = role.(string)
+	if role, ok := claims["role"].(string); ok {
+		t.Claims.Role = role
 	}
 
 	return t
 }
 
+// Audience sets the aud claim, which identifies the service the token is intended for
+func (t *Token) Audience(aud string) *Token {
+	t.Claims.Audience = aud
+	return t
+}
+
 // Valid returns true if the Token.Encoded string is a valid JWT
 func (t *Token) Valid() bool {
-	_, err := jwt.Parse(t.Encoded, func(tok *jwt.Token) (interface{}, error) {
-		return []byte(t.signingKey), nil
-	})
-	if err != nil {
-		return false
-	}
-	return true
+	v := TokenValidator{Keyring: NewKeyring(t.key)}
+	_, err := v.Decode(t.Encoded)
+	return err == nil
 }
 
 // String returns the encoded token string (JWS)
@@ -108,69 +121,15 @@ func (t *Token) String() string {
 
 // Decode attempts to decode token with signingKey and returns a new Token value if everything checks out
 func DecodeToken(token, signingKey string) (Token, error) {
+	return DecodeSignedToken(token, NewKeyring(HMACKey(signingKey)))
+}
 
-	t := Token{
-		Encoded:    token,
-		signingKey: []byte(signingKey),
-	}
-
-	// The jwt library panics if the jwt does not contain 3 '.'s - assume because it splits the string at each period
-	// and gets and index out of range if it does not end up with three pieces.
-	if len(strings.Split(token, ".")) < 3 {
-		return t, errors.New("JWT should have 3 parts in format aaaa.bbbb.cccc")
-	}
-
-	// Parse the token which sets the Valid field
-	tok, err := jwt.Parse(token, func(tok *jwt.Token) (interface{}, error) {
-		return t.signingKey, nil
-	})
-	if err != nil {
-		return t, errors.New("Error parsing token: " + err.Error())
-	}
-
-	claims, ok := tok.Claims.(jwt.MapClaims)
-	if ok && tok.Valid {
-
-		//Custom claims
-		t.Claims.ID = claims["id"].(string)
-		t.Claims.Name = claims["name"].(string)
-		t.Claims.Role = claims["role"].(string)
-
-		// Standard claims
-		t.Claims.ExpiresAt = int64(claims["exp"].(float64))
-		t.Claims.IssuedAt = int64(claims["iat"].(float64))
-		t.Claims.Issuer = claims["iss"].(string)
-
-		// reverse engineer ttlHours from iat and exp
-		t.ttlHours = (int(t.Claims.ExpiresAt) - int(t.Claims.IssuedAt)) / 3600
-
-		// Set the friendly dates
-		issueTime := time.Unix(t.Claims.IssuedAt, 0)
-		t.SetTimes(issueTime)
-
-		return t, nil
-	}
-
-	// Below here we are in error land
-	ve, ok := err.(*jwt.ValidationError)
-	if !ok {
-		return t, errors.New("Failed to validate token - " + err.Error())
-	}
-
-	if ve.Errors&jwt.ValidationErrorMalformed != 0 {
-		return t, errors.New("Token malformed")
-	}
-	if ve.Errors&jwt.ValidationErrorNotValidYet != 0 {
-		return t, errors.New("Token issue date is in the future - not valid yet?")
-	}
-	if ve.Errors&jwt.ValidationErrorExpired != 0 {
-		return t, errors.New("Token has expired")
-	}
-	if ve.Errors&jwt.ValidationErrorSignatureInvalid != 0 {
-		return t, errors.New("Token signature is invalid")
-	}
-
-	return t, errors.New("Token error: " + err.Error())
+// DecodeSignedToken attempts to decode a token with the key in the keyring identified by the kid header, and
+// returns a new Token value if everything checks out. Tokens without a kid are verified with the HMAC key. The issuer
+// and audience are not checked - use a TokenValidator for that.
+func DecodeSignedToken(token string, kr *Keyring) (Token, error) {
+	v := TokenValidator{Keyring: kr}
+	return v.Decode(token)
 }
 
 // FromHeader extracts the jwt string from the header Authorization string (a).
@@ -0,0 +1,225 @@
+package datastore
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// minimum size of an RSA signing key
+const minRSABits = 2048
+
+// SigningKey is a key for signing and verifying tokens. HMAC keys are shared secrets, RSA and EC keys can be
+// published in a JWKS so that other services can verify tokens.
+type SigningKey struct {
+	ID     string // kid, empty for the HMAC key so tokens signed with it have no kid
+	Method jwt.SigningMethod
+	sign   interface{}
+	verify interface{}
+}
+
+// HMACKey returns an HS256 key for the shared secret
+func HMACKey(secret string) SigningKey {
+	return SigningKey{
+		Method: jwt.SigningMethodHS256,
+		sign:   []byte(secret),
+		verify: []byte(secret),
+	}
+}
+
+// empty returns true if there is no key to sign with, or the HMAC secret is blank
+func (k SigningKey) empty() bool {
+	secret, ok := k.sign.([]byte)
+	return k.sign == nil || (ok && len(secret) == 0)
+}
+
+// ParsePrivateKeys parses one or more PEM encoded private keys. RSA keys are used for RS256 and EC keys on the
+// P-256 curve for ES256. The kid of each key is its JWK thumbprint (RFC 7638), so it is stable and needs no config.
+func ParsePrivateKeys(data []byte) ([]SigningKey, error) {
+	var xk []SigningKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		k, err := parsePrivateKey(block)
+		if err != nil {
+			return nil, err
+		}
+		xk = append(xk, k)
+	}
+	return xk, nil
+}
+
+// Keyring holds the keys used to sign and verify tokens. The first key is the active key, that new tokens are
+// signed with. The rest are retired keys that are only used to verify tokens issued before a rotation, and can be
+// removed once those tokens have expired.
+type Keyring struct {
+	keys []SigningKey
+}
+
+// NewKeyring returns a pointer to a Keyring with the keys, the first of which is active
+func NewKeyring(keys ...SigningKey) *Keyring {
+	return &Keyring{keys: keys}
+}
+
+// Active returns the key for signing new tokens
+func (kr *Keyring) Active() SigningKey {
+	if len(kr.keys) == 0 {
+		return SigningKey{Method: jwt.SigningMethodHS256}
+	}
+	return kr.keys[0]
+}
+
+// Key returns the key with the kid
+func (kr *Keyring) Key(kid string) (SigningKey, bool) {
+	for _, k := range kr.keys {
+		if k.ID == kid {
+			return k, true
+		}
+	}
+	return SigningKey{}, false
+}
+
+// Algorithms returns the signing algorithms of the keys in the keyring
+func (kr *Keyring) Algorithms() []string {
+	var xa []string
+	for _, k := range kr.keys {
+		if !containsAny([]string{k.Method.Alg()}, xa) {
+			xa = append(xa, k.Method.Alg())
+		}
+	}
+	return xa
+}
+
+// JWK is a public key in JSON Web Key format
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys in the keyring, active and retired, so that other services can verify tokens.
+// HMAC keys are secret so are never included.
+func (kr *Keyring) JWKS() JWKS {
+	set := JWKS{Keys: []JWK{}}
+	for _, k := range kr.keys {
+		jwk, ok := publicJWK(k)
+		if ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
+
+// parsePrivateKey parses an RSA or EC private key in PKCS#1, SEC 1 or PKCS#8 format
+func parsePrivateKey(block *pem.Block) (SigningKey, error) {
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return SigningKey{}, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return SigningKey{}, errors.Wrap(err, "could not parse private key")
+	}
+
+	var k SigningKey
+	switch pk := key.(type) {
+	case *rsa.PrivateKey:
+		if pk.N.BitLen() < minRSABits {
+			return k, fmt.Errorf("RSA key must be at least %d bits", minRSABits)
+		}
+		k = SigningKey{Method: jwt.SigningMethodRS256, sign: pk, verify: &pk.PublicKey}
+	case *ecdsa.PrivateKey:
+		if pk.Curve != elliptic.P256() {
+			return k, errors.New("EC key must use the P-256 curve")
+		}
+		k = SigningKey{Method: jwt.SigningMethodES256, sign: pk, verify: &pk.PublicKey}
+	default:
+		return k, errors.New("private key must be RSA or EC")
+	}
+
+	jwk, _ := publicJWK(k)
+	k.ID = thumbprint(jwk)
+	return k, nil
+}
+
+// publicJWK returns the public part of an RSA or EC key as a JWK. The kid is taken from the key, so is empty when
+// the JWK is used to calculate the thumbprint.
+func publicJWK(k SigningKey) (JWK, bool) {
+	enc := base64.RawURLEncoding.EncodeToString
+	switch pub := k.verify.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			Kid: k.ID,
+			Use: "sig",
+			Alg: k.Method.Alg(),
+			N:   enc(pub.N.Bytes()),
+			E:   enc(big.NewInt(int64(pub.E)).Bytes()),
+		}, true
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		return JWK{
+			Kty: "EC",
+			Kid: k.ID,
+			Use: "sig",
+			Alg: k.Method.Alg(),
+			Crv: pub.Curve.Params().Name,
+			X:   enc(padBytes(pub.X.Bytes(), size)),
+			Y:   enc(padBytes(pub.Y.Bytes(), size)),
+		}, true
+	}
+	return JWK{}, false
+}
+
+// thumbprint returns the RFC 7638 thumbprint of the JWK - a hash of the required members in lexical order
+func thumbprint(jwk JWK) string {
+	var s string
+	switch jwk.Kty {
+	case "RSA":
+		s = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, jwk.E, jwk.N)
+	case "EC":
+		s = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, jwk.Crv, jwk.X, jwk.Y)
+	}
+	h := sha256.Sum256([]byte(s))
+	return base64.RawURLEncoding.EncodeToString(h[:])
+}
+
+// padBytes left pads b with zeros to size, as required for EC coordinates
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	p := make([]byte, size)
+	copy(p[size-len(b):], b)
+	return p
+}
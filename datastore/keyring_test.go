@@ -0,0 +1,110 @@
+package datastore_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/matryer/is"
+	"github.com/mikedonnici/rtcl-api/datastore"
+)
+
+// testPEMKeys returns a PEM encoded RSA key and EC key
+func testPEMKeys(t *testing.T) (rsaPEM, ecPEM []byte) {
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rk)})
+
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := x509.MarshalECPrivateKey(ek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b})
+	return rsaPEM, ecPEM
+}
+
+func TestKeyring(t *testing.T) {
+	is := is.New(t)
+	rsaPEM, ecPEM := testPEMKeys(t)
+
+	keys, err := datastore.ParsePrivateKeys(append(rsaPEM, ecPEM...))
+	is.NoErr(err)                                 // error parsing keys
+	is.Equal(len(keys), 2)                        // expected two keys
+	is.Equal(keys[0].Method.Alg(), "RS256")       // RSA key should be RS256
+	is.Equal(keys[1].Method.Alg(), "ES256")       // EC key should be ES256
+	is.True(keys[0].ID != "" && keys[1].ID != "") // keys should have a kid
+
+	again, err := datastore.ParsePrivateKeys(rsaPEM)
+	is.NoErr(err)                     // error parsing key
+	is.Equal(again[0].ID, keys[0].ID) // kid should be the same each time the key is parsed
+
+	hmac := datastore.HMACKey(signingKey)
+	kr := datastore.NewKeyring(append(keys, hmac)...)
+	jwks := kr.JWKS()
+	is.Equal(len(jwks.Keys), 2)         // JWKS should only have the public keys
+	is.Equal(jwks.Keys[0].Kty, "RSA")   // wrong key type
+	is.Equal(jwks.Keys[1].Crv, "P-256") // wrong curve
+
+	for _, k := range append(keys, hmac) {
+		tk, err := datastore.NewSignedToken(issuer, k, ttlHours).Encode()
+		is.NoErr(err) // error encoding token
+		tk2, err := datastore.DecodeSignedToken(tk.String(), kr)
+		is.NoErr(err)                                 // error decoding token
+		is.Equal(tk2.Claims.Issuer, tk.Claims.Issuer) // wrong issuer
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	is := is.New(t)
+	rsaPEM, ecPEM := testPEMKeys(t)
+	oldKeys, err := datastore.ParsePrivateKeys(rsaPEM)
+	is.NoErr(err) // error parsing key
+	newKeys, err := datastore.ParsePrivateKeys(ecPEM)
+	is.NoErr(err) // error parsing key
+
+	before := datastore.NewKeyring(oldKeys[0])
+	tk, err := datastore.NewSignedToken(issuer, before.Active(), ttlHours).Encode()
+	is.NoErr(err) // error encoding token
+
+	// new key is active and old key is retired, so tokens signed with either are valid
+	after := datastore.NewKeyring(newKeys[0], oldKeys[0])
+	_, err = datastore.DecodeSignedToken(tk.String(), after)
+	is.NoErr(err) // token signed with a retired key should be valid
+	tk2, err := datastore.NewSignedToken(issuer, after.Active(), ttlHours).Encode()
+	is.NoErr(err) // error encoding token
+	_, err = datastore.DecodeSignedToken(tk2.String(), after)
+	is.NoErr(err) // token signed with the active key should be valid
+
+	// once the old key is removed its tokens are invalid
+	_, err = datastore.DecodeSignedToken(tk.String(), datastore.NewKeyring(newKeys[0]))
+	is.True(err != nil) // token signed with a removed key should be invalid
+}
+
+// TestKeyringAlgMismatch checks that a token cannot be forged by signing it with HS256 and the public RSA key as
+// the secret, with the kid of the RSA key
+func TestKeyringAlgMismatch(t *testing.T) {
+	is := is.New(t)
+	rsaPEM, _ := testPEMKeys(t)
+	keys, err := datastore.ParsePrivateKeys(rsaPEM)
+	is.NoErr(err) // error parsing key
+	kr := datastore.NewKeyring(keys...)
+
+	jwk := kr.JWKS().Keys[0]
+	tok := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"id": userID, "iss": issuer})
+	tok.Header["kid"] = jwk.Kid
+	forged, err := tok.SignedString([]byte(jwk.N))
+	is.NoErr(err) // error signing forged token
+	_, err = datastore.DecodeSignedToken(forged, kr)
+	is.True(err != nil) // token with the wrong alg for the key should be invalid
+}
@@ -0,0 +1,77 @@
+package datastore
+
+import (
+	"fmt"
+	"time"
+)
+
+// Account lockout policy for failed logins. The first few failures are free, after that the account is locked
+// for a period that doubles with each failure, up to a maximum. The lockout ends by itself when the period is up,
+// or can be cleared with User.ClearLoginFailures.
+const (
+	LoginFreeAttempts = 5
+	LoginBaseLockout  = time.Minute
+	LoginMaxLockout   = 6 * time.Hour
+)
+
+// LockoutError is returned by UserAuth when the account is locked out after too many failed logins
+type LockoutError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockoutError) Error() string {
+	return fmt.Sprintf("too many failed logins, try again in %s", e.RetryAfter)
+}
+
+// Backoff returns the lockout period after the specified number of failures. There is no lockout for the free
+// attempts, then the lockout starts at base and doubles with each failure up to max.
+func Backoff(failures, free int, base, max time.Duration) time.Duration {
+	if failures <= free {
+		return 0
+	}
+	d := base
+	for i := free + 1; i < failures; i++ {
+		d *= 2
+		if d >= max {
+			return max
+		}
+	}
+	return d
+}
+
+// LoginRetryAfter returns how long until the user can try to log in again, or zero if they are not locked out
+func (u *User) LoginRetryAfter(now time.Time) time.Duration {
+	if now.Before(u.LoginLockout) {
+		return u.LoginLockout.Sub(now)
+	}
+	return 0
+}
+
+// RecordFailedLogin increments the failed login count and, once the free attempts are used up, locks the
+// account out for an exponentially increasing period. The stored count is incremented atomically, rather than
+// saving the user, as the user may be stale after a slow password check and concurrent failures must all count.
+func (u *User) RecordFailedLogin(now time.Time) error {
+	n, err := u.ds.Users.RecordFailedLogin(u.ID, now)
+	if err != nil {
+		return err
+	}
+	u.FailedLogins = n
+	d := Backoff(n, LoginFreeAttempts, LoginBaseLockout, LoginMaxLockout)
+	if d > 0 && now.Add(d).After(u.LoginLockout) {
+		u.LoginLockout = now.Add(d)
+	}
+	return nil
+}
+
+// ClearLoginFailures removes any lockout and resets the failed login count. This happens on a successful login,
+// and can be done by an admin to unlock an account before the lockout period is up. Only the failed login fields
+// are stored, so other changes to the user must be saved first.
+func (u *User) ClearLoginFailures() error {
+	err := u.ds.Users.ClearLoginFailures(u.ID)
+	if err != nil {
+		return err
+	}
+	u.FailedLogins = 0
+	u.LoginLockout = time.Time{}
+	return nil
+}
@@ -23,13 +23,12 @@ func (l *Log) Save() error {
 	if !l.ID.Valid() {
 		l.ID = bson.NewObjectId()
 	}
-	_, err := l.ds.logsCollection().Upsert(bson.M{"_id": l.ID}, l)
-	return err
+	return l.ds.Logs.Save(*l)
 }
 
 // Delete deletes log from the datastore
 func (l *Log) Delete() error {
-	return l.ds.logsCollection().RemoveId(l.ID)
+	return l.ds.Logs.Delete(l.ID)
 }
 
 // checkFields ensures required field values
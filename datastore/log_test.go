@@ -8,47 +8,36 @@ import (
 	"time"
 
 	"github.com/mikedonnici/rtcl-api/datastore"
-	"github.com/mikedonnici/rtcl-api/datastore/mongo"
-	"github.com/mikedonnici/rtcl-api/testdata"
 )
 
-var logTestDB = testdata.New()
-var logTestDS = datastore.New()
+var logTestDS *datastore.Datastore
 
 func TestLog(t *testing.T) {
 
-	var err error
-
-	err = logTestDB.SetupMongoDB()
+	backends, err := testBackends()
 	if err != nil {
 		log.Fatalln(err)
 	}
-	defer cleanupLogTest()
 
-	logTestDS.Mongo, err = mongo.NewConnection(testdata.MongoDSN, logTestDB.DBName, "test")
-	if err != nil {
-		log.Fatalln(err)
-	}
-
-	t.Run("log", func(t *testing.T) {
-		t.Run("testPingDB", testPingDB)
-		t.Run("testAddLog", testAddLog)
-		t.Run("testUpdateLog", testUpdateLog)
-		t.Run("testDeleteLog", testDeleteLog)
-		t.Run("testLogByID", testLogByID)
-		t.Run("testLogByIDNotFound", testLogByIDNotFound)
-		t.Run("testLogsByUserID", testLogsByUserID)
-	})
-}
-
-func cleanupLogTest() {
-	err := logTestDB.TearDownMongoDB()
-	if err != nil {
-		log.Println(err)
+	for _, b := range backends {
+		logTestDS = b.ds
+		t.Run(b.name, func(t *testing.T) {
+			t.Run("testPingDB", testPingDB)
+			t.Run("testAddLog", testAddLog)
+			t.Run("testUpdateLog", testUpdateLog)
+			t.Run("testDeleteLog", testDeleteLog)
+			t.Run("testLogByID", testLogByID)
+			t.Run("testLogByIDNotFound", testLogByIDNotFound)
+			t.Run("testLogsByUserID", testLogsByUserID)
+		})
+		b.cleanup()
 	}
 }
 
 func testPingDB(t *testing.T) {
+	if logTestDS.Mongo == nil {
+		t.Skip("not a Mongo backend")
+	}
 	is := is.New(t)
 	err := logTestDS.Mongo.Session.Ping()
 	is.NoErr(err) // cannot ping database
@@ -0,0 +1,92 @@
+package datastore
+
+import (
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// NewMemoryStore returns a pointer to a Datastore with in-memory repositories. Nothing is persisted, so it is
+// intended for tests and local development.
+func NewMemoryStore() *Datastore {
+	return &Datastore{
+		Users:          &docUsers{c: newMemoryCollection()},
+		Logs:           &docLogs{c: newMemoryCollection()},
+		Articles:       &docArticles{c: newMemoryCollection()},
+		Bookmarks:      &docBookmarks{c: newMemoryCollection()},
+		Shares:         &docShares{c: newMemoryCollection()},
+		ConsumedTokens: &docTokenIDs{c: newMemoryCollection()},
+		RevokedTokens:  &docTokenIDs{c: newMemoryCollection()},
+		RefreshTokens:  &docRefreshTokens{c: newMemoryCollection()},
+		Clients:        &docClients{c: newMemoryCollection()},
+	}
+}
+
+// memoryCollection is a collection held in a map. Insertion order is kept so that scans are deterministic.
+type memoryCollection struct {
+	mu   sync.RWMutex
+	docs map[string][]byte
+	keys []string
+}
+
+func newMemoryCollection() *memoryCollection {
+	return &memoryCollection{docs: map[string][]byte{}}
+}
+
+func (c *memoryCollection) get(id string, v interface{}) error {
+	c.mu.RLock()
+	data, ok := c.docs[id]
+	c.mu.RUnlock()
+	if !ok {
+		return ErrNotFound
+	}
+	return bson.Unmarshal(data, v)
+}
+
+func (c *memoryCollection) put(id string, v interface{}) error {
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.docs[id]; !ok {
+		c.keys = append(c.keys, id)
+	}
+	c.docs[id] = data
+	return nil
+}
+
+func (c *memoryCollection) remove(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.docs[id]; !ok {
+		return ErrNotFound
+	}
+	delete(c.docs, id)
+	for i, k := range c.keys {
+		if k == id {
+			c.keys = append(c.keys[:i], c.keys[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// each calls fn for every document, in insertion order. The lock is not held while fn runs so that fn can call
+// back into the collection.
+func (c *memoryCollection) each(fn func(data []byte) error) error {
+	c.mu.RLock()
+	xd := make([][]byte, 0, len(c.keys))
+	for _, k := range c.keys {
+		xd = append(xd, c.docs[k])
+	}
+	c.mu.RUnlock()
+	for _, data := range xd {
+		err := fn(data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
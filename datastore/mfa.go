@@ -0,0 +1,223 @@
+package datastore
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters (RFC 6238). These are the defaults that authenticator apps assume, so the otpauth URI works with
+// all of them.
+const (
+	TOTPPeriod = 30 // seconds
+	TOTPDigits = 6
+	totpSkew   = 1 // steps either side of now that are accepted, for clock drift
+)
+
+// number of recovery codes issued when two-factor auth is confirmed
+const recoveryCodeCount = 10
+
+// Two-factor auth errors
+var (
+	ErrMFACodeInvalid    = errors.New("two-factor code is not valid")
+	ErrMFANotEnrolled    = errors.New("two-factor auth is not set up")
+	ErrMFAAlreadyEnabled = errors.New("two-factor auth is already enabled")
+)
+
+// TOTPCode returns the TOTP code for the base32 encoded secret at time t
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, t.Unix()/TOTPPeriod), nil
+}
+
+// EnrollTOTP generates a new TOTP secret for the user and returns it, and the otpauth URI for a QR code. The secret
+// is saved but two-factor auth is not enabled until ConfirmTOTP is called with a code from the authenticator app.
+func (u *User) EnrollTOTP(issuer string) (secret, uri string, err error) {
+	if u.MFAEnabled {
+		return "", "", ErrMFAAlreadyEnabled
+	}
+
+	b := make([]byte, 20) // 160 bits, as recommended by RFC 4226
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", "", err
+	}
+	u.TOTPSecret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b)
+	u.TOTPLastStep = 0
+	err = u.update()
+	if err != nil {
+		return "", "", err
+	}
+
+	v := url.Values{}
+	v.Set("secret", u.TOTPSecret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(TOTPDigits))
+	v.Set("period", fmt.Sprint(TOTPPeriod))
+	uri = "otpauth://totp/" + url.PathEscape(issuer+":"+u.Email) + "?" + v.Encode()
+
+	return u.TOTPSecret, uri, nil
+}
+
+// ConfirmTOTP enables two-factor auth if the code matches the enrolled secret, and returns a set of single use
+// recovery codes. The codes are only returned here - just their hashes are stored.
+func (u *User) ConfirmTOTP(code string) ([]string, error) {
+	if u.MFAEnabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+	if u.TOTPSecret == "" {
+		return nil, ErrMFANotEnrolled
+	}
+	if !u.checkTOTP(code) {
+		return nil, ErrMFACodeInvalid
+	}
+
+	codes, err := u.newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	u.MFAEnabled = true
+	return codes, u.update()
+}
+
+// CheckMFA checks a code from the authenticator app or, failing that, one of the recovery codes. A recovery code is
+// removed once it has been used. The user is saved so that neither kind of code can be used twice.
+func (u *User) CheckMFA(code string) error {
+	if !u.MFAEnabled {
+		return ErrMFANotEnrolled
+	}
+	if !u.checkTOTP(code) && !u.useRecoveryCode(code) {
+		return ErrMFACodeInvalid
+	}
+	return u.update()
+}
+
+// DisableMFA turns off two-factor auth and removes the secret and recovery codes
+func (u *User) DisableMFA() error {
+	u.MFAEnabled = false
+	u.TOTPSecret = ""
+	u.TOTPLastStep = 0
+	u.RecoveryCodes = nil
+	return u.update()
+}
+
+// MFAAuth is the second step of UserAuth for a user with two-factor auth. Failed codes count towards the same
+// lockout as failed passwords.
+func (ds *Datastore) MFAAuth(userID, code string) (*User, error) {
+	u, err := ds.UserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if u.Disabled {
+		return nil, ErrAccountDisabled
+	}
+
+	now := ds.now()
+	wait := u.LoginRetryAfter(now)
+	if wait > 0 {
+		return nil, &LockoutError{RetryAfter: wait}
+	}
+
+	err = u.CheckMFA(code)
+	if err == ErrMFACodeInvalid {
+		err = u.RecordFailedLogin(now)
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrMFACodeInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if u.FailedLogins > 0 {
+		err = u.ClearLoginFailures()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
+// checkTOTP returns true if the code matches the secret within the allowed clock drift, and has not been used
+// before. It records the step of the matching code but does not save the user.
+func (u *User) checkTOTP(code string) bool {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(u.TOTPSecret)
+	if err != nil || len(code) != TOTPDigits {
+		return false
+	}
+	now := u.ds.now().Unix() / TOTPPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= u.TOTPLastStep {
+			continue
+		}
+		if hmac.Equal([]byte(hotp(key, step)), []byte(code)) {
+			u.TOTPLastStep = step
+			return true
+		}
+	}
+	return false
+}
+
+// newRecoveryCodes replaces the user's recovery codes and returns the new ones. It does not save the user.
+func (u *User) newRecoveryCodes() ([]string, error) {
+	var codes, hashes []string
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		c := strings.ToLower(base32.StdEncoding.EncodeToString(b)) // 8 chars
+		c = c[:4] + "-" + c[4:]
+		codes = append(codes, c)
+		hashes = append(hashes, hash(normaliseRecoveryCode(c)))
+	}
+	u.RecoveryCodes = hashes
+	return codes, nil
+}
+
+// useRecoveryCode removes the recovery code and returns true if it is one of the user's unused codes
+func (u *User) useRecoveryCode(code string) bool {
+	h := hash(normaliseRecoveryCode(code))
+	for i, rc := range u.RecoveryCodes {
+		if hmac.Equal([]byte(rc), []byte(h)) {
+			u.RecoveryCodes = append(u.RecoveryCodes[:i], u.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// normaliseRecoveryCode allows recovery codes to be entered in either case and without the dash
+func normaliseRecoveryCode(code string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+}
+
+// hotp returns the HOTP code (RFC 4226) for the key and counter
+func hotp(key []byte, counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	h := hmac.New(sha1.New, key)
+	h.Write(msg)
+	sum := h.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < TOTPDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTPDigits, n%mod)
+}
@@ -0,0 +1,185 @@
+package datastore_test
+
+import (
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/mikedonnici/rtcl-api/datastore"
+)
+
+var mfaTestDS *datastore.Datastore
+
+func TestMFA(t *testing.T) {
+
+	backends, err := testBackends()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	for _, b := range backends {
+		mfaTestDS = b.ds
+		t.Run(b.name, func(t *testing.T) {
+			t.Run("testTOTPCode", testTOTPCode)
+			t.Run("testMFAEnroll", testMFAEnroll)
+			t.Run("testMFACodeReplay", testMFACodeReplay)
+			t.Run("testMFARecoveryCode", testMFARecoveryCode)
+			t.Run("testMFAAuthLockout", testMFAAuthLockout)
+			t.Run("testMFADisable", testMFADisable)
+		})
+		b.cleanup()
+	}
+}
+
+// mfaUser returns a saved user with two-factor auth enabled, and the recovery codes. The datastore clock is fixed
+// at now so that codes can be generated for it.
+func mfaUser(t *testing.T, now time.Time) (*datastore.User, []string) {
+	mfaTestDS.Now = func() time.Time { return now }
+	u := newTestUser(t, mfaTestDS)
+	secret, _, err := u.EnrollTOTP(issuer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := datastore.TOTPCode(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, err := u.ConfirmTOTP(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u, codes
+}
+
+// testTOTPCode checks the code against the SHA-1 test vectors in RFC 6238, truncated to 6 digits
+func testTOTPCode(t *testing.T) {
+	is := is.New(t)
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" // "12345678901234567890"
+	vectors := map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1234567890:  "005924",
+		20000000000: "353130",
+	}
+	for ts, want := range vectors {
+		code, err := datastore.TOTPCode(secret, time.Unix(ts, 0))
+		is.NoErr(err)        // error generating code
+		is.Equal(code, want) // wrong code for test vector
+	}
+}
+
+func testMFAEnroll(t *testing.T) {
+	is := is.New(t)
+	now := time.Now()
+	mfaTestDS.Now = func() time.Time { return now }
+	defer func() { mfaTestDS.Now = nil }()
+
+	u := mfaTestDS.NewUser()
+	u.FirstName = "MFA"
+	u.LastName = "Enroll"
+	u.Email = "mfa.enroll@rtcl.io"
+	is.NoErr(u.Save()) // error saving user
+
+	_, err := u.ConfirmTOTP("123456")
+	is.Equal(err, datastore.ErrMFANotEnrolled) // cannot confirm before enrolling
+
+	secret, uri, err := u.EnrollTOTP("rtcl")
+	is.NoErr(err)                                                              // error enrolling
+	is.Equal(len(secret), 32)                                                  // secret should be 160 bits in base32
+	is.True(strings.HasPrefix(uri, "otpauth://totp/rtcl:mfa.enroll@rtcl.io?")) // wrong uri label
+
+	u2, err := mfaTestDS.UserByID(u.ID.Hex())
+	is.NoErr(err)           // error fetching user
+	is.True(!u2.MFAEnabled) // should not be enabled until confirmed
+
+	_, err = u2.ConfirmTOTP("000000")
+	is.Equal(err, datastore.ErrMFACodeInvalid) // wrong code should not confirm
+
+	code, err := datastore.TOTPCode(secret, now.Add(-30*time.Second))
+	is.NoErr(err) // error generating code
+	codes, err := u2.ConfirmTOTP(code)
+	is.NoErr(err)            // code from the previous step should be accepted
+	is.Equal(len(codes), 10) // expected 10 recovery codes
+
+	u3, err := mfaTestDS.UserByID(u.ID.Hex())
+	is.NoErr(err)                            // error fetching user
+	is.True(u3.MFAEnabled)                   // should be enabled
+	is.True(u3.RecoveryCodes[0] != codes[0]) // recovery codes should be hashed
+
+	_, _, err = u3.EnrollTOTP("rtcl")
+	is.Equal(err, datastore.ErrMFAAlreadyEnabled) // cannot enroll again while enabled
+}
+
+func testMFACodeReplay(t *testing.T) {
+	is := is.New(t)
+	now := time.Now()
+	u, _ := mfaUser(t, now)
+	defer func() { mfaTestDS.Now = nil }()
+
+	code, err := datastore.TOTPCode(u.TOTPSecret, now)
+	is.NoErr(err) // error generating code
+	err = u.CheckMFA(code)
+	is.Equal(err, datastore.ErrMFACodeInvalid) // code used to confirm cannot be used again
+
+	mfaTestDS.Now = func() time.Time { return now.Add(30 * time.Second) }
+	code, err = datastore.TOTPCode(u.TOTPSecret, now.Add(30*time.Second))
+	is.NoErr(err) // error generating code
+	_, err = mfaTestDS.MFAAuth(u.ID.Hex(), code)
+	is.NoErr(err) // code for the next step should be accepted
+	_, err = mfaTestDS.MFAAuth(u.ID.Hex(), code)
+	is.Equal(err, datastore.ErrMFACodeInvalid) // code should only be accepted once
+
+	mfaTestDS.Now = func() time.Time { return now.Add(5 * time.Minute) }
+	_, err = mfaTestDS.MFAAuth(u.ID.Hex(), code)
+	is.Equal(err, datastore.ErrMFACodeInvalid) // old code should be rejected
+}
+
+func testMFARecoveryCode(t *testing.T) {
+	is := is.New(t)
+	u, codes := mfaUser(t, time.Now())
+	defer func() { mfaTestDS.Now = nil }()
+
+	_, err := mfaTestDS.MFAAuth(u.ID.Hex(), codes[3])
+	is.NoErr(err) // recovery code should be accepted
+	_, err = mfaTestDS.MFAAuth(u.ID.Hex(), codes[3])
+	is.Equal(err, datastore.ErrMFACodeInvalid) // recovery code should only be accepted once
+
+	_, err = mfaTestDS.MFAAuth(u.ID.Hex(), " "+strings.ToUpper(strings.Replace(codes[4], "-", "", 1)))
+	is.NoErr(err) // recovery code should be accepted without the dash and in upper case
+
+	u2, err := mfaTestDS.UserByID(u.ID.Hex())
+	is.NoErr(err)                      // error fetching user
+	is.Equal(len(u2.RecoveryCodes), 8) // used recovery codes should be removed
+}
+
+func testMFAAuthLockout(t *testing.T) {
+	is := is.New(t)
+	u, codes := mfaUser(t, time.Now())
+	defer func() { mfaTestDS.Now = nil }()
+
+	for i := 0; i < datastore.LoginFreeAttempts+1; i++ {
+		_, err := mfaTestDS.MFAAuth(u.ID.Hex(), "000000")
+		is.Equal(err, datastore.ErrMFACodeInvalid) // wrong code should be rejected
+	}
+	_, err := mfaTestDS.MFAAuth(u.ID.Hex(), codes[0])
+	_, locked := err.(*datastore.LockoutError)
+	is.True(locked) // should be locked out after too many wrong codes
+}
+
+func testMFADisable(t *testing.T) {
+	is := is.New(t)
+	u, _ := mfaUser(t, time.Now())
+	defer func() { mfaTestDS.Now = nil }()
+
+	is.NoErr(u.DisableMFA()) // error disabling two-factor auth
+	u2, err := mfaTestDS.UserByID(u.ID.Hex())
+	is.NoErr(err)                      // error fetching user
+	is.True(!u2.MFAEnabled)            // should be disabled
+	is.Equal(u2.TOTPSecret, "")        // secret should be removed
+	is.Equal(len(u2.RecoveryCodes), 0) // recovery codes should be removed
+
+	err = u2.CheckMFA("123456")
+	is.Equal(err, datastore.ErrMFANotEnrolled) // no codes accepted once disabled
+}
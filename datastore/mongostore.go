@@ -0,0 +1,453 @@
+package datastore
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/mikedonnici/rtcl-api/datastore/mongo"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const usersCollection = "users"
+const logsCollection = "logs"
+const articlesCollection = "articles"
+const bookmarksCollection = "bookmarks"
+const sharesCollection = "shares"
+const consumedTokensCollection = "consumed_tokens"
+const revokedTokensCollection = "revoked_tokens"
+const refreshTokensCollection = "refresh_tokens"
+const clientsCollection = "clients"
+
+// NewMongoStore returns a pointer to a Datastore with repositories backed by the Mongo connection
+func NewMongoStore(m *mongo.Connection) *Datastore {
+	return &Datastore{
+		Mongo:          m,
+		Users:          &mongoUsers{m},
+		Logs:           &mongoLogs{m},
+		Articles:       &mongoArticles{m},
+		Bookmarks:      &mongoBookmarks{m},
+		Shares:         &mongoShares{m},
+		ConsumedTokens: &mongoTokenIDs{m, consumedTokensCollection},
+		RevokedTokens:  &mongoTokenIDs{m, revokedTokensCollection},
+		RefreshTokens:  &mongoRefreshTokens{m},
+		Clients:        &mongoClients{m},
+	}
+}
+
+// mongoErr translates mgo errors to the datastore equivalents
+func mongoErr(err error) error {
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+// mongoUsers is a UserRepository backed by the users collection
+type mongoUsers struct {
+	m *mongo.Connection
+}
+
+func (r *mongoUsers) c() *mgo.Collection {
+	return r.m.Session.DB(r.m.DBName).C(usersCollection)
+}
+
+func (r *mongoUsers) ByID(id bson.ObjectId) (User, error) {
+	var u User
+	err := r.c().FindId(id).One(&u)
+	return u, mongoErr(err)
+}
+
+func (r *mongoUsers) ByEmail(email string) (User, error) {
+	var u User
+	err := r.c().Find(bson.M{"email": email}).One(&u)
+	return u, mongoErr(err)
+}
+
+func (r *mongoUsers) Save(u User) error {
+	n, err := r.c().Find(bson.M{"email": u.Email, "_id": bson.M{"$ne": u.ID}}).Count()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrEmailExists
+	}
+	_, err = r.c().UpsertId(u.ID, u)
+	return err
+}
+
+// AddSearch uses $addToSet so an identical search sub doc is never stored twice
+func (r *mongoUsers) AddSearch(id bson.ObjectId, s Search) error {
+	update := bson.M{"$addToSet": bson.M{"searches": s}}
+	return mongoErr(r.c().UpdateId(id, update))
+}
+
+// UpdateSearch sets the search sub doc matched by id with the positional operator
+func (r *mongoUsers) UpdateSearch(id bson.ObjectId, s Search) error {
+	q := bson.M{"_id": id, "searches._id": s.ID}
+	update := bson.M{"$set": bson.M{"searches.$": s}}
+	return mongoErr(r.c().Update(q, update))
+}
+
+// RemoveSearch pulls the search sub doc with the id
+func (r *mongoUsers) RemoveSearch(id, searchID bson.ObjectId) error {
+	update := bson.M{"$pull": bson.M{"searches": bson.M{"_id": searchID}}}
+	return mongoErr(r.c().UpdateId(id, update))
+}
+
+// RecordFailedLogin increments the count with $inc, and returns the new count from the same operation. The lockout
+// is then set only if it is earlier than the one for the count, so a concurrent failure cannot shorten it.
+func (r *mongoUsers) RecordFailedLogin(id bson.ObjectId, now time.Time) (int, error) {
+	var u User
+	change := mgo.Change{
+		Update:    bson.M{"$inc": bson.M{"failedLogins": 1}},
+		ReturnNew: true,
+	}
+	_, err := r.c().FindId(id).Select(bson.M{"failedLogins": 1}).Apply(change, &u)
+	if err != nil {
+		return 0, mongoErr(err)
+	}
+	d := Backoff(u.FailedLogins, LoginFreeAttempts, LoginBaseLockout, LoginMaxLockout)
+	if d > 0 {
+		q := bson.M{"_id": id, "loginLockout": bson.M{"$not": bson.M{"$gte": now.Add(d)}}}
+		update := bson.M{"$set": bson.M{"loginLockout": now.Add(d)}}
+		err = r.c().Update(q, update)
+		if err != nil && err != mgo.ErrNotFound {
+			return 0, err
+		}
+	}
+	return u.FailedLogins, nil
+}
+
+// ClearLoginFailures sets only the failed login fields
+func (r *mongoUsers) ClearLoginFailures(id bson.ObjectId) error {
+	update := bson.M{"$set": bson.M{"failedLogins": 0, "loginLockout": time.Time{}}}
+	return mongoErr(r.c().UpdateId(id, update))
+}
+
+// DueNotification returns users with a notification date before now. Note that this needs to exclude dates that
+// are zero, null or missing, hence the check for values greater than epoch.
+func (r *mongoUsers) DueNotification(now time.Time) ([]User, error) {
+	var xu []User
+	epoch := time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+	q := bson.M{
+		"notification": bson.M{
+			"$gt": epoch,
+			"$lt": now,
+		},
+	}
+	err := r.c().Find(q).All(&xu)
+	return xu, err
+}
+
+// DueDeletion returns users with a deleteAt date that has passed, excluding zero dates as for DueNotification
+func (r *mongoUsers) DueDeletion(now time.Time) ([]User, error) {
+	var xu []User
+	epoch := time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+	q := bson.M{
+		"deleteAt": bson.M{
+			"$gt":  epoch,
+			"$lte": now,
+		},
+	}
+	err := r.c().Find(q).All(&xu)
+	return xu, err
+}
+
+func (r *mongoUsers) List(filter string, skip, limit int) ([]User, error) {
+	q := bson.M{}
+	if filter != "" {
+		re := bson.RegEx{Pattern: regexp.QuoteMeta(filter), Options: "i"}
+		q["$or"] = []bson.M{{"email": re}, {"firstName": re}, {"lastName": re}}
+	}
+	var xu []User
+	err := r.c().Find(q).Sort("email").Skip(skip).Limit(limit).All(&xu)
+	return xu, err
+}
+
+func (r *mongoUsers) Delete(id bson.ObjectId) error {
+	return mongoErr(r.c().RemoveId(id))
+}
+
+// mongoLogs is a LogRepository backed by the logs collection
+type mongoLogs struct {
+	m *mongo.Connection
+}
+
+func (r *mongoLogs) c() *mgo.Collection {
+	return r.m.Session.DB(r.m.DBName).C(logsCollection)
+}
+
+func (r *mongoLogs) ByID(id bson.ObjectId) (Log, error) {
+	var l Log
+	err := r.c().FindId(id).One(&l)
+	return l, mongoErr(err)
+}
+
+func (r *mongoLogs) ByUserID(userID bson.ObjectId) ([]Log, error) {
+	var xl []Log
+	err := r.c().Find(bson.M{"user_id": userID}).All(&xl)
+	return xl, err
+}
+
+func (r *mongoLogs) Save(l Log) error {
+	_, err := r.c().UpsertId(l.ID, l)
+	return err
+}
+
+func (r *mongoLogs) Delete(id bson.ObjectId) error {
+	return mongoErr(r.c().RemoveId(id))
+}
+
+// mongoBookmarks is a BookmarkRepository backed by the bookmarks collection
+type mongoBookmarks struct {
+	m *mongo.Connection
+}
+
+func (r *mongoBookmarks) c() *mgo.Collection {
+	return r.m.Session.DB(r.m.DBName).C(bookmarksCollection)
+}
+
+func (r *mongoBookmarks) ByID(id bson.ObjectId) (Bookmark, error) {
+	var b Bookmark
+	err := r.c().FindId(id).One(&b)
+	return b, mongoErr(err)
+}
+
+func (r *mongoBookmarks) ByUserID(userID bson.ObjectId) ([]Bookmark, error) {
+	var xb []Bookmark
+	err := r.c().Find(bson.M{"userId": userID}).All(&xb)
+	return xb, err
+}
+
+func (r *mongoBookmarks) Save(b Bookmark) error {
+	_, err := r.c().UpsertId(b.ID, b)
+	return err
+}
+
+func (r *mongoBookmarks) Delete(id bson.ObjectId) error {
+	return mongoErr(r.c().RemoveId(id))
+}
+
+// mongoShares is a ShareRepository backed by the shares collection
+type mongoShares struct {
+	m *mongo.Connection
+}
+
+func (r *mongoShares) c() *mgo.Collection {
+	return r.m.Session.DB(r.m.DBName).C(sharesCollection)
+}
+
+func (r *mongoShares) ByID(id string) (Share, error) {
+	var sh Share
+	err := r.c().FindId(id).One(&sh)
+	return sh, mongoErr(err)
+}
+
+func (r *mongoShares) BySearchID(searchID bson.ObjectId) ([]Share, error) {
+	return r.find(bson.M{"searchId": searchID})
+}
+
+func (r *mongoShares) ByOwnerID(ownerID bson.ObjectId) ([]Share, error) {
+	return r.find(bson.M{"ownerId": ownerID})
+}
+
+func (r *mongoShares) ByEmail(email string) ([]Share, error) {
+	return r.find(bson.M{"emails": email})
+}
+
+func (r *mongoShares) find(q bson.M) ([]Share, error) {
+	var xs []Share
+	err := r.c().Find(q).Sort("created", "seq").All(&xs)
+	return xs, err
+}
+
+func (r *mongoShares) Save(sh Share) error {
+	_, err := r.c().UpsertId(sh.ID, sh)
+	return err
+}
+
+// AddSubscriber uses $addToSet so that concurrent subscriptions are not lost
+func (r *mongoShares) AddSubscriber(id string, userID bson.ObjectId) error {
+	return mongoErr(r.c().UpdateId(id, bson.M{"$addToSet": bson.M{"subscribers": userID}}))
+}
+
+func (r *mongoShares) RemoveSubscriber(id string, userID bson.ObjectId) error {
+	return mongoErr(r.c().UpdateId(id, bson.M{"$pull": bson.M{"subscribers": userID}}))
+}
+
+func (r *mongoShares) Delete(id string) error {
+	return mongoErr(r.c().RemoveId(id))
+}
+
+// mongoArticles is an ArticleRepository backed by the articles collection
+type mongoArticles struct {
+	m *mongo.Connection
+}
+
+func (r *mongoArticles) c() *mgo.Collection {
+	return r.m.Session.DB(r.m.DBName).C(articlesCollection)
+}
+
+func (r *mongoArticles) ByPMID(pmid string) (Article, error) {
+	var a Article
+	err := r.c().FindId(pmid).One(&a)
+	return a, mongoErr(err)
+}
+
+func (r *mongoArticles) ByPMIDs(pmids []string) ([]Article, error) {
+	var xa []Article
+	err := r.c().Find(bson.M{"_id": bson.M{"$in": pmids}}).All(&xa)
+	return xa, err
+}
+
+func (r *mongoArticles) ByCategories(categories []string, since time.Time) ([]Article, error) {
+	// articles saved before categories were lower-cased can have any case
+	var in []interface{}
+	for _, c := range categories {
+		in = append(in, bson.RegEx{Pattern: "^" + regexp.QuoteMeta(c) + "$", Options: "i"})
+	}
+	var xa []Article
+	q := bson.M{
+		"category":  bson.M{"$in": in},
+		"published": bson.M{"$gte": since},
+	}
+	err := r.c().Find(q).All(&xa)
+	return xa, err
+}
+
+// Upsert only sets created when the article is inserted, so that it is kept for existing articles
+func (r *mongoArticles) Upsert(xa ...Article) error {
+	if len(xa) == 0 {
+		return nil
+	}
+	b := r.c().Bulk()
+	b.Unordered()
+	for _, a := range xa {
+		set, err := bsonMap(a)
+		if err != nil {
+			return err
+		}
+		delete(set, "_id")
+		delete(set, "created")
+		b.Upsert(bson.M{"_id": a.PMID}, bson.M{"$set": set, "$setOnInsert": bson.M{"created": a.Created}})
+	}
+	_, err := b.Run()
+	return err
+}
+
+// bsonMap returns the bson document of v as a map
+func bsonMap(v interface{}) (bson.M, error) {
+	data, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	m := bson.M{}
+	return m, bson.Unmarshal(data, &m)
+}
+
+// mongoTokenIDs is a TokenIDRepository backed by the named collection. A TTL index removes records once the token
+// has expired.
+type mongoTokenIDs struct {
+	m    *mongo.Connection
+	name string
+}
+
+func (r *mongoTokenIDs) c() *mgo.Collection {
+	return r.m.Session.DB(r.m.DBName).C(r.name)
+}
+
+// Add relies on the unique _id so that two concurrent requests cannot both add the same id
+func (r *mongoTokenIDs) Add(id string, expires time.Time) error {
+	err := r.c().EnsureIndex(mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second})
+	if err != nil {
+		return err
+	}
+	err = r.c().Insert(bson.M{"_id": id, "expires": expires})
+	if mgo.IsDup(err) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+func (r *mongoTokenIDs) Exists(id string) (bool, error) {
+	n, err := r.c().FindId(id).Count()
+	return n > 0, err
+}
+
+// mongoRefreshTokens is a RefreshTokenRepository backed by the refresh_tokens collection. A TTL index removes
+// tokens once they have expired.
+type mongoRefreshTokens struct {
+	m *mongo.Connection
+}
+
+func (r *mongoRefreshTokens) c() *mgo.Collection {
+	return r.m.Session.DB(r.m.DBName).C(refreshTokensCollection)
+}
+
+func (r *mongoRefreshTokens) ByID(id string) (RefreshToken, error) {
+	var t RefreshToken
+	err := r.c().FindId(id).One(&t)
+	return t, mongoErr(err)
+}
+
+func (r *mongoRefreshTokens) Save(t RefreshToken) error {
+	err := r.c().EnsureIndex(mgo.Index{Key: []string{"expires"}, ExpireAfter: time.Second})
+	if err != nil {
+		return err
+	}
+	_, err = r.c().UpsertId(t.ID, t)
+	return err
+}
+
+// Use only matches an unused token so that, of two concurrent requests, only one can mark it used
+func (r *mongoRefreshTokens) Use(id string) error {
+	q := bson.M{"_id": id, "used": false}
+	return mongoErr(r.c().Update(q, bson.M{"$set": bson.M{"used": true}}))
+}
+
+func (r *mongoRefreshTokens) RevokeFamily(family string) error {
+	_, err := r.c().UpdateAll(bson.M{"family": family}, bson.M{"$set": bson.M{"revoked": true}})
+	return err
+}
+
+func (r *mongoRefreshTokens) RevokeUser(userID bson.ObjectId) error {
+	_, err := r.c().UpdateAll(bson.M{"userId": userID}, bson.M{"$set": bson.M{"revoked": true}})
+	return err
+}
+
+// mongoClients is a ClientRepository backed by the clients collection
+type mongoClients struct {
+	m *mongo.Connection
+}
+
+func (r *mongoClients) c() *mgo.Collection {
+	return r.m.Session.DB(r.m.DBName).C(clientsCollection)
+}
+
+func (r *mongoClients) ByID(id bson.ObjectId) (Client, error) {
+	var c Client
+	err := r.c().FindId(id).One(&c)
+	return c, mongoErr(err)
+}
+
+func (r *mongoClients) ByKeyHash(keyHash string) (Client, error) {
+	var c Client
+	err := r.c().Find(bson.M{"keyHash": keyHash}).One(&c)
+	return c, mongoErr(err)
+}
+
+func (r *mongoClients) Save(c Client) error {
+	err := r.c().EnsureIndex(mgo.Index{Key: []string{"keyHash"}, Unique: true})
+	if err != nil {
+		return err
+	}
+	_, err = r.c().UpsertId(c.ID, c)
+	return err
+}
+
+func (r *mongoClients) All() ([]Client, error) {
+	var xc []Client
+	err := r.c().Find(nil).Sort("created").All(&xc)
+	return xc, err
+}
@@ -0,0 +1,82 @@
+package datastore
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+)
+
+// Argon2id parameters for new password hashes. These are stored in the encoded hash so they can be changed
+// at any time - existing hashes will continue to verify and are upgraded on the next successful login.
+const (
+	argonTime    uint32 = 1
+	argonMemory  uint32 = 64 * 1024
+	argonThreads uint8  = 2
+	argonKeyLen  uint32 = 32
+	argonSaltLen        = 16
+)
+
+// hashPassword returns an argon2id hash of password, encoded in the PHC string format:
+// $argon2id$v=19$m=65536,t=1,p=2$<salt>$<key>
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, argonSaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", errors.Wrap(err, "could not generate password salt")
+	}
+	key := argon2.IDKey([]byte(password), salt, argonTime, argonMemory, argonThreads, argonKeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		argonMemory,
+		argonTime,
+		argonThreads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// verifyPassword checks password against an encoded argon2id hash. It returns true for needsRehash if the hash
+// was created with parameters that differ from the current ones.
+func verifyPassword(password, encoded string) (match bool, needsRehash bool, err error) {
+	p := strings.Split(encoded, "$")
+	if len(p) != 6 || p[1] != "argon2id" {
+		return false, false, errors.New("password hash is not in argon2id format")
+	}
+
+	var version int
+	_, err = fmt.Sscanf(p[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return false, false, errors.New("unsupported argon2 version")
+	}
+
+	var memory, time uint32
+	var threads uint8
+	_, err = fmt.Sscanf(p[3], "m=%d,t=%d,p=%d", &memory, &time, &threads)
+	if err != nil {
+		return false, false, errors.Wrap(err, "could not parse argon2 parameters")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(p[4])
+	if err != nil {
+		return false, false, errors.Wrap(err, "could not decode password salt")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(p[5])
+	if err != nil {
+		return false, false, errors.Wrap(err, "could not decode password key")
+	}
+
+	other := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	match = subtle.ConstantTimeCompare(key, other) == 1
+	needsRehash = memory != argonMemory || time != argonTime || threads != argonThreads || uint32(len(key)) != argonKeyLen
+	return match, needsRehash, nil
+}
+
+// isLegacyHash returns true if the stored password is a hex-encoded SHA-256 hash from before argon2id was used
+func isLegacyHash(encoded string) bool {
+	return len(encoded) == 64 && !strings.HasPrefix(encoded, "$")
+}
@@ -0,0 +1,316 @@
+package datastore
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/mikedonnici/rtcl-api/query"
+)
+
+// RecommendDays is how far back, by publication date, articles are considered for recommendations
+const RecommendDays = 180
+
+// DefaultRecommendations is the number of recommendations returned when no limit is given, and
+// MaxRecommendations the most that can be asked for
+const (
+	DefaultRecommendations = 20
+	MaxRecommendations     = 100
+)
+
+// The weight of each feature of an article that matches the user's profile. A keyword, which for PubMed articles is
+// usually an author, says the most about what the user reads, and a category the least as every candidate has one.
+const (
+	keywordWeight  = 1.0
+	journalWeight  = 0.5
+	categoryWeight = 0.25
+	searchWeight   = 1.0
+)
+
+// logHalfLife is the age, in days, at which a log counts half as much as one from today. userCategoryWeight and
+// searchFilterWeight are what the user's own categories, and the filters of a saved search, add to the profile -
+// the same as a log from today and two logs from today.
+const (
+	logHalfLife        = 30
+	userCategoryWeight = 1.0
+	searchFilterWeight = 2.0
+)
+
+// Recommendation is an article recommended for a user. The reasons are the features that matched the user's
+// profile, eg "keyword:Zhang L", "journal:Atherosclerosis", "category:cardiology" or "search:Athletes", with those
+// that added the most to the score first.
+type Recommendation struct {
+	Article Article  `json:"article"`
+	Score   float64  `json:"score"`
+	Reasons []string `json:"reasons"`
+}
+
+// profile is what the user cares about, as weights for the keywords, journals and categories of the articles they
+// have logged, and of their saved searches. Keys are lower case.
+type profile struct {
+	keywords   map[string]float64
+	journals   map[string]float64
+	categories map[string]float64
+	searches   []profileSearch
+}
+
+// profileSearch is a saved search, with the terms of its query that are not negated
+type profileSearch struct {
+	name  string
+	terms []*query.Node
+}
+
+func newProfile() *profile {
+	return &profile{
+		keywords:   map[string]float64{},
+		journals:   map[string]float64{},
+		categories: map[string]float64{},
+	}
+}
+
+// addArticle adds the features of an article to the profile with the weight
+func (p *profile) addArticle(a Article, w float64) {
+	for _, k := range a.Keywords {
+		p.keywords[strings.ToLower(k)] += w
+	}
+	if a.SourceNameAbbrev != "" {
+		p.journals[strings.ToLower(a.SourceNameAbbrev)] += w
+	}
+	if a.Category != "" {
+		p.categories[strings.ToLower(a.Category)] += w
+	}
+}
+
+// addSearch adds the filters and query terms of a saved search to the profile. Queries that do not parse, which
+// may have been saved before the query language, are skipped.
+func (p *profile) addSearch(s Search) {
+	for _, c := range s.Categories {
+		p.categories[strings.ToLower(c)] += searchFilterWeight
+	}
+	for _, j := range s.Journals {
+		p.journals[strings.ToLower(j)] += searchFilterWeight
+	}
+	n, err := query.Parse(s.Query)
+	if err != nil {
+		return
+	}
+	terms := positiveTerms(n)
+	if len(terms) > 0 {
+		p.searches = append(p.searches, profileSearch{s.Name, terms})
+	}
+}
+
+// positiveTerms returns the terms of the query that are not under a NOT
+func positiveTerms(n *query.Node) []*query.Node {
+	switch n.Op {
+	case query.OpTerm:
+		return []*query.Node{n}
+	case query.OpNot:
+		return nil
+	}
+	var xn []*query.Node
+	for _, c := range n.Nodes {
+		xn = append(xn, positiveTerms(c)...)
+	}
+	return xn
+}
+
+// categoryList returns the categories in the profile, sorted
+func (p *profile) categoryList() []string {
+	var xs []string
+	for c := range p.categories {
+		xs = append(xs, c)
+	}
+	sort.Strings(xs)
+	return xs
+}
+
+// reason is a feature of an article that matched the profile, and what it added to the score
+type reason struct {
+	name  string
+	score float64
+}
+
+// score returns the score of the article against the profile, and the reasons for it
+func (p *profile) score(a Article) (float64, []string) {
+	var xr []reason
+	for _, k := range a.Keywords {
+		if w := p.keywords[strings.ToLower(k)]; w > 0 {
+			xr = append(xr, reason{"keyword:" + k, w * keywordWeight})
+		}
+	}
+	if w := p.journals[strings.ToLower(a.SourceNameAbbrev)]; w > 0 {
+		xr = append(xr, reason{"journal:" + a.SourceNameAbbrev, w * journalWeight})
+	}
+	if w := p.categories[strings.ToLower(a.Category)]; w > 0 {
+		xr = append(xr, reason{"category:" + a.Category, w * categoryWeight})
+	}
+	for _, s := range p.searches {
+		var matched int
+		for _, t := range s.terms {
+			if matchTerm(a, t) {
+				matched++
+			}
+		}
+		if matched > 0 {
+			xr = append(xr, reason{"search:" + s.name, searchWeight * float64(matched) / float64(len(s.terms))})
+		}
+	}
+
+	sort.SliceStable(xr, func(i, j int) bool {
+		if xr[i].score != xr[j].score {
+			return xr[i].score > xr[j].score
+		}
+		return xr[i].name < xr[j].name
+	})
+	var total float64
+	reasons := make([]string, len(xr))
+	for i, r := range xr {
+		total += r.score
+		reasons[i] = r.name
+	}
+	return math.Round(total*1000) / 1000, reasons
+}
+
+// matchTerm returns true if the article has the words of the query term, in the field it is limited to
+func matchTerm(a Article, t *query.Node) bool {
+	switch t.Field {
+	case query.FieldTitle:
+		return hasWords(a.Title, t.Value)
+	case query.FieldJournal:
+		return hasWords(a.SourceName, t.Value) || hasWords(a.SourceNameAbbrev, t.Value)
+	case query.FieldAuthor:
+		return hasWords(strings.Join(a.Keywords, ", "), t.Value)
+	}
+	return hasWords(a.Title, t.Value) || hasWords(a.Summary, t.Value) ||
+		hasWords(strings.Join(a.Keywords, ", "), t.Value)
+}
+
+// hasWords returns true if the text has the words of the phrase, next to each other, ignoring case and punctuation
+func hasWords(text, phrase string) bool {
+	tw, pw := words(text), words(phrase)
+	if len(pw) == 0 {
+		return false
+	}
+	for i := 0; i+len(pw) <= len(tw); i++ {
+		match := true
+		for j := range pw {
+			if tw[i+j] != pw[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// words splits the text into lower case words of letters and digits
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// logWeight returns the weight of a log, which halves every logHalfLife days. A log with a date that does not
+// parse counts as one logHalfLife days old.
+func logWeight(date string, now time.Time) float64 {
+	d, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return 0.5
+	}
+	age := now.Sub(d).Hours() / 24
+	if age < 0 {
+		age = 0
+	}
+	return math.Pow(0.5, age/logHalfLife)
+}
+
+// Recommendations returns articles for the user, best first, scored on how well their keywords, journal and
+// category match the articles the user has logged - more recent logs counting for more - and their saved searches.
+// Candidates are the stored articles published in the last RecommendDays days, in the user's categories or those of
+// their logs and searches. Articles the user has logged are left out, as are those that match nothing. Ties are
+// broken by the newest article and then the PMID, so the order only depends on the data and the datastore clock.
+func (ds *Datastore) Recommendations(userID string, limit int) ([]Recommendation, error) {
+	u, err := ds.UserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = DefaultRecommendations
+	}
+	if limit > MaxRecommendations {
+		limit = MaxRecommendations
+	}
+	now := ds.now()
+
+	p := newProfile()
+	for _, c := range u.Categories {
+		p.categories[strings.ToLower(c)] += userCategoryWeight
+	}
+	for _, s := range u.Searches {
+		p.addSearch(s)
+	}
+
+	xl, err := ds.Logs.ByUserID(u.ID)
+	if err != nil {
+		return nil, err
+	}
+	logged := map[string]float64{}
+	var pmids []string
+	for _, l := range xl {
+		if l.PMID == "" {
+			continue
+		}
+		if _, ok := logged[l.PMID]; !ok {
+			pmids = append(pmids, l.PMID)
+		}
+		logged[l.PMID] += logWeight(l.Date, now)
+	}
+	xa, err := ds.Articles.ByPMIDs(pmids)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range xa {
+		p.addArticle(a, logged[a.PMID])
+	}
+
+	categories := p.categoryList()
+	if len(categories) == 0 {
+		return nil, nil
+	}
+	candidates, err := ds.Articles.ByCategories(categories, now.AddDate(0, 0, -RecommendDays))
+	if err != nil {
+		return nil, err
+	}
+
+	var xr []Recommendation
+	for _, a := range candidates {
+		if _, ok := logged[a.PMID]; ok {
+			continue
+		}
+		score, reasons := p.score(a)
+		if score <= 0 {
+			continue
+		}
+		xr = append(xr, Recommendation{Article: a, Score: score, Reasons: reasons})
+	}
+	sort.Slice(xr, func(i, j int) bool {
+		a, b := xr[i], xr[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if !a.Article.Published.Equal(b.Article.Published) {
+			return a.Article.Published.After(b.Article.Published)
+		}
+		return a.Article.PMID < b.Article.PMID
+	})
+	if len(xr) > limit {
+		xr = xr[:limit]
+	}
+	return xr, nil
+}
@@ -0,0 +1,144 @@
+package datastore_test
+
+import (
+	"log"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/mikedonnici/rtcl-api/datastore"
+)
+
+var recommendTestDS *datastore.Datastore
+
+// recommendNow is a week after the last of br's logs, so that the weights of the logs are the same on every run
+var recommendNow = time.Date(2018, 12, 10, 0, 0, 0, 0, time.UTC)
+
+func TestRecommend(t *testing.T) {
+
+	backends, err := testBackends()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	for _, b := range backends {
+		recommendTestDS = b.ds
+		recommendTestDS.Now = func() time.Time { return recommendNow }
+		t.Run(b.name, func(t *testing.T) {
+			t.Run("testRecommendations", testRecommendations)
+			t.Run("testRecommendationsSearch", testRecommendationsSearch)
+			t.Run("testRecommendationsLimit", testRecommendationsLimit)
+			t.Run("testRecommendationsNoHistory", testRecommendationsNoHistory)
+			t.Run("testRecommendationsCategoryCase", testRecommendationsCategoryCase)
+		})
+		b.cleanup()
+	}
+}
+
+// pmids returns the PMIDs of the recommended articles, in order
+func pmids(xr []datastore.Recommendation) []string {
+	var xs []string
+	for _, r := range xr {
+		xs = append(xs, r.Article.PMID)
+	}
+	return xs
+}
+
+func testRecommendations(t *testing.T) {
+	is := is.New(t)
+	xr, err := recommendTestDS.Recommendations("5b3bcd72463cd6029e04de18", 0)
+	is.NoErr(err)
+	// the logged articles and the dermatology article are left out, and 30180001 shares an author and a journal
+	// with br's logs
+	is.Equal(pmids(xr), []string{"30180001", "30180002", "30180003"})
+	is.Equal(xr[0].Reasons, []string{"category:cardiology", "keyword:Zhang L", "journal:Atherosclerosis"})
+	is.Equal(xr[1].Reasons, []string{"category:cardiology"})
+	is.Equal(xr[2].Reasons, []string{"category:physiotherapy"})
+	is.True(xr[0].Score > xr[1].Score)
+	is.True(xr[1].Score > xr[2].Score)
+
+	// the same data gives the same scores
+	again, err := recommendTestDS.Recommendations("5b3bcd72463cd6029e04de18", 0)
+	is.NoErr(err)
+	is.Equal(again, xr)
+
+	// older logs count for less, so a month later the shared author adds less to 30180001
+	recommendTestDS.Now = func() time.Time { return recommendNow.AddDate(0, 1, 0) }
+	defer func() { recommendTestDS.Now = func() time.Time { return recommendNow } }()
+	later, err := recommendTestDS.Recommendations("5b3bcd72463cd6029e04de18", 0)
+	is.NoErr(err)
+	is.True(later[0].Score < xr[0].Score)
+}
+
+func testRecommendationsSearch(t *testing.T) {
+	is := is.New(t)
+	u, err := recommendTestDS.UserByID("5b3bcd72463cd6029e04de18")
+	is.NoErr(err)
+	s, err := u.AddSearch(datastore.Search{
+		Name:       "Arrest rehab",
+		Query:      "cardiac arrest -melanoma",
+		Categories: []string{"physiotherapy"},
+	})
+	is.NoErr(err)
+	defer u.RemoveSearch(s.ID.Hex())
+
+	xr, err := recommendTestDS.Recommendations("5b3bcd72463cd6029e04de18", 0)
+	is.NoErr(err)
+	is.Equal(xr[0].Article.PMID, "30180003") // expected the article matching the saved search first
+	is.Equal(xr[0].Reasons, []string{"search:Arrest rehab", "category:physiotherapy"})
+
+	// a search category brings in articles from outside the user's categories
+	s2, err := u.AddSearch(datastore.Search{Query: "melanoma", Journals: []string{"JAMA Dermatol"}, Categories: []string{"dermatology"}})
+	is.NoErr(err)
+	defer u.RemoveSearch(s2.ID.Hex())
+	xr, err = recommendTestDS.Recommendations("5b3bcd72463cd6029e04de18", 0)
+	is.NoErr(err)
+	is.Equal(xr[0].Article.PMID, "30180004")
+	is.Equal(xr[0].Reasons, []string{"journal:JAMA Dermatol", "search:melanoma", "category:dermatology"})
+}
+
+func testRecommendationsLimit(t *testing.T) {
+	is := is.New(t)
+	xr, err := recommendTestDS.Recommendations("5b3bcd72463cd6029e04de18", 2)
+	is.NoErr(err)
+	is.Equal(pmids(xr), []string{"30180001", "30180002"})
+
+	_, err = recommendTestDS.Recommendations("5b3bcd72463cd6029e04de00", 0)
+	is.Equal(err, datastore.ErrNotFound)
+}
+
+func testRecommendationsNoHistory(t *testing.T) {
+	is := is.New(t)
+	xr, err := recommendTestDS.Recommendations("5b3bcd72463cd6029e04de1a", 0)
+	is.NoErr(err)
+	is.Equal(len(xr), 0) // expected nothing for a user with no categories, logs or searches
+
+	// articles published before the window are not recommended
+	recommendTestDS.Now = func() time.Time { return recommendNow.AddDate(1, 0, 0) }
+	defer func() { recommendTestDS.Now = func() time.Time { return recommendNow } }()
+	xr, err = recommendTestDS.Recommendations("5b3bcd72463cd6029e04de18", 0)
+	is.NoErr(err)
+	is.Equal(len(xr), 0)
+}
+
+// Tests that articles stored with a category in a different case, before categories were lower-cased, are found
+func testRecommendationsCategoryCase(t *testing.T) {
+	is := is.New(t)
+	err := recommendTestDS.Articles.Upsert(datastore.Article{
+		PMID:      "30180009",
+		Category:  "Cardiology",
+		Published: recommendNow.AddDate(0, 0, -7),
+		Title:     "Upper case category",
+	})
+	is.NoErr(err)
+	xr, err := recommendTestDS.Recommendations("5b3bcd72463cd6029e04de18", 0)
+	is.NoErr(err)
+	found := false
+	for _, r := range xr {
+		if r.Article.PMID == "30180009" {
+			found = true
+			is.Equal(r.Reasons, []string{"category:Cardiology"})
+		}
+	}
+	is.True(found) // expected the article to be recommended
+}
@@ -0,0 +1,105 @@
+package datastore
+
+import (
+	"errors"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrNotFound is returned by all repositories when the requested record does not exist
+var ErrNotFound = errors.New("not found")
+
+// ErrEmailExists is returned when saving a user with an email that belongs to a different user
+var ErrEmailExists = errors.New("email already exists for a different user id")
+
+// ErrDuplicate is returned when adding a record with an id that already exists
+var ErrDuplicate = errors.New("duplicate id")
+
+// UserRepository stores User records. Implementations must treat email as unique, and return ErrNotFound when
+// a user does not exist. List returns users ordered by email, and if filter is not empty only those with a name or
+// email that contains it, ignoring case. DueDeletion returns users with a scheduled deletion that is due.
+// UpdateSearch replaces the search with the same id, and returns ErrNotFound if the user does not have it.
+// RecordFailedLogin and ClearLoginFailures change only the failed login fields, atomically, so that concurrent
+// logins cannot overwrite each other. RecordFailedLogin increments the count, extends the lockout to the Backoff
+// for the new count if that is later, and returns the new count.
+type UserRepository interface {
+	ByID(id bson.ObjectId) (User, error)
+	ByEmail(email string) (User, error)
+	Save(u User) error
+	AddSearch(id bson.ObjectId, s Search) error
+	UpdateSearch(id bson.ObjectId, s Search) error
+	RemoveSearch(id, searchID bson.ObjectId) error
+	RecordFailedLogin(id bson.ObjectId, now time.Time) (int, error)
+	ClearLoginFailures(id bson.ObjectId) error
+	DueNotification(now time.Time) ([]User, error)
+	DueDeletion(now time.Time) ([]User, error)
+	List(filter string, skip, limit int) ([]User, error)
+	Delete(id bson.ObjectId) error
+}
+
+// LogRepository stores Log records
+type LogRepository interface {
+	ByID(id bson.ObjectId) (Log, error)
+	ByUserID(userID bson.ObjectId) ([]Log, error)
+	Save(l Log) error
+	Delete(id bson.ObjectId) error
+}
+
+// ShareRepository stores Share records. BySearchID, ByOwnerID and ByEmail return shares oldest first, and ByEmail
+// matches the lower case email. AddSubscriber does nothing if the user is already a subscriber. AddSubscriber and
+// RemoveSubscriber return ErrNotFound if the share does not exist.
+type ShareRepository interface {
+	ByID(id string) (Share, error)
+	BySearchID(searchID bson.ObjectId) ([]Share, error)
+	ByOwnerID(ownerID bson.ObjectId) ([]Share, error)
+	ByEmail(email string) ([]Share, error)
+	Save(sh Share) error
+	AddSubscriber(id string, userID bson.ObjectId) error
+	RemoveSubscriber(id string, userID bson.ObjectId) error
+	Delete(id string) error
+}
+
+// BookmarkRepository stores Bookmark records. ByUserID returns the user's bookmarks in any order.
+type BookmarkRepository interface {
+	ByID(id bson.ObjectId) (Bookmark, error)
+	ByUserID(userID bson.ObjectId) ([]Bookmark, error)
+	Save(b Bookmark) error
+	Delete(id bson.ObjectId) error
+}
+
+// ArticleRepository stores Article records, keyed by PMID. ByPMIDs returns the articles that exist, in any order.
+// ByCategories returns the articles in any of the categories, ignoring case, published on or after since, in any
+// order. Upsert adds or replaces each article, but keeps the Created time of an existing one.
+type ArticleRepository interface {
+	ByPMID(pmid string) (Article, error)
+	ByPMIDs(pmids []string) ([]Article, error)
+	ByCategories(categories []string, since time.Time) ([]Article, error)
+	Upsert(xa ...Article) error
+}
+
+// TokenIDRepository records a set of token ids, eg action tokens that have been used or access tokens that have
+// been revoked. Records are only needed until the token expires, after which the token is rejected anyway. Add
+// returns ErrDuplicate if the id is already recorded.
+type TokenIDRepository interface {
+	Add(id string, expires time.Time) error
+	Exists(id string) (bool, error)
+}
+
+// RefreshTokenRepository stores RefreshToken records. Use marks a token as used, and must return ErrNotFound if
+// there is no unused token with the id, so that a token can only be exchanged once even under concurrent requests.
+type RefreshTokenRepository interface {
+	ByID(id string) (RefreshToken, error)
+	Save(t RefreshToken) error
+	Use(id string) error
+	RevokeFamily(family string) error
+	RevokeUser(userID bson.ObjectId) error
+}
+
+// ClientRepository stores Client records. ByKeyHash returns ErrNotFound if no client has the key hash.
+type ClientRepository interface {
+	ByID(id bson.ObjectId) (Client, error)
+	ByKeyHash(keyHash string) (Client, error)
+	Save(c Client) error
+	All() ([]Client, error)
+}
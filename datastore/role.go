@@ -0,0 +1,121 @@
+package datastore
+
+import (
+	"errors"
+)
+
+// User roles. Users saved before roles were added have no stored role and are treated as RoleUser.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// ErrAccountDisabled is returned by UserAuth for a user that has been disabled by an admin
+var ErrAccountDisabled = errors.New("account has been disabled")
+
+// ValidRole returns true if role is one of the defined roles
+func ValidRole(role string) bool {
+	return role == RoleUser || role == RoleAdmin
+}
+
+// HasRole returns true if the user has the specified role
+func (u *User) HasRole(role string) bool {
+	return u.role() == role
+}
+
+// SetRole sets and saves the user's role. Access tokens carry the role at the time they were issued, so anything
+// that depends on the role should check the stored user.
+func (u *User) SetRole(role string) error {
+	if !ValidRole(role) {
+		return errors.New("invalid role: " + role)
+	}
+	u.Role = role
+	return u.update()
+}
+
+// Disable stops the user from logging in, and ends all of their sessions, until Enable is called
+func (u *User) Disable() error {
+	u.Disabled = true
+	return u.EndSessions() // saves the user
+}
+
+// Enable reverses Disable, and also clears any lockout from failed logins
+func (u *User) Enable() error {
+	u.Disabled = false
+	err := u.update()
+	if err != nil {
+		return err
+	}
+	return u.ClearLoginFailures()
+}
+
+// ForceReset replaces the password with one that cannot be guessed and ends all sessions, so the user has to set
+// a new password with a reset link.
+func (u *User) ForceReset() error {
+	err := u.SetPassword(impossiblePassword())
+	if err != nil {
+		return err
+	}
+	return u.EndSessions() // saves the user
+}
+
+// ListUsers returns users ordered by email, optionally filtered by a string contained in the name or email
+func (ds *Datastore) ListUsers(filter string, skip, limit int) ([]User, error) {
+	xu, err := ds.Users.List(filter, skip, limit)
+	if err != nil {
+		return nil, err
+	}
+	for i := range xu {
+		xu[i].ds = ds
+	}
+	return xu, nil
+}
+
+// DeleteUser removes the user with their logs and bookmarks, and revokes their refresh tokens and search shares
+func (ds *Datastore) DeleteUser(id string) error {
+	u, err := ds.UserByID(id)
+	if err != nil {
+		return err
+	}
+
+	xl, err := ds.Logs.ByUserID(u.ID)
+	if err != nil {
+		return err
+	}
+	for _, l := range xl {
+		err = ds.Logs.Delete(l.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	xb, err := ds.Bookmarks.ByUserID(u.ID)
+	if err != nil {
+		return err
+	}
+	for _, b := range xb {
+		err = ds.Bookmarks.Delete(b.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = ds.revokeShares(u.ID, "")
+	if err != nil {
+		return err
+	}
+
+	err = ds.RefreshTokens.RevokeUser(u.ID)
+	if err != nil {
+		return err
+	}
+	return ds.Users.Delete(u.ID)
+}
+
+// role returns the user role, with the default for users that do not have one stored
+func (u *User) role() string {
+	if u.Role == "" {
+		return RoleUser
+	}
+	return u.Role
+}
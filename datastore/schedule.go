@@ -0,0 +1,183 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Notification frequencies for a Schedule
+const (
+	NotifyDaily   = "daily"
+	NotifyWeekly  = "weekly"
+	NotifyMonthly = "monthly"
+)
+
+// PausedIndefinitely is the PausedUntil of a user who has unsubscribed from notifications
+var PausedIndefinitely = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// DefaultNotificationDays is how far the notification date is pushed forward for a user who has not set a schedule
+const DefaultNotificationDays = 7
+
+// Schedule is when a user wants to be notified of new articles. The time of day and the weekday or day of the month
+// are in the user's timezone, so a notification stays at the same local time across daylight saving changes. A
+// zero Schedule means the user has not chosen one, and gets a notification every DefaultNotificationDays.
+type Schedule struct {
+	Frequency   string    `json:"frequency" bson:"frequency"`     // daily, weekly or monthly
+	Weekday     string    `json:"weekday" bson:"weekday"`         // weekly only, eg "monday"
+	DayOfMonth  int       `json:"dayOfMonth" bson:"dayOfMonth"`   // monthly only, 1-31, the last day of a shorter month
+	Hour        int       `json:"hour" bson:"hour"`               // 0-23
+	Timezone    string    `json:"timezone" bson:"timezone"`       // IANA name, eg "Australia/Sydney", UTC if empty
+	PausedUntil time.Time `json:"pausedUntil" bson:"pausedUntil"` // no notifications before this time
+}
+
+// ScheduleError is returned for a Schedule that is not valid
+type ScheduleError struct {
+	Reason string
+}
+
+func (e *ScheduleError) Error() string {
+	return "invalid notification schedule: " + e.Reason
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// Validate returns a *ScheduleError if the schedule cannot be used
+func (s Schedule) Validate() error {
+	switch s.Frequency {
+	case "", NotifyDaily:
+	case NotifyWeekly:
+		if _, ok := weekdays[strings.ToLower(s.Weekday)]; !ok {
+			return &ScheduleError{fmt.Sprintf("weekday %q is not a day of the week", s.Weekday)}
+		}
+	case NotifyMonthly:
+		if s.DayOfMonth < 1 || s.DayOfMonth > 31 {
+			return &ScheduleError{"dayOfMonth must be from 1 to 31"}
+		}
+	default:
+		return &ScheduleError{fmt.Sprintf("frequency %q must be daily, weekly or monthly", s.Frequency)}
+	}
+	if s.Hour < 0 || s.Hour > 23 {
+		return &ScheduleError{"hour must be from 0 to 23"}
+	}
+	if _, err := time.LoadLocation(s.Timezone); err != nil {
+		return &ScheduleError{fmt.Sprintf("unknown timezone %q", s.Timezone)}
+	}
+	return nil
+}
+
+// Next returns the first notification time after the specified time, and not before PausedUntil. The schedule must
+// be valid and have a frequency.
+func (s Schedule) Next(after time.Time) time.Time {
+	if after.Before(s.PausedUntil) {
+		after = s.PausedUntil.Add(-time.Nanosecond) // a notification can fall on the end of the pause
+	}
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	t := after.In(loc)
+	at := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, s.Hour, 0, 0, 0, loc)
+	}
+
+	switch s.Frequency {
+	case NotifyWeekly:
+		days := (int(weekdays[strings.ToLower(s.Weekday)]) - int(t.Weekday()) + 7) % 7
+		next := at(t.Year(), t.Month(), t.Day()+days)
+		if !next.After(t) {
+			next = at(t.Year(), t.Month(), t.Day()+days+7)
+		}
+		return next
+	case NotifyMonthly:
+		// the day is capped at the end of the month so that, eg, the 31st is the last day of every month
+		onDay := func(year int, month time.Month) time.Time {
+			last := time.Date(year, month+1, 0, 0, 0, 0, 0, loc).Day()
+			if s.DayOfMonth < last {
+				last = s.DayOfMonth
+			}
+			return at(year, month, last)
+		}
+		next := onDay(t.Year(), t.Month())
+		if !next.After(t) {
+			next = onDay(t.Year(), t.Month()+1)
+		}
+		return next
+	default:
+		next := at(t.Year(), t.Month(), t.Day())
+		if !next.After(t) {
+			next = at(t.Year(), t.Month(), t.Day()+1)
+		}
+		return next
+	}
+}
+
+// Paused returns true if notifications are paused at the specified time
+func (s Schedule) Paused(now time.Time) bool {
+	return now.Before(s.PausedUntil)
+}
+
+// Unsubscribe pauses notifications indefinitely, from the link in a notification email, and saves the user. The
+// user can get notifications again by setting a schedule without the pause.
+func (u *User) Unsubscribe() error {
+	u.Schedule.PausedUntil = PausedIndefinitely
+	return u.update()
+}
+
+// SetSchedule validates the schedule and sets the notification date to the next one due. A schedule with no
+// frequency goes back to the default, which keeps the current notification date unless it is in a pause. It does
+// not save the user.
+func (u *User) SetSchedule(s Schedule) error {
+	err := s.Validate()
+	if err != nil {
+		return err
+	}
+	s.Weekday = strings.ToLower(s.Weekday)
+	u.Schedule = s
+	if s.Frequency != "" {
+		u.Notification = s.Next(u.ds.now())
+	} else if u.Notification.Before(s.PausedUntil) {
+		u.Notification = s.PausedUntil
+	}
+	return nil
+}
+
+// AdvanceNotification moves the notification date on to the next one in the user's schedule, once the notification
+// has been sent, and saves the user. With the default schedule a missed notification is next due a full period from
+// now, rather than straight away.
+func (u *User) AdvanceNotification() error {
+	now := u.ds.now()
+	if u.Schedule.Frequency == "" {
+		next := u.Notification.AddDate(0, 0, DefaultNotificationDays)
+		if !next.After(now) {
+			next = now.AddDate(0, 0, DefaultNotificationDays)
+		}
+		u.Notification = next
+		return u.update()
+	}
+	u.Notification = u.Schedule.Next(now)
+	return u.update()
+}
+
+// scheduleFromUpdate converts the decoded JSON of a schedule in a partial update
+func scheduleFromUpdate(v interface{}) (Schedule, error) {
+	var s Schedule
+	b, err := json.Marshal(v)
+	if err != nil {
+		return s, err
+	}
+	err = json.Unmarshal(b, &s)
+	if err != nil {
+		return s, &ScheduleError{err.Error()}
+	}
+	return s, nil
+}
@@ -0,0 +1,233 @@
+package datastore_test
+
+import (
+	"log"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/mikedonnici/rtcl-api/datastore"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var scheduleTestDS *datastore.Datastore
+
+func TestSchedule(t *testing.T) {
+	t.Run("testScheduleNext", testScheduleNext)
+	t.Run("testScheduleValidate", testScheduleValidate)
+
+	backends, err := testBackends()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	for _, b := range backends {
+		scheduleTestDS = b.ds
+		t.Run(b.name, func(t *testing.T) {
+			t.Run("testUserSetSchedule", testUserSetSchedule)
+			t.Run("testUserAdvanceNotification", testUserAdvanceNotification)
+			t.Run("testUsersDueNotificationPaused", testUsersDueNotificationPaused)
+			t.Run("testUserUnsubscribe", testUserUnsubscribe)
+		})
+		b.cleanup()
+	}
+}
+
+func testScheduleNext(t *testing.T) {
+	is := is.New(t)
+	sydney, err := time.LoadLocation("Australia/Sydney")
+	is.NoErr(err)
+
+	// Wednesday 2018-10-03 09:30 UTC
+	after := time.Date(2018, 10, 3, 9, 30, 0, 0, time.UTC)
+	cases := []struct {
+		name     string
+		schedule datastore.Schedule
+		want     time.Time
+	}{
+		{"daily later today", datastore.Schedule{Frequency: "daily", Hour: 17},
+			time.Date(2018, 10, 3, 17, 0, 0, 0, time.UTC)},
+		{"daily tomorrow", datastore.Schedule{Frequency: "daily", Hour: 8},
+			time.Date(2018, 10, 4, 8, 0, 0, 0, time.UTC)},
+		{"daily in timezone", datastore.Schedule{Frequency: "daily", Hour: 8, Timezone: "Australia/Sydney"},
+			time.Date(2018, 10, 4, 8, 0, 0, 0, sydney)},
+		{"daily across dst", datastore.Schedule{Frequency: "daily", Hour: 8, Timezone: "Australia/Sydney",
+			PausedUntil: time.Date(2018, 10, 8, 0, 0, 0, 0, sydney)},
+			time.Date(2018, 10, 8, 8, 0, 0, 0, sydney)},
+		{"weekly", datastore.Schedule{Frequency: "weekly", Weekday: "monday", Hour: 8},
+			time.Date(2018, 10, 8, 8, 0, 0, 0, time.UTC)},
+		{"weekly same day passed", datastore.Schedule{Frequency: "weekly", Weekday: "wednesday", Hour: 8},
+			time.Date(2018, 10, 10, 8, 0, 0, 0, time.UTC)},
+		{"weekly same day to come", datastore.Schedule{Frequency: "weekly", Weekday: "Wednesday", Hour: 10},
+			time.Date(2018, 10, 3, 10, 0, 0, 0, time.UTC)},
+		{"monthly", datastore.Schedule{Frequency: "monthly", DayOfMonth: 15},
+			time.Date(2018, 10, 15, 0, 0, 0, 0, time.UTC)},
+		{"monthly next month", datastore.Schedule{Frequency: "monthly", DayOfMonth: 1, Hour: 6},
+			time.Date(2018, 11, 1, 6, 0, 0, 0, time.UTC)},
+		{"monthly short month", datastore.Schedule{Frequency: "monthly", DayOfMonth: 31,
+			PausedUntil: time.Date(2018, 11, 1, 0, 0, 0, 0, time.UTC)},
+			time.Date(2018, 11, 30, 0, 0, 0, 0, time.UTC)},
+		{"paused", datastore.Schedule{Frequency: "weekly", Weekday: "monday", Hour: 8,
+			PausedUntil: time.Date(2018, 10, 20, 0, 0, 0, 0, time.UTC)},
+			time.Date(2018, 10, 22, 8, 0, 0, 0, time.UTC)},
+		{"due at end of pause", datastore.Schedule{Frequency: "daily", Hour: 8,
+			PausedUntil: time.Date(2018, 10, 20, 8, 0, 0, 0, time.UTC)},
+			time.Date(2018, 10, 20, 8, 0, 0, 0, time.UTC)},
+	}
+	for _, c := range cases {
+		got := c.schedule.Next(after)
+		if !got.Equal(c.want) {
+			t.Errorf("%s: Next() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func testScheduleValidate(t *testing.T) {
+	is := is.New(t)
+	valid := []datastore.Schedule{
+		{},
+		{Frequency: "daily", Hour: 23, Timezone: "America/New_York"},
+		{Frequency: "weekly", Weekday: "Friday"},
+		{Frequency: "monthly", DayOfMonth: 31},
+	}
+	for _, s := range valid {
+		is.NoErr(s.Validate()) // schedule should be valid
+	}
+
+	invalid := []datastore.Schedule{
+		{Frequency: "hourly"},
+		{Frequency: "weekly", Weekday: "someday"},
+		{Frequency: "monthly"},
+		{Frequency: "monthly", DayOfMonth: 32},
+		{Frequency: "daily", Hour: 24},
+		{Frequency: "daily", Timezone: "Mars/Olympus_Mons"},
+	}
+	for _, s := range invalid {
+		_, ok := s.Validate().(*datastore.ScheduleError)
+		is.True(ok) // expected a ScheduleError
+	}
+}
+
+// scheduleUser returns a saved user with a notification that was due yesterday
+func scheduleUser(t *testing.T, now time.Time) *datastore.User {
+	u := newTestUser(t, scheduleTestDS)
+	u.Notification = now.AddDate(0, 0, -1)
+	err := scheduleTestDS.Users.Save(*u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// Tests that a schedule in a partial update sets the next notification date
+func testUserSetSchedule(t *testing.T) {
+	is := is.New(t)
+	now := time.Date(2018, 10, 3, 9, 30, 0, 0, time.UTC)
+	scheduleTestDS.Now = func() time.Time { return now }
+	defer func() { scheduleTestDS.Now = nil }()
+	u := scheduleUser(t, now)
+
+	err := u.SavePartial(bson.M{"schedule": map[string]interface{}{
+		"frequency": "weekly",
+		"weekday":   "Monday",
+		"hour":      8.0, // numbers are decoded from JSON as float64
+		"timezone":  "Europe/London",
+	}})
+	is.NoErr(err) // error saving schedule
+
+	u2, err := scheduleTestDS.UserByID(u.ID.Hex())
+	is.NoErr(err)
+	is.Equal(u2.Schedule.Weekday, "monday") // weekday should be normalised
+	london, _ := time.LoadLocation("Europe/London")
+	is.True(u2.Notification.Equal(time.Date(2018, 10, 8, 8, 0, 0, 0, london))) // next notification incorrect
+
+	err = u.SavePartial(bson.M{"schedule": map[string]interface{}{"frequency": "fortnightly"}})
+	_, ok := err.(*datastore.ScheduleError)
+	is.True(ok) // expected a ScheduleError
+}
+
+// Tests moving the notification date on once a notification has been sent
+func testUserAdvanceNotification(t *testing.T) {
+	is := is.New(t)
+	now := time.Date(2018, 10, 3, 9, 30, 0, 0, time.UTC)
+	scheduleTestDS.Now = func() time.Time { return now }
+	defer func() { scheduleTestDS.Now = nil }()
+
+	// no schedule falls back to the default number of days
+	u := scheduleUser(t, now)
+	last := u.Notification
+	is.NoErr(u.AdvanceNotification())
+	is.True(u.Notification.Equal(last.AddDate(0, 0, datastore.DefaultNotificationDays)))
+
+	// a notification missed by more than the default days is next due the default days from now
+	u = scheduleUser(t, now)
+	u.Notification = now.AddDate(0, -2, 0)
+	is.NoErr(u.AdvanceNotification())
+	is.True(u.Notification.Equal(now.AddDate(0, 0, datastore.DefaultNotificationDays)))
+
+	// a missed monthly notification is next due in the coming month, not the one that was missed
+	u = scheduleUser(t, now)
+	u.Schedule = datastore.Schedule{Frequency: "monthly", DayOfMonth: 1}
+	is.NoErr(u.AdvanceNotification())
+	u2, err := scheduleTestDS.UserByID(u.ID.Hex())
+	is.NoErr(err)
+	is.True(u2.Notification.Equal(time.Date(2018, 11, 1, 0, 0, 0, 0, time.UTC))) // next notification incorrect
+}
+
+// Tests that paused users are not due a notification
+func testUsersDueNotificationPaused(t *testing.T) {
+	is := is.New(t)
+	now := time.Now()
+	u := scheduleUser(t, now)
+
+	isDue := func() bool {
+		xu, err := scheduleTestDS.UsersDueNotification()
+		is.NoErr(err)
+		for _, d := range xu {
+			if d.ID == u.ID {
+				return true
+			}
+		}
+		return false
+	}
+	is.True(isDue()) // user should be due
+
+	// pausing with the default schedule holds the notification until the end of the pause
+	err := u.SetSchedule(datastore.Schedule{PausedUntil: now.AddDate(0, 0, 14)})
+	is.NoErr(err)
+	is.True(u.Notification.Equal(u.Schedule.PausedUntil))
+	is.NoErr(scheduleTestDS.Users.Save(*u))
+	is.True(!isDue()) // paused user should not be due
+
+	// a stale notification date is still held back by the pause
+	u.Notification = now.AddDate(0, 0, -1)
+	is.NoErr(scheduleTestDS.Users.Save(*u))
+	is.True(!isDue()) // paused user should not be due
+}
+
+// Tests that an unsubscribed user is not due a notification until they set a schedule again
+func testUserUnsubscribe(t *testing.T) {
+	is := is.New(t)
+	u := scheduleUser(t, time.Now())
+	is.NoErr(u.Unsubscribe())
+
+	isDue := func() bool {
+		xu, err := scheduleTestDS.UsersDueNotification()
+		is.NoErr(err)
+		for _, d := range xu {
+			if d.ID == u.ID {
+				return true
+			}
+		}
+		return false
+	}
+	is.True(!isDue()) // unsubscribed user should not be due
+	u2, err := scheduleTestDS.UserByID(u.ID.Hex())
+	is.NoErr(err)
+	is.True(u2.Schedule.PausedUntil.Equal(datastore.PausedIndefinitely)) // expected the pause to be saved
+
+	is.NoErr(u2.SavePartial(bson.M{"schedule": map[string]interface{}{"frequency": "daily"}}))
+	u2.Notification = time.Now().AddDate(0, 0, -1) // make the next notification due
+	is.NoErr(scheduleTestDS.Users.Save(*u2))
+	is.True(isDue()) // expected notifications to resume with a new schedule
+}
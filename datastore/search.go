@@ -0,0 +1,317 @@
+package datastore
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/mikedonnici/rtcl-api/query"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// ErrSearchExists is returned when saving a search with the same query as another of the user's searches
+var ErrSearchExists = errors.New("search query already exists for this user")
+
+// Search is a saved search. The filters narrow the articles matched by the query, and are ignored when empty. From
+// and To are publication dates in the form 2006-01-02. LastRun and LastPMID are the run state, set by
+// RecordSearchRun when the search is run for a notification, so that only newer articles are sent the next time.
+// Link is set for a copy of another user's shared search, see Subscribe.
+type Search struct {
+	ID         bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Name       string        `json:"name" bson:"name"`
+	Query      string        `json:"query" bson:"query"`
+	Categories []string      `json:"categories" bson:"categories"`
+	Journals   []string      `json:"journals" bson:"journals"`
+	From       string        `json:"from" bson:"from"`
+	To         string        `json:"to" bson:"to"`
+	Created    time.Time     `json:"created" bson:"created"`
+	Updated    time.Time     `json:"updated" bson:"updated"`
+	LastRun    time.Time     `json:"lastRun" bson:"lastRun"`
+	LastPMID   string        `json:"lastPMID" bson:"lastPMID"`
+	Link       *SearchLink   `json:"link,omitempty" bson:"link,omitempty"`
+}
+
+// SearchError is returned for a search that is not valid
+type SearchError struct {
+	Reason string
+}
+
+func (e *SearchError) Error() string {
+	return "invalid search: " + e.Reason
+}
+
+// check validates the search fields that can be set by the user, and tidies them up. The query must parse, see
+// the query package for the syntax.
+func (s *Search) check() error {
+	s.Query = strings.TrimSpace(s.Query)
+	if s.Query == "" {
+		return &SearchError{"query is missing"}
+	}
+	_, err := query.Parse(s.Query)
+	if err != nil {
+		return &SearchError{err.Error()}
+	}
+	s.Name = strings.TrimSpace(s.Name)
+	if s.Name == "" {
+		s.Name = s.Query
+	}
+	s.Categories = tidyList(s.Categories)
+	s.Journals = tidyList(s.Journals)
+
+	var from, to time.Time
+	if s.From != "" {
+		from, err = time.Parse("2006-01-02", s.From)
+		if err != nil {
+			return &SearchError{"from must be a date like 2006-01-02"}
+		}
+	}
+	if s.To != "" {
+		to, err = time.Parse("2006-01-02", s.To)
+		if err != nil {
+			return &SearchError{"to must be a date like 2006-01-02"}
+		}
+	}
+	if !from.IsZero() && !to.IsZero() && to.Before(from) {
+		return &SearchError{"to is before from"}
+	}
+	return nil
+}
+
+// tidyList trims the values in the list and removes empty ones
+func tidyList(xs []string) []string {
+	var tidy []string
+	for _, s := range xs {
+		s = strings.TrimSpace(s)
+		if s != "" {
+			tidy = append(tidy, s)
+		}
+	}
+	return tidy
+}
+
+// tidyLowerList trims and lower cases the values in the list, and removes empty and duplicate ones
+func tidyLowerList(xs []string) []string {
+	seen := map[string]bool{}
+	var tidy []string
+	for _, s := range tidyList(xs) {
+		s = strings.ToLower(s)
+		if !seen[s] {
+			seen[s] = true
+			tidy = append(tidy, s)
+		}
+	}
+	return tidy
+}
+
+// AddSearch adds a new search for the user, and returns it with its id. It returns ErrSearchExists if the user
+// already has a search with the same query.
+func (u *User) AddSearch(s Search) (Search, error) {
+	return u.addSearch(s, nil)
+}
+
+// addSearch adds the search with the link, which is nil unless it is a copy of a shared search
+func (u *User) addSearch(s Search, link *SearchLink) (Search, error) {
+	err := s.check()
+	if err != nil {
+		return s, err
+	}
+	if u.SearchExists(s.Query) {
+		return s, ErrSearchExists
+	}
+
+	s.ID = bson.NewObjectId()
+	s.Created = u.ds.now()
+	s.Updated = s.Created
+	s.LastRun = time.Time{}
+	s.LastPMID = ""
+	s.Link = link
+	err = u.ds.Users.AddSearch(u.ID, s)
+	if err != nil {
+		return s, err
+	}
+	u.Searches = append(u.Searches, s)
+	return s, nil
+}
+
+// SaveSearch saves a search (one or more search terms) for a user, with no filters
+func (u *User) SaveSearch(q string) error {
+	_, err := u.AddSearch(Search{Query: q})
+	return err
+}
+
+// SearchByID returns the user's search with the id, or ErrNotFound
+func (u *User) SearchByID(id string) (Search, error) {
+	for _, s := range u.Searches {
+		if s.ID.Hex() == id {
+			return s, nil
+		}
+	}
+	return Search{}, ErrNotFound
+}
+
+// UpdateSearch replaces the name, query and filters of the user's search with the same id. The run state is kept.
+// Linked copies of the search are updated to match, and a search that is itself a linked copy returns
+// ErrSearchLinked.
+func (u *User) UpdateSearch(s Search) (Search, error) {
+	old, err := u.SearchByID(s.ID.Hex())
+	if err != nil {
+		return s, err
+	}
+	if old.Link != nil {
+		return s, ErrSearchLinked
+	}
+	err = s.check()
+	if err != nil {
+		return s, err
+	}
+	for _, x := range u.Searches {
+		if x.ID != s.ID && sameQuery(x.Query, s.Query) {
+			return s, ErrSearchExists
+		}
+	}
+
+	s.Created = old.Created
+	s.Updated = u.ds.now()
+	s.LastRun = old.LastRun
+	s.LastPMID = old.LastPMID
+	s.Link = nil
+	err = u.replaceSearch(s)
+	if err != nil {
+		return s, err
+	}
+	return s, u.ds.syncShares(u.ID, s)
+}
+
+// RecordSearchRun sets the run state of the search after it has been run. The pmid is the newest article found,
+// and if it is empty the last one seen is kept.
+func (u *User) RecordSearchRun(id, pmid string) error {
+	s, err := u.SearchByID(id)
+	if err != nil {
+		return err
+	}
+	s.LastRun = u.ds.now()
+	if pmid != "" {
+		s.LastPMID = pmid
+	}
+	return u.replaceSearch(s)
+}
+
+func (u *User) replaceSearch(s Search) error {
+	err := u.ds.Users.UpdateSearch(u.ID, s)
+	if err != nil {
+		return err
+	}
+	for i := range u.Searches {
+		if u.Searches[i].ID == s.ID {
+			u.Searches[i] = s
+		}
+	}
+	return nil
+}
+
+// RemoveSearch deletes the user's search with the id, or returns ErrNotFound. The shares of the search are revoked,
+// or if it is a linked copy the user is unsubscribed.
+func (u *User) RemoveSearch(id string) error {
+	s, err := u.SearchByID(id)
+	if err != nil {
+		return err
+	}
+	if s.Link != nil {
+		err = u.ds.Shares.RemoveSubscriber(s.Link.ShareID, u.ID)
+	} else {
+		err = u.ds.revokeShares(u.ID, s.ID)
+	}
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	err = u.ds.Users.RemoveSearch(u.ID, s.ID)
+	if err != nil {
+		return err
+	}
+
+	var updatedList []Search
+	for _, x := range u.Searches {
+		if x.ID != s.ID {
+			updatedList = append(updatedList, x)
+		}
+	}
+	u.Searches = updatedList
+	return nil
+}
+
+// DeleteSearch deletes the search with the query from the user's search list
+func (u *User) DeleteSearch(q string) error {
+	for _, s := range u.Searches {
+		if sameQuery(s.Query, q) {
+			return u.RemoveSearch(s.ID.Hex())
+		}
+	}
+	return errors.New("cannot find the query so unable to delete it")
+}
+
+// SearchExists returns true if the user has a search with the same query, or one that means the same thing
+func (u *User) SearchExists(q string) bool {
+	for _, s := range u.Searches {
+		if sameQuery(s.Query, q) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameQuery returns true if the queries mean the same thing, eg "heart failure" and "failure AND Heart". Queries
+// saved before the query language may not parse, and are compared as text.
+func sameQuery(q1, q2 string) bool {
+	n1, err1 := query.Parse(q1)
+	n2, err2 := query.Parse(q2)
+	if err1 != nil || err2 != nil {
+		return matchString(q1, q2)
+	}
+	return n1.Key() == n2.Key()
+}
+
+// SavedSearches retrieves the set of Searches for a user
+func (u *User) SavedSearches() ([]Search, error) {
+	return u.Searches, nil
+}
+
+// migrateSearches gives an id and name to searches saved before they had them, and returns true if there were any
+func (u *User) migrateSearches() bool {
+	var migrated bool
+	for i := range u.Searches {
+		s := &u.Searches[i]
+		if s.ID.Valid() {
+			continue
+		}
+		s.ID = bson.NewObjectId()
+		if s.Name == "" {
+			s.Name = s.Query
+		}
+		if s.Updated.IsZero() {
+			s.Updated = s.Created
+		}
+		migrated = true
+	}
+	return migrated
+}
+
+// MigrateSearches gives an id to every saved search that does not have one, and returns the number of users
+// updated. Users are also migrated when they are fetched, so this only needs to be run once to finish the job.
+func (ds *Datastore) MigrateSearches() (int, error) {
+	xu, err := ds.Users.List("", 0, 0)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, u := range xu {
+		if !u.migrateSearches() {
+			continue
+		}
+		err = ds.Users.Save(u)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,210 @@
+package datastore_test
+
+import (
+	"log"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/mikedonnici/rtcl-api/datastore"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var searchTestDS *datastore.Datastore
+
+func TestSearch(t *testing.T) {
+
+	backends, err := testBackends()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	for _, b := range backends {
+		searchTestDS = b.ds
+		t.Run(b.name, func(t *testing.T) {
+			t.Run("testSearchAdd", testSearchAdd)
+			t.Run("testSearchInvalid", testSearchInvalid)
+			t.Run("testSearchQuery", testSearchQuery)
+			t.Run("testSearchUpdate", testSearchUpdate)
+			t.Run("testSearchRun", testSearchRun)
+			t.Run("testSearchRemove", testSearchRemove)
+			t.Run("testSearchMigrate", testSearchMigrate)
+		})
+		b.cleanup()
+	}
+}
+
+func testSearchAdd(t *testing.T) {
+	is := is.New(t)
+	u := newTestUser(t, searchTestDS)
+
+	s, err := u.AddSearch(datastore.Search{
+		Query:      " cardiomyopathy  athletes ",
+		Categories: []string{"cardiology", " "},
+		Journals:   []string{"J Am Coll Cardiol"},
+		From:       "2018-01-01",
+	})
+	is.NoErr(err)                                  // error adding search
+	is.True(s.ID.Valid())                          // expected an id
+	is.Equal(s.Name, "cardiomyopathy  athletes")   // name should default to the query
+	is.Equal(s.Categories, []string{"cardiology"}) // empty categories should be removed
+
+	u2, err := searchTestDS.UserByID(u.ID.Hex())
+	is.NoErr(err)
+	s2, err := u2.SearchByID(s.ID.Hex())
+	is.NoErr(err) // error fetching search by id
+	is.Equal(s2.Journals, s.Journals)
+	is.Equal(s2.From, "2018-01-01")
+
+	_, err = u2.AddSearch(datastore.Search{Query: "Cardiomyopathy Athletes"})
+	is.Equal(err, datastore.ErrSearchExists) // expected duplicate query to be rejected
+
+	_, err = u2.SearchByID(bson.NewObjectId().Hex())
+	is.Equal(err, datastore.ErrNotFound)
+}
+
+func testSearchInvalid(t *testing.T) {
+	is := is.New(t)
+	u := newTestUser(t, searchTestDS)
+	cases := []datastore.Search{
+		{Query: "  "},
+		{Query: "valid", From: "01/01/2018"},
+		{Query: "valid", To: "yesterday"},
+		{Query: "valid", From: "2018-02-01", To: "2018-01-01"},
+	}
+	for _, c := range cases {
+		_, err := u.AddSearch(c)
+		_, ok := err.(*datastore.SearchError)
+		is.True(ok) // expected a SearchError
+	}
+	is.Equal(len(u.Searches), 0) // invalid searches should not be saved
+}
+
+// Tests that queries are parsed, and that queries that mean the same thing are duplicates
+func testSearchQuery(t *testing.T) {
+	is := is.New(t)
+	u := newTestUser(t, searchTestDS)
+
+	for _, q := range []string{"(heart failure", "heart AND", "size:large", `"unterminated`} {
+		_, err := u.AddSearch(datastore.Search{Query: q})
+		_, ok := err.(*datastore.SearchError)
+		is.True(ok) // expected a SearchError for a query that does not parse
+	}
+
+	_, err := u.AddSearch(datastore.Search{Query: `(heart OR cardiac) failure -journal:"Am J Cardiol"`})
+	is.NoErr(err) // error adding search
+	_, err = u.AddSearch(datastore.Search{Query: `NOT journal:"am j cardiol" AND failure (Cardiac OR heart)`})
+	is.Equal(err, datastore.ErrSearchExists) // expected the same query in a different order to be a duplicate
+	_, err = u.AddSearch(datastore.Search{Query: `heart OR cardiac failure -journal:"Am J Cardiol"`})
+	is.NoErr(err) // a different grouping is a different query
+	is.NoErr(u.DeleteSearch("failure AND (heart OR cardiac) AND -journal:\"Am J Cardiol\""))
+	is.Equal(len(u.Searches), 1)
+}
+
+func testSearchUpdate(t *testing.T) {
+	is := is.New(t)
+	u := newTestUser(t, searchTestDS)
+	s1, err := u.AddSearch(datastore.Search{Query: "calcium score"})
+	is.NoErr(err)
+	s2, err := u.AddSearch(datastore.Search{Query: "atherosclerosis"})
+	is.NoErr(err)
+
+	s2.Name = "Plaque"
+	s2.Query = "atherosclerosis plaque"
+	s2.LastPMID = "12345" // run state cannot be set by an update
+	updated, err := u.UpdateSearch(s2)
+	is.NoErr(err) // error updating search
+	is.Equal(updated.Created, s2.Created)
+	is.Equal(updated.LastPMID, "")
+
+	u2, err := searchTestDS.UserByID(u.ID.Hex())
+	is.NoErr(err)
+	s, err := u2.SearchByID(s2.ID.Hex())
+	is.NoErr(err)
+	is.Equal(s.Name, "Plaque")
+	is.Equal(s.Query, "atherosclerosis plaque")
+	is.Equal(len(u2.Searches), 2) // update should not add a search
+
+	s2.Query = "Calcium  Score"
+	_, err = u.UpdateSearch(s2)
+	is.Equal(err, datastore.ErrSearchExists) // expected query of another search to be rejected
+
+	s1.Name = "Same query"
+	_, err = u.UpdateSearch(s1)
+	is.NoErr(err) // a search can keep its own query
+
+	_, err = u.UpdateSearch(datastore.Search{ID: bson.NewObjectId(), Query: "missing"})
+	is.Equal(err, datastore.ErrNotFound)
+}
+
+func testSearchRun(t *testing.T) {
+	is := is.New(t)
+	now := time.Date(2018, 10, 3, 9, 30, 0, 0, time.UTC)
+	searchTestDS.Now = func() time.Time { return now }
+	defer func() { searchTestDS.Now = nil }()
+
+	u := newTestUser(t, searchTestDS)
+	s, err := u.AddSearch(datastore.Search{Query: "heart failure"})
+	is.NoErr(err)
+	is.NoErr(u.RecordSearchRun(s.ID.Hex(), "30265433"))
+	is.NoErr(u.RecordSearchRun(s.ID.Hex(), "")) // no new articles
+
+	u2, err := searchTestDS.UserByID(u.ID.Hex())
+	is.NoErr(err)
+	s, err = u2.SearchByID(s.ID.Hex())
+	is.NoErr(err)
+	is.True(s.LastRun.Equal(now))    // expected last run time
+	is.Equal(s.LastPMID, "30265433") // last article should be kept when there are no new ones
+}
+
+func testSearchRemove(t *testing.T) {
+	is := is.New(t)
+	u := newTestUser(t, searchTestDS)
+	s1, err := u.AddSearch(datastore.Search{Query: "one"})
+	is.NoErr(err)
+	s2, err := u.AddSearch(datastore.Search{Query: "two"})
+	is.NoErr(err)
+
+	is.NoErr(u.RemoveSearch(s1.ID.Hex()))
+	is.Equal(u.RemoveSearch(s1.ID.Hex()), datastore.ErrNotFound)
+
+	u2, err := searchTestDS.UserByID(u.ID.Hex())
+	is.NoErr(err)
+	is.Equal(len(u2.Searches), 1)
+	is.Equal(u2.Searches[0].ID, s2.ID) // the other search should remain
+}
+
+// Tests that searches saved before they had ids are given one
+func testSearchMigrate(t *testing.T) {
+	is := is.New(t)
+	u := newTestUser(t, searchTestDS)
+	u.Searches = []datastore.Search{
+		{Created: time.Now(), Query: "legacy one"},
+		{Created: time.Now(), Query: "legacy two"},
+	}
+	is.NoErr(searchTestDS.Users.Save(*u)) // saved without the checks, as an older version would have
+
+	n, err := searchTestDS.MigrateSearches()
+	is.NoErr(err)
+	is.True(n >= 1) // expected the user to be migrated
+
+	u2, err := searchTestDS.UserByID(u.ID.Hex())
+	is.NoErr(err)
+	for _, s := range u2.Searches {
+		is.True(s.ID.Valid())     // expected an id
+		is.Equal(s.Name, s.Query) // expected the query as the name
+	}
+
+	// users are also migrated when they are fetched
+	u3 := newTestUser(t, searchTestDS)
+	u3.Searches = []datastore.Search{{Created: time.Now(), Query: "legacy three"}}
+	is.NoErr(searchTestDS.Users.Save(*u3))
+	u4, err := searchTestDS.UserByID(u3.ID.Hex())
+	is.NoErr(err)
+	id := u4.Searches[0].ID
+	is.True(id.Valid()) // expected an id
+	u5, err := searchTestDS.UserByID(u3.ID.Hex())
+	is.NoErr(err)
+	is.Equal(u5.Searches[0].ID, id) // the id should have been saved
+	is.NoErr(u5.DeleteSearch("legacy three"))
+}
@@ -0,0 +1,168 @@
+package datastore
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// RefreshTokenTTL is the default lifetime of a refresh token. Each refresh issues a new token with a fresh TTL, so
+// this is how long a session can sit idle before the user has to log in again.
+const RefreshTokenTTL = 30 * 24 * time.Hour
+
+// Errors returned when refreshing or checking tokens
+var (
+	ErrRefreshTokenInvalid = errors.New("refresh token is invalid or has expired")
+	ErrRefreshTokenReused  = errors.New("refresh token has already been used")
+	ErrTokenRevoked        = errors.New("token has been revoked")
+)
+
+// RefreshToken is a single use token that is exchanged for a new access token and a new refresh token. Only a hash
+// of the token string is stored. All of the refresh tokens that descend from one login share a Family, so that if a
+// used token is presented again - which means it has been copied - the whole session is revoked.
+type RefreshToken struct {
+	ID      string        `bson:"_id"` // sha-256 of the token string
+	UserID  bson.ObjectId `bson:"userId"`
+	Family  string        `bson:"family"`
+	Created time.Time     `bson:"created"`
+	Expires time.Time     `bson:"expires"`
+	Used    bool          `bson:"used"`
+	Revoked bool          `bson:"revoked"`
+}
+
+// RefreshToken starts a new session for the user and returns the refresh token string
+func (u *User) RefreshToken(ttl time.Duration) (string, error) {
+	return u.ds.newRefreshToken(u.ID, randomID(), ttl)
+}
+
+// EndSessions revokes every access and refresh token issued to the user so far, eg after a password change. Access
+// tokens are rejected by CheckToken if they were issued before the current second, so a token issued immediately
+// afterwards is still valid.
+func (u *User) EndSessions() error {
+	u.TokensValidAfter = u.ds.now().Truncate(time.Second)
+	err := u.ds.RefreshTokens.RevokeUser(u.ID)
+	if err != nil {
+		return err
+	}
+	return u.update()
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one in the same family, and returns the user it was issued
+// to. If the token has already been used the family is revoked and ErrRefreshTokenReused is returned.
+func (ds *Datastore) RotateRefreshToken(token string, ttl time.Duration) (*User, string, error) {
+	rt, err := ds.RefreshTokens.ByID(hash(token))
+	if err == ErrNotFound {
+		return nil, "", ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if rt.Revoked || !ds.now().Before(rt.Expires) {
+		return nil, "", ErrRefreshTokenInvalid
+	}
+
+	err = ds.RefreshTokens.Use(rt.ID)
+	if err == ErrNotFound {
+		err = ds.RefreshTokens.RevokeFamily(rt.Family)
+		if err != nil {
+			return nil, "", err
+		}
+		return nil, "", ErrRefreshTokenReused
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	u, err := ds.UserByID(rt.UserID.Hex())
+	if err == ErrNotFound {
+		return nil, "", ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if u.Disabled {
+		return nil, "", ErrRefreshTokenInvalid
+	}
+
+	next, err := ds.newRefreshToken(u.ID, rt.Family, ttl)
+	return u, next, err
+}
+
+// Logout revokes the access token and, if refreshToken is not empty, the session that the refresh token belongs to.
+func (ds *Datastore) Logout(t Token, refreshToken string) error {
+	err := ds.RevokeToken(t)
+	if err != nil || refreshToken == "" {
+		return err
+	}
+
+	rt, err := ds.RefreshTokens.ByID(hash(refreshToken))
+	if err == ErrNotFound {
+		return nil // nothing to revoke
+	}
+	if err != nil {
+		return err
+	}
+	if rt.UserID.Hex() != t.Claims.ID {
+		return ErrRefreshTokenInvalid
+	}
+	return ds.RefreshTokens.RevokeFamily(rt.Family)
+}
+
+// RevokeToken adds the access token id (jti) to the revocation list until the token expires. Tokens issued before
+// ids were added cannot be revoked individually, but are still ended by User.EndSessions.
+func (ds *Datastore) RevokeToken(t Token) error {
+	if t.Claims.Id == "" {
+		return nil
+	}
+	err := ds.RevokedTokens.Add(t.Claims.Id, t.ExpiresAt)
+	if err == ErrDuplicate {
+		return nil
+	}
+	return err
+}
+
+// CheckToken checks that a decoded access token has not been revoked, either by id or because the user ended all
+// sessions after it was issued or has been disabled, and returns the user it was issued to.
+func (ds *Datastore) CheckToken(t Token) (*User, error) {
+	if t.Claims.Id != "" {
+		revoked, err := ds.RevokedTokens.Exists(t.Claims.Id)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, ErrTokenRevoked
+		}
+	}
+
+	u, err := ds.UserByID(t.Claims.ID)
+	if err != nil {
+		return nil, err
+	}
+	if u.Disabled || t.Claims.IssuedAt < u.TokensValidAfter.Unix() {
+		return nil, ErrTokenRevoked
+	}
+	return u, nil
+}
+
+// newRefreshToken stores a new refresh token in the family and returns the token string
+func (ds *Datastore) newRefreshToken(userID bson.ObjectId, family string, ttl time.Duration) (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	now := ds.now()
+	rt := RefreshToken{
+		ID:      hash(token),
+		UserID:  userID,
+		Family:  family,
+		Created: now,
+		Expires: now.Add(ttl),
+	}
+	return token, ds.RefreshTokens.Save(rt)
+}
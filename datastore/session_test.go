@@ -0,0 +1,170 @@
+package datastore_test
+
+import (
+	"log"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/mikedonnici/rtcl-api/datastore"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var sessionTestDS *datastore.Datastore
+
+func TestSession(t *testing.T) {
+
+	backends, err := testBackends()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	for _, b := range backends {
+		sessionTestDS = b.ds
+		t.Run(b.name, func(t *testing.T) {
+			t.Run("testTokenID", testTokenID)
+			t.Run("testRefreshTokenRotate", testRefreshTokenRotate)
+			t.Run("testRefreshTokenReuse", testRefreshTokenReuse)
+			t.Run("testRefreshTokenExpired", testRefreshTokenExpired)
+			t.Run("testRevokeToken", testRevokeToken)
+			t.Run("testTokenIDsExpire", testTokenIDsExpire)
+			t.Run("testLogout", testLogout)
+			t.Run("testEndSessions", testEndSessions)
+		})
+		b.cleanup()
+	}
+}
+
+func testTokenID(t *testing.T) {
+	is := is.New(t)
+	tk1, err := datastore.NewToken(issuer, signingKey, ttlHours).Encode()
+	is.NoErr(err) // error encoding token
+	tk2, err := datastore.NewToken(issuer, signingKey, ttlHours).Encode()
+	is.NoErr(err)                           // error encoding token
+	is.True(tk1.Claims.Id != "")            // token should have a jti
+	is.True(tk1.Claims.Id != tk2.Claims.Id) // each token should have a unique jti
+	tk3, err := datastore.DecodeToken(tk1.String(), signingKey)
+	is.NoErr(err)                          // error decoding token
+	is.Equal(tk3.Claims.Id, tk1.Claims.Id) // jti not decoded
+}
+
+func testRefreshTokenRotate(t *testing.T) {
+	is := is.New(t)
+	u := newTestUser(t, sessionTestDS)
+	rt, err := u.RefreshToken(time.Hour)
+	is.NoErr(err) // error issuing refresh token
+
+	u2, rt2, err := sessionTestDS.RotateRefreshToken(rt, time.Hour)
+	is.NoErr(err)         // error rotating refresh token
+	is.Equal(u2.ID, u.ID) // refresh token issued to the wrong user
+	is.True(rt2 != rt)    // expected a new refresh token
+	_, _, err = sessionTestDS.RotateRefreshToken(rt2, time.Hour)
+	is.NoErr(err) // new refresh token should be valid
+
+	_, _, err = sessionTestDS.RotateRefreshToken("notarealtoken", time.Hour)
+	is.Equal(err, datastore.ErrRefreshTokenInvalid) // unknown token should be invalid
+}
+
+func testRefreshTokenReuse(t *testing.T) {
+	is := is.New(t)
+	u := newTestUser(t, sessionTestDS)
+	rt, err := u.RefreshToken(time.Hour)
+	is.NoErr(err) // error issuing refresh token
+	_, rt2, err := sessionTestDS.RotateRefreshToken(rt, time.Hour)
+	is.NoErr(err) // error rotating refresh token
+
+	_, _, err = sessionTestDS.RotateRefreshToken(rt, time.Hour)
+	is.Equal(err, datastore.ErrRefreshTokenReused) // a used token should not be accepted again
+	_, _, err = sessionTestDS.RotateRefreshToken(rt2, time.Hour)
+	is.Equal(err, datastore.ErrRefreshTokenInvalid) // reuse should revoke the rest of the session
+}
+
+func testRefreshTokenExpired(t *testing.T) {
+	is := is.New(t)
+	u := newTestUser(t, sessionTestDS)
+	rt, err := u.RefreshToken(-time.Minute)
+	is.NoErr(err) // error issuing refresh token
+	_, _, err = sessionTestDS.RotateRefreshToken(rt, time.Hour)
+	is.Equal(err, datastore.ErrRefreshTokenInvalid) // expired token should be invalid
+}
+
+func testRevokeToken(t *testing.T) {
+	is := is.New(t)
+	u := newTestUser(t, sessionTestDS)
+	tk, err := u.Token(issuer, signingKey, ttlHours)
+	is.NoErr(err) // error issuing token
+
+	_, err = sessionTestDS.CheckToken(tk)
+	is.NoErr(err)                           // token should be valid before it is revoked
+	is.NoErr(sessionTestDS.RevokeToken(tk)) // error revoking token
+	is.NoErr(sessionTestDS.RevokeToken(tk)) // revoking twice should not be an error
+	_, err = sessionTestDS.CheckToken(tk)
+	is.Equal(err, datastore.ErrTokenRevoked) // revoked token should be rejected
+}
+
+// testTokenIDsExpire tests that token ids are removed once the token has expired, so they are not kept forever. Mongo
+// removes them with a TTL index in the background, so this is only checked for the other backends.
+func testTokenIDsExpire(t *testing.T) {
+	if sessionTestDS.Mongo != nil {
+		t.Skip("expired token ids are removed by the Mongo TTL index")
+	}
+	is := is.New(t)
+	now := time.Now()
+	expired := bson.NewObjectId().Hex()
+	valid := bson.NewObjectId().Hex()
+	is.NoErr(sessionTestDS.RevokedTokens.Add(expired, now.Add(-time.Minute))) // error adding expired id
+	is.NoErr(sessionTestDS.RevokedTokens.Add(valid, now.Add(time.Hour)))      // error adding valid id
+
+	found, err := sessionTestDS.RevokedTokens.Exists(expired)
+	is.NoErr(err)
+	is.True(!found) // expired id should be removed when another id is added
+	found, err = sessionTestDS.RevokedTokens.Exists(valid)
+	is.NoErr(err)
+	is.True(found) // id should be kept until the token expires
+}
+
+func testLogout(t *testing.T) {
+	is := is.New(t)
+	u := newTestUser(t, sessionTestDS)
+	tk, err := u.Token(issuer, signingKey, ttlHours)
+	is.NoErr(err) // error issuing token
+	rt, err := u.RefreshToken(time.Hour)
+	is.NoErr(err) // error issuing refresh token
+
+	other := newTestUser(t, sessionTestDS)
+	otherRT, err := other.RefreshToken(time.Hour)
+	is.NoErr(err) // error issuing refresh token
+	err = sessionTestDS.Logout(tk, otherRT)
+	is.Equal(err, datastore.ErrRefreshTokenInvalid) // should not log out another user's session
+
+	is.NoErr(sessionTestDS.Logout(tk, rt)) // error logging out
+	_, err = sessionTestDS.CheckToken(tk)
+	is.Equal(err, datastore.ErrTokenRevoked) // access token should be revoked
+	_, _, err = sessionTestDS.RotateRefreshToken(rt, time.Hour)
+	is.Equal(err, datastore.ErrRefreshTokenInvalid) // refresh token should be revoked
+}
+
+func testEndSessions(t *testing.T) {
+	is := is.New(t)
+	u := newTestUser(t, sessionTestDS)
+	tk, err := datastore.NewToken(issuer, signingKey, ttlHours).
+		CustomClaims(map[string]interface{}{"id": u.ID.Hex()}).
+		SetTimes(time.Now().Add(-time.Minute)).
+		Encode()
+	is.NoErr(err) // error issuing token
+	rt, err := u.RefreshToken(time.Hour)
+	is.NoErr(err) // error issuing refresh token
+
+	err = u.SavePartial(bson.M{"password": "newPassword"})
+	is.NoErr(err) // error changing password
+
+	_, err = sessionTestDS.CheckToken(tk)
+	is.Equal(err, datastore.ErrTokenRevoked) // token issued before the password change should be rejected
+	_, _, err = sessionTestDS.RotateRefreshToken(rt, time.Hour)
+	is.Equal(err, datastore.ErrRefreshTokenInvalid) // refresh token should be revoked
+
+	tk, err = u.Token(issuer, signingKey, ttlHours)
+	is.NoErr(err) // error issuing token
+	_, err = sessionTestDS.CheckToken(tk)
+	is.NoErr(err) // token issued after the password change should be valid
+}
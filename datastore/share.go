@@ -0,0 +1,318 @@
+package datastore
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// MaxShareEmails is the most colleagues a search can be shared with at a time
+const MaxShareEmails = 10
+
+// ErrShareOwner is returned when a user subscribes to a share of their own search
+var ErrShareOwner = errors.New("cannot subscribe to your own search")
+
+// ErrSearchLinked is returned when changing a search that is linked to a share, which must be forked first
+var ErrSearchLinked = errors.New("search is linked to a shared search and must be forked to change it")
+
+// Share publishes one of the owner's saved searches. The id is a random token, so a share with no emails works as
+// a link that anyone with the id can open. A share with emails can only be opened by users with one of them.
+// Subscribers are the users with a linked copy of the search, which is updated when the owner updates theirs.
+// Seq is a time-ordered id that keeps shares made in the same millisecond in order, as the id is random.
+type Share struct {
+	ID          string          `json:"id" bson:"_id"`
+	OwnerID     bson.ObjectId   `json:"ownerId" bson:"ownerId"`
+	SearchID    bson.ObjectId   `json:"searchId" bson:"searchId"`
+	Emails      []string        `json:"emails" bson:"emails"`
+	Subscribers []bson.ObjectId `json:"subscribers" bson:"subscribers"`
+	Created     time.Time       `json:"created" bson:"created"`
+	Seq         bson.ObjectId   `json:"-" bson:"seq"`
+}
+
+// SearchLink is set on a search that is a linked copy of a shared search
+type SearchLink struct {
+	ShareID string        `json:"shareId" bson:"shareId"`
+	OwnerID bson.ObjectId `json:"ownerId" bson:"ownerId"`
+}
+
+// IsLink returns true if the share is a link rather than to named users
+func (sh Share) IsLink() bool {
+	return len(sh.Emails) == 0
+}
+
+// canOpen returns true if the user is the owner, or the share is a link or to the user's email
+func (sh Share) canOpen(u *User) bool {
+	if sh.OwnerID == u.ID || sh.IsLink() {
+		return true
+	}
+	for _, e := range sh.Emails {
+		if strings.EqualFold(e, u.Email) {
+			return true
+		}
+	}
+	return false
+}
+
+// newShareID returns a random id for a share, which is hard to guess as it is all that is needed to open a link
+func newShareID() (string, error) {
+	b := make([]byte, 18)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// ShareSearch shares the user's search with the colleagues with the emails, or as a link if there are none, and
+// returns the new share. Linked copies of a search cannot be shared again.
+func (u *User) ShareSearch(searchID string, emails []string) (Share, error) {
+	sh, err := u.NewShare(searchID, emails)
+	if err != nil {
+		return sh, err
+	}
+	return sh, u.AddShare(sh)
+}
+
+// NewShare checks the search and the emails for ShareSearch, and returns the share without saving it. This lets the
+// caller check anything else, eg a rate limit, before the share is saved with AddShare.
+func (u *User) NewShare(searchID string, emails []string) (Share, error) {
+	s, err := u.SearchByID(searchID)
+	if err != nil {
+		return Share{}, err
+	}
+	if s.Link != nil {
+		return Share{}, ErrSearchLinked
+	}
+	emails = tidyLowerList(emails)
+	if len(emails) > MaxShareEmails {
+		return Share{}, &SearchError{fmt.Sprintf("a search can be shared with up to %d emails at a time", MaxShareEmails)}
+	}
+	for _, e := range emails {
+		if !strings.Contains(e, "@") {
+			return Share{}, &SearchError{"not a valid email: " + e}
+		}
+	}
+
+	id, err := newShareID()
+	if err != nil {
+		return Share{}, err
+	}
+	sh := Share{
+		ID:       id,
+		OwnerID:  u.ID,
+		SearchID: s.ID,
+		Emails:   emails,
+		Created:  u.ds.now(),
+		Seq:      bson.NewObjectId(),
+	}
+	return sh, nil
+}
+
+// AddShare saves a share returned by NewShare
+func (u *User) AddShare(sh Share) error {
+	if sh.OwnerID != u.ID {
+		return ErrNotFound
+	}
+	return u.ds.Shares.Save(sh)
+}
+
+// SearchShares returns the shares of the user's search, oldest first
+func (u *User) SearchShares(searchID string) ([]Share, error) {
+	s, err := u.SearchByID(searchID)
+	if err != nil {
+		return nil, err
+	}
+	return u.ds.Shares.BySearchID(s.ID)
+}
+
+// RevokeShare deletes a share of the user's search, so it can no longer be opened. The copies of subscribers are
+// unlinked, and kept as their own searches that no longer follow the owner's.
+func (u *User) RevokeShare(searchID, shareID string) error {
+	s, err := u.SearchByID(searchID)
+	if err != nil {
+		return err
+	}
+	sh, err := u.ds.Shares.ByID(shareID)
+	if err != nil {
+		return err
+	}
+	if sh.OwnerID != u.ID || sh.SearchID != s.ID {
+		return ErrNotFound
+	}
+	return u.ds.revokeShare(sh)
+}
+
+// revokeShare unlinks the copies of the subscribers and deletes the share
+func (ds *Datastore) revokeShare(sh Share) error {
+	for _, id := range sh.Subscribers {
+		sub, err := ds.Users.ByID(id)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, s := range sub.Searches {
+			if s.Link != nil && s.Link.ShareID == sh.ID {
+				s.Link = nil
+				err = ds.Users.UpdateSearch(id, s)
+				if err != nil && err != ErrNotFound {
+					return err
+				}
+			}
+		}
+	}
+	return ds.Shares.Delete(sh.ID)
+}
+
+// revokeShares revokes every share of the owner's search, or all of the owner's shares if searchID is empty
+func (ds *Datastore) revokeShares(ownerID, searchID bson.ObjectId) error {
+	xs, err := ds.Shares.ByOwnerID(ownerID)
+	if err != nil {
+		return err
+	}
+	for _, sh := range xs {
+		if searchID != "" && sh.SearchID != searchID {
+			continue
+		}
+		err = ds.revokeShare(sh)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SharedSearch returns the share with the id, and the owner's search as it is now, if the user can open it.
+// Otherwise, or if it has been revoked, it returns ErrNotFound.
+func (u *User) SharedSearch(shareID string) (Share, Search, error) {
+	sh, err := u.ds.Shares.ByID(shareID)
+	if err != nil {
+		return Share{}, Search{}, err
+	}
+	if !sh.canOpen(u) {
+		return Share{}, Search{}, ErrNotFound
+	}
+	owner, err := u.ds.UserByID(sh.OwnerID.Hex())
+	if err != nil {
+		return Share{}, Search{}, err
+	}
+	s, err := owner.SearchByID(sh.SearchID.Hex())
+	if err != nil {
+		return Share{}, Search{}, err
+	}
+	return sh, s, nil
+}
+
+// SharedWithMe returns the shares to the user's email, oldest first
+func (u *User) SharedWithMe() ([]Share, error) {
+	return u.ds.Shares.ByEmail(strings.ToLower(u.Email))
+}
+
+// Subscribe adds a linked copy of the shared search to the user's searches, and returns it. The copy has the same
+// name, query and filters as the owner's, and its own id and run state. It returns ErrSearchExists if the user
+// already has a search with the same query.
+func (u *User) Subscribe(shareID string) (Search, error) {
+	sh, owned, err := u.SharedSearch(shareID)
+	if err != nil {
+		return Search{}, err
+	}
+	if sh.OwnerID == u.ID {
+		return Search{}, ErrShareOwner
+	}
+
+	s := Search{
+		Name:       owned.Name,
+		Query:      owned.Query,
+		Categories: owned.Categories,
+		Journals:   owned.Journals,
+		From:       owned.From,
+		To:         owned.To,
+	}
+	s, err = u.addSearch(s, &SearchLink{ShareID: sh.ID, OwnerID: sh.OwnerID})
+	if err != nil {
+		return s, err
+	}
+	return s, u.ds.Shares.AddSubscriber(sh.ID, u.ID)
+}
+
+// ForkSearch unlinks the user's copy of a shared search, so that it no longer follows the owner's and can be
+// changed. It returns a SearchError if the search is not a linked copy.
+func (u *User) ForkSearch(searchID string) (Search, error) {
+	s, err := u.SearchByID(searchID)
+	if err != nil {
+		return s, err
+	}
+	if s.Link == nil {
+		return s, &SearchError{"search is not a copy of a shared search"}
+	}
+	shareID := s.Link.ShareID
+	s.Link = nil
+	s.Updated = u.ds.now()
+	err = u.replaceSearch(s)
+	if err != nil {
+		return s, err
+	}
+	err = u.ds.Shares.RemoveSubscriber(shareID, u.ID)
+	if err == ErrNotFound {
+		err = nil
+	}
+	return s, err
+}
+
+// syncShares copies the owner's search to the linked copies of its subscribers. The run state of each copy is
+// kept, and subscribers that no longer have a copy are removed from the share.
+func (ds *Datastore) syncShares(ownerID bson.ObjectId, s Search) error {
+	xs, err := ds.Shares.BySearchID(s.ID)
+	if err != nil {
+		return err
+	}
+	for _, sh := range xs {
+		if sh.OwnerID != ownerID {
+			continue
+		}
+		for _, id := range sh.Subscribers {
+			copied, err := ds.syncCopy(id, sh.ID, s)
+			if err != nil {
+				return err
+			}
+			if !copied {
+				err = ds.Shares.RemoveSubscriber(sh.ID, id)
+				if err != nil && err != ErrNotFound {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// syncCopy updates the subscriber's linked copy of the search, and returns false if they do not have one
+func (ds *Datastore) syncCopy(userID bson.ObjectId, shareID string, s Search) (bool, error) {
+	sub, err := ds.Users.ByID(userID)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, c := range sub.Searches {
+		if c.Link == nil || c.Link.ShareID != shareID {
+			continue
+		}
+		c.Name = s.Name
+		c.Query = s.Query
+		c.Categories = s.Categories
+		c.Journals = s.Journals
+		c.From = s.From
+		c.To = s.To
+		c.Updated = s.Updated
+		return true, ds.Users.UpdateSearch(userID, c)
+	}
+	return false, nil
+}
@@ -0,0 +1,303 @@
+package datastore_test
+
+import (
+	"fmt"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/mikedonnici/rtcl-api/datastore"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var shareTestDS *datastore.Datastore
+
+// The owner of the shared searches is br, and the colleagues oj and dh
+const (
+	shareOwner = "5b3bcd72463cd6029e04de18"
+	shareOJ    = "5b3bcd72463cd6029e04de1a"
+	shareDH    = "5b3bcd72463cd6029e04de1c"
+)
+
+func TestShare(t *testing.T) {
+
+	backends, err := testBackends()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	for _, b := range backends {
+		shareTestDS = b.ds
+		t.Run(b.name, func(t *testing.T) {
+			t.Run("testShareSearch", testShareSearch)
+			t.Run("testSharedSearch", testSharedSearch)
+			t.Run("testSubscribe", testSubscribe)
+			t.Run("testSubscriptionFollowsOwner", testSubscriptionFollowsOwner)
+			t.Run("testForkSearch", testForkSearch)
+			t.Run("testRevokeShare", testRevokeShare)
+			t.Run("testRemoveSharedSearch", testRemoveSharedSearch)
+		})
+		b.cleanup()
+	}
+}
+
+// shareUser fetches the user with the id
+func shareUser(t *testing.T, id string) *datastore.User {
+	u, err := shareTestDS.UserByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// ownerSearch adds a search with the query for the owner
+func ownerSearch(t *testing.T, q string) datastore.Search {
+	s, err := shareUser(t, shareOwner).AddSearch(datastore.Search{Query: q, Categories: []string{"cardiology"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func testShareSearch(t *testing.T) {
+	is := is.New(t)
+	s := ownerSearch(t, "quadricuspid aortic valve")
+	owner := shareUser(t, shareOwner)
+
+	// the clock is moved on between shares, so their order does not depend on timing
+	now := time.Now().UTC()
+	shareTestDS.Now = func() time.Time { return now }
+	defer func() { shareTestDS.Now = nil }()
+
+	link, err := owner.ShareSearch(s.ID.Hex(), nil)
+	is.NoErr(err)
+	is.True(len(link.ID) >= 24) // expected a long random id
+	is.True(link.IsLink())
+	is.Equal(link.SearchID, s.ID)
+
+	now = now.Add(time.Minute)
+	named, err := owner.ShareSearch(s.ID.Hex(), []string{" DH@rtcl.io ", "dh@rtcl.io", ""})
+	is.NoErr(err)
+	is.True(!named.IsLink())
+	is.Equal(named.Emails, []string{"dh@rtcl.io"}) // expected emails to be tidied
+	is.True(named.ID != link.ID)
+
+	var many []string
+	for i := 0; i <= datastore.MaxShareEmails; i++ {
+		many = append(many, fmt.Sprintf("c%d@rtcl.io", i))
+	}
+	_, err = owner.ShareSearch(s.ID.Hex(), many)
+	if _, ok := err.(*datastore.SearchError); !ok {
+		t.Errorf("expected a SearchError for too many emails, got %v", err)
+	}
+	_, err = owner.ShareSearch(s.ID.Hex(), []string{"dh"})
+	if _, ok := err.(*datastore.SearchError); !ok {
+		t.Errorf("expected a SearchError, got %v", err)
+	}
+	_, err = owner.ShareSearch("5b3bcd72463cd6029e04de00", nil)
+	is.Equal(err, datastore.ErrNotFound)
+
+	xs, err := owner.SearchShares(s.ID.Hex())
+	is.NoErr(err)
+	is.Equal(len(xs), 2)
+	is.Equal(xs[0].ID, link.ID) // expected the oldest first
+
+	// a new share is only saved once it is added, by its owner
+	s2 := ownerSearch(t, "bicuspid aortic valve")
+	owner = shareUser(t, shareOwner)
+	sh, err := owner.NewShare(s2.ID.Hex(), nil)
+	is.NoErr(err)
+	xs, err = owner.SearchShares(s2.ID.Hex())
+	is.NoErr(err)
+	is.Equal(len(xs), 0) // expected the new share not to be saved
+	is.Equal(shareUser(t, shareOJ).AddShare(sh), datastore.ErrNotFound)
+	is.NoErr(owner.AddShare(sh))
+	xs, err = owner.SearchShares(s2.ID.Hex())
+	is.NoErr(err)
+	is.Equal(len(xs), 1)
+}
+
+func testSharedSearch(t *testing.T) {
+	is := is.New(t)
+	owner := shareUser(t, shareOwner)
+	s, err := owner.SearchByID(ownerSearchID(t, "quadricuspid aortic valve"))
+	is.NoErr(err)
+	xs, err := owner.SearchShares(s.ID.Hex())
+	is.NoErr(err)
+	link, named := xs[0], xs[1]
+
+	_, got, err := shareUser(t, shareOJ).SharedSearch(link.ID)
+	is.NoErr(err) // anyone can open a link
+	is.Equal(got.Query, s.Query)
+	_, got, err = shareUser(t, shareDH).SharedSearch(named.ID)
+	is.NoErr(err) // expected the named colleague to open the share
+	is.Equal(got.ID, s.ID)
+	_, _, err = shareUser(t, shareOJ).SharedSearch(named.ID)
+	is.Equal(err, datastore.ErrNotFound) // expected other users not to open a named share
+	_, _, err = shareUser(t, shareOJ).SharedSearch("nope")
+	is.Equal(err, datastore.ErrNotFound)
+
+	mine, err := shareUser(t, shareDH).SharedWithMe()
+	is.NoErr(err)
+	is.Equal(len(mine), 1)
+	is.Equal(mine[0].ID, named.ID)
+	mine, err = shareUser(t, shareOJ).SharedWithMe()
+	is.NoErr(err)
+	is.Equal(len(mine), 0) // expected link shares not to be listed
+}
+
+// ownerSearchID returns the id of the owner's search with the query
+func ownerSearchID(t *testing.T, q string) string {
+	for _, s := range shareUser(t, shareOwner).Searches {
+		if s.Query == q {
+			return s.ID.Hex()
+		}
+	}
+	t.Fatalf("owner has no search %q", q)
+	return ""
+}
+
+func testSubscribe(t *testing.T) {
+	is := is.New(t)
+	owner := shareUser(t, shareOwner)
+	xs, err := owner.SearchShares(ownerSearchID(t, "quadricuspid aortic valve"))
+	is.NoErr(err)
+	named := xs[1]
+
+	dh := shareUser(t, shareDH)
+	s, err := dh.Subscribe(named.ID)
+	is.NoErr(err)
+	is.Equal(s.Query, "quadricuspid aortic valve")
+	is.Equal(s.Categories, []string{"cardiology"})
+	is.True(s.ID.Hex() != ownerSearchID(t, s.Query)) // expected a copy with its own id
+	is.Equal(s.Link, &datastore.SearchLink{ShareID: named.ID, OwnerID: owner.ID})
+
+	sh, _, err := dh.SharedSearch(named.ID)
+	is.NoErr(err)
+	is.Equal(sh.Subscribers, []bson.ObjectId{dh.ID})
+
+	_, err = shareUser(t, shareDH).Subscribe(named.ID)
+	is.Equal(err, datastore.ErrSearchExists) // expected the same query not to be added twice
+	_, err = owner.Subscribe(named.ID)
+	is.Equal(err, datastore.ErrShareOwner)
+	_, err = shareUser(t, shareOJ).Subscribe(named.ID)
+	is.Equal(err, datastore.ErrNotFound)
+
+	s.Name = "Mine now"
+	_, err = shareUser(t, shareDH).UpdateSearch(s)
+	is.Equal(err, datastore.ErrSearchLinked) // expected a linked copy not to be changed
+	_, err = shareUser(t, shareDH).ShareSearch(s.ID.Hex(), nil)
+	is.Equal(err, datastore.ErrSearchLinked) // expected a linked copy not to be shared again
+}
+
+// linkedCopy returns the user's copy of the shared search
+func linkedCopy(t *testing.T, userID, shareID string) (datastore.Search, bool) {
+	for _, s := range shareUser(t, userID).Searches {
+		if s.Link != nil && s.Link.ShareID == shareID {
+			return s, true
+		}
+	}
+	return datastore.Search{}, false
+}
+
+func testSubscriptionFollowsOwner(t *testing.T) {
+	is := is.New(t)
+	owner := shareUser(t, shareOwner)
+	id := ownerSearchID(t, "quadricuspid aortic valve")
+	xs, err := owner.SearchShares(id)
+	is.NoErr(err)
+	named := xs[1]
+
+	c, ok := linkedCopy(t, shareDH, named.ID)
+	is.True(ok)
+	is.NoErr(shareUser(t, shareDH).RecordSearchRun(c.ID.Hex(), "30180001"))
+
+	s, err := owner.SearchByID(id)
+	is.NoErr(err)
+	s.Name = "QAV"
+	s.Query = "quadricuspid aortic valve OR QAV"
+	s.Journals = []string{"Circulation"}
+	_, err = owner.UpdateSearch(s)
+	is.NoErr(err)
+
+	c, ok = linkedCopy(t, shareDH, named.ID)
+	is.True(ok)
+	is.Equal(c.Name, "QAV") // expected the copy to follow the owner's update
+	is.Equal(c.Query, "quadricuspid aortic valve OR QAV")
+	is.Equal(c.Journals, []string{"Circulation"})
+	is.Equal(c.LastPMID, "30180001") // expected the copy to keep its run state
+}
+
+func testForkSearch(t *testing.T) {
+	is := is.New(t)
+	owner := shareUser(t, shareOwner)
+	id := ownerSearchID(t, "quadricuspid aortic valve OR QAV")
+	xs, err := owner.SearchShares(id)
+	is.NoErr(err)
+	link := xs[0]
+
+	oj := shareUser(t, shareOJ)
+	c, err := oj.Subscribe(link.ID)
+	is.NoErr(err)
+	f, err := oj.ForkSearch(c.ID.Hex())
+	is.NoErr(err)
+	is.True(f.Link == nil)
+	is.Equal(f.ID, c.ID)
+
+	f.Name = "My QAV"
+	_, err = shareUser(t, shareOJ).UpdateSearch(f)
+	is.NoErr(err) // expected a fork to be changed
+
+	s, err := owner.SearchByID(id)
+	is.NoErr(err)
+	s.Name = "Valves"
+	_, err = owner.UpdateSearch(s)
+	is.NoErr(err)
+	f, err = shareUser(t, shareOJ).SearchByID(c.ID.Hex())
+	is.NoErr(err)
+	is.Equal(f.Name, "My QAV") // expected a fork not to follow the owner
+
+	sh, _, err := owner.SharedSearch(link.ID)
+	is.NoErr(err)
+	is.Equal(len(sh.Subscribers), 0) // expected the fork to unsubscribe
+
+	_, err = shareUser(t, shareOJ).ForkSearch(c.ID.Hex())
+	if _, ok := err.(*datastore.SearchError); !ok {
+		t.Errorf("expected a SearchError, got %v", err)
+	}
+	is.NoErr(shareUser(t, shareOJ).RemoveSearch(c.ID.Hex()))
+}
+
+func testRevokeShare(t *testing.T) {
+	is := is.New(t)
+	owner := shareUser(t, shareOwner)
+	id := ownerSearchID(t, "quadricuspid aortic valve OR QAV")
+	xs, err := owner.SearchShares(id)
+	is.NoErr(err)
+	named := xs[1]
+
+	is.Equal(shareUser(t, shareDH).RevokeShare(id, named.ID), datastore.ErrNotFound) // only the owner can revoke
+	is.NoErr(owner.RevokeShare(id, named.ID))
+
+	_, _, err = shareUser(t, shareDH).SharedSearch(named.ID)
+	is.Equal(err, datastore.ErrNotFound) // expected a revoked share not to open
+	_, ok := linkedCopy(t, shareDH, named.ID)
+	is.True(!ok) // expected the copy to be unlinked
+	dh := shareUser(t, shareDH)
+	is.True(dh.SearchExists("quadricuspid aortic valve OR QAV")) // expected the copy to be kept
+	is.Equal(owner.RevokeShare(id, named.ID), datastore.ErrNotFound)
+}
+
+func testRemoveSharedSearch(t *testing.T) {
+	is := is.New(t)
+	owner := shareUser(t, shareOwner)
+	id := ownerSearchID(t, "quadricuspid aortic valve OR QAV")
+	xs, err := owner.SearchShares(id)
+	is.NoErr(err)
+	is.Equal(len(xs), 1)
+
+	is.NoErr(owner.RemoveSearch(id))
+	_, _, err = shareUser(t, shareOJ).SharedSearch(xs[0].ID)
+	is.Equal(err, datastore.ErrNotFound) // expected the shares of a removed search to be revoked
+}
@@ -2,11 +2,11 @@ package datastore
 
 import (
 	"crypto/sha256"
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"os"
 	"reflect"
-	"strconv"
 	"strings"
 	"time"
 
@@ -26,57 +26,94 @@ type User struct {
 	FirstName    string        `json:"firstName" bson:"firstName"`
 	LastName     string        `json:"lastName" bson:"lastName"`
 	Email        string        `json:"email" bson:"email"`
+	PendingEmail string        `json:"pendingEmail" bson:"pendingEmail"` // new email waiting to be confirmed
 	Password     string        `json:"password" bson:"password"`
 	Locked       bool          `json:"locked" bson:"locked"`
+	Role         string        `json:"role" bson:"role"`
+	Disabled     bool          `json:"disabled" bson:"disabled"`
+	DeleteAt     time.Time     `json:"deleteAt" bson:"deleteAt"` // zero unless the user has asked to be deleted
 	Categories   []string      `json:"categories" bson:"categories"`
 	Searches     []Search      `json:"searches" bson:"searches"`
-	Notification time.Time     `json:"notification" bson:"notification"`
+	Notification time.Time     `json:"notification" bson:"notification"` // when the next notification is due
+	Schedule     Schedule      `json:"schedule" bson:"schedule"`
+	FailedLogins int           `json:"-" bson:"failedLogins"`
+	LoginLockout time.Time     `json:"-" bson:"loginLockout"`
+
+	// TokensValidAfter is set by EndSessions, access tokens issued before it are rejected
+	TokensValidAfter time.Time `json:"-" bson:"tokensValidAfter"`
+
+	// Two-factor auth, see mfa.go. The TOTP secret is set by EnrollTOTP but is not required to log in until
+	// ConfirmTOTP sets MFAEnabled.
+	MFAEnabled    bool     `json:"mfaEnabled" bson:"mfaEnabled"`
+	TOTPSecret    string   `json:"-" bson:"totpSecret"`
+	TOTPLastStep  int64    `json:"-" bson:"totpLastStep"`  // the last code used, so it cannot be replayed
+	RecoveryCodes []string `json:"-" bson:"recoveryCodes"` // hashes of the unused recovery codes
 }
 
-// Search represents stored User search
-type Search struct {
-	Created time.Time `json:"created" bson:"created"`
-	Query   string    `json:"query" bson:"query"`
-}
+// ErrUserExists is returned by Save for a user that already has an id
+var ErrUserExists = errors.New("user already exists")
 
-// Save adds / updates a user record
+// Save adds a new user, who is locked until they confirm their email. It returns ErrUserExists if the user has an id,
+// as an existing user is only changed through SavePartial, SetRole, SetPassword and the other methods that change one
+// thing about a user.
 func (u *User) Save() error {
 
+	if u.ID != "" {
+		return ErrUserExists
+	}
+
 	err := u.checkFields()
 	if err != nil {
 		return err
 	}
 
-	checkUsr := User{
-		ds: u.ds, // attach the datastore
+	if u.ds.UserEmailExists(u.Email) {
+		return ErrEmailExists
 	}
 
-	// This user should either not exist, or be the same user for which data is being saved
-	err = checkUsr.ByEmail(u.Email)
-	if err == nil { // found a user record..
-		if checkUsr.ID != u.ID { // email exists for a different user
-			return errors.New("Email already exists for a different user id")
-		}
+	u.ID = bson.NewObjectId()
+	u.Locked = true
+	u.Role = RoleUser // roles can only be changed with SetRole
+	if u.Password == "" {
+		u.Password = impossiblePassword()
 	}
+	err = u.SetPassword(u.Password)
+	if err != nil {
+		return err
+	}
+
+	return u.ds.Users.Save(*u)
+}
+
+// update saves the changes to an existing user
+func (u *User) update() error {
 
-	// New user
 	if !u.ID.Valid() {
+		return errors.New("object id is not valid")
+	}
 
-		if u.ds.UserEmailExists(u.Email) {
-			return errors.New("User with that email already exists")
-		}
+	err := u.checkFields()
+	if err != nil {
+		return err
+	}
 
-		u.ID = bson.NewObjectId()
-		u.Locked = true
-		if u.Password == "" {
-			u.Password = impossiblePassword()
-		}
-		u.Password = u.hashPass(u.Password)
+	checkUsr := User{
+		ds: u.ds, // attach the datastore
+	}
+
+	// The email should not belong to another user
+	err = checkUsr.ByEmail(u.Email)
+	if err == nil && checkUsr.ID != u.ID {
+		return ErrEmailExists
 	}
 
-	q := bson.M{"_id": u.ID}
-	_, err = u.ds.usersCollection().Upsert(q, u)
-	return err
+	return u.ds.Users.Save(*u)
+}
+
+// Confirm unlocks a new user once they have confirmed their email, and saves the user
+func (u *User) Confirm() error {
+	u.Locked = false
+	return u.update()
 }
 
 // SavePartial updates user fields in update arg
@@ -92,23 +129,45 @@ func (u *User) SavePartial(update bson.M) error {
 		u.LastName = lastName.(string)
 	}
 
+	// a new email is held as pending until it is confirmed, see RequestEmailChange
 	email, ok := update["email"]
 	if ok {
-		u.Email = email.(string)
+		err := u.RequestEmailChange(email.(string))
+		if err != nil {
+			return err
+		}
 	}
 
 	// password field should not be an empty string
 	password, ok := update["password"]
-	if ok && len(password.(string)) > 0 {
-		u.Password = u.hashPass(password.(string))
+	passwordChanged := ok && len(password.(string)) > 0
+	if passwordChanged {
+		err := u.SetPassword(password.(string))
+		if err != nil {
+			return err
+		}
 	}
 
+	// categories are stored in lower case so that they match the articles, see SaveArticles
 	categories, ok := update["categories"]
 	if ok {
 		u.Categories = []string{}
 		cats := categories.([]interface{})
 		for _, v := range cats {
-			u.Categories = append(u.Categories, v.(string))
+			u.Categories = append(u.Categories, strings.ToLower(strings.TrimSpace(v.(string))))
+		}
+	}
+
+	// a schedule sets the next notification date, which a notification date in the same update overrides
+	schedule, ok := update["schedule"]
+	if ok {
+		sc, err := scheduleFromUpdate(schedule)
+		if err != nil {
+			return err
+		}
+		err = u.SetSchedule(sc)
+		if err != nil {
+			return err
 		}
 	}
 
@@ -121,7 +180,16 @@ func (u *User) SavePartial(update bson.M) error {
 		u.Notification = t
 	}
 
-	return u.Save()
+	err := u.update()
+	if err != nil {
+		return err
+	}
+
+	// a new password ends any sessions that may have been started by someone who knew the old one
+	if passwordChanged {
+		return u.EndSessions()
+	}
+	return nil
 }
 
 // ByID validates the id string, fetches a user record by id (_id), and populates the User fields.
@@ -133,113 +201,84 @@ func (u *User) ByID(id string) error {
 	}
 
 	ds := u.ds // detach the datastore
-	q := bson.M{"_id": bson.ObjectIdHex(id)}
-	err := u.ds.usersCollection().Find(q).One(&u) // datastore is nil now!
-	u.ds = ds                                     // re-attach the datastore
-	return err
+	x, err := ds.Users.ByID(bson.ObjectIdHex(id))
+	if err != nil {
+		return err
+	}
+	*u = x    // datastore is nil now!
+	u.ds = ds // re-attach the datastore
+	return u.saveMigrated()
 }
 
 // ByEmail looks up a user record by email and populates User fields.
 func (u *User) ByEmail(email string) error {
 	ds := u.ds
-	q := bson.M{"email": email}
-	err := u.ds.usersCollection().Find(q).One(&u)
+	x, err := ds.Users.ByEmail(email)
+	if err != nil {
+		return err
+	}
+	*u = x
 	u.ds = ds // re-attach datastore
-	return err
+	return u.saveMigrated()
 }
 
-// KeyGen generates an access key for a user by hashing a few string values from the user record along
-// with a couple of UTC date strings. This allows the same hash hash to be validated until midnight on the same day.
-func (u *User) KeyGen() string {
-	s := strings.ToLower(u.Email) + u.Password + time.Now().UTC().Month().String() + strconv.Itoa(time.Now().UTC().Day())
-	h := sha256.New()
-	h.Write([]byte(s))
-	return fmt.Sprintf("%x", h.Sum(nil))
+// saveMigrated brings a user saved by an older version up to date, see migrateSearches
+func (u *User) saveMigrated() error {
+	if u.migrateSearches() {
+		return u.ds.Users.Save(*u)
+	}
+	return nil
 }
 
-// Token returns a valid JWT for the user
+// Token returns a valid JWT for the user, signed with HS256 and the shared secret signingKey
 func (u *User) Token(issuer, signingKey string, ttl int) (Token, error) {
+	return u.SignedToken(issuer, "", HMACKey(signingKey), ttl)
+}
+
+// SignedToken returns a valid JWT for the user, signed with the key. The audience is optional.
+func (u *User) SignedToken(issuer, audience string, key SigningKey, ttl int) (Token, error) {
 	c := map[string]interface{}{
 		"id":   u.ID.Hex(),
 		"name": u.FirstName + " " + u.LastName,
-		"role": "user",
+		"role": u.role(),
 	}
-	return NewToken(issuer, signingKey, ttl).CustomClaims(c).Encode()
+	return NewSignedToken(issuer, key, ttl).CustomClaims(c).Audience(audience).Encode()
 }
 
-// SaveSearch saves a search (one or more search terms) for a user. The mongo $addToSet will not save a
-// duplicate value however as the search in an object it will have a new time stamp so need to check for
-// duplicate query strings.
-func (u *User) SaveSearch(query string) error {
-
-	if u.SearchExists(query) {
-		return errors.New("exact search query already exists for this user")
-	}
+// IncrementNotification increments the notification date by the specified number of days.
+func (u *User) IncrementNotification(days int) error {
+	u.Notification = u.Notification.AddDate(0, 0, days)
+	return u.update()
+}
 
-	q := bson.M{"_id": u.ID}
-	s := Search{
-		Created: time.Now(),
-		Query:   query,
+// CheckPassword verifies the clear text password against the stored hash. If the stored hash is in the legacy
+// SHA-256 format, or was created with outdated parameters, needsRehash is true and the caller should store a fresh
+// hash of the password.
+func (u *User) CheckPassword(password string) (match bool, needsRehash bool) {
+	if isLegacyHash(u.Password) {
+		match = subtle.ConstantTimeCompare([]byte(u.legacyHashPass(password)), []byte(u.Password)) == 1
+		return match, match
 	}
-	update := bson.M{"$addToSet": bson.M{"searches": s}}
-	err := u.ds.usersCollection().Update(q, update)
+	match, needsRehash, err := verifyPassword(password, u.Password)
 	if err != nil {
-		return err
+		return false, false
 	}
-	u.Searches = append(u.Searches, s)
-
-	return nil
+	return match, needsRehash
 }
 
-// DeleteSearch deletes the query from the user's search list
-func (u *User) DeleteSearch(query string) error {
-
-	if !u.SearchExists(query) {
-		return errors.New("cannot find the query so unable to delete it")
-	}
-
-	q := bson.M{"_id": u.ID}
-	// $lt used to match any searches sub doc older than 'now' - ie all, that match the query string
-	update := bson.M{"$pull": bson.M{"searches": bson.M{"created": bson.M{"$lt": time.Now()}, "query": query}}}
-	err := u.ds.usersCollection().Update(q, update)
+// SetPassword hashes the clear text password and stores it in the User value. It does not save the user record.
+func (u *User) SetPassword(password string) error {
+	h, err := hashPassword(password)
 	if err != nil {
 		return err
 	}
-
-	var updatedList []Search
-	for _, s := range u.Searches {
-		if s.Query != query {
-			updatedList = append(updatedList, s)
-		}
-	}
-	u.Searches = updatedList
-
+	u.Password = h
 	return nil
 }
 
-// SearchExists returns true if the query string already exists in the user's list of searches
-func (u *User) SearchExists(query string) bool {
-	for _, s := range u.Searches {
-		if matchString(s.Query, query) {
-			return true
-		}
-	}
-	return false
-}
-
-// SavedSearches retrieves the set of Searches for a user
-func (u *User) SavedSearches() ([]Search, error) {
-	return u.Searches, nil
-}
-
-// IncrementNotification increments the notification date by the specified number of days.
-func (u *User) IncrementNotification(days int) error {
-	u.Notification = u.Notification.AddDate(0,0, days)
-	return u.Save()
-}
-
-// hashPass returns a hashed Password from the users email and the clear text Password
-func (u *User) hashPass(password string) string {
+// legacyHashPass returns the original SHA-256 password hash, from the user id and the clear text password. It is
+// only used to verify passwords that have not been upgraded to argon2id.
+func (u *User) legacyHashPass(password string) string {
 	salt := hash(u.ID.Hex() + os.Getenv("PASSWORD_SALT")) // empty if not present
 	return hash(password + salt)
 }
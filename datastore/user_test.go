@@ -3,66 +3,61 @@ package datastore_test
 import (
 	"gopkg.in/mgo.v2/bson"
 	"log"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/matryer/is"
 	"github.com/mikedonnici/rtcl-api/datastore"
-	"github.com/mikedonnici/rtcl-api/datastore/mongo"
-	"github.com/mikedonnici/rtcl-api/testdata"
-	"gopkg.in/mgo.v2"
 )
 
 const testIssuer = "TestTokenIssuer"
 const testSigningKey = "testTokenSigningKey"
 const testTTLHours = 4
 
-var userTestDB = testdata.New()
-var userTestDS = datastore.New()
+var userTestDS *datastore.Datastore
 
 func TestUser(t *testing.T) {
 
-	var err error
-
-	err = userTestDB.SetupMongoDB()
-	if err != nil {
-		log.Fatalln(err)
-	}
-	defer cleanupUserTest()
-
-	userTestDS.Mongo, err = mongo.NewConnection(testdata.MongoDSN, userTestDB.DBName, "test")
+	backends, err := testBackends()
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	t.Run("user", func(t *testing.T) {
-		t.Run("testUserByID", testUserByID)
-		t.Run("testUserByIDInvalidHex", testUserByIDInvalidHex)
-		t.Run("testUserByEmail", testUserByEmail)
-		t.Run("testUserNotFoundByID", testUserNotFoundByID)
-		t.Run("testUserNotFoundByEmail", testUserNotFoundByEmail)
-		t.Run("testUserExists", testUserExists)
-		t.Run("testUserAdd", testUserAdd)
-		t.Run("testUserAddMissingFields", testUserAddMissingFields)
-		t.Run("testUserAddEmailExists", testUserAddEmailExists)
-		t.Run("testUserSave", testUserSave)
-		t.Run("testUserSavePartial", testUserSavePartial)
-		t.Run("testUserSaveEmailExists", testUserSaveEmailExists)
-		t.Run("testUserKeyGen", testUserKeyGen)
-		t.Run("testUserAuth", testUserAuth)
-		t.Run("testUserToken", testUserToken)
-		t.Run("testUserSaveSearch", testUserSaveSearch)
-		t.Run("testUserDeleteSearch", testUserDeleteSearch)
-		t.Run("testUserSavedSearches", testUserSavedSearches)
-		t.Run("testUsersDueNotification", testUsersDueNotification)
-		t.Run("testUserIncrementNotification", testUserIncrementNotification)
-	})
-}
-
-func cleanupUserTest() {
-	err := userTestDB.TearDownMongoDB()
-	if err != nil {
-		log.Println(err)
+	for _, b := range backends {
+		userTestDS = b.ds
+		t.Run(b.name, func(t *testing.T) {
+			t.Run("testUserByID", testUserByID)
+			t.Run("testUserByIDInvalidHex", testUserByIDInvalidHex)
+			t.Run("testUserByEmail", testUserByEmail)
+			t.Run("testUserNotFoundByID", testUserNotFoundByID)
+			t.Run("testUserNotFoundByEmail", testUserNotFoundByEmail)
+			t.Run("testUserExists", testUserExists)
+			t.Run("testUserAdd", testUserAdd)
+			t.Run("testUserAddMissingFields", testUserAddMissingFields)
+			t.Run("testUserAddEmailExists", testUserAddEmailExists)
+			t.Run("testUserSave", testUserSave)
+			t.Run("testUserSavePartial", testUserSavePartial)
+			t.Run("testUserSaveEmailExists", testUserSaveEmailExists)
+			t.Run("testUserEmailChange", testUserEmailChange)
+			t.Run("testUserAuth", testUserAuth)
+			t.Run("testUserAuthLegacyRehash", testUserAuthLegacyRehash)
+			t.Run("testUserAuthLockout", testUserAuthLockout)
+			t.Run("testUserAuthConcurrentFailures", testUserAuthConcurrentFailures)
+			t.Run("testUserToken", testUserToken)
+			t.Run("testUserSaveSearch", testUserSaveSearch)
+			t.Run("testUserDeleteSearch", testUserDeleteSearch)
+			t.Run("testUserSavedSearches", testUserSavedSearches)
+			t.Run("testUsersDueNotification", testUsersDueNotification)
+			t.Run("testUserIncrementNotification", testUserIncrementNotification)
+			t.Run("testUserRole", testUserRole)
+			t.Run("testUserDisable", testUserDisable)
+			t.Run("testUserList", testUserList)
+			t.Run("testUserDelete", testUserDelete)
+			t.Run("testUserScheduleDeletion", testUserScheduleDeletion)
+		})
+		b.cleanup()
 	}
 }
 
@@ -118,8 +113,8 @@ func testUserNotFoundByID(t *testing.T) {
 
 	for _, c := range cases {
 		_, err := userTestDS.UserByID(c.id)
-		is.True(err != nil)            // expected an error
-		is.Equal(err, mgo.ErrNotFound) // expected 'not found' error
+		is.True(err != nil)                  // expected an error
+		is.Equal(err, datastore.ErrNotFound) // expected 'not found' error
 	}
 }
 
@@ -134,8 +129,8 @@ func testUserNotFoundByEmail(t *testing.T) {
 
 	for _, c := range cases {
 		_, err := userTestDS.UserByEmail(c.email)
-		is.True(err != nil)            // expected an error
-		is.Equal(err, mgo.ErrNotFound) // expected 'not found' error
+		is.True(err != nil)                  // expected an error
+		is.Equal(err, datastore.ErrNotFound) // expected 'not found' error
 	}
 }
 
@@ -163,8 +158,8 @@ func testUserAdd(t *testing.T) {
 	u.Email = "bs@rtcl.io"
 	u.Categories = []string{"cardiology", "physiotherapy"}
 	u.Searches = []datastore.Search{
-		{time.Now(), "search one"},
-		{time.Now(), "search two"},
+		{Created: time.Now(), Query: "search one"},
+		{Created: time.Now(), Query: "search two"},
 	}
 	u.Notification = time.Now().AddDate(0, 0, 7)
 	err := u.Save()
@@ -216,13 +211,22 @@ func testUserSave(t *testing.T) {
 	is.NoErr(err) // error adding user
 
 	u.LastName = "WasSaved"
+	u.MFAEnabled = true
 	err = u.Save()
+	is.Equal(err, datastore.ErrUserExists) // expected an existing user not to be saved
+	u2, err := userTestDS.UserByID(u.ID.Hex())
+	is.NoErr(err)
+	is.Equal(u2.LastName, "Save") // expected the rejected save not to be stored
+	is.True(!u2.MFAEnabled)
+
+	// an existing user is updated with SavePartial
+	err = u2.SavePartial(bson.M{"lastName": "WasSaved"})
 	is.NoErr(err) // error saving user
 
 	// reset and fetch the user to ensure record was updated
-	u2, err := userTestDS.UserByID(u.ID.Hex())
+	u3, err := userTestDS.UserByID(u.ID.Hex())
 	is.NoErr(err)                     // error saving user
-	is.Equal(u2.LastName, u.LastName) // last name should have been saved
+	is.Equal(u3.LastName, "WasSaved") // last name should have been saved
 }
 
 func testUserSavePartial(t *testing.T) {
@@ -239,18 +243,18 @@ func testUserSavePartial(t *testing.T) {
 	// fields to be updated. Note that the list of categories gets decoded as a []interface{}
 	update := bson.M{
 		"lastName": "SavedPartially",
-		"categories": []interface{}{"one", "two"},
-		"notification": "2018-11-02",
+		"categories": []interface{}{"One", " two"},
+		"notification": "2118-11-02",
 	}
 	err = u.SavePartial(update)
 	is.NoErr(err) // error saving user
 
 	// re-fetch the user to ensure record was updated
 	u2, err := userTestDS.UserByID(u.ID.Hex())
-	is.NoErr(err)                           // error fetching user
-	is.Equal(u2.LastName, "SavedPartially") // last name should have been changed
-	is.Equal(len(u2.Categories), 2)         // expected 2 categories after partial save
-	newDate, _ := time.Parse("2006-01-02", "2018-11-02")
+	is.NoErr(err)                                   // error fetching user
+	is.Equal(u2.LastName, "SavedPartially")         // last name should have been changed
+	is.Equal(u2.Categories, []string{"one", "two"}) // expected categories in lower case after partial save
+	newDate, _ := time.Parse("2006-01-02", "2118-11-02")
 	is.Equal(u2.Notification.UTC(), newDate.UTC())
 }
 
@@ -267,19 +271,62 @@ func testUserSaveEmailExists(t *testing.T) {
 	is.NoErr(err) // error adding user
 
 	// change email to one that already exists from the testdata
-	u.FirstName = "Michael"
-	u.LastName = "Smithson"
-	u.Email = "br@rtcl.io" // should clash
-	err = u.Save()
-	is.True(err != nil) // expect error saving a duplicate email
+	err = u.SavePartial(bson.M{"firstName": "Michael", "email": "br@rtcl.io"}) // should clash
+	is.True(err != nil)                                                        // expect error saving a duplicate email
 }
 
-func testUserKeyGen(t *testing.T) {
+// testUserEmailChange tests that a new email is held as pending until it is confirmed with the change-email token
+func testUserEmailChange(t *testing.T) {
 	is := is.New(t)
-	u, err := userTestDS.UserByEmail("dh@rtcl.io")
-	is.NoErr(err) // error fetching user
-	k := u.KeyGen()
-	is.Equal(len(k), 64) // key should be 64 chars long
+
+	u := userTestDS.NewUser()
+	u.FirstName = "Emma"
+	u.LastName = "Change"
+	u.Email = "echange@rtcl.io"
+	is.NoErr(u.Save()) // error adding user
+
+	err := u.SavePartial(bson.M{"email": "br@rtcl.io"})
+	is.Equal(err, datastore.ErrEmailExists) // cannot change to the email of another user
+	err = u.SavePartial(bson.M{"email": "BR@rtcl.io"})
+	is.Equal(err, datastore.ErrEmailExists) // expected the email to be lower case before it is checked
+	for _, e := range []string{"", "echange", "Emma <echange2@rtcl.io>", "<a href=x>echange2@rtcl.io</a>"} {
+		err = u.SavePartial(bson.M{"email": e})
+		is.Equal(err, datastore.ErrEmailInvalid) // expected only a bare address
+	}
+
+	err = u.SavePartial(bson.M{"email": "echange2@rtcl.io"})
+	is.NoErr(err) // error requesting email change
+	u2, err := userTestDS.UserByID(u.ID.Hex())
+	is.NoErr(err)                                 // error fetching user
+	is.Equal(u2.Email, "echange@rtcl.io")         // email should not change until confirmed
+	is.Equal(u2.PendingEmail, "echange2@rtcl.io") // expected pending email
+
+	tk, err := u2.EmailChangeToken(testSigningKey)
+	is.NoErr(err) // error generating change-email token
+	a, err := datastore.DecodeActionToken(tk, datastore.ActionChangeEmail, testSigningKey, time.Now())
+	is.NoErr(err)                        // error decoding change-email token
+	is.Equal(a.Data, "echange2@rtcl.io") // token should carry the new email
+
+	err = u2.ConfirmEmailChange("other@rtcl.io")
+	is.Equal(err, datastore.ErrActionTokenInvalid) // only the pending email can be confirmed
+
+	// another user takes the address before it is confirmed
+	x := userTestDS.NewUser()
+	x.FirstName = "Quick"
+	x.LastName = "Taker"
+	x.Email = "echange2@rtcl.io"
+	is.NoErr(x.Save()) // error adding user
+	err = u2.ConfirmEmailChange(a.Data)
+	is.Equal(err, datastore.ErrEmailExists) // uniqueness should still be checked on confirm
+	is.Equal(u2.Email, "echange@rtcl.io")   // email should be unchanged
+
+	err = u2.SavePartial(bson.M{"email": "echange3@rtcl.io"})
+	is.NoErr(err)                                       // error requesting email change
+	is.NoErr(u2.ConfirmEmailChange("echange3@rtcl.io")) // error confirming email change
+	u3, err := userTestDS.UserByID(u.ID.Hex())
+	is.NoErr(err)                          // error fetching user
+	is.Equal(u3.Email, "echange3@rtcl.io") // email should be changed
+	is.Equal(u3.PendingEmail, "")          // pending email should be cleared
 }
 
 // testUserAuth tests the basic user auth function which finds the user by email, and then
@@ -315,6 +362,237 @@ func testUserAuth(t *testing.T) {
 	}
 }
 
+// testUserAuthLegacyRehash tests that a user with a legacy SHA-256 password hash, as inserted by the test data, can
+// still authenticate and that the stored hash is upgraded to argon2id on success.
+func testUserAuthLegacyRehash(t *testing.T) {
+	is := is.New(t)
+
+	u, err := userTestDS.UserByEmail("oj@rtcl.io")
+	is.NoErr(err)                 // error fetching user
+	is.Equal(len(u.Password), 64) // expected a legacy hex hash in the test data
+	_, err = userTestDS.UserAuth("oj@rtcl.io", "wrongpassword")
+	is.True(err != nil) // expected auth to fail with wrong password
+	_, err = userTestDS.UserAuth("oj@rtcl.io", "12345abcde")
+	is.NoErr(err) // legacy password should authenticate
+
+	u, err = userTestDS.UserByEmail("oj@rtcl.io")
+	is.NoErr(err)                                        // error re-fetching user
+	is.True(strings.HasPrefix(u.Password, "$argon2id$")) // password hash should have been upgraded
+
+	_, err = userTestDS.UserAuth("oj@rtcl.io", "12345abcde")
+	is.NoErr(err) // upgraded password should authenticate
+}
+
+// testUserAuthLockout tests that an account is locked out after too many failed logins, using a fake clock
+func testUserAuthLockout(t *testing.T) {
+	is := is.New(t)
+
+	now := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	userTestDS.Now = func() time.Time { return now }
+	defer func() { userTestDS.Now = nil }()
+
+	u := userTestDS.NewUser()
+	u.FirstName = "Lock"
+	u.LastName = "Out"
+	u.Email = "lockout@rtcl.io"
+	u.Password = "theRightPassword"
+	is.NoErr(u.Save()) // error adding user for lockout test
+
+	for i := 0; i < datastore.LoginFreeAttempts; i++ {
+		_, err := userTestDS.UserAuth("lockout@rtcl.io", "theWrongPassword")
+		_, locked := err.(*datastore.LockoutError)
+		is.True(err != nil && !locked) // free attempts should fail without a lockout
+	}
+
+	// the next failure locks the account, after which even the right password is refused
+	_, err := userTestDS.UserAuth("lockout@rtcl.io", "theWrongPassword")
+	is.True(err != nil) // expected failure
+	_, err = userTestDS.UserAuth("lockout@rtcl.io", "theRightPassword")
+	lockout, ok := err.(*datastore.LockoutError)
+	is.True(ok)                                              // expected a lockout error
+	is.Equal(lockout.RetryAfter, datastore.LoginBaseLockout) // expected the base lockout period
+
+	// lockout ends after the period and the right password works, clearing the failures
+	now = now.Add(datastore.LoginBaseLockout)
+	u2, err := userTestDS.UserAuth("lockout@rtcl.io", "theRightPassword")
+	is.NoErr(err)                // expected auth to succeed after lockout
+	is.Equal(u2.FailedLogins, 0) // failed logins should be cleared
+}
+
+// testUserAuthConcurrentFailures tests that failed logins made at the same time all count towards the lockout
+func testUserAuthConcurrentFailures(t *testing.T) {
+	is := is.New(t)
+
+	now := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	userTestDS.Now = func() time.Time { return now }
+	defer func() { userTestDS.Now = nil }()
+
+	u := userTestDS.NewUser()
+	u.FirstName = "Lock"
+	u.LastName = "Burst"
+	u.Email = "burst@rtcl.io"
+	u.Password = "theRightPassword"
+	is.NoErr(u.Save()) // error adding user for lockout test
+
+	const n = datastore.LoginFreeAttempts + 3
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			userTestDS.UserAuth("burst@rtcl.io", "theWrongPassword")
+		}()
+	}
+	wg.Wait()
+
+	u2, err := userTestDS.UserByID(u.ID.Hex())
+	is.NoErr(err)
+	is.Equal(u2.FailedLogins, n)         // expected every failure to be counted
+	is.True(u2.LoginRetryAfter(now) > 0) // expected the account to be locked out
+	is.NoErr(u2.ClearLoginFailures())    // error clearing failures
+	u2, err = userTestDS.UserByID(u.ID.Hex())
+	is.NoErr(err)
+	is.Equal(u2.FailedLogins, 0)
+	is.True(u2.LoginLockout.IsZero())
+	is.Equal(u2.FirstName, "Lock") // expected only the failed login fields to change
+}
+
+func testUserRole(t *testing.T) {
+	is := is.New(t)
+	u := userTestDS.NewUser()
+	u.FirstName = "Role"
+	u.LastName = "Test"
+	u.Email = "role@rtcl.io"
+	u.Role = datastore.RoleAdmin
+	is.NoErr(u.Save())                     // error adding user
+	is.True(u.HasRole(datastore.RoleUser)) // new users should have the user role, whatever was posted
+
+	is.True(u.SetRole("superuser") != nil)   // expected an error for an invalid role
+	is.NoErr(u.SetRole(datastore.RoleAdmin)) // error setting role
+	u2, err := userTestDS.UserByID(u.ID.Hex())
+	is.NoErr(err)                            // error fetching user
+	is.True(u2.HasRole(datastore.RoleAdmin)) // role not saved
+
+	tk, err := u2.Token(testIssuer, testSigningKey, testTTLHours)
+	is.NoErr(err)                                 // error creating token
+	is.Equal(tk.Claims.Role, datastore.RoleAdmin) // role claim should be the user role
+}
+
+func testUserDisable(t *testing.T) {
+	is := is.New(t)
+	u := userTestDS.NewUser()
+	u.FirstName = "Disable"
+	u.LastName = "Test"
+	u.Email = "disable@rtcl.io"
+	u.Password = "thePassword"
+	is.NoErr(u.Save()) // error adding user
+
+	is.NoErr(u.Disable()) // error disabling user
+	_, err := userTestDS.UserAuth("disable@rtcl.io", "thePassword")
+	is.Equal(err, datastore.ErrAccountDisabled) // disabled user should not be able to log in
+
+	is.NoErr(u.Enable()) // error enabling user
+	_, err = userTestDS.UserAuth("disable@rtcl.io", "thePassword")
+	is.NoErr(err) // enabled user should be able to log in
+
+	is.NoErr(u.ForceReset()) // error forcing reset
+	_, err = userTestDS.UserAuth("disable@rtcl.io", "thePassword")
+	is.True(err != nil) // old password should not work after a forced reset
+}
+
+func testUserList(t *testing.T) {
+	is := is.New(t)
+	xu, err := userTestDS.ListUsers("BR@RTCL", 0, 10)
+	is.NoErr(err)                       // error listing users
+	is.Equal(len(xu), 1)                // expected one user matching the filter
+	is.Equal(xu[0].Email, "br@rtcl.io") // wrong user
+
+	xu, err = userTestDS.ListUsers("", 0, 2)
+	is.NoErr(err)                      // error listing users
+	is.Equal(len(xu), 2)               // expected limit of 2 users
+	is.True(xu[0].Email < xu[1].Email) // expected users ordered by email
+	xu2, err := userTestDS.ListUsers("", 1, 1)
+	is.NoErr(err)                       // error listing users
+	is.Equal(xu2[0].Email, xu[1].Email) // skip did not skip the first user
+}
+
+func testUserDelete(t *testing.T) {
+	is := is.New(t)
+	u := userTestDS.NewUser()
+	u.FirstName = "Delete"
+	u.LastName = "Test"
+	u.Email = "delete@rtcl.io"
+	is.NoErr(u.Save()) // error adding user
+
+	l := userTestDS.NewLog()
+	l.UserID = u.ID
+	is.NoErr(l.Save()) // error adding log
+	_, err := userTestDS.AddBookmark(u.ID.Hex(), datastore.Bookmark{PMID: "30173079"})
+	is.NoErr(err) // error adding bookmark
+
+	is.NoErr(userTestDS.DeleteUser(u.ID.Hex())) // error deleting user
+	_, err = userTestDS.UserByID(u.ID.Hex())
+	is.Equal(err, datastore.ErrNotFound) // user should be deleted
+	xl, err := userTestDS.LogsByUserID(u.ID.Hex())
+	is.NoErr(err)        // error fetching logs
+	is.Equal(len(xl), 0) // logs should be deleted with the user
+	xb, err := userTestDS.BookmarksByUserID(u.ID.Hex(), "", "")
+	is.NoErr(err)        // error fetching bookmarks
+	is.Equal(len(xb), 0) // bookmarks should be deleted with the user
+}
+
+// testUserScheduleDeletion tests that a user with a deletion grace period is only deleted by PurgeDeletedUsers
+// once it has passed, and not at all if the deletion is cancelled
+func testUserScheduleDeletion(t *testing.T) {
+	is := is.New(t)
+	now := time.Now()
+	userTestDS.Now = func() time.Time { return now }
+	defer func() { userTestDS.Now = nil }()
+
+	u1 := newTestUser(t, userTestDS)
+	u2 := newTestUser(t, userTestDS)
+
+	is.NoErr(u1.ScheduleDeletion(24 * time.Hour)) // error scheduling deletion
+	is.NoErr(u2.ScheduleDeletion(24 * time.Hour)) // error scheduling deletion
+	is.NoErr(u2.CancelDeletion())                 // error cancelling deletion
+
+	n, err := userTestDS.PurgeDeletedUsers()
+	is.NoErr(err)  // error purging users
+	is.Equal(n, 0) // no users should be deleted during the grace period
+
+	now = now.Add(25 * time.Hour)
+	n, err = userTestDS.PurgeDeletedUsers()
+	is.NoErr(err)  // error purging users
+	is.Equal(n, 1) // expected one user to be deleted
+	_, err = userTestDS.UserByID(u1.ID.Hex())
+	is.Equal(err, datastore.ErrNotFound) // user should be deleted after the grace period
+	_, err = userTestDS.UserByID(u2.ID.Hex())
+	is.NoErr(err) // user that cancelled should not be deleted
+
+	u3 := newTestUser(t, userTestDS)
+	is.NoErr(u3.ScheduleDeletion(0)) // error deleting user
+	_, err = userTestDS.UserByID(u3.ID.Hex())
+	is.Equal(err, datastore.ErrNotFound) // user should be deleted straight away without a grace period
+}
+
+func TestBackoff(t *testing.T) {
+	is := is.New(t)
+	cases := []struct {
+		failures int
+		expect   time.Duration
+	}{
+		{failures: 0, expect: 0},
+		{failures: 5, expect: 0},
+		{failures: 6, expect: time.Minute},
+		{failures: 7, expect: 2 * time.Minute},
+		{failures: 9, expect: 8 * time.Minute},
+		{failures: 100, expect: time.Hour},
+	}
+	for _, c := range cases {
+		is.Equal(datastore.Backoff(c.failures, 5, time.Minute, time.Hour), c.expect) // unexpected backoff
+	}
+}
+
 // testUserToken create a Token value for a user in the test data
 func testUserToken(t *testing.T) {
 	is := is.New(t)
@@ -391,6 +669,19 @@ func testUsersDueNotification(t *testing.T) {
 	xu, err := userTestDS.UsersDueNotification()
 	is.NoErr(err)
 	is.Equal(len(xu), 2) // expected 2 users with notifications due
+
+	// users waiting to be deleted are not notified during the grace period
+	u := userTestDS.NewUser()
+	u.FirstName = "Deleted"
+	u.LastName = "Soon"
+	u.Email = "deleted.soon@rtcl.io"
+	u.Notification = time.Now().AddDate(0, 0, -1)
+	is.NoErr(u.Save()) // error adding user
+	is.NoErr(u.ScheduleDeletion(24 * time.Hour))
+	xu, err = userTestDS.UsersDueNotification()
+	is.NoErr(err)
+	is.Equal(len(xu), 2) // expected a user waiting to be deleted not to be due
+	is.NoErr(userTestDS.DeleteUser(u.ID.Hex()))
 }
 
 // Tests incrementing the notification date by x days
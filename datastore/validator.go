@@ -0,0 +1,202 @@
+package datastore
+
+import (
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// Errors returned by TokenValidator. Each one is a different reason for rejecting a token, so that a client can be
+// told whether to refresh the token or start again.
+var (
+	ErrTokenMalformed   = errors.New("token is malformed")
+	ErrTokenSignature   = errors.New("token signature is invalid")
+	ErrTokenAlgorithm   = errors.New("token signing algorithm is not allowed")
+	ErrTokenExpired     = errors.New("token has expired")
+	ErrTokenNotValidYet = errors.New("token is not valid yet")
+	ErrTokenIssuer      = errors.New("token issuer is not valid")
+	ErrTokenAudience    = errors.New("token audience is not valid")
+)
+
+// TokenValidator decodes and validates access tokens. The signature is verified with the key in the Keyring
+// identified by the kid header, and the alg header must be one of Algorithms as well as match the key. If Issuer is
+// set the iss claim must match it, and if Audiences is set the aud claim must contain at least one of them.
+type TokenValidator struct {
+	Keyring    *Keyring
+	Issuer     string
+	Audiences  []string
+	Algorithms []string         // defaults to the algorithms of the keys in the Keyring
+	Leeway     time.Duration    // allowance for clock skew when checking exp, iat and nbf
+	Now        func() time.Time // defaults to time.Now
+}
+
+// Decode returns the decoded Token if it is valid, or one of the ErrToken errors if it is not
+func (v *TokenValidator) Decode(token string) (Token, error) {
+
+	t := Token{
+		Encoded: token,
+	}
+
+	// The jwt library panics if the jwt does not contain 3 '.'s - assume because it splits the string at each period
+	// and gets and index out of range if it does not end up with three pieces.
+	if len(strings.Split(token, ".")) != 3 {
+		return t, ErrTokenMalformed
+	}
+
+	// time based claims are checked below, with leeway
+	p := jwt.Parser{SkipClaimsValidation: true}
+	tok, err := p.Parse(token, func(tok *jwt.Token) (interface{}, error) {
+		alg := tok.Method.Alg()
+		if !v.algorithmAllowed(alg) {
+			return nil, ErrTokenAlgorithm
+		}
+		kid, _ := tok.Header["kid"].(string)
+		k, ok := v.Keyring.Key(kid)
+		if !ok {
+			return nil, ErrTokenSignature
+		}
+		// the alg header must match the key, otherwise eg a public RSA key could be used as an HMAC secret
+		if alg != k.Method.Alg() {
+			return nil, ErrTokenAlgorithm
+		}
+		t.key = k
+		return k.verify, nil
+	})
+	if err != nil {
+		return t, parseError(err)
+	}
+
+	claims, ok := tok.Claims.(jwt.MapClaims)
+	if !ok {
+		return t, ErrTokenMalformed
+	}
+	aud, err := t.setClaims(claims)
+	if err != nil {
+		return t, err
+	}
+	return t, v.checkClaims(t, aud)
+}
+
+// setClaims sets the Token claims from the decoded claims, and returns the audiences as the aud claim can be a string
+// or an array. The custom claims are optional but exp and iat are required.
+func (t *Token) setClaims(claims jwt.MapClaims) ([]string, error) {
+
+	str := func(name string) string {
+		s, _ := claims[name].(string)
+		return s
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, ErrTokenMalformed
+	}
+	iat, ok := claims["iat"].(float64)
+	if !ok {
+		return nil, ErrTokenMalformed
+	}
+	nbf, _ := claims["nbf"].(float64)
+
+	var aud []string
+	switch a := claims["aud"].(type) {
+	case string:
+		aud = []string{a}
+	case []interface{}:
+		for _, x := range a {
+			s, ok := x.(string)
+			if !ok {
+				return nil, ErrTokenMalformed
+			}
+			aud = append(aud, s)
+		}
+	case nil:
+	default:
+		return nil, ErrTokenMalformed
+	}
+
+	// Custom claims
+	t.Claims.ID = str("id")
+	t.Claims.Name = str("name")
+	t.Claims.Role = str("role")
+
+	// Standard claims
+	t.Claims.ExpiresAt = int64(exp)
+	t.Claims.IssuedAt = int64(iat)
+	t.Claims.NotBefore = int64(nbf)
+	t.Claims.Issuer = str("iss")
+	t.Claims.Id = str("jti") // not present in tokens issued before revocation was added
+	t.Claims.Audience = strings.Join(aud, " ")
+
+	// reverse engineer ttlHours from iat and exp
+	t.ttlHours = (int(t.Claims.ExpiresAt) - int(t.Claims.IssuedAt)) / 3600
+
+	// Set the friendly dates
+	t.IssuedAt = time.Unix(t.Claims.IssuedAt, 0)
+	t.ExpiresAt = time.Unix(t.Claims.ExpiresAt, 0)
+
+	return aud, nil
+}
+
+// checkClaims checks the time based claims, issuer and audience
+func (v *TokenValidator) checkClaims(t Token, aud []string) error {
+
+	now := time.Now()
+	if v.Now != nil {
+		now = v.Now()
+	}
+	leeway := int64(v.Leeway / time.Second)
+
+	if now.Unix() > t.Claims.ExpiresAt+leeway {
+		return ErrTokenExpired
+	}
+	if now.Unix() < t.Claims.IssuedAt-leeway || now.Unix() < t.Claims.NotBefore-leeway {
+		return ErrTokenNotValidYet
+	}
+	if v.Issuer != "" && t.Claims.Issuer != v.Issuer {
+		return ErrTokenIssuer
+	}
+	if len(v.Audiences) > 0 && !containsAny(aud, v.Audiences) {
+		return ErrTokenAudience
+	}
+	return nil
+}
+
+// algorithmAllowed returns true if alg is one of the allowed algorithms
+func (v *TokenValidator) algorithmAllowed(alg string) bool {
+	allowed := v.Algorithms
+	if len(allowed) == 0 {
+		allowed = v.Keyring.Algorithms()
+	}
+	return containsAny([]string{alg}, allowed)
+}
+
+// parseError maps an error from the jwt library to one of the ErrToken errors
+func parseError(err error) error {
+	ve, ok := err.(*jwt.ValidationError)
+	if !ok {
+		return ErrTokenMalformed
+	}
+	// errors returned by the keyfunc are already one of ours
+	if ve.Inner == ErrTokenAlgorithm || ve.Inner == ErrTokenSignature {
+		return ve.Inner
+	}
+	switch {
+	case ve.Errors&jwt.ValidationErrorSignatureInvalid != 0:
+		return ErrTokenSignature
+	case ve.Errors&jwt.ValidationErrorUnverifiable != 0:
+		return ErrTokenAlgorithm // alg in the header is not one the library knows
+	}
+	return ErrTokenMalformed
+}
+
+// containsAny returns true if any of the strings in xs is in set
+func containsAny(xs, set []string) bool {
+	for _, x := range xs {
+		for _, s := range set {
+			if x == s {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package datastore_test
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/matryer/is"
+	"github.com/mikedonnici/rtcl-api/datastore"
+)
+
+// TestTokenValidator checks that each reason for rejecting a token returns the matching error
+func TestTokenValidator(t *testing.T) {
+	is := is.New(t)
+
+	v := datastore.TokenValidator{
+		Keyring:   datastore.NewKeyring(datastore.HMACKey(signingKey)),
+		Issuer:    issuer,
+		Audiences: []string{"rtcl-web", "rtcl-app"},
+		Leeway:    time.Minute,
+	}
+	hmacToken := func(claims jwt.MapClaims) string {
+		s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(signingKey))
+		is.NoErr(err) // error signing token
+		return s
+	}
+	now := time.Now()
+	claims := func(c jwt.MapClaims) jwt.MapClaims {
+		m := jwt.MapClaims{"iss": issuer, "aud": "rtcl-app", "iat": now.Unix(), "exp": now.Add(time.Hour).Unix()}
+		for k, v := range c {
+			m[k] = v
+		}
+		return m
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"`+issuer+`"}`)) + "."
+
+	cases := []struct {
+		token string
+		err   error
+	}{
+		{hmacToken(claims(nil)), nil},
+		{hmacToken(claims(jwt.MapClaims{"aud": []string{"other", "rtcl-web"}})), nil},
+		{hmacToken(claims(jwt.MapClaims{"exp": now.Add(-30 * time.Second).Unix()})), nil}, // within leeway
+		{hmacToken(claims(jwt.MapClaims{"exp": now.Add(-2 * time.Minute).Unix()})), datastore.ErrTokenExpired},
+		{hmacToken(claims(jwt.MapClaims{"iat": now.Add(2 * time.Minute).Unix()})), datastore.ErrTokenNotValidYet},
+		{hmacToken(claims(jwt.MapClaims{"nbf": now.Add(2 * time.Minute).Unix()})), datastore.ErrTokenNotValidYet},
+		{hmacToken(claims(jwt.MapClaims{"iss": "someone else"})), datastore.ErrTokenIssuer},
+		{hmacToken(claims(jwt.MapClaims{"aud": "other"})), datastore.ErrTokenAudience},
+		{hmacToken(claims(jwt.MapClaims{"aud": nil})), datastore.ErrTokenAudience},
+		{hmacToken(jwt.MapClaims{"iss": issuer, "aud": "rtcl-app"}), datastore.ErrTokenMalformed}, // no exp or iat
+		{hmacToken(claims(jwt.MapClaims{"exp": "tomorrow"})), datastore.ErrTokenMalformed},
+		{"not.a.token", datastore.ErrTokenMalformed},
+		{"notatoken", datastore.ErrTokenMalformed},
+		{hmacToken(claims(nil)) + "x", datastore.ErrTokenSignature},
+		{unsigned, datastore.ErrTokenAlgorithm},
+	}
+	for _, c := range cases {
+		_, err := v.Decode(c.token)
+		is.Equal(err, c.err) // unexpected validation result
+	}
+
+	// missing custom claims should not panic
+	tk, err := v.Decode(hmacToken(claims(jwt.MapClaims{"id": 42})))
+	is.NoErr(err)              // token without string custom claims should be valid
+	is.Equal(tk.Claims.ID, "") // id claim should be empty
+}
+
+// TestTokenValidatorAlgorithms checks that only the allowed algorithms are accepted
+func TestTokenValidatorAlgorithms(t *testing.T) {
+	is := is.New(t)
+
+	rsaPEM, _ := testPEMKeys(t)
+	keys, err := datastore.ParsePrivateKeys(rsaPEM)
+	is.NoErr(err) // error parsing key
+	kr := datastore.NewKeyring(keys[0], datastore.HMACKey(signingKey))
+
+	hs, err := datastore.NewToken(issuer, signingKey, ttlHours).Encode()
+	is.NoErr(err) // error creating HS256 token
+	rs, err := datastore.NewSignedToken(issuer, keys[0], ttlHours).Encode()
+	is.NoErr(err) // error creating RS256 token
+
+	v := datastore.TokenValidator{Keyring: kr}
+	_, err = v.Decode(hs.String())
+	is.NoErr(err) // HS256 should be allowed by default as there is an HMAC key
+	_, err = v.Decode(rs.String())
+	is.NoErr(err) // RS256 should be allowed by default as there is an RSA key
+
+	v.Algorithms = []string{"RS256"}
+	_, err = v.Decode(hs.String())
+	is.Equal(err, datastore.ErrTokenAlgorithm) // HS256 should not be allowed when pinned to RS256
+	_, err = v.Decode(rs.String())
+	is.NoErr(err) // RS256 should still be allowed
+}
+
+// TestTokenAudience checks that the aud claim set on a new token is decoded
+func TestTokenAudience(t *testing.T) {
+	is := is.New(t)
+	tk, err := datastore.NewToken(issuer, signingKey, ttlHours).Audience("rtcl-app").Encode()
+	is.NoErr(err) // error creating token
+	v := datastore.TokenValidator{
+		Keyring:   datastore.NewKeyring(datastore.HMACKey(signingKey)),
+		Audiences: []string{"rtcl-app"},
+	}
+	tk2, err := v.Decode(tk.String())
+	is.NoErr(err)                             // token for the audience should be valid
+	is.Equal(tk2.Claims.Audience, "rtcl-app") // wrong audience
+}
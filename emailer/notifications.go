@@ -3,17 +3,19 @@ package emailer
 import (
 	"fmt"
 	"github.com/mikedonnici/rtcl-api/datastore"
+	"html"
 	"os"
 )
 
-// WelcomeUser sends a welcome email with a link to unlock the user account.
-func WelcomeUser(u datastore.User) {
+// WelcomeUser sends a welcome email with a link to unlock the user account. The token is a confirm-email
+// action token for the user.
+func WelcomeUser(u datastore.User, token string) {
 
 	body := `<h3>Welcome, %s!</h3>
              <p>Please click on this link to activate your account:</p>
 			 <p><a href="%s" target="_blank">Activate my account</a></p>
 			 <p>Happy RTCL-ing</p>`
-	link := os.Getenv("API_URL") + "/users/" + u.ID.Hex() + "/confirm/" + u.KeyGen()
+	link := os.Getenv("API_URL") + "/users/" + u.ID.Hex() + "/confirm/" + token
 	body = fmt.Sprintf(body, u.FirstName, link)
 
 	e := New()
@@ -27,15 +29,16 @@ func WelcomeUser(u datastore.User) {
 	e.Send()
 }
 
-// ResetPassword sends an email with a link to reset the user password.
-func ResetPassword(u datastore.User) {
+// ResetPassword sends an email with a link to reset the user password. The token is a reset-password
+// action token for the user.
+func ResetPassword(u datastore.User, token string) {
 
 	body := `<h3>Hi, %s!</h3>
 			 <p>The link below will allow you to reset your password.</p>
              <p>If you didn't ask for this you can ignore this email.</p>
 			 <p><a href="%s" target="_blank">Reset my password</a></p>
 			 <p>Happy RTCL-ing</p>`
-	link := os.Getenv("API_URL") + "/users/" + u.ID.Hex() + "/reset/" + u.KeyGen()
+	link := os.Getenv("API_URL") + "/users/" + u.ID.Hex() + "/reset/" + token
 	body = fmt.Sprintf(body, u.FirstName, link)
 
 	e := New()
@@ -48,3 +51,118 @@ func ResetPassword(u datastore.User) {
 	e.HTMLContent = body
 	e.Send()
 }
+
+// MagicLink sends an email with a link to log in without a password. The token is a magic-link action token for
+// the user, and the link opens the app which exchanges it for an access token.
+func MagicLink(u datastore.User, token string) {
+
+	body := `<h3>Hi, %s!</h3>
+			 <p>Click on the link below to log in to RTCL. It can only be used once and expires in 15 minutes.</p>
+			 <p>If you didn't ask for this you can ignore this email.</p>
+			 <p><a href="%s" target="_blank">Log in to RTCL</a></p>
+			 <p>Happy RTCL-ing</p>`
+	link := os.Getenv("APP_URL") + "/login/" + u.ID.Hex() + "/" + token
+	body = fmt.Sprintf(body, html.EscapeString(u.FirstName), link)
+
+	e := New()
+	e.FromEmail = "notifier@rtcl.io"
+	e.FromName = "RTCL Notifier"
+	e.Subject = "Log in to RTCL"
+	e.ToEmail = u.Email
+	e.ToName = u.FirstName + " " + u.LastName
+	e.PlainContent = "Login link: " + link
+	e.HTMLContent = body
+	e.Send()
+}
+
+// ConfirmEmailChange sends an email to the new address with a link to confirm the change. The token is a
+// change-email action token for the user.
+func ConfirmEmailChange(u datastore.User, token string) {
+
+	body := `<h3>Hi, %s!</h3>
+			 <p>Please click on the link below to confirm that this is your new email address for RTCL.</p>
+			 <p>If you didn't ask for this you can ignore this email.</p>
+			 <p><a href="%s" target="_blank">Confirm my email address</a></p>
+			 <p>Happy RTCL-ing</p>`
+	link := os.Getenv("API_URL") + "/users/" + u.ID.Hex() + "/email/" + token
+	body = fmt.Sprintf(body, html.EscapeString(u.FirstName), link)
+
+	e := New()
+	e.FromEmail = "notifier@rtcl.io"
+	e.FromName = "RTCL Notifier"
+	e.Subject = "Confirm your new RTCL email address"
+	e.ToEmail = u.PendingEmail
+	e.ToName = u.FirstName + " " + u.LastName
+	e.PlainContent = "Confirmation link: " + link
+	e.HTMLContent = body
+	e.Send()
+}
+
+// Notification tells the user that there may be new articles for their saved searches. The token is an unsubscribe
+// action token for the user, for the link that stops these emails.
+func Notification(u datastore.User, token string) error {
+
+	body := `<h3>Hi, %s!</h3>
+			 <p>There may be new articles for your saved searches.</p>
+			 <p><a href="%s" target="_blank">Open RTCL</a></p>
+			 <p>Happy RTCL-ing</p>
+			 <p><small><a href="%s" target="_blank">Unsubscribe from these emails</a></small></p>`
+	link := os.Getenv("APP_URL")
+	unsubscribe := os.Getenv("API_URL") + "/users/" + u.ID.Hex() + "/unsubscribe/" + token
+	body = fmt.Sprintf(body, html.EscapeString(u.FirstName), link, unsubscribe)
+
+	e := New()
+	e.FromEmail = "notifier@rtcl.io"
+	e.FromName = "RTCL Notifier"
+	e.Subject = "New articles on RTCL"
+	e.ToEmail = u.Email
+	e.ToName = u.FirstName + " " + u.LastName
+	e.PlainContent = "There may be new articles for your saved searches: " + link + "\n\nUnsubscribe: " + unsubscribe
+	e.HTMLContent = body
+	return e.Send()
+}
+
+// EmailChangeNotice tells the current address that a change to the pending email has been requested, so that the
+// owner knows if someone else has access to their account.
+func EmailChangeNotice(u datastore.User) {
+
+	body := `<h3>Hi, %s!</h3>
+			 <p>A request was made to change the email address for your RTCL account to %s.</p>
+			 <p>The change will only be made once it is confirmed from the new address. If you didn't ask for this,
+			 please reset your password.</p>
+			 <p>Happy RTCL-ing</p>`
+	body = fmt.Sprintf(body, html.EscapeString(u.FirstName), html.EscapeString(u.PendingEmail))
+
+	e := New()
+	e.FromEmail = "notifier@rtcl.io"
+	e.FromName = "RTCL Notifier"
+	e.Subject = "RTCL email change requested"
+	e.ToEmail = u.Email
+	e.ToName = u.FirstName + " " + u.LastName
+	e.PlainContent = "A request was made to change your RTCL email address to " + u.PendingEmail
+	e.HTMLContent = body
+	e.Send()
+}
+
+// SharedSearch tells a colleague that the owner has shared a saved search with them. The link opens the shared
+// search in the app, where the colleague can subscribe to it.
+func SharedSearch(owner datastore.User, s datastore.Search, email, shareID string) {
+
+	body := `<h3>Hi!</h3>
+			 <p>%s has shared their RTCL search <strong>%s</strong> with you.</p>
+			 <p>Subscribe to it to get the new articles it finds, and any changes %s makes to it.</p>
+			 <p><a href="%s" target="_blank">View the search</a></p>
+			 <p>Happy RTCL-ing</p>`
+	link := os.Getenv("APP_URL") + "/shared/" + shareID
+	name := owner.FirstName + " " + owner.LastName
+	body = fmt.Sprintf(body, html.EscapeString(name), html.EscapeString(s.Name), html.EscapeString(owner.FirstName), link)
+
+	e := New()
+	e.FromEmail = "notifier@rtcl.io"
+	e.FromName = "RTCL Notifier"
+	e.Subject = name + " shared a search with you"
+	e.ToEmail = email
+	e.PlainContent = name + " shared the search " + s.Name + " with you: " + link
+	e.HTMLContent = body
+	e.Send()
+}
@@ -5,15 +5,20 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/34South/envr"
 	"github.com/mikedonnici/rtcl-api/datastore"
-	"github.com/mikedonnici/rtcl-api/datastore/mongo"
+	"github.com/mikedonnici/rtcl-api/search"
 	"github.com/mikedonnici/rtcl-api/server"
 )
 
 const defaultPort = "5000"
 
+// searchReload is how often the local search index is reloaded, to pick up articles added by cmd/indexer
+const searchReload = time.Hour
+
 func main() {
 
 	var err error
@@ -26,14 +31,13 @@ func main() {
 	port := setPort(*portFlag)
 	setEnv(*cfgFlag)
 
-	d := datastore.New()
-	d.Mongo, err = mongo.NewConnection(
-		os.Getenv("MONGODB_URI"),
-		os.Getenv("MONGODB_NAME"),
-		os.Getenv("MONGODB_DESC"),
-	)
+	d, err := datastore.OpenFromEnv()
 	if err != nil {
-		log.Fatalf("Datastore could not connect to MongoDB")
+		log.Fatalf("Datastore could not be opened - %s", err)
+	}
+	defer d.Close()
+	if d.Bolt != nil {
+		log.Println("Using embedded datastore", os.Getenv("BOLTDB_PATH"))
 	}
 
 	if os.Getenv("PASSWORD_SALT") == "" {
@@ -44,12 +48,54 @@ func main() {
 	if err != nil {
 		log.Fatalln("Could not convert TOKEN_HOURS_TTL value to an integer")
 	}
+	var refreshTTL int // optional, server uses the default if not set
+	if os.Getenv("TOKEN_REFRESH_HOURS_TTL") != "" {
+		refreshTTL, err = strconv.Atoi(os.Getenv("TOKEN_REFRESH_HOURS_TTL"))
+		if err != nil {
+			log.Fatalln("Could not convert TOKEN_REFRESH_HOURS_TTL value to an integer")
+		}
+	}
+	// access tokens are signed with the first of TOKEN_PRIVATE_KEYS if there are any, otherwise TOKEN_SIGNINGKEY
+	keys, err := datastore.ParsePrivateKeys([]byte(os.Getenv("TOKEN_PRIVATE_KEYS")))
+	if err != nil {
+		log.Fatalf("Could not parse TOKEN_PRIVATE_KEYS - %s", err)
+	}
+	keys = append(keys, datastore.HMACKey(os.Getenv("TOKEN_SIGNINGKEY")))
+	leeway := 30 // seconds, optional
+	if os.Getenv("TOKEN_LEEWAY_SECONDS") != "" {
+		leeway, err = strconv.Atoi(os.Getenv("TOKEN_LEEWAY_SECONDS"))
+		if err != nil {
+			log.Fatalln("Could not convert TOKEN_LEEWAY_SECONDS value to an integer")
+		}
+	}
+
+	var graceDays int // optional, accounts are deleted straight away if not set
+	if os.Getenv("ACCOUNT_DELETION_GRACE_DAYS") != "" {
+		graceDays, err = strconv.Atoi(os.Getenv("ACCOUNT_DELETION_GRACE_DAYS"))
+		if err != nil {
+			log.Fatalln("Could not convert ACCOUNT_DELETION_GRACE_DAYS value to an integer")
+		}
+	}
+
+	searcher, err := setSearch(d)
+	if err != nil {
+		log.Fatalf("Search index could not be opened - %s", err)
+	}
+
 	cfg := server.Config{
-		Port: port,
+		Port:          port,
+		Search:        searcher,
+		TrustProxy:    os.Getenv("TRUST_PROXY") == "true",
+		DeletionGrace: time.Duration(graceDays) * 24 * time.Hour,
 		Token: server.TokenConfig{
-			Issuer:     os.Getenv("TOKEN_ISSUER"),
-			SigningKey: os.Getenv("TOKEN_SIGNINGKEY"),
-			HoursTTL:   ttl,
+			Issuer:          os.Getenv("TOKEN_ISSUER"),
+			SigningKey:      os.Getenv("TOKEN_SIGNINGKEY"),
+			Keyring:         datastore.NewKeyring(keys...),
+			HoursTTL:        ttl,
+			RefreshHoursTTL: refreshTTL,
+			Audiences:       envList("TOKEN_AUDIENCES"),
+			Algorithms:      envList("TOKEN_ALGORITHMS"),
+			Leeway:          time.Duration(leeway) * time.Second,
 		},
 	}
 	srv := server.NewServer(cfg, d)
@@ -57,6 +103,17 @@ func main() {
 	log.Fatal(srv.Start())
 }
 
+// envList returns the comma-separated values of an env var, or nil if it is not set
+func envList(name string) []string {
+	var xs []string
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if strings.TrimSpace(v) != "" {
+			xs = append(xs, strings.TrimSpace(v))
+		}
+	}
+	return xs
+}
+
 // setPort sets the port number for the server, with the env var taking the highest precedence.
 func setPort(port string) string {
 	if os.Getenv("PORT") != "" {
@@ -68,18 +125,40 @@ func setPort(port string) string {
 	return defaultPort
 }
 
+// setSearch returns the search backend. If SEARCH_INDEX is "local" it is the built-in index in the datastore, which
+// is reloaded every searchReload to pick up new articles, otherwise it is the Algolia articles index.
+func setSearch(d *datastore.Datastore) (search.SearchIndex, error) {
+	if os.Getenv("SEARCH_INDEX") != "local" {
+		return search.NewAlgolia(os.Getenv("ALGOLIA_APP_ID"), os.Getenv("ALGOLIA_ADMIN_KEY"), search.AlgoliaIndexName), nil
+	}
+	store, err := search.NewStore(d)
+	if err != nil {
+		return nil, err
+	}
+	ix, err := search.Open(store)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Using local search index with %d articles", ix.Len())
+	go func() {
+		for range time.Tick(searchReload) {
+			err := ix.Reload()
+			if err != nil {
+				log.Printf("Search index could not be reloaded - %s", err)
+			}
+		}
+	}()
+	return ix, nil
+}
+
 func setEnv(cfg string) {
 
-	// declare required env vars
+	// declare required env vars - the datastore needs either MONGODB_* or BOLTDB_PATH, see datastore.OpenFromEnv()
 	e := envr.New("rtclEnv", []string{
-		"ADMIN_API_KEY",
 		"API_URL",
 		"APP_URL",
 		"ALGOLIA_APP_ID",
 		"ALGOLIA_ADMIN_KEY",
-		"MONGODB_URI",
-		"MONGODB_NAME",
-		"MONGODB_DESC",
 		"SENDGRID_API_KEY",
 		"TOKEN_ISSUER",
 		"TOKEN_SIGNINGKEY",
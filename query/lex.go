@@ -0,0 +1,112 @@
+package query
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokWord tokenKind = iota
+	tokPhrase
+	tokField
+	tokAnd
+	tokOr
+	tokNot
+	tokLParen
+	tokRParen
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokPhrase:
+		return "phrase"
+	case tokField:
+		return "field"
+	case tokAnd, tokOr, tokNot:
+		return t.value
+	case tokLParen:
+		return "("
+	case tokRParen:
+		return ")"
+	}
+	return "word"
+}
+
+// lex splits the query into tokens
+func lex(q string) ([]token, error) {
+	var toks []token
+	i := 0
+	for i < len(q) {
+		r, size := utf8.DecodeRuneInString(q[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+		case r == '(':
+			toks = append(toks, token{tokLParen, "(", i})
+			i++
+		case r == ')':
+			toks = append(toks, token{tokRParen, ")", i})
+			i++
+		case r == '"':
+			end := strings.IndexByte(q[i+1:], '"')
+			if end < 0 {
+				return nil, &SyntaxError{i, "missing closing quote"}
+			}
+			phrase := strings.Join(strings.Fields(q[i+1:i+1+end]), " ")
+			if phrase == "" {
+				return nil, &SyntaxError{i, "empty phrase"}
+			}
+			toks = append(toks, token{tokPhrase, phrase, i})
+			i += end + 2
+		case r == '-':
+			// a - at the start of a term negates it, elsewhere it is part of a word such as beta-blocker
+			if i+1 >= len(q) || strings.ContainsRune(" \t\r\n)", rune(q[i+1])) {
+				return nil, &SyntaxError{i, "- must be followed by a term"}
+			}
+			toks = append(toks, token{tokNot, "-", i})
+			i++
+		default:
+			start := i
+			for i < len(q) {
+				r, size = utf8.DecodeRuneInString(q[i:])
+				if unicode.IsSpace(r) || r == '(' || r == ')' || r == '"' || r == ':' {
+					break
+				}
+				i += size
+			}
+			w := q[start:i]
+			if i < len(q) && q[i] == ':' {
+				if w == "" {
+					return nil, &SyntaxError{i, "missing field name"}
+				}
+				toks = append(toks, token{tokField, w, start})
+				i++
+				continue
+			}
+			toks = append(toks, wordToken(w, start))
+		}
+	}
+	return toks, nil
+}
+
+// wordToken returns the token for a word, which is an operator if it is AND, OR or NOT in upper case
+func wordToken(w string, pos int) token {
+	switch w {
+	case "AND":
+		return token{tokAnd, w, pos}
+	case "OR":
+		return token{tokOr, w, pos}
+	case "NOT":
+		return token{tokNot, w, pos}
+	}
+	return token{tokWord, w, pos}
+}
@@ -0,0 +1,304 @@
+// Package query parses the query language for saved searches into an AST, which can be compared with other queries
+// and translated for each of the search backends.
+//
+// A query is made of words and "quoted phrases", combined with AND, OR and NOT, and grouped with parentheses.
+// Operators must be in upper case - in lower case they are just words. Words next to each other are ANDed, and -word
+// is the same as NOT word. AND binds more tightly than OR. A word, phrase or group can be limited to a field with
+// title:, journal: or author:, eg:
+//
+//	(heart OR cardiac) failure journal:"Am J Cardiol" -title:review
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Op is the kind of a Node
+type Op int
+
+// Node kinds
+const (
+	OpTerm Op = iota
+	OpAnd
+	OpOr
+	OpNot
+)
+
+// Fields that a term can be limited to
+const (
+	FieldTitle   = "title"
+	FieldJournal = "journal"
+	FieldAuthor  = "author"
+)
+
+var fields = map[string]bool{FieldTitle: true, FieldJournal: true, FieldAuthor: true}
+
+// Node is a node in the AST of a query. A term is a word, or a phrase with the words separated by single spaces,
+// and Field is empty if it can match any field. AND and OR have two or more Nodes, and NOT has one.
+type Node struct {
+	Op    Op
+	Field string
+	Value string
+	Nodes []*Node
+}
+
+// SyntaxError is returned by Parse for a query that is not valid. Pos is the byte offset in the query.
+type SyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Msg, e.Pos)
+}
+
+// Parse parses the query and returns the root of its AST. The AST is simplified - nested ANDs and ORs are flattened,
+// double negatives removed, and repeated operands removed - and the operands are sorted, so that queries that mean
+// the same thing have the same Key.
+func Parse(q string) (*Node, error) {
+	toks, err := lex(q)
+	if err != nil {
+		return nil, err
+	}
+	if len(toks) == 0 {
+		return nil, &SyntaxError{0, "query is empty"}
+	}
+	p := &parser{toks: toks, end: len(q)}
+	n, err := p.parseOr("")
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		t := p.toks[p.pos]
+		return nil, &SyntaxError{t.pos, "unexpected " + t.String()}
+	}
+	return simplify(n), nil
+}
+
+// String returns the query for the AST, which parses to the same AST
+func (n *Node) String() string {
+	switch n.Op {
+	case OpTerm:
+		v := n.Value
+		if needsQuotes(v) {
+			v = `"` + v + `"`
+		}
+		if n.Field != "" {
+			return n.Field + ":" + v
+		}
+		return v
+	case OpNot:
+		return "NOT " + n.Nodes[0].group()
+	}
+	op := " AND "
+	if n.Op == OpOr {
+		op = " OR "
+	}
+	xs := make([]string, len(n.Nodes))
+	for i, c := range n.Nodes {
+		xs[i] = c.group()
+	}
+	return strings.Join(xs, op)
+}
+
+// Key returns a string that is the same for queries that mean the same thing, ignoring case
+func (n *Node) Key() string {
+	return strings.ToLower(n.String())
+}
+
+// Terms returns all of the terms in the query, including those that are negated
+func (n *Node) Terms() []*Node {
+	if n.Op == OpTerm {
+		return []*Node{n}
+	}
+	var xn []*Node
+	for _, c := range n.Nodes {
+		xn = append(xn, c.Terms()...)
+	}
+	return xn
+}
+
+// group returns the query for the node, in parentheses if it is an AND or OR
+func (n *Node) group() string {
+	if n.Op == OpAnd || n.Op == OpOr {
+		return "(" + n.String() + ")"
+	}
+	return n.String()
+}
+
+func needsQuotes(v string) bool {
+	return isOperator(v) || strings.HasPrefix(v, "-") || strings.ContainsAny(v, " :()")
+}
+
+func isOperator(v string) bool {
+	return v == "AND" || v == "OR" || v == "NOT"
+}
+
+// simplify flattens nested ANDs and ORs, removes double negatives and repeated operands, and sorts the operands
+func simplify(n *Node) *Node {
+	switch n.Op {
+	case OpNot:
+		c := simplify(n.Nodes[0])
+		if c.Op == OpNot {
+			return c.Nodes[0]
+		}
+		return &Node{Op: OpNot, Nodes: []*Node{c}}
+	case OpAnd, OpOr:
+		var xn []*Node
+		seen := map[string]bool{}
+		for _, c := range n.Nodes {
+			c = simplify(c)
+			operands := []*Node{c}
+			if c.Op == n.Op {
+				operands = c.Nodes
+			}
+			for _, o := range operands {
+				k := o.Key()
+				if !seen[k] {
+					seen[k] = true
+					xn = append(xn, o)
+				}
+			}
+		}
+		if len(xn) == 1 {
+			return xn[0]
+		}
+		sort.SliceStable(xn, func(i, j int) bool {
+			return xn[i].Key() < xn[j].Key()
+		})
+		return &Node{Op: n.Op, Nodes: xn}
+	}
+	return n
+}
+
+// parser is a recursive descent parser for the tokens of a query:
+//
+//	or      = and { "OR" and }
+//	and     = unary { [ "AND" ] unary }
+//	unary   = ( "NOT" | "-" ) unary | primary
+//	primary = "(" or ")" | [ field ":" ] ( word | phrase | "(" or ")" )
+type parser struct {
+	toks []token
+	pos  int
+	end  int // the length of the query, for errors at the end
+}
+
+func (p *parser) peek() (token, bool) {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos], true
+	}
+	return token{}, false
+}
+
+// unexpected returns an error for the next token, or for the end of the query
+func (p *parser) unexpected() error {
+	t, ok := p.peek()
+	if !ok {
+		return &SyntaxError{p.end, "query ends unexpectedly"}
+	}
+	return &SyntaxError{t.pos, "unexpected " + t.String()}
+}
+
+func (p *parser) parseOr(field string) (*Node, error) {
+	n, err := p.parseAnd(field)
+	if err != nil {
+		return nil, err
+	}
+	or := &Node{Op: OpOr, Nodes: []*Node{n}}
+	for {
+		t, ok := p.peek()
+		if !ok || t.kind != tokOr {
+			break
+		}
+		p.pos++
+		n, err = p.parseAnd(field)
+		if err != nil {
+			return nil, err
+		}
+		or.Nodes = append(or.Nodes, n)
+	}
+	if len(or.Nodes) == 1 {
+		return or.Nodes[0], nil
+	}
+	return or, nil
+}
+
+func (p *parser) parseAnd(field string) (*Node, error) {
+	n, err := p.parseUnary(field)
+	if err != nil {
+		return nil, err
+	}
+	and := &Node{Op: OpAnd, Nodes: []*Node{n}}
+	for {
+		t, ok := p.peek()
+		if !ok || t.kind == tokOr || t.kind == tokRParen {
+			break
+		}
+		if t.kind == tokAnd {
+			p.pos++
+		}
+		n, err = p.parseUnary(field)
+		if err != nil {
+			return nil, err
+		}
+		and.Nodes = append(and.Nodes, n)
+	}
+	if len(and.Nodes) == 1 {
+		return and.Nodes[0], nil
+	}
+	return and, nil
+}
+
+func (p *parser) parseUnary(field string) (*Node, error) {
+	t, ok := p.peek()
+	if ok && t.kind == tokNot {
+		p.pos++
+		n, err := p.parseUnary(field)
+		if err != nil {
+			return nil, err
+		}
+		return &Node{Op: OpNot, Nodes: []*Node{n}}, nil
+	}
+	return p.parsePrimary(field)
+}
+
+func (p *parser) parsePrimary(field string) (*Node, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, p.unexpected()
+	}
+	switch t.kind {
+	case tokWord, tokPhrase:
+		p.pos++
+		return &Node{Op: OpTerm, Field: field, Value: t.value}, nil
+	case tokLParen:
+		p.pos++
+		n, err := p.parseOr(field)
+		if err != nil {
+			return nil, err
+		}
+		t, ok = p.peek()
+		if !ok || t.kind != tokRParen {
+			return nil, &SyntaxError{p.end, "missing )"}
+		}
+		p.pos++
+		return n, nil
+	case tokField:
+		if field != "" {
+			return nil, &SyntaxError{t.pos, "a field cannot be used inside another field"}
+		}
+		f := strings.ToLower(t.value)
+		if !fields[f] {
+			return nil, &SyntaxError{t.pos, "unknown field, use title, journal or author"}
+		}
+		p.pos++
+		next, ok := p.peek()
+		if !ok || (next.kind != tokWord && next.kind != tokPhrase && next.kind != tokLParen) {
+			return nil, p.unexpected()
+		}
+		return p.parsePrimary(f)
+	}
+	return nil, p.unexpected()
+}
@@ -0,0 +1,151 @@
+package query_test
+
+import (
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/mikedonnici/rtcl-api/query"
+)
+
+func TestParse(t *testing.T) {
+	t.Run("testParse", testParse)
+	t.Run("testParseErrors", testParseErrors)
+	t.Run("testParseKey", testParseKey)
+	t.Run("testParseAST", testParseAST)
+}
+
+// testParse checks the simplified query for each input, which also checks that String parses to the same AST
+func testParse(t *testing.T) {
+	is := is.New(t)
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"heart", "heart"},
+		{"  heart   failure ", "failure AND heart"},
+		{"heart AND failure", "failure AND heart"},
+		{"heart OR cardiac", "cardiac OR heart"},
+		{"(heart OR cardiac) failure", "(cardiac OR heart) AND failure"},
+		{"heart OR cardiac failure", "(cardiac AND failure) OR heart"},
+		{`"heart   failure" acute`, `"heart failure" AND acute`},
+		{`"heart"`, "heart"},
+		{"NOT stent", "NOT stent"},
+		{"-stent angina", "angina AND NOT stent"},
+		{"NOT NOT stent", "stent"},
+		{"NOT (a OR b)", "NOT (a OR b)"},
+		{"beta-blocker", "beta-blocker"},
+		{"heart and failure", "and AND failure AND heart"},
+		{`"AND" x`, `"AND" AND x`},
+		{"title:stent", "title:stent"},
+		{"Title:Stent", "title:Stent"},
+		{`journal:"Am J Cardiol"`, `journal:"Am J Cardiol"`},
+		{`author:(smith OR jones)`, "author:jones OR author:smith"},
+		{"title:(heart failure) -title:review", "NOT title:review AND title:failure AND title:heart"},
+		{"a a A", "a"},
+		{"(a AND (b AND c))", "a AND b AND c"},
+		{"a OR (b OR a)", "a OR b"},
+	}
+	for _, c := range cases {
+		n, err := query.Parse(c.in)
+		if err != nil {
+			t.Errorf("Parse(%q) error: %v", c.in, err)
+			continue
+		}
+		if n.String() != c.want {
+			t.Errorf("Parse(%q) = %s, want %s", c.in, n.String(), c.want)
+		}
+		n2, err := query.Parse(n.String())
+		is.NoErr(err)                     // the string of the AST should parse
+		is.Equal(n2.String(), n.String()) // the string of the AST should parse to the same AST
+	}
+}
+
+func testParseErrors(t *testing.T) {
+	cases := []struct {
+		in  string
+		pos int
+	}{
+		{"", 0},
+		{"   ", 0},
+		{"heart AND", 9},
+		{"OR heart", 0},
+		{"heart OR OR failure", 9},
+		{"(heart failure", 14},
+		{"heart)", 5},
+		{`"heart failure`, 0},
+		{`heart ""`, 6},
+		{"NOT", 3},
+		{"- heart", 0},
+		{"size:large", 0},
+		{"title:journal:x", 6},
+		{"title:(journal:x)", 7},
+		{":heart", 0},
+		{"title:", 6},
+		{"()", 1},
+	}
+	for _, c := range cases {
+		_, err := query.Parse(c.in)
+		se, ok := err.(*query.SyntaxError)
+		if !ok {
+			t.Errorf("Parse(%q) error = %v, want a SyntaxError", c.in, err)
+			continue
+		}
+		if se.Pos != c.pos {
+			t.Errorf("Parse(%q) error %q at %d, want %d", c.in, se.Msg, se.Pos, c.pos)
+		}
+	}
+}
+
+// testParseKey checks that queries that mean the same thing have the same key
+func testParseKey(t *testing.T) {
+	same := [][2]string{
+		{"heart failure", "Failure  HEART"},
+		{"heart AND failure", "failure heart"},
+		{"(a OR b) c", "c AND (b OR a)"},
+		{"-stent angina", "angina NOT stent"},
+		{`title:"Heart failure"`, `TITLE:"heart  failure"`},
+		{"author:(smith OR jones)", "author:jones OR author:smith"},
+	}
+	for _, c := range same {
+		a, err := query.Parse(c[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := query.Parse(c[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Key() != b.Key() {
+			t.Errorf("%q and %q should have the same key, got %s and %s", c[0], c[1], a.Key(), b.Key())
+		}
+	}
+
+	different := [][2]string{
+		{"heart failure", `"heart failure"`},
+		{"a OR b c", "(a OR b) c"},
+		{"title:stent", "stent"},
+		{"a -b", "b -a"},
+	}
+	for _, c := range different {
+		a, _ := query.Parse(c[0])
+		b, _ := query.Parse(c[1])
+		if a.Key() == b.Key() {
+			t.Errorf("%q and %q should not have the same key", c[0], c[1])
+		}
+	}
+}
+
+func testParseAST(t *testing.T) {
+	is := is.New(t)
+	n, err := query.Parse(`(heart OR cardiac) -journal:"Am J Cardiol"`)
+	is.NoErr(err)
+	is.Equal(n.Op, query.OpAnd)
+	is.Equal(len(n.Nodes), 2)
+	is.Equal(n.Nodes[0].Op, query.OpOr)
+	not := n.Nodes[1]
+	is.Equal(not.Op, query.OpNot)
+	is.Equal(not.Nodes[0].Op, query.OpTerm)
+	is.Equal(not.Nodes[0].Field, query.FieldJournal)
+	is.Equal(not.Nodes[0].Value, "Am J Cardiol")
+	is.Equal(len(n.Terms()), 3)
+}
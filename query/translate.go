@@ -0,0 +1,206 @@
+package query
+
+import (
+	"strings"
+)
+
+// TranslateError is returned when a query cannot be expressed in the syntax of a search backend
+type TranslateError struct {
+	Target string
+	Reason string
+}
+
+func (e *TranslateError) Error() string {
+	return "query cannot be used with " + e.Target + ": " + e.Reason
+}
+
+// pubmedTags are the PubMed search field tags for the query fields
+var pubmedTags = map[string]string{
+	FieldTitle:   "ti",
+	FieldJournal: "jour",
+	FieldAuthor:  "au",
+}
+
+// PubMed returns the query in PubMed term syntax. PubMed has no unary NOT, so a negated term must be ANDed with at
+// least one term that is not negated.
+func (n *Node) PubMed() (string, error) {
+	switch n.Op {
+	case OpTerm:
+		if n.Field == "" {
+			if isPubMedWord(n.Value) {
+				return n.Value, nil
+			}
+			return `"` + n.Value + `"`, nil
+		}
+		return `"` + n.Value + `"[` + pubmedTags[n.Field] + `]`, nil
+	case OpNot:
+		return "", &TranslateError{"PubMed", "NOT must be combined with AND with a term that is not negated"}
+	case OpOr:
+		xs := make([]string, len(n.Nodes))
+		for i, c := range n.Nodes {
+			s, err := c.PubMed()
+			if err != nil {
+				return "", err
+			}
+			xs[i] = pubmedGroup(c, s)
+		}
+		return strings.Join(xs, " OR "), nil
+	}
+
+	// PubMed evaluates left to right, so the negated operands go at the end: a AND b NOT c NOT d
+	var and, not []string
+	for _, c := range n.Nodes {
+		neg := c.Op == OpNot
+		if neg {
+			c = c.Nodes[0]
+		}
+		s, err := c.PubMed()
+		if err != nil {
+			return "", err
+		}
+		s = pubmedGroup(c, s)
+		if neg {
+			not = append(not, s)
+		} else {
+			and = append(and, s)
+		}
+	}
+	if len(and) == 0 {
+		return "", &TranslateError{"PubMed", "NOT must be combined with AND with a term that is not negated"}
+	}
+	s := strings.Join(and, " AND ")
+	for _, x := range not {
+		s += " NOT " + x
+	}
+	return s, nil
+}
+
+func pubmedGroup(n *Node, s string) string {
+	if n.Op == OpAnd || n.Op == OpOr {
+		return "(" + s + ")"
+	}
+	return s
+}
+
+// isPubMedWord returns true if the value can be used in a PubMed term without quotes, which would turn off
+// automatic term mapping
+func isPubMedWord(v string) bool {
+	if isOperator(v) {
+		return false
+	}
+	for _, r := range v {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '\'') {
+			return false
+		}
+	}
+	return true
+}
+
+// algoliaFacets are the attributes of the articles index for the fields that are filtered on. The author names
+// are stored in keywords.
+var algoliaFacets = map[string]string{
+	FieldJournal: "pubNameAbbr",
+	FieldAuthor:  "keywords",
+}
+
+// Algolia is a query translated for an Algolia search. Query is the full text part, for a search with
+// advancedSyntax, and Filters is the facet filters. If Attributes is not empty the search should be limited to them
+// with restrictSearchableAttributes.
+type Algolia struct {
+	Query      string
+	Filters    string
+	Attributes []string
+}
+
+// Algolia returns the query translated for an Algolia search. Algolia full text search cannot do OR, and its filters
+// must be ANDed groups of ORed filters, so the query must be an AND of clauses that are either:
+//
+//   - words, phrases or negated words and phrases, which can all be limited to the title
+//   - journal or author terms, negated terms, or ORs of terms
+func (n *Node) Algolia() (Algolia, error) {
+	var a Algolia
+	clauses := []*Node{n}
+	if n.Op == OpAnd {
+		clauses = n.Nodes
+	}
+
+	var text, filters []string
+	textField := "-" // the field of the text terms, - until there is one
+	for _, c := range clauses {
+		facet, ok := facetClause(c)
+		if !ok {
+			return a, &TranslateError{"Algolia", "journal and author cannot be combined with other terms in OR or NOT"}
+		}
+		if facet {
+			f, err := algoliaFilter(c)
+			if err != nil {
+				return a, err
+			}
+			filters = append(filters, f)
+			continue
+		}
+
+		neg := c.Op == OpNot
+		if neg {
+			c = c.Nodes[0]
+		}
+		if c.Op != OpTerm {
+			return a, &TranslateError{"Algolia", "only journal and author can be used with OR or grouped NOT"}
+		}
+		if textField != "-" && c.Field != textField {
+			return a, &TranslateError{"Algolia", "title terms cannot be combined with terms for any field"}
+		}
+		textField = c.Field
+		t := c.Value
+		if strings.Contains(t, " ") {
+			t = `"` + t + `"`
+		}
+		if neg {
+			t = "-" + t
+		}
+		text = append(text, t)
+	}
+
+	a.Query = strings.Join(text, " ")
+	a.Filters = strings.Join(filters, " AND ")
+	if textField == FieldTitle {
+		a.Attributes = []string{"title"}
+	}
+	return a, nil
+}
+
+// facetClause returns true if all of the terms in the clause are for facet fields, and ok is false if some are and
+// some are not
+func facetClause(n *Node) (facet bool, ok bool) {
+	var facets, others int
+	for _, t := range n.Terms() {
+		if _, ok := algoliaFacets[t.Field]; ok {
+			facets++
+		} else {
+			others++
+		}
+	}
+	return facets > 0, facets == 0 || others == 0
+}
+
+// algoliaFilter returns the filter for a clause of facet terms
+func algoliaFilter(n *Node) (string, error) {
+	switch n.Op {
+	case OpTerm:
+		return algoliaFacets[n.Field] + `:"` + n.Value + `"`, nil
+	case OpNot:
+		if n.Nodes[0].Op == OpTerm {
+			return "NOT " + algoliaFacets[n.Nodes[0].Field] + `:"` + n.Nodes[0].Value + `"`, nil
+		}
+	case OpOr:
+		xs := make([]string, len(n.Nodes))
+		for i, c := range n.Nodes {
+			if c.Op != OpTerm {
+				return "", &TranslateError{"Algolia", "journal and author filters in OR must not be grouped or negated"}
+			}
+			xs[i] = algoliaFacets[c.Field] + `:"` + c.Value + `"`
+		}
+		return "(" + strings.Join(xs, " OR ") + ")", nil
+	}
+	return "", &TranslateError{"Algolia", "NOT can only be used on a single journal or author"}
+}
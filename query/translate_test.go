@@ -0,0 +1,107 @@
+package query_test
+
+import (
+	"testing"
+
+	"github.com/mikedonnici/rtcl-api/query"
+)
+
+func TestTranslate(t *testing.T) {
+	t.Run("testPubMed", testPubMed)
+	t.Run("testAlgolia", testAlgolia)
+}
+
+func testPubMed(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"heart", "heart"},
+		{"heart failure", "failure AND heart"},
+		{`"heart failure"`, `"heart failure"`},
+		{"(heart OR cardiac) failure", "(cardiac OR heart) AND failure"},
+		{"angina -stent -review", "angina NOT review NOT stent"},
+		{"(a OR b) NOT (c OR d)", "(a OR b) NOT (c OR d)"},
+		{"title:stent", `"stent"[ti]`},
+		{`journal:"Am J Cardiol" author:"Smith J"`, `"Smith J"[au] AND "Am J Cardiol"[jour]`},
+		{"β-blocker", `"β-blocker"`},
+		{`"OR"`, `"OR"`},
+	}
+	for _, c := range cases {
+		n, err := query.Parse(c.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := n.PubMed()
+		if err != nil {
+			t.Errorf("PubMed(%q) error: %v", c.in, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("PubMed(%q) = %s, want %s", c.in, got, c.want)
+		}
+	}
+
+	for _, in := range []string{"NOT stent", "-a -b", "a OR NOT b"} {
+		n, err := query.Parse(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = n.PubMed()
+		if _, ok := err.(*query.TranslateError); !ok {
+			t.Errorf("PubMed(%q) error = %v, want a TranslateError", in, err)
+		}
+	}
+}
+
+func testAlgolia(t *testing.T) {
+	cases := []struct {
+		in         string
+		query      string
+		filters    string
+		attributes []string
+	}{
+		{"heart failure", "failure heart", "", nil},
+		{`"heart failure" -stent`, `"heart failure" -stent`, "", nil},
+		{"title:(heart failure)", "failure heart", "", []string{"title"}},
+		{`journal:"Am J Cardiol"`, "", `pubNameAbbr:"Am J Cardiol"`, nil},
+		{`stent (journal:Circulation OR journal:Heart) -author:"Smith J"`, "stent",
+			`(pubNameAbbr:"Circulation" OR pubNameAbbr:"Heart") AND NOT keywords:"Smith J"`, nil},
+		{"-journal:Chest", "", `NOT pubNameAbbr:"Chest"`, nil},
+	}
+	for _, c := range cases {
+		n, err := query.Parse(c.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := n.Algolia()
+		if err != nil {
+			t.Errorf("Algolia(%q) error: %v", c.in, err)
+			continue
+		}
+		if got.Query != c.query || got.Filters != c.filters || len(got.Attributes) != len(c.attributes) {
+			t.Errorf("Algolia(%q) = %+v, want query %s filters %s attributes %v", c.in, got, c.query, c.filters,
+				c.attributes)
+		}
+	}
+
+	unsupported := []string{
+		"heart OR cardiac",
+		"NOT (a b)",
+		"stent OR journal:Chest",
+		"title:stent heart",
+		"journal:Chest OR NOT journal:Heart",
+		"NOT (journal:Chest OR journal:Heart)",
+		"(journal:Chest author:Smith) OR journal:Heart",
+	}
+	for _, in := range unsupported {
+		n, err := query.Parse(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = n.Algolia()
+		if _, ok := err.(*query.TranslateError); !ok {
+			t.Errorf("Algolia(%q) error = %v, want a TranslateError", in, err)
+		}
+	}
+}
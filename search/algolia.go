@@ -0,0 +1,176 @@
+package search
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/algolia/algoliasearch-client-go/algoliasearch"
+	"github.com/mikedonnici/rtcl-api/query"
+)
+
+// AlgoliaIndexName is the name of the Algolia index of articles
+const AlgoliaIndexName = "articles"
+
+// Algolia is a SearchIndex on an Algolia index
+type Algolia struct {
+	index algoliasearch.Index
+}
+
+// NewAlgolia returns the Algolia index with the name, for the app and API key. Indexing needs the admin key.
+func NewAlgolia(appID, apiKey, name string) *Algolia {
+	return NewAlgoliaIndex(algoliasearch.NewClient(appID, apiKey).InitIndex(name))
+}
+
+// NewAlgoliaIndex returns a SearchIndex on an index from an Algolia client
+func NewAlgoliaIndex(index algoliasearch.Index) *Algolia {
+	return &Algolia{index: index}
+}
+
+// Upsert adds the documents as objects, which replaces any with the same objectID
+func (a *Algolia) Upsert(docs ...Document) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	objects := make([]algoliasearch.Object, len(docs))
+	for i, d := range docs {
+		objects[i] = d.Object()
+	}
+	_, err := a.index.AddObjects(objects)
+	return err
+}
+
+func (a *Algolia) Delete(ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := a.index.DeleteObjects(ids)
+	return err
+}
+
+func (a *Algolia) DeleteBy(f Filter) error {
+	if f.Empty() {
+		return ErrEmptyFilter
+	}
+	_, err := a.index.DeleteBy(algoliasearch.Map{"filters": algoliaFilters(f)})
+	return err
+}
+
+// Search translates the query text with the query package, so it returns a *query.TranslateError for a query that
+// Algolia cannot run. The Score of the hits is zero as Algolia does not return one.
+func (a *Algolia) Search(q Query) (Result, error) {
+	var r Result
+	params := algoliasearch.Map{
+		"advancedSyntax":        true,
+		"attributesToHighlight": []string{"title"},
+		"attributesToSnippet":   []string{fmt.Sprintf("summary:%d", snippetWords)},
+		"highlightPreTag":       "<em>",
+		"highlightPostTag":      "</em>",
+		"snippetEllipsisText":   "…",
+		"page":                  q.Page,
+	}
+	if q.HitsPerPage > 0 {
+		hpp := q.HitsPerPage
+		if hpp > MaxHitsPerPage {
+			hpp = MaxHitsPerPage
+		}
+		params["hitsPerPage"] = hpp
+	}
+
+	var text string
+	filters := []string{}
+	if q.Text != "" {
+		n, err := query.Parse(q.Text)
+		if err != nil {
+			return r, err
+		}
+		aq, err := n.Algolia()
+		if err != nil {
+			return r, err
+		}
+		text = aq.Query
+		if aq.Filters != "" {
+			filters = append(filters, aq.Filters)
+		}
+		if len(aq.Attributes) > 0 {
+			params["restrictSearchableAttributes"] = aq.Attributes
+		}
+	}
+	if f := algoliaFilters(q.Filter()); f != "" {
+		filters = append(filters, f)
+	}
+	if len(filters) > 0 {
+		params["filters"] = strings.Join(filters, " AND ")
+	}
+
+	res, err := a.index.Search(text, params)
+	if err != nil {
+		return r, err
+	}
+	r = Result{
+		Hits:        make([]Hit, 0, len(res.Hits)),
+		NbHits:      res.NbHits,
+		Page:        res.Page,
+		NbPages:     res.NbPages,
+		HitsPerPage: res.HitsPerPage,
+	}
+	for _, h := range res.Hits {
+		d, err := DocumentFromObject(h)
+		if err != nil {
+			return r, err
+		}
+		r.Hits = append(r.Hits, Hit{
+			Document: d,
+			Highlight: Highlight{
+				Title:   algoliaValue(h, "_highlightResult", "title"),
+				Summary: algoliaValue(h, "_snippetResult", "summary"),
+			},
+		})
+	}
+	return r, nil
+}
+
+func (a *Algolia) SetSettings(s Settings) error {
+	m := algoliasearch.Map{}
+	if len(s.SearchableAttributes) > 0 {
+		m["searchableAttributes"] = s.SearchableAttributes
+	}
+	if len(s.AttributesForFaceting) > 0 {
+		m["attributesForFaceting"] = s.AttributesForFaceting
+	}
+	if len(s.CustomRanking) > 0 {
+		m["customRanking"] = s.CustomRanking
+	}
+	if s.HitsPerPage > 0 {
+		m["hitsPerPage"] = s.HitsPerPage
+	}
+	_, err := a.index.SetSettings(m)
+	return err
+}
+
+// algoliaFilters returns the filter as an Algolia filters string, or an empty string if the filter is empty
+func algoliaFilters(f Filter) string {
+	var xs []string
+	if len(f.Categories) > 0 {
+		cs := make([]string, len(f.Categories))
+		for i, c := range f.Categories {
+			cs[i] = fmt.Sprintf("category:%q", c)
+		}
+		xs = append(xs, "("+strings.Join(cs, " OR ")+")")
+	}
+	if !f.From.IsZero() {
+		xs = append(xs, fmt.Sprintf("pubTime >= %d", f.From.Unix()))
+	}
+	if !f.To.IsZero() {
+		xs = append(xs, fmt.Sprintf("pubTime <= %d", f.To.Unix()))
+	}
+	return strings.Join(xs, " AND ")
+}
+
+// algoliaValue returns the value of the attribute in the highlight or snippet result of a hit, or an empty string
+// if it is not there
+func algoliaValue(h algoliasearch.Map, result, attribute string) string {
+	m, _ := h[result].(map[string]interface{})
+	v, _ := m[attribute].(map[string]interface{})
+	s, _ := v["value"].(string)
+	return s
+}
@@ -0,0 +1,43 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+)
+
+// span is a token in a text, with its byte offsets so that it can be highlighted
+type span struct {
+	term       string
+	start, end int
+}
+
+// tokenize splits text into lower case tokens of letters and digits. There is no stemming and no stop words, so
+// that phrases match exactly, and BM25 keeps common words from dominating the scores.
+func tokenize(text string) []span {
+	var xs []span
+	start := -1
+	for i, r := range text {
+		word := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if word && start < 0 {
+			start = i
+		}
+		if !word && start >= 0 {
+			xs = append(xs, span{strings.ToLower(text[start:i]), start, i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		xs = append(xs, span{strings.ToLower(text[start:]), start, len(text)})
+	}
+	return xs
+}
+
+// terms returns just the tokens of the text
+func terms(text string) []string {
+	xs := tokenize(text)
+	terms := make([]string, len(xs))
+	for i, s := range xs {
+		terms[i] = s.term
+	}
+	return terms
+}
@@ -0,0 +1,96 @@
+// Package search is the article search for the API and the indexer. SearchIndex is the interface to a search
+// backend, which is either Algolia or Index, a full-text index that runs in the same process as the API for small
+// deployments. Index ranks results with BM25 and persists its documents in a Store so it can be rebuilt when it is
+// opened. Queries use the language of the query package. Fake is a SearchIndex for tests.
+package search
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/mikedonnici/rtcl-api/datastore"
+)
+
+// Document is an article in the index. The fields are the same as the objects that cmd/indexer sends to Algolia,
+// so the same objects can be added to either.
+type Document struct {
+	ObjectID    string   `json:"objectID" bson:"_id"`
+	Category    string   `json:"category" bson:"category"`
+	Title       string   `json:"title" bson:"title"`
+	URL         string   `json:"url" bson:"url"`
+	Keywords    []string `json:"keywords" bson:"keywords"`
+	PubName     string   `json:"pubName" bson:"pubName"`
+	PubNameAbbr string   `json:"pubNameAbbr" bson:"pubNameAbbr"`
+	PubVolume   string   `json:"pubVolume" bson:"pubVolume"`
+	PubIssue    string   `json:"pubIssue" bson:"pubIssue"`
+	PubPageRef  string   `json:"pubPageRef" bson:"pubPageRef"`
+	PubTime     int64    `json:"pubTime" bson:"pubTime"`
+	PubDate     string   `json:"pubDate" bson:"pubDate"`
+	Summary     string   `json:"summary" bson:"summary"`
+}
+
+// DocumentFromObject converts an object built for Algolia, such as an algoliasearch.Object, to a Document
+func DocumentFromObject(o map[string]interface{}) (Document, error) {
+	var d Document
+	b, err := json.Marshal(o)
+	if err != nil {
+		return d, err
+	}
+	err = json.Unmarshal(b, &d)
+	if err != nil {
+		return d, err
+	}
+	if d.ObjectID == "" {
+		return d, errors.New("object has no objectID")
+	}
+	return d, nil
+}
+
+// Published returns the publication time of the article
+func (d Document) Published() time.Time {
+	return time.Unix(d.PubTime, 0).UTC()
+}
+
+// Object returns the document as an object for Algolia. Every field is set, as Algolia needs a summary attribute
+// for snippets to work.
+func (d Document) Object() map[string]interface{} {
+	kw := d.Keywords
+	if kw == nil {
+		kw = []string{}
+	}
+	return map[string]interface{}{
+		"objectID":    d.ObjectID,
+		"category":    d.Category,
+		"title":       d.Title,
+		"url":         d.URL,
+		"keywords":    kw,
+		"pubName":     d.PubName,
+		"pubNameAbbr": d.PubNameAbbr,
+		"pubVolume":   d.PubVolume,
+		"pubIssue":    d.PubIssue,
+		"pubPageRef":  d.PubPageRef,
+		"pubTime":     d.PubTime,
+		"pubDate":     d.PubDate,
+		"summary":     d.Summary,
+	}
+}
+
+// Article returns the document as a datastore.Article, without the Created and Updated times
+func (d Document) Article() datastore.Article {
+	return datastore.Article{
+		PMID:             d.ObjectID,
+		Category:         d.Category,
+		Published:        d.Published(),
+		Title:            d.Title,
+		Summary:          d.Summary,
+		Keywords:         d.Keywords,
+		URL:              d.URL,
+		SourceName:       d.PubName,
+		SourceNameAbbrev: d.PubNameAbbr,
+		SourceVolume:     d.PubVolume,
+		SourceIssue:      d.PubIssue,
+		SourcePages:      d.PubPageRef,
+		SourcePubDate:    d.PubDate,
+	}
+}
@@ -0,0 +1,81 @@
+package search
+
+import "sync"
+
+// Fake is an in-memory SearchIndex for tests. It records the calls made to it, and answers queries from a local
+// Index of the upserted documents. If Err is set every method returns it without doing anything.
+type Fake struct {
+	mu       sync.Mutex
+	index    *Index
+	Err      error
+	Upserts  [][]Document // the documents of each call to Upsert
+	Deletes  [][]string   // the ids of each call to Delete
+	Filters  []Filter     // the filter of each call to DeleteBy
+	Queries  []Query      // the query of each call to Search
+	Settings []Settings   // the settings of each call to SetSettings
+}
+
+// NewFake returns an empty fake index
+func NewFake() *Fake {
+	return &Fake{index: NewIndex()}
+}
+
+// Len returns the number of documents in the fake index
+func (f *Fake) Len() int {
+	return f.index.Len()
+}
+
+// Document returns the document with the id
+func (f *Fake) Document(id string) (Document, bool) {
+	return f.index.Document(id)
+}
+
+func (f *Fake) Upsert(docs ...Document) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	f.Upserts = append(f.Upserts, docs)
+	return f.index.Add(docs...)
+}
+
+func (f *Fake) Delete(ids ...string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	f.Deletes = append(f.Deletes, ids)
+	return f.index.Delete(ids...)
+}
+
+func (f *Fake) DeleteBy(filter Filter) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	f.Filters = append(f.Filters, filter)
+	return f.index.DeleteBy(filter)
+}
+
+func (f *Fake) Search(q Query) (Result, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return Result{}, f.Err
+	}
+	f.Queries = append(f.Queries, q)
+	return f.index.Search(q)
+}
+
+func (f *Fake) SetSettings(s Settings) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return f.Err
+	}
+	f.Settings = append(f.Settings, s)
+	return f.index.SetSettings(s)
+}
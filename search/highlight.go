@@ -0,0 +1,108 @@
+package search
+
+import (
+	"html"
+	"strings"
+
+	"github.com/mikedonnici/rtcl-api/query"
+)
+
+// snippetWords is the number of words in a summary snippet, and snippetLead the number before the first match
+const (
+	snippetWords = 30
+	snippetLead  = 8
+)
+
+// Highlight is the title and a snippet of the summary as HTML, with the words that matched the query in <em> tags
+type Highlight struct {
+	Title   string `json:"title"`
+	Summary string `json:"summary"`
+}
+
+// highlightTerms returns the terms of the query that are not negated
+func highlightTerms(n *query.Node) map[string]bool {
+	ht := map[string]bool{}
+	var walk func(n *query.Node)
+	walk = func(n *query.Node) {
+		switch n.Op {
+		case query.OpNot:
+			return
+		case query.OpTerm:
+			for _, t := range terms(n.Value) {
+				ht[t] = true
+			}
+			return
+		}
+		for _, c := range n.Nodes {
+			walk(c)
+		}
+	}
+	if n != nil {
+		walk(n)
+	}
+	return ht
+}
+
+func newHighlight(d Document, ht map[string]bool) Highlight {
+	return Highlight{
+		Title:   highlight(d.Title, tokenize(d.Title), ht),
+		Summary: snippet(d.Summary, ht),
+	}
+}
+
+// snippet returns about snippetWords words of the text, starting a little before the first highlighted word
+func snippet(text string, ht map[string]bool) string {
+	xs := tokenize(text)
+	if len(xs) <= snippetWords {
+		return highlight(text, xs, ht)
+	}
+	first := 0
+	for i, s := range xs {
+		if ht[s.term] {
+			first = i
+			break
+		}
+	}
+	start := first - snippetLead
+	if start < 0 {
+		start = 0
+	}
+	end := start + snippetWords
+	if end > len(xs) {
+		end = len(xs)
+		start = end - snippetWords
+	}
+
+	window := xs[start:end]
+	offset := window[0].start
+	shifted := make([]span, len(window))
+	for i, s := range window {
+		shifted[i] = span{s.term, s.start - offset, s.end - offset}
+	}
+	h := highlight(text[offset:window[len(window)-1].end], shifted, ht)
+	if start > 0 {
+		h = "… " + h
+	}
+	if end < len(xs) {
+		h += " …"
+	}
+	return h
+}
+
+// highlight returns the text escaped for HTML, with the tokens in ht wrapped in <em> tags
+func highlight(text string, xs []span, ht map[string]bool) string {
+	var b strings.Builder
+	last := 0
+	for _, s := range xs {
+		if !ht[s.term] {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[last:s.start]))
+		b.WriteString("<em>")
+		b.WriteString(html.EscapeString(text[s.start:s.end]))
+		b.WriteString("</em>")
+		last = s.end
+	}
+	b.WriteString(html.EscapeString(text[last:]))
+	return b.String()
+}
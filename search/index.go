@@ -0,0 +1,502 @@
+package search
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mikedonnici/rtcl-api/query"
+)
+
+// BM25 parameters
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// DefaultHitsPerPage is the page size when a Query does not set one, and MaxHitsPerPage the largest allowed.
+// MaxPage is the last page that clients are allowed to ask for.
+const (
+	DefaultHitsPerPage = 20
+	MaxHitsPerPage     = 100
+	MaxPage            = 1000
+)
+
+// field is an indexed field of a Document
+type field int
+
+const (
+	fieldTitle field = iota
+	fieldSummary
+	fieldKeywords
+	fieldJournal
+	numFields
+)
+
+// fieldWeights scale the term frequencies of each field, so a match in the title counts for more than one in the
+// summary
+var fieldWeights = [numFields]float64{
+	fieldTitle:    3,
+	fieldSummary:  1,
+	fieldKeywords: 1.5,
+	fieldJournal:  1,
+}
+
+// queryFields are the indexed fields searched for each field of the query language
+var queryFields = map[string][]field{
+	"":                 {fieldTitle, fieldSummary, fieldKeywords, fieldJournal},
+	query.FieldTitle:   {fieldTitle},
+	query.FieldJournal: {fieldJournal},
+	query.FieldAuthor:  {fieldKeywords},
+}
+
+// listGap separates the values of a list field, such as keywords, so that a phrase cannot match across two values
+const listGap = 100
+
+// posting holds the positions of a term in each field of a document
+type posting [numFields][]int
+
+// entry is an indexed document
+type entry struct {
+	doc    Document
+	length float64  // weighted number of tokens
+	terms  []string // distinct terms, to remove the postings
+}
+
+// Index is an in-memory inverted index of Documents. It is safe for concurrent use. If it has a Store, changes are
+// saved to the store before the index is updated.
+type Index struct {
+	mu       sync.RWMutex
+	store    Store
+	settings Settings
+	docs     map[string]*entry
+	postings map[string]map[string]*posting // term -> objectID -> positions
+	length   float64                        // total weighted length, for the average
+}
+
+// NewIndex returns an empty index that is not persisted
+func NewIndex() *Index {
+	return &Index{
+		docs:     map[string]*entry{},
+		postings: map[string]map[string]*posting{},
+	}
+}
+
+// Open returns an index of the documents in the store, which changes to the index are saved to
+func Open(store Store) (*Index, error) {
+	ix := NewIndex()
+	ix.store = store
+	return ix, ix.Reload()
+}
+
+// Reload rebuilds the index from its store, eg after the indexer has added documents from another process
+func (ix *Index) Reload() error {
+	if ix.store == nil {
+		return nil
+	}
+	xd, err := ix.store.Load()
+	if err != nil {
+		return err
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.docs = map[string]*entry{}
+	ix.postings = map[string]map[string]*posting{}
+	ix.length = 0
+	for _, d := range xd {
+		ix.add(d)
+	}
+	return nil
+}
+
+// Len returns the number of documents in the index
+func (ix *Index) Len() int {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	return len(ix.docs)
+}
+
+// Add adds documents to the index, replacing any with the same ObjectID
+func (ix *Index) Add(docs ...Document) error {
+	if ix.store != nil {
+		err := ix.store.Save(docs...)
+		if err != nil {
+			return err
+		}
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	for _, d := range docs {
+		ix.add(d)
+	}
+	return nil
+}
+
+// Upsert is the same as Add, for SearchIndex
+func (ix *Index) Upsert(docs ...Document) error {
+	return ix.Add(docs...)
+}
+
+// AddObjects adds objects built for Algolia to the index, see DocumentFromObject
+func (ix *Index) AddObjects(objects ...map[string]interface{}) error {
+	docs := make([]Document, len(objects))
+	for i, o := range objects {
+		d, err := DocumentFromObject(o)
+		if err != nil {
+			return err
+		}
+		docs[i] = d
+	}
+	return ix.Add(docs...)
+}
+
+// Delete removes documents from the index. Ids that are not in the index are ignored.
+func (ix *Index) Delete(ids ...string) error {
+	if ix.store != nil {
+		err := ix.store.Delete(ids...)
+		if err != nil {
+			return err
+		}
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	for _, id := range ids {
+		ix.remove(id)
+	}
+	return nil
+}
+
+// DeleteBy removes the documents that match the filter. It returns ErrEmptyFilter rather than deleting every
+// document.
+func (ix *Index) DeleteBy(f Filter) error {
+	if f.Empty() {
+		return ErrEmptyFilter
+	}
+	var ids []string
+	ix.mu.RLock()
+	for id, e := range ix.docs {
+		if f.Match(e.doc) {
+			ids = append(ids, id)
+		}
+	}
+	ix.mu.RUnlock()
+	if len(ids) == 0 {
+		return nil
+	}
+	return ix.Delete(ids...)
+}
+
+// SetSettings sets the default page size. The other settings are ignored, as the fields and ranking of the index
+// are fixed.
+func (ix *Index) SetSettings(s Settings) error {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.settings = s
+	return nil
+}
+
+// Document returns the document with the id
+func (ix *Index) Document(id string) (Document, bool) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	e, ok := ix.docs[id]
+	if !ok {
+		return Document{}, false
+	}
+	return e.doc, true
+}
+
+// add indexes the document, which must be called with the lock held
+func (ix *Index) add(d Document) {
+	ix.remove(d.ObjectID)
+
+	var fields [numFields][]string
+	fields[fieldTitle] = terms(d.Title)
+	fields[fieldSummary] = terms(d.Summary)
+	fields[fieldKeywords] = listTerms(d.Keywords)
+	fields[fieldJournal] = listTerms([]string{d.PubName, d.PubNameAbbr})
+
+	e := &entry{doc: d}
+	for f, xt := range fields {
+		for pos, t := range xt {
+			if t == "" {
+				continue // a gap between list values
+			}
+			docs, ok := ix.postings[t]
+			if !ok {
+				docs = map[string]*posting{}
+				ix.postings[t] = docs
+			}
+			p, ok := docs[d.ObjectID]
+			if !ok {
+				p = &posting{}
+				docs[d.ObjectID] = p
+				e.terms = append(e.terms, t)
+			}
+			p[f] = append(p[f], pos)
+			e.length += fieldWeights[f]
+		}
+	}
+	ix.docs[d.ObjectID] = e
+	ix.length += e.length
+}
+
+// remove removes the document from the index, which must be called with the lock held
+func (ix *Index) remove(id string) {
+	e, ok := ix.docs[id]
+	if !ok {
+		return
+	}
+	for _, t := range e.terms {
+		delete(ix.postings[t], id)
+		if len(ix.postings[t]) == 0 {
+			delete(ix.postings, t)
+		}
+	}
+	ix.length -= e.length
+	delete(ix.docs, id)
+}
+
+// listTerms returns the terms of each value, separated by empty gaps of listGap terms
+func listTerms(values []string) []string {
+	var xt []string
+	for i, v := range values {
+		if i > 0 {
+			xt = append(xt, make([]string, listGap)...)
+		}
+		xt = append(xt, terms(v)...)
+	}
+	return xt
+}
+
+// Query is a search of the index
+type Query struct {
+	Text        string    // in the query language, see package query, or empty to match every document
+	Categories  []string  // only articles in these categories, or any category if empty
+	From        time.Time // only articles published at or after From, if it is not zero
+	To          time.Time // only articles published at or before To, if it is not zero
+	Page        int       // the page of results, from 0
+	HitsPerPage int       // the default of the index if zero
+}
+
+// Filter returns the filter of the query
+func (q Query) Filter() Filter {
+	return Filter{Categories: q.Categories, From: q.From, To: q.To}
+}
+
+// Result is a page of hits for a Query
+type Result struct {
+	Hits        []Hit `json:"hits"`
+	NbHits      int   `json:"nbHits"`
+	Page        int   `json:"page"`
+	NbPages     int   `json:"nbPages"`
+	HitsPerPage int   `json:"hitsPerPage"`
+}
+
+// Hit is a document that matches a query, with its BM25 score and the matched words highlighted
+type Hit struct {
+	Document
+	Score     float64   `json:"score"`
+	Highlight Highlight `json:"highlight"`
+}
+
+// Search returns a page of the documents that match the query, ranked by score and then by publication date, newest
+// first. It returns a *query.SyntaxError if the text does not parse.
+func (ix *Index) Search(q Query) (Result, error) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	r := Result{Page: q.Page, HitsPerPage: q.HitsPerPage}
+	if r.HitsPerPage <= 0 {
+		r.HitsPerPage = ix.settings.HitsPerPage
+	}
+	if r.HitsPerPage <= 0 {
+		r.HitsPerPage = DefaultHitsPerPage
+	}
+	if r.HitsPerPage > MaxHitsPerPage {
+		r.HitsPerPage = MaxHitsPerPage
+	}
+	if r.Page < 0 {
+		r.Page = 0
+	}
+
+	var root *query.Node
+	if q.Text != "" {
+		var err error
+		root, err = query.Parse(q.Text)
+		if err != nil {
+			return r, err
+		}
+	}
+
+	var scores map[string]float64
+	if root == nil {
+		scores = ix.all()
+	} else {
+		scores = ix.eval(root)
+	}
+
+	f := q.Filter()
+	var hits []Hit
+	for id, score := range scores {
+		d := ix.docs[id].doc
+		if !f.Match(d) {
+			continue
+		}
+		hits = append(hits, Hit{Document: d, Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		if hits[i].PubTime != hits[j].PubTime {
+			return hits[i].PubTime > hits[j].PubTime
+		}
+		return hits[i].ObjectID < hits[j].ObjectID
+	})
+
+	r.NbHits = len(hits)
+	r.NbPages = (len(hits) + r.HitsPerPage - 1) / r.HitsPerPage
+	if r.Page > len(hits)/r.HitsPerPage { // checked before multiplying, so a huge page cannot overflow
+		r.Hits = []Hit{}
+		return r, nil
+	}
+	start := r.Page * r.HitsPerPage
+	if start >= len(hits) {
+		r.Hits = []Hit{}
+		return r, nil
+	}
+	end := start + r.HitsPerPage
+	if end > len(hits) {
+		end = len(hits)
+	}
+	r.Hits = hits[start:end]
+
+	highlight := highlightTerms(root)
+	for i := range r.Hits {
+		r.Hits[i].Highlight = newHighlight(r.Hits[i].Document, highlight)
+	}
+	return r, nil
+}
+
+// all returns every document with a score of zero
+func (ix *Index) all() map[string]float64 {
+	scores := make(map[string]float64, len(ix.docs))
+	for id := range ix.docs {
+		scores[id] = 0
+	}
+	return scores
+}
+
+// eval returns the documents that match the node, with their scores
+func (ix *Index) eval(n *query.Node) map[string]float64 {
+	switch n.Op {
+	case query.OpTerm:
+		return ix.matchTerm(n)
+	case query.OpNot:
+		scores := ix.all()
+		for id := range ix.eval(n.Nodes[0]) {
+			delete(scores, id)
+		}
+		return scores
+	case query.OpOr:
+		scores := map[string]float64{}
+		for _, c := range n.Nodes {
+			for id, s := range ix.eval(c) {
+				scores[id] += s
+			}
+		}
+		return scores
+	}
+
+	// AND
+	scores := ix.eval(n.Nodes[0])
+	for _, c := range n.Nodes[1:] {
+		if len(scores) == 0 {
+			break
+		}
+		next := ix.eval(c)
+		for id, s := range scores {
+			cs, ok := next[id]
+			if !ok {
+				delete(scores, id)
+				continue
+			}
+			scores[id] = s + cs
+		}
+	}
+	return scores
+}
+
+// matchTerm returns the documents with the word, or the words of the phrase in order, in the fields of the term
+func (ix *Index) matchTerm(n *query.Node) map[string]float64 {
+	fields := queryFields[n.Field]
+	xt := terms(n.Value)
+	scores := map[string]float64{}
+	if len(xt) == 0 {
+		return scores
+	}
+
+	for id := range ix.postings[xt[0]] {
+		if !ix.hasPhrase(id, xt, fields) {
+			continue
+		}
+		var score float64
+		for _, t := range xt {
+			score += ix.bm25(t, id, fields)
+		}
+		scores[id] = score
+	}
+	return scores
+}
+
+// hasPhrase returns true if the terms are next to each other in one of the fields of the document
+func (ix *Index) hasPhrase(id string, xt []string, fields []field) bool {
+	ps := make([]*posting, len(xt))
+	for i, t := range xt {
+		p, ok := ix.postings[t][id]
+		if !ok {
+			return false
+		}
+		ps[i] = p
+	}
+	for _, f := range fields {
+	positions:
+		for _, start := range ps[0][f] {
+			for i := 1; i < len(ps); i++ {
+				if !contains(ps[i][f], start+i) {
+					continue positions
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// bm25 returns the BM25 score of the term in the document, with the term frequency and document length weighted
+// by field
+func (ix *Index) bm25(t, id string, fields []field) float64 {
+	docs := ix.postings[t]
+	p := docs[id]
+	var tf float64
+	for _, f := range fields {
+		tf += fieldWeights[f] * float64(len(p[f]))
+	}
+	n := float64(len(ix.docs))
+	df := float64(len(docs))
+	idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+	avg := ix.length / n
+	dl := ix.docs[id].length
+	return idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*dl/avg))
+}
+
+func contains(xi []int, i int) bool {
+	for _, x := range xi {
+		if x == i {
+			return true
+		}
+	}
+	return false
+}
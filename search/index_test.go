@@ -0,0 +1,289 @@
+package search_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/mikedonnici/rtcl-api/query"
+	"github.com/mikedonnici/rtcl-api/search"
+)
+
+// testDocs are a few articles, with dates in October 2018
+var testDocs = []search.Document{
+	{
+		ObjectID:    "30001",
+		Category:    "cardiology",
+		Title:       "Heart failure with preserved ejection fraction in athletes",
+		Keywords:    []string{"Nakamura Y", "Smith J"},
+		PubName:     "The American journal of cardiology",
+		PubNameAbbr: "Am J Cardiol",
+		PubTime:     date(1).Unix(),
+		PubDate:     "2018-10-01",
+		Summary:     "Heart failure is common. We studied athletes with heart failure and preserved ejection fraction.",
+	},
+	{
+		ObjectID:    "30002",
+		Category:    "cardiology",
+		Title:       "Stent thrombosis after PCI",
+		Keywords:    []string{"Jones A"},
+		PubName:     "Circulation",
+		PubNameAbbr: "Circulation",
+		PubTime:     date(2).Unix(),
+		PubDate:     "2018-10-02",
+		Summary:     "Failure of the stent was rare, and the heart recovered in most patients.",
+	},
+	{
+		ObjectID:    "30003",
+		Category:    "dermatology",
+		Title:       "Melanoma screening & outcomes",
+		Keywords:    []string{"Smith J"},
+		PubName:     "Journal of the American Academy of Dermatology",
+		PubNameAbbr: "J Am Acad Dermatol",
+		PubTime:     date(3).Unix(),
+		PubDate:     "2018-10-03",
+		Summary:     "Screening for melanoma improved outcomes.",
+	},
+	{
+		ObjectID:    "30004",
+		Category:    "cardiology",
+		Title:       "Cardiac rehabilitation",
+		Keywords:    []string{"Heart J"},
+		PubName:     "Heart",
+		PubNameAbbr: "Heart",
+		PubTime:     date(4).Unix(),
+		PubDate:     "2018-10-04",
+		Summary:     "Rehabilitation after a cardiac event.",
+	},
+}
+
+func date(day int) time.Time {
+	return time.Date(2018, 10, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestIndex(t *testing.T) {
+	t.Run("testIndexSearch", testIndexSearch)
+	t.Run("testIndexRanking", testIndexRanking)
+	t.Run("testIndexFilters", testIndexFilters)
+	t.Run("testIndexPages", testIndexPages)
+	t.Run("testIndexHighlight", testIndexHighlight)
+	t.Run("testIndexUpdate", testIndexUpdate)
+	t.Run("testIndexObjects", testIndexObjects)
+}
+
+func newTestIndex(t *testing.T) *search.Index {
+	ix := search.NewIndex()
+	err := ix.Add(testDocs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ix
+}
+
+// ids returns the ids of the hits, in order
+func ids(r search.Result) string {
+	var xs []string
+	for _, h := range r.Hits {
+		xs = append(xs, h.ObjectID)
+	}
+	return strings.Join(xs, " ")
+}
+
+// sorted returns the ids of the hits, sorted, for queries where the order is not being tested
+func sorted(r search.Result) string {
+	xs := strings.Fields(ids(r))
+	for i := range xs {
+		for j := i + 1; j < len(xs); j++ {
+			if xs[j] < xs[i] {
+				xs[i], xs[j] = xs[j], xs[i]
+			}
+		}
+	}
+	return strings.Join(xs, " ")
+}
+
+func testIndexSearch(t *testing.T) {
+	ix := newTestIndex(t)
+	cases := []struct {
+		text string
+		want string
+	}{
+		{"heart", "30001 30002 30004"},
+		{"HEART failure", "30001 30002"},
+		{`"heart failure"`, "30001"},
+		{`"failure heart"`, ""},
+		{"heart -stent", "30001 30004"},
+		{"melanoma OR stent", "30002 30003"},
+		{"title:heart", "30001"},
+		{`journal:"Am J Cardiol"`, "30001"},
+		{"journal:heart", "30004"},
+		{`author:"smith j"`, "30001 30003"},
+		{`author:"y smith"`, ""}, // a phrase cannot span two keywords
+		{"NOT cardiac", "30001 30002 30003"},
+		{"screening outcomes", "30003"},
+		{"nothing", ""},
+	}
+	for _, c := range cases {
+		r, err := ix.Search(search.Query{Text: c.text})
+		if err != nil {
+			t.Errorf("Search(%q) error: %v", c.text, err)
+			continue
+		}
+		if sorted(r) != c.want {
+			t.Errorf("Search(%q) = %q, want %q", c.text, sorted(r), c.want)
+		}
+		if r.NbHits != len(r.Hits) {
+			t.Errorf("Search(%q) NbHits = %d, want %d", c.text, r.NbHits, len(r.Hits))
+		}
+	}
+
+	_, err := ix.Search(search.Query{Text: "(heart"})
+	if _, ok := err.(*query.SyntaxError); !ok {
+		t.Errorf("expected a query.SyntaxError, got %v", err)
+	}
+}
+
+func testIndexRanking(t *testing.T) {
+	is := is.New(t)
+	ix := newTestIndex(t)
+
+	// 30001 has heart failure in the title and twice in the summary
+	r, err := ix.Search(search.Query{Text: "heart failure"})
+	is.NoErr(err)
+	is.Equal(ids(r), "30001 30002")
+	is.True(r.Hits[0].Score > r.Hits[1].Score) // expected a higher score for more matches
+
+	// a title match ranks above a summary match
+	r, err = ix.Search(search.Query{Text: "cardiac"})
+	is.NoErr(err)
+	is.Equal(ids(r), "30004")
+
+	// with no text every document matches, newest first
+	r, err = ix.Search(search.Query{})
+	is.NoErr(err)
+	is.Equal(ids(r), "30004 30003 30002 30001")
+}
+
+func testIndexFilters(t *testing.T) {
+	is := is.New(t)
+	ix := newTestIndex(t)
+
+	r, err := ix.Search(search.Query{Text: "heart", Categories: []string{"cardiology"}})
+	is.NoErr(err)
+	is.Equal(sorted(r), "30001 30002 30004")
+
+	r, err = ix.Search(search.Query{Categories: []string{"dermatology"}})
+	is.NoErr(err)
+	is.Equal(ids(r), "30003")
+
+	r, err = ix.Search(search.Query{Text: "heart", From: date(2), To: date(3)})
+	is.NoErr(err)
+	is.Equal(ids(r), "30002")
+
+	r, err = ix.Search(search.Query{From: date(4)})
+	is.NoErr(err)
+	is.Equal(ids(r), "30004")
+}
+
+func testIndexPages(t *testing.T) {
+	is := is.New(t)
+	ix := newTestIndex(t)
+
+	r, err := ix.Search(search.Query{HitsPerPage: 3})
+	is.NoErr(err)
+	is.Equal(ids(r), "30004 30003 30002")
+	is.Equal(r.NbHits, 4)
+	is.Equal(r.NbPages, 2)
+
+	r, err = ix.Search(search.Query{HitsPerPage: 3, Page: 1})
+	is.NoErr(err)
+	is.Equal(ids(r), "30001")
+	is.Equal(r.Page, 1)
+
+	r, err = ix.Search(search.Query{HitsPerPage: 3, Page: 5})
+	is.NoErr(err)
+	is.Equal(len(r.Hits), 0) // expected an empty page past the end
+	is.True(r.Hits != nil)   // expected an empty list rather than null
+
+	r, err = ix.Search(search.Query{HitsPerPage: 20, Page: 461168601842738791})
+	is.NoErr(err)
+	is.Equal(len(r.Hits), 0) // expected an empty page rather than an overflow
+
+	r, err = ix.Search(search.Query{HitsPerPage: 1000})
+	is.NoErr(err)
+	is.Equal(r.HitsPerPage, search.MaxHitsPerPage)
+}
+
+func testIndexHighlight(t *testing.T) {
+	is := is.New(t)
+	ix := newTestIndex(t)
+
+	r, err := ix.Search(search.Query{Text: "melanoma -stent"})
+	is.NoErr(err)
+	is.Equal(len(r.Hits), 1)
+	is.Equal(r.Hits[0].Highlight.Title, "<em>Melanoma</em> screening &amp; outcomes")
+	is.Equal(r.Hits[0].Highlight.Summary, "Screening for <em>melanoma</em> improved outcomes.")
+
+	// a long summary is cut down to a snippet around the first match
+	long := search.Document{ObjectID: "1", Title: "Long", Summary: strings.Repeat("filler ", 50) + "needle" +
+		strings.Repeat(" filler", 50)}
+	ix.Add(long)
+	r, err = ix.Search(search.Query{Text: "needle"})
+	is.NoErr(err)
+	s := r.Hits[0].Highlight.Summary
+	is.True(strings.HasPrefix(s, "… filler"))       // expected an ellipsis before the snippet
+	is.True(strings.HasSuffix(s, "filler …"))       // expected an ellipsis after the snippet
+	is.True(strings.Contains(s, "<em>needle</em>")) // expected the match to be highlighted
+	is.Equal(len(strings.Fields(s)), 32)            // expected 30 words and two ellipses
+}
+
+func testIndexUpdate(t *testing.T) {
+	is := is.New(t)
+	ix := newTestIndex(t)
+
+	d := testDocs[2]
+	d.Title = "Psoriasis"
+	d.Summary = "Psoriasis treatments."
+	is.NoErr(ix.Add(d))
+	is.Equal(ix.Len(), 4) // replacing a document should not add one
+
+	r, err := ix.Search(search.Query{Text: "melanoma"})
+	is.NoErr(err)
+	is.Equal(len(r.Hits), 0) // the old terms should be removed
+	r, err = ix.Search(search.Query{Text: "psoriasis"})
+	is.NoErr(err)
+	is.Equal(ids(r), "30003")
+
+	is.NoErr(ix.Delete("30003", "missing"))
+	is.Equal(ix.Len(), 3)
+	_, ok := ix.Document("30003")
+	is.True(!ok) // expected the document to be deleted
+	r, err = ix.Search(search.Query{Text: "psoriasis"})
+	is.NoErr(err)
+	is.Equal(len(r.Hits), 0)
+}
+
+// testIndexObjects tests adding the objects that cmd/indexer builds for Algolia
+func testIndexObjects(t *testing.T) {
+	is := is.New(t)
+	ix := search.NewIndex()
+	err := ix.AddObjects(map[string]interface{}{
+		"objectID":    "29747859",
+		"category":    "cardiology",
+		"title":       "Long-term mortality",
+		"keywords":    []string{"Nakamura Y"},
+		"pubNameAbbr": "Am J Cardiol",
+		"pubTime":     date(1).Unix(),
+		"pubDate":     "2018-10-01",
+		"summary":     "",
+	})
+	is.NoErr(err)
+	d, ok := ix.Document("29747859")
+	is.True(ok)
+	is.Equal(d.Published(), date(1))
+	is.Equal(d.Keywords, []string{"Nakamura Y"})
+
+	err = ix.AddObjects(map[string]interface{}{"title": "no id"})
+	is.True(err != nil) // expected an error for an object with no objectID
+}
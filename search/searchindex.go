@@ -0,0 +1,75 @@
+package search
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrEmptyFilter is returned by DeleteBy for a filter that would match every document
+var ErrEmptyFilter = errors.New("filter is empty")
+
+// SearchIndex is a search backend for articles. It is implemented by the local Index, by Algolia, and by Fake for
+// tests, so that the indexer and the server do not depend on a particular backend.
+type SearchIndex interface {
+	// Upsert adds documents, replacing any with the same ObjectID
+	Upsert(docs ...Document) error
+	// Delete removes documents by ObjectID, ignoring any that are not in the index
+	Delete(ids ...string) error
+	// DeleteBy removes the documents that match the filter, which must not be empty
+	DeleteBy(f Filter) error
+	// Search returns a page of the documents that match the query
+	Search(q Query) (Result, error)
+	// SetSettings configures the index
+	SetSettings(s Settings) error
+}
+
+// Filter selects documents by category and publication date
+type Filter struct {
+	Categories []string  // documents in any of these categories, ignoring case, or any category if empty
+	From       time.Time // documents published at or after From, if it is not zero
+	To         time.Time // documents published at or before To, if it is not zero
+}
+
+// Empty returns true if the filter matches every document
+func (f Filter) Empty() bool {
+	return len(f.Categories) == 0 && f.From.IsZero() && f.To.IsZero()
+}
+
+// Match returns true if the document matches the filter
+func (f Filter) Match(d Document) bool {
+	if len(f.Categories) > 0 {
+		var ok bool
+		for _, c := range f.Categories {
+			ok = ok || strings.EqualFold(c, d.Category)
+		}
+		if !ok {
+			return false
+		}
+	}
+	if !f.From.IsZero() && d.PubTime < f.From.Unix() {
+		return false
+	}
+	if !f.To.IsZero() && d.PubTime > f.To.Unix() {
+		return false
+	}
+	return true
+}
+
+// Settings configure a SearchIndex. Algolia uses all of them, the local Index only uses HitsPerPage as its fields
+// and ranking are fixed.
+type Settings struct {
+	SearchableAttributes  []string // in order of importance
+	AttributesForFaceting []string // attributes used in filters
+	CustomRanking         []string // tie breakers, eg desc(pubTime)
+	HitsPerPage           int      // default page size
+}
+
+// DefaultSettings are the settings for the articles index. The facets are the attributes used in the filters of
+// the query package and of Filter.
+var DefaultSettings = Settings{
+	SearchableAttributes:  []string{"title", "keywords", "summary", "pubName,pubNameAbbr"},
+	AttributesForFaceting: []string{"category", "keywords", "pubNameAbbr"},
+	CustomRanking:         []string{"desc(pubTime)"},
+	HitsPerPage:           DefaultHitsPerPage,
+}
@@ -0,0 +1,190 @@
+package search_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/algolia/algoliasearch-client-go/algoliasearch"
+	"github.com/matryer/is"
+	"github.com/mikedonnici/rtcl-api/query"
+	"github.com/mikedonnici/rtcl-api/search"
+)
+
+// algoliaIndex records the calls made to an Algolia index. The methods that are not used are left to the embedded
+// interface, which is nil.
+type algoliaIndex struct {
+	algoliasearch.Index
+	added    []algoliasearch.Object
+	deleted  []string
+	params   algoliasearch.Map
+	query    string
+	settings algoliasearch.Map
+	res      algoliasearch.QueryRes
+}
+
+func (a *algoliaIndex) AddObjects(objects []algoliasearch.Object) (algoliasearch.BatchRes, error) {
+	a.added = append(a.added, objects...)
+	return algoliasearch.BatchRes{}, nil
+}
+
+func (a *algoliaIndex) DeleteObjects(ids []string) (algoliasearch.BatchRes, error) {
+	a.deleted = append(a.deleted, ids...)
+	return algoliasearch.BatchRes{}, nil
+}
+
+func (a *algoliaIndex) DeleteBy(params algoliasearch.Map) (algoliasearch.DeleteTaskRes, error) {
+	a.params = params
+	return algoliasearch.DeleteTaskRes{}, nil
+}
+
+func (a *algoliaIndex) Search(query string, params algoliasearch.Map) (algoliasearch.QueryRes, error) {
+	a.query = query
+	a.params = params
+	return a.res, nil
+}
+
+func (a *algoliaIndex) SetSettings(settings algoliasearch.Map) (algoliasearch.UpdateTaskRes, error) {
+	a.settings = settings
+	return algoliasearch.UpdateTaskRes{}, nil
+}
+
+func TestSearchIndex(t *testing.T) {
+	t.Run("testIndexDeleteBy", testIndexDeleteBy)
+	t.Run("testIndexSettings", testIndexSettings)
+	t.Run("testAlgolia", testAlgolia)
+	t.Run("testAlgoliaSearch", testAlgoliaSearch)
+	t.Run("testFake", testFake)
+}
+
+func testIndexDeleteBy(t *testing.T) {
+	is := is.New(t)
+	ix := newTestIndex(t)
+
+	is.Equal(ix.DeleteBy(search.Filter{}), search.ErrEmptyFilter)
+	is.Equal(ix.Len(), 4)
+
+	is.NoErr(ix.DeleteBy(search.Filter{Categories: []string{"Cardiology"}, To: date(2)}))
+	r, err := ix.Search(search.Query{})
+	is.NoErr(err)
+	is.Equal(ids(r), "30004 30003")
+
+	is.NoErr(ix.DeleteBy(search.Filter{From: date(4)}))
+	r, err = ix.Search(search.Query{})
+	is.NoErr(err)
+	is.Equal(ids(r), "30003")
+}
+
+func testIndexSettings(t *testing.T) {
+	is := is.New(t)
+	ix := newTestIndex(t)
+	is.NoErr(ix.SetSettings(search.Settings{HitsPerPage: 3}))
+	r, err := ix.Search(search.Query{})
+	is.NoErr(err)
+	is.Equal(len(r.Hits), 3)
+	is.Equal(r.HitsPerPage, 3)
+}
+
+func testAlgolia(t *testing.T) {
+	is := is.New(t)
+	ai := &algoliaIndex{}
+	a := search.NewAlgoliaIndex(ai)
+
+	is.NoErr(a.Upsert(testDocs[:2]...))
+	is.Equal(len(ai.added), 2)
+	is.Equal(ai.added[0]["objectID"], "30001")
+	is.Equal(ai.added[0]["pubNameAbbr"], "Am J Cardiol")
+	is.Equal(ai.added[0]["pubTime"], date(1).Unix())
+
+	is.NoErr(a.Delete("30001", "30002"))
+	is.Equal(ai.deleted, []string{"30001", "30002"})
+
+	is.Equal(a.DeleteBy(search.Filter{}), search.ErrEmptyFilter)
+	is.NoErr(a.DeleteBy(search.Filter{Categories: []string{"cardiology", "oncology"}, To: date(2)}))
+	is.Equal(ai.params["filters"], `(category:"cardiology" OR category:"oncology") AND pubTime <= 1538438400`)
+
+	is.NoErr(a.SetSettings(search.DefaultSettings))
+	is.Equal(ai.settings["customRanking"], []string{"desc(pubTime)"})
+	is.Equal(ai.settings["attributesForFaceting"], []string{"category", "keywords", "pubNameAbbr"})
+	is.Equal(ai.settings["hitsPerPage"], search.DefaultHitsPerPage)
+}
+
+func testAlgoliaSearch(t *testing.T) {
+	is := is.New(t)
+	ai := &algoliaIndex{res: algoliasearch.QueryRes{
+		Hits: []algoliasearch.Map{{
+			"objectID": "30001",
+			"title":    "Heart failure",
+			"keywords": []interface{}{"Smith J"},
+			"pubTime":  float64(date(1).Unix()),
+			"_highlightResult": map[string]interface{}{
+				"title": map[string]interface{}{"value": "<em>Heart</em> failure"},
+			},
+			"_snippetResult": map[string]interface{}{
+				"summary": map[string]interface{}{"value": "… <em>heart</em> …"},
+			},
+		}},
+		NbHits:      21,
+		NbPages:     2,
+		Page:        1,
+		HitsPerPage: 20,
+	}}
+	a := search.NewAlgoliaIndex(ai)
+
+	r, err := a.Search(search.Query{
+		Text:       `heart -stent journal:"Am J Cardiol"`,
+		Categories: []string{"cardiology"},
+		From:       date(1),
+		Page:       1,
+	})
+	is.NoErr(err)
+	is.Equal(ai.query, "heart -stent")
+	is.Equal(ai.params["filters"], `pubNameAbbr:"Am J Cardiol" AND (category:"cardiology") AND pubTime >= 1538352000`)
+	is.Equal(ai.params["page"], 1)
+	is.Equal(ai.params["advancedSyntax"], true)
+	is.Equal(ai.params["restrictSearchableAttributes"], nil) // expected every attribute to be searched
+
+	is.Equal(r.NbHits, 21)
+	is.Equal(r.NbPages, 2)
+	is.Equal(r.Page, 1)
+	is.Equal(len(r.Hits), 1)
+	is.Equal(r.Hits[0].ObjectID, "30001")
+	is.Equal(r.Hits[0].Keywords, []string{"Smith J"})
+	is.Equal(r.Hits[0].Published(), date(1))
+	is.Equal(r.Hits[0].Highlight.Title, "<em>Heart</em> failure")
+	is.Equal(r.Hits[0].Highlight.Summary, "… <em>heart</em> …")
+
+	_, err = a.Search(search.Query{Text: "title:heart"})
+	is.NoErr(err)
+	is.Equal(ai.params["restrictSearchableAttributes"], []string{"title"})
+	is.Equal(ai.params["filters"], nil) // expected no filters
+
+	_, err = a.Search(search.Query{Text: "heart OR stent"})
+	if _, ok := err.(*query.TranslateError); !ok {
+		t.Errorf("expected a query.TranslateError, got %v", err)
+	}
+}
+
+func testFake(t *testing.T) {
+	is := is.New(t)
+	var ix search.SearchIndex = search.NewFake()
+	f := ix.(*search.Fake)
+
+	is.NoErr(ix.Upsert(testDocs...))
+	is.NoErr(ix.Delete("30001"))
+	is.NoErr(ix.DeleteBy(search.Filter{Categories: []string{"dermatology"}}))
+	is.NoErr(ix.SetSettings(search.DefaultSettings))
+	r, err := ix.Search(search.Query{Text: "heart"})
+	is.NoErr(err)
+	is.Equal(sorted(r), "30002 30004")
+
+	is.Equal(len(f.Upserts), 1)
+	is.Equal(f.Deletes, [][]string{{"30001"}})
+	is.Equal(f.Filters, []search.Filter{{Categories: []string{"dermatology"}}})
+	is.Equal(f.Settings, []search.Settings{search.DefaultSettings})
+	is.Equal(f.Queries, []search.Query{{Text: "heart"}})
+	is.Equal(f.Len(), 2)
+
+	f.Err = errors.New("fake error")
+	is.Equal(ix.Upsert(testDocs...), f.Err)
+	is.Equal(len(f.Upserts), 1) // expected the failed call not to be recorded
+}
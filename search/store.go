@@ -0,0 +1,139 @@
+package search
+
+import (
+	"encoding/json"
+
+	"github.com/mikedonnici/rtcl-api/datastore"
+	"github.com/mikedonnici/rtcl-api/datastore/mongo"
+	"github.com/pkg/errors"
+	"go.etcd.io/bbolt"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// storeName is the name of the bolt bucket or Mongo collection that holds the documents
+const storeName = "searchIndex"
+
+// Store persists the documents of an Index. Save replaces documents with the same ObjectID, and Delete ignores
+// ids that are not stored.
+type Store interface {
+	Load() ([]Document, error)
+	Save(docs ...Document) error
+	Delete(ids ...string) error
+}
+
+// NewStore returns a store in the database of the datastore, a BoltStore or MongoStore depending on its backend
+func NewStore(d *datastore.Datastore) (Store, error) {
+	if d.Bolt != nil {
+		return NewBoltStore(d.Bolt)
+	}
+	if d.Mongo != nil {
+		return NewMongoStore(d.Mongo), nil
+	}
+	return nil, errors.New("datastore has no database for a search store")
+}
+
+// BoltStore stores documents as JSON in a bucket of a bolt database, such as the one used by the datastore
+type BoltStore struct {
+	db *bbolt.DB
+}
+
+// NewBoltStore returns a store in the database, creating the bucket if it does not exist
+func NewBoltStore(db *bbolt.DB) (*BoltStore, error) {
+	err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(storeName))
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create bucket "+storeName)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Load() ([]Document, error) {
+	var xd []Document
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(storeName)).ForEach(func(k, v []byte) error {
+			var d Document
+			err := json.Unmarshal(v, &d)
+			if err != nil {
+				return errors.Wrap(err, "could not decode document "+string(k))
+			}
+			xd = append(xd, d)
+			return nil
+		})
+	})
+	return xd, err
+}
+
+func (s *BoltStore) Save(docs ...Document) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(storeName))
+		for _, d := range docs {
+			data, err := json.Marshal(d)
+			if err != nil {
+				return err
+			}
+			err = b.Put([]byte(d.ObjectID), data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) Delete(ids ...string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(storeName))
+		for _, id := range ids {
+			err := b.Delete([]byte(id))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// MongoStore stores documents in a Mongo collection, keyed by ObjectID
+type MongoStore struct {
+	m *mongo.Connection
+}
+
+// NewMongoStore returns a store in the database of the connection
+func NewMongoStore(m *mongo.Connection) *MongoStore {
+	return &MongoStore{m: m}
+}
+
+func (s *MongoStore) c() *mgo.Collection {
+	c, _ := s.m.Collection(storeName)
+	return c
+}
+
+func (s *MongoStore) Load() ([]Document, error) {
+	var xd []Document
+	err := s.c().Find(nil).All(&xd)
+	return xd, err
+}
+
+func (s *MongoStore) Save(docs ...Document) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	b := s.c().Bulk()
+	b.Unordered()
+	for _, d := range docs {
+		b.Upsert(bson.M{"_id": d.ObjectID}, d)
+	}
+	_, err := b.Run()
+	return err
+}
+
+func (s *MongoStore) Delete(ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := s.c().RemoveAll(bson.M{"_id": bson.M{"$in": ids}})
+	return err
+}
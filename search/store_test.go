@@ -0,0 +1,72 @@
+package search_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/mikedonnici/rtcl-api/search"
+	"github.com/mikedonnici/rtcl-api/testdata"
+	"go.etcd.io/bbolt"
+)
+
+func TestStore(t *testing.T) {
+	f, err := ioutil.TempFile("", "rtcl_search_*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	db, err := bbolt.Open(f.Name(), 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	bolt, err := search.NewBoltStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("bolt", func(t *testing.T) { testStore(t, bolt) })
+
+	if !testdata.MongoAvailable() {
+		t.Log("Mongo server not available - skipping Mongo store")
+		return
+	}
+	tdb := testdata.New()
+	err = tdb.SetupMongoDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tdb.TearDownMongoDB()
+	ds, err := tdb.Datastore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("mongo", func(t *testing.T) { testStore(t, search.NewMongoStore(ds.Mongo)) })
+}
+
+// testStore tests that an index opened from the store has the documents saved by another index
+func testStore(t *testing.T, store search.Store) {
+	is := is.New(t)
+	ix, err := search.Open(store)
+	is.NoErr(err)
+	is.NoErr(ix.Add(testDocs...))
+	is.NoErr(ix.Delete(testDocs[0].ObjectID))
+
+	ix2, err := search.Open(store)
+	is.NoErr(err)
+	is.Equal(ix2.Len(), len(testDocs)-1)
+	r, err := ix2.Search(search.Query{Text: "melanoma"})
+	is.NoErr(err)
+	is.Equal(ids(r), "30003")
+
+	// Reload picks up changes made through another index
+	d := testDocs[0]
+	is.NoErr(ix.Add(d))
+	is.NoErr(ix2.Reload())
+	got, ok := ix2.Document(d.ObjectID)
+	is.True(ok) // expected the document added by the other index
+	is.Equal(got.Keywords, d.Keywords)
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mikedonnici/rtcl-api/datastore"
+)
+
+// deleteUserHandler deletes the user's account, with their searches and logs, once they have entered their password
+// again. If the server has a deletion grace period the account is only scheduled for deletion, and all sessions are
+// ended.
+func (s *server) deleteUserHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body := struct {
+			Password string `json:"password"`
+		}{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, nil, err)
+			return
+		}
+
+		u, err := s.store.UserByID(r.Context().Value("userID").(string))
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+
+		// failures count towards the login lockout, so a stolen token cannot be used to guess the password
+		now := s.now()
+		wait := u.LoginRetryAfter(now)
+		if wait > 0 {
+			respondTooManyRequests(w, wait)
+			return
+		}
+		match, _ := u.CheckPassword(body.Password)
+		if !match {
+			err = u.RecordFailedLogin(now)
+			if err != nil {
+				respondJSON(w, http.StatusInternalServerError, nil, err)
+				return
+			}
+			respondJSON(w, http.StatusForbidden, nil, errors.New("password does not match"))
+			return
+		}
+
+		err = u.ScheduleDeletion(s.config.DeletionGrace)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+
+		if u.DeleteAt.IsZero() {
+			log.Printf("User %s deleted their account", u.ID.Hex())
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		log.Printf("User %s scheduled their account for deletion at %v", u.ID.Hex(), u.DeleteAt)
+		respondJSON(w, http.StatusAccepted, map[string]time.Time{"deleteAt": u.DeleteAt}, nil)
+	}
+}
+
+// restoreUserHandler cancels a scheduled deletion during the grace period
+func (s *server) restoreUserHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := s.store.UserByID(r.Context().Value("userID").(string))
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		err = u.CancelDeletion()
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		u.Password = datastore.PasswordMask
+		respondJSON(w, http.StatusOK, u, nil)
+	}
+}
+
+// exportUserHandler responds with a zip of all of the user's data - their profile, saved searches, logs and
+// bookmarks - as JSON, with the searches and logs also as CSV.
+func (s *server) exportUserHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := s.store.UserByID(r.Context().Value("userID").(string))
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		xl, err := s.store.LogsByUserID(u.ID.Hex())
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		xb, err := s.store.BookmarksByUserID(u.ID.Hex(), "", "")
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		u.Password = datastore.PasswordMask
+
+		filename := fmt.Sprintf("rtcl-export-%s.zip", s.now().Format("2006-01-02"))
+		w.Header().Set("content-type", "application/zip")
+		w.Header().Set("content-disposition", `attachment; filename="`+filename+`"`)
+		err = writeExport(w, u, xl, xb)
+		if err != nil {
+			// the status has been sent so all that can be done is to log it
+			log.Printf("Error exporting user %s - %s", u.ID.Hex(), err)
+		}
+	}
+}
+
+// writeExport writes the zip for exportUserHandler
+func writeExport(w io.Writer, u *datastore.User, xl []datastore.Log, xb []datastore.Bookmark) error {
+	z := zip.NewWriter(w)
+
+	files := []struct {
+		name  string
+		write func(io.Writer) error
+	}{
+		{"profile.json", jsonWriter(u)},
+		{"searches.json", jsonWriter(u.Searches)},
+		{"searches.csv", csvWriter(searchRows(u.Searches))},
+		{"logs.json", jsonWriter(xl)},
+		{"logs.csv", csvWriter(logRows(xl))},
+		{"bookmarks.json", jsonWriter(xb)},
+	}
+	for _, f := range files {
+		fw, err := z.Create(f.name)
+		if err != nil {
+			return err
+		}
+		err = f.write(fw)
+		if err != nil {
+			return err
+		}
+	}
+	return z.Close()
+}
+
+// searchRows returns the saved searches as CSV rows, with a header
+func searchRows(xs []datastore.Search) [][]string {
+	rows := [][]string{{"id", "name", "created", "query", "categories", "journals", "from", "to"}}
+	for _, s := range xs {
+		rows = append(rows, []string{s.ID.Hex(), s.Name, s.Created.Format(time.RFC3339), s.Query,
+			strings.Join(s.Categories, "; "), strings.Join(s.Journals, "; "), s.From, s.To})
+	}
+	return rows
+}
+
+// logRows returns the logs as CSV rows, with a header
+func logRows(xl []datastore.Log) [][]string {
+	rows := [][]string{{"id", "date", "pmid", "minutes", "title", "source", "url", "comment"}}
+	for _, l := range xl {
+		rows = append(rows, []string{l.ID.Hex(), l.Date, l.PMID, strconv.Itoa(l.Minutes), l.Title, l.Source, l.URL,
+			l.Comment})
+	}
+	return rows
+}
+
+func jsonWriter(v interface{}) func(io.Writer) error {
+	return func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+}
+
+func csvWriter(rows [][]string) func(io.Writer) error {
+	return func(w io.Writer) error {
+		cw := csv.NewWriter(w)
+		for _, row := range rows {
+			for i, v := range row {
+				row[i] = csvCell(v)
+			}
+		}
+		cw.WriteAll(rows)
+		return cw.Error()
+	}
+}
+
+// csvCell prefixes a value that a spreadsheet would run as a formula with ', so that user text such as a search
+// name is shown as it was written
+func csvCell(v string) string {
+	if v != "" && strings.ContainsRune("=+-@\t\r", rune(v[0])) {
+		return "'" + v
+	}
+	return v
+}
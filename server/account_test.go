@@ -0,0 +1,119 @@
+package server_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/mikedonnici/rtcl-api/datastore"
+	"github.com/mikedonnici/rtcl-api/testdata"
+)
+
+var accountDS *datastore.Datastore
+
+// TestAccount runs the account deletion and export tests against their own in-memory datastore, as they delete users
+func TestAccount(t *testing.T) {
+
+	var err error
+
+	accountDS, err = testdata.NewMemoryStore()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	t.Run("account", func(t *testing.T) {
+		t.Run("testExportUser", testExportUser)
+		t.Run("testDeleteUser", testDeleteUser)
+		t.Run("testDeleteUserGracePeriod", testDeleteUserGracePeriod)
+	})
+}
+
+func testExportUser(t *testing.T) {
+	is := is.New(t)
+	u, err := accountDS.UserByID("5b3bcd72463cd6029e04de18")
+	is.NoErr(err)
+	_, err = u.AddSearch(datastore.Search{Name: "=HYPERLINK(\"http://x\")", Query: "-formula"})
+	is.NoErr(err) // error adding search
+	w := userRequest(t, srvConfig, accountDS, nil, "GET", "/user/export", "", "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, http.StatusOK)                             // expected 200 OK
+	is.Equal(w.Header().Get("content-type"), "application/zip") // expected a zip
+
+	z, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	is.NoErr(err) // error reading zip
+	files := map[string][]byte{}
+	for _, f := range z.File {
+		rc, err := f.Open()
+		is.NoErr(err) // error opening file in zip
+		files[f.Name], err = ioutil.ReadAll(rc)
+		is.NoErr(err) // error reading file in zip
+		rc.Close()
+	}
+	for _, name := range []string{"profile.json", "searches.json", "searches.csv", "logs.json", "logs.csv", "bookmarks.json"} {
+		_, ok := files[name]
+		is.True(ok) // missing file in export
+	}
+	is.True(bytes.Contains(files["profile.json"], []byte("br@rtcl.io")))           // profile should be the user's
+	is.True(bytes.Contains(files["profile.json"], []byte(datastore.PasswordMask))) // password hash should not be exported
+
+	xl, err := accountDS.LogsByUserID("5b3bcd72463cd6029e04de18")
+	is.NoErr(err) // error fetching logs
+	rows, err := csv.NewReader(bytes.NewReader(files["logs.csv"])).ReadAll()
+	is.NoErr(err)                  // error reading logs csv
+	is.Equal(len(rows), len(xl)+1) // expected a header and a row for each log
+	is.Equal(rows[0][0], "id")     // expected a header row
+
+	rows, err = csv.NewReader(bytes.NewReader(files["searches.csv"])).ReadAll()
+	is.NoErr(err) // error reading searches csv
+	var found bool
+	for _, row := range rows {
+		if row[1] == `'=HYPERLINK("http://x")` {
+			found = true
+			is.Equal(row[3], "'-formula")
+		}
+	}
+	is.True(found) // expected formulas to be prefixed with '
+}
+
+func testDeleteUser(t *testing.T) {
+	is := is.New(t)
+	const uid = "5b3bcd72463cd6029e04de18"
+
+	w := userRequest(t, srvConfig, accountDS, nil, "DELETE", "/user", `{"password": "wrong"}`, uid)
+	is.Equal(w.Code, http.StatusForbidden) // expected 403 Forbidden for the wrong password
+
+	w = userRequest(t, srvConfig, accountDS, nil, "DELETE", "/user", `{"password": "12345abcde"}`, uid)
+	is.Equal(w.Code, http.StatusNoContent) // expected 204 No Content
+
+	_, err := accountDS.UserByID(uid)
+	is.Equal(err, datastore.ErrNotFound) // user should be deleted
+	xl, err := accountDS.LogsByUserID(uid)
+	is.NoErr(err)        // error fetching logs
+	is.Equal(len(xl), 0) // logs should be deleted with the user
+}
+
+func testDeleteUserGracePeriod(t *testing.T) {
+	is := is.New(t)
+	const uid = "5b3bcd72463cd6029e04de1a"
+	cfg := srvConfig
+	cfg.DeletionGrace = 7 * 24 * time.Hour
+
+	w := userRequest(t, cfg, accountDS, nil, "DELETE", "/user", `{"password": "12345abcde"}`, uid)
+	is.Equal(w.Code, http.StatusAccepted) // expected 202 Accepted with a grace period
+
+	u, err := accountDS.UserByID(uid)
+	is.NoErr(err)                 // user should not be deleted during the grace period
+	is.True(!u.DeleteAt.IsZero()) // expected a deletion date
+
+	// sessions were ended, so the user logs in again to restore their account
+	w = userRequest(t, cfg, accountDS, nil, "POST", "/user/restore", "", uid)
+	is.Equal(w.Code, http.StatusOK) // expected 200 OK
+	u, err = accountDS.UserByID(uid)
+	is.NoErr(err)                // error fetching user
+	is.True(u.DeleteAt.IsZero()) // deletion should be cancelled
+}
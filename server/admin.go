@@ -0,0 +1,164 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/mikedonnici/rtcl-api/datastore"
+	"github.com/mikedonnici/rtcl-api/emailer"
+)
+
+// default and maximum number of users returned by adminUsersHandler
+const (
+	adminUsersLimit    = 50
+	adminUsersMaxLimit = 500
+)
+
+// adminUsersHandler lists users ordered by email. The optional query params are q, to filter by a string in the name
+// or email, and skip and limit for paging.
+func (s *server) adminUsersHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+
+		skip, err := queryInt(q.Get("skip"), 0)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, nil, errors.New("skip should be an integer"))
+			return
+		}
+		limit, err := queryInt(q.Get("limit"), adminUsersLimit)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, nil, errors.New("limit should be an integer"))
+			return
+		}
+		if skip < 0 {
+			respondJSON(w, http.StatusBadRequest, nil, errors.New("skip cannot be negative"))
+			return
+		}
+		if limit < 1 || limit > adminUsersMaxLimit {
+			respondJSON(w, http.StatusBadRequest, nil, fmt.Errorf("limit should be 1 to %d", adminUsersMaxLimit))
+			return
+		}
+
+		xu, err := s.store.ListUsers(q.Get("q"), skip, limit)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		for i := range xu {
+			xu[i].Password = datastore.PasswordMask
+		}
+		if xu == nil {
+			xu = []datastore.User{} // respond with an empty list rather than null
+		}
+		respondJSON(w, http.StatusOK, xu, nil)
+	}
+}
+
+// adminDeleteUserHandler deletes a user and their logs
+func (s *server) adminDeleteUserHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		err := s.store.DeleteUser(id)
+		if err != nil {
+			respondNotFoundOrBadRequest(w, err)
+			return
+		}
+		log.Println(fmt.Sprintf("Admin %s: %s %s", r.Context().Value("userID"), r.Method, r.URL.Path))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// adminLockUserHandler disables a user so they cannot log in, and ends their sessions
+func (s *server) adminLockUserHandler() http.HandlerFunc {
+	return s.adminUpdateUser(func(u *datastore.User) error {
+		return u.Disable()
+	})
+}
+
+// adminUnlockUserHandler enables a disabled user, and clears any lockout from failed logins
+func (s *server) adminUnlockUserHandler() http.HandlerFunc {
+	return s.adminUpdateUser(func(u *datastore.User) error {
+		return u.Enable()
+	})
+}
+
+// adminResetUserHandler forces a password reset. The current password stops working, all sessions are ended and
+// the user is emailed a reset link.
+func (s *server) adminResetUserHandler() http.HandlerFunc {
+	return s.adminUpdateUser(func(u *datastore.User) error {
+		err := u.ForceReset()
+		if err != nil {
+			return err
+		}
+		tk, err := u.ActionToken(datastore.ActionResetPassword, s.config.Token.SigningKey)
+		if err != nil {
+			return err
+		}
+		emailer.ResetPassword(*u, tk)
+		return nil
+	})
+}
+
+// adminDisableMFAHandler turns off two-factor auth for a user who has lost their authenticator and recovery codes
+func (s *server) adminDisableMFAHandler() http.HandlerFunc {
+	return s.adminUpdateUser(func(u *datastore.User) error {
+		return u.DisableMFA()
+	})
+}
+
+// adminUserRoleHandler sets the role of a user
+func (s *server) adminUserRoleHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body := struct {
+			Role string `json:"role"`
+		}{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, nil, err)
+			return
+		}
+		if !datastore.ValidRole(body.Role) {
+			respondJSON(w, http.StatusBadRequest, nil, errors.New("invalid role"))
+			return
+		}
+
+		s.adminUpdateUser(func(u *datastore.User) error {
+			return u.SetRole(body.Role)
+		})(w, r)
+	}
+}
+
+// adminUpdateUser returns a handler that fetches the user in the {id} route var, applies fn and responds with the
+// updated user. Each action is logged with the id of the admin.
+func (s *server) adminUpdateUser(fn func(u *datastore.User) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := s.store.UserByID(mux.Vars(r)["id"])
+		if err != nil {
+			respondNotFoundOrBadRequest(w, err)
+			return
+		}
+
+		err = fn(u)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		log.Println(fmt.Sprintf("Admin %s: %s %s", r.Context().Value("userID"), r.Method, r.URL.Path))
+
+		u.Password = datastore.PasswordMask
+		respondJSON(w, http.StatusOK, u, nil)
+	}
+}
+
+// queryInt converts a query param to an int, or returns def if it is empty
+func queryInt(v string, def int) (int, error) {
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
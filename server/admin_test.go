@@ -0,0 +1,114 @@
+package server_test
+
+import (
+	"encoding/json"
+	"log"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/mikedonnici/rtcl-api/datastore"
+	"github.com/mikedonnici/rtcl-api/server"
+	"github.com/mikedonnici/rtcl-api/testdata"
+)
+
+var adminDS *datastore.Datastore
+
+// TestAdmin runs the admin route tests against their own in-memory datastore, as they lock and delete users
+func TestAdmin(t *testing.T) {
+
+	var err error
+
+	adminDS, err = testdata.NewMemoryStore()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// br@rtcl.io is the admin for these tests
+	u, err := adminDS.UserByID("5b3bcd72463cd6029e04de18")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = u.SetRole(datastore.RoleAdmin)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	t.Run("admin", func(t *testing.T) {
+		t.Run("testAdminRequiresRole", testAdminRequiresRole)
+		t.Run("testAdminListUsers", testAdminListUsers)
+		t.Run("testAdminLockUser", testAdminLockUser)
+		t.Run("testAdminSetRole", testAdminSetRole)
+		t.Run("testAdminDeleteUser", testAdminDeleteUser)
+	})
+}
+
+func testAdminRequiresRole(t *testing.T) {
+	is := is.New(t)
+	w := userRequest(t, srvConfig, adminDS, nil, "GET", "/admin/users", "", "5b3bcd72463cd6029e04de1a")
+	is.Equal(w.Code, 403) // expected 403 Forbidden for a user without the admin role
+
+	r := httptest.NewRequest("GET", "/admin/users", nil)
+	w = httptest.NewRecorder()
+	server.NewServer(srvConfig, adminDS).ServeHTTP(w, r)
+	is.Equal(w.Code, 401) // expected 401 Unauthorized without a token
+}
+
+func testAdminListUsers(t *testing.T) {
+	is := is.New(t)
+	w := userRequest(t, srvConfig, adminDS, nil, "GET", "/admin/users?q=oj@&limit=10", "", "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, 200) // expected 200 OK
+
+	var xu []datastore.User
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &xu))    // error decoding response
+	is.Equal(len(xu), 1)                             // expected one user matching the filter
+	is.Equal(xu[0].Email, "oj@rtcl.io")              // wrong user
+	is.Equal(xu[0].Password, datastore.PasswordMask) // password should be masked
+
+	w = userRequest(t, srvConfig, adminDS, nil, "GET", "/admin/users?limit=100000", "", "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, 400) // expected 400 Bad Request for a limit that is too big
+}
+
+func testAdminLockUser(t *testing.T) {
+	is := is.New(t)
+	w := userRequest(t, srvConfig, adminDS, nil, "POST", "/admin/users/5b3bcd72463cd6029e04de1a/lock", "", "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, 200) // expected 200 OK
+	u, err := adminDS.UserByID("5b3bcd72463cd6029e04de1a")
+	is.NoErr(err)       // error fetching user
+	is.True(u.Disabled) // user should be disabled
+
+	b := strings.NewReader(`{"email": "oj@rtcl.io", "password": "12345abcde"}`)
+	r := httptest.NewRequest("POST", "/auth", b)
+	w2 := httptest.NewRecorder()
+	server.NewServer(srvConfig, adminDS).ServeHTTP(w2, r)
+	is.Equal(w2.Code, 403) // locked user should not be able to log in
+
+	w = userRequest(t, srvConfig, adminDS, nil, "POST", "/admin/users/5b3bcd72463cd6029e04de1a/unlock", "", "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, 200) // expected 200 OK
+	u, err = adminDS.UserByID("5b3bcd72463cd6029e04de1a")
+	is.NoErr(err)        // error fetching user
+	is.True(!u.Disabled) // user should be enabled
+}
+
+func testAdminSetRole(t *testing.T) {
+	is := is.New(t)
+	w := userRequest(t, srvConfig, adminDS, nil, "PUT", "/admin/users/5b3bcd72463cd6029e04de1c/role", `{"role": "wizard"}`, "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, 400) // expected 400 Bad Request for an invalid role
+
+	w = userRequest(t, srvConfig, adminDS, nil, "PUT", "/admin/users/5b3bcd72463cd6029e04de1c/role", `{"role": "admin"}`, "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, 200) // expected 200 OK
+	w = userRequest(t, srvConfig, adminDS, nil, "GET", "/admin/users/5b3bcd72463cd6029e04de18", "", "5b3bcd72463cd6029e04de1c")
+	is.Equal(w.Code, 200) // new admin should have access
+}
+
+func testAdminDeleteUser(t *testing.T) {
+	is := is.New(t)
+	w := userRequest(t, srvConfig, adminDS, nil, "DELETE", "/admin/users/5b3bcd72463cd6029e04de1a", "", "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, 204) // expected 204 No Content
+	_, err := adminDS.UserByID("5b3bcd72463cd6029e04de1a")
+	is.Equal(err, datastore.ErrNotFound) // user should be deleted
+
+	w = userRequest(t, srvConfig, adminDS, nil, "DELETE", "/admin/users/5b3bcd72463cd6029e04de1a", "", "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, 404) // expected 404 Not Found for a deleted user
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mikedonnici/rtcl-api/datastore"
+)
+
+// article is the JSON shape of an article in API responses, based on the Article in schema.md. Fields are not
+// removed or renamed so that clients can rely on it whichever search backend is used.
+type article struct {
+	SourceID         string     `json:"sourceId"`
+	Category         string     `json:"category"`
+	Published        time.Time  `json:"published"`
+	Title            string     `json:"title"`
+	Summary          string     `json:"summary"`
+	Keywords         []string   `json:"keywords"`
+	URL              string     `json:"url"`
+	SourceName       string     `json:"sourceName"`
+	SourceNameAbbrev string     `json:"sourceNameAbbrev"`
+	SourceVolume     string     `json:"sourceVolume"`
+	SourceIssue      string     `json:"sourceIssue"`
+	SourcePages      string     `json:"sourcePages"`
+	SourcePubDate    string     `json:"sourcePubDate"`
+	Highlight        *highlight `json:"highlight,omitempty"`
+}
+
+// highlight is the title and a snippet of the summary of a search hit, as HTML with the matched words in <em> tags
+type highlight struct {
+	Title   string `json:"title"`
+	Summary string `json:"summary"`
+}
+
+// newArticle converts a stored article to the response shape
+func newArticle(a datastore.Article) article {
+	kw := a.Keywords
+	if kw == nil {
+		kw = []string{}
+	}
+	return article{
+		SourceID:         a.PMID,
+		Category:         a.Category,
+		Published:        a.Published.UTC(),
+		Title:            a.Title,
+		Summary:          a.Summary,
+		Keywords:         kw,
+		URL:              a.URL,
+		SourceName:       a.SourceName,
+		SourceNameAbbrev: a.SourceNameAbbrev,
+		SourceVolume:     a.SourceVolume,
+		SourceIssue:      a.SourceIssue,
+		SourcePages:      a.SourcePages,
+		SourcePubDate:    a.SourcePubDate,
+	}
+}
+
+// articleHandler responds with the article with the PMID
+func (s *server) articleHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a, err := s.store.ArticleByPMID(mux.Vars(r)["pmid"])
+		if err == datastore.ErrNotFound {
+			respondJSON(w, http.StatusNotFound, nil, err)
+			return
+		}
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		respondJSON(w, http.StatusOK, newArticle(a), nil)
+	}
+}
+
+// articlesHandler responds with the articles with the comma-separated PMIDs in the ids param, in the same order.
+// PMIDs that are not stored are left out. There can be at most datastore.MaxArticleIDs ids, counting duplicates.
+func (s *server) articlesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var ids []string
+		for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+			if strings.TrimSpace(id) != "" {
+				ids = append(ids, strings.TrimSpace(id))
+			}
+		}
+		if len(ids) > datastore.MaxArticleIDs {
+			respondJSON(w, http.StatusBadRequest, nil, datastore.ErrTooManyArticleIDs)
+			return
+		}
+		if len(ids) == 0 {
+			respondJSON(w, http.StatusBadRequest, nil, errors.New("ids is required"))
+			return
+		}
+
+		xa, err := s.store.ArticlesByPMID(ids)
+		if err == datastore.ErrTooManyArticleIDs {
+			respondJSON(w, http.StatusBadRequest, nil, err)
+			return
+		}
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		articles := make([]article, len(xa))
+		for i, a := range xa {
+			articles[i] = newArticle(a)
+		}
+		respondJSON(w, http.StatusOK, articles, nil)
+	}
+}
@@ -0,0 +1,90 @@
+package server_test
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/mikedonnici/rtcl-api/datastore"
+	"github.com/mikedonnici/rtcl-api/server"
+	"github.com/mikedonnici/rtcl-api/testdata"
+)
+
+var articlesDS *datastore.Datastore
+
+// TestArticles runs the article tests against their own in-memory datastore
+func TestArticles(t *testing.T) {
+
+	var err error
+
+	articlesDS, err = testdata.NewMemoryStore()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	t.Run("articles", func(t *testing.T) {
+		t.Run("testArticle", testArticle)
+		t.Run("testArticles", testArticles)
+	})
+}
+
+func testArticle(t *testing.T) {
+	is := is.New(t)
+	w := userRequest(t, srvConfig, articlesDS, nil, "GET", "/articles/30173671", "", "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, http.StatusOK)
+	var a map[string]interface{}
+	is.NoErr(json.NewDecoder(w.Body).Decode(&a))
+	is.Equal(a["sourceId"], "30173671")
+	is.Equal(a["category"], "cardiology")
+	is.Equal(a["published"], "2018-09-03T00:00:00Z")
+	is.Equal(a["sourceNameAbbrev"], "J Cardiovasc Magn Reson")
+	is.Equal(a["sourceVolume"], "20")
+	is.Equal(a["sourceIssue"], "1")
+	is.Equal(a["sourcePages"], "60")
+	is.Equal(a["url"], "https://doi.org/10.1186/s12968-018-0482-7")
+	_, ok := a["highlight"]
+	is.True(!ok) // expected no highlight outside of a search
+
+	w = userRequest(t, srvConfig, articlesDS, nil, "GET", "/articles/1", "", "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, http.StatusNotFound)
+
+	r := httptest.NewRequest("GET", "/articles/30173671", nil)
+	w = httptest.NewRecorder()
+	server.NewServer(srvConfig, articlesDS).ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusUnauthorized) // expected a token to be required
+}
+
+func testArticles(t *testing.T) {
+	is := is.New(t)
+	w := userRequest(t, srvConfig, articlesDS, nil, "GET", "/articles?ids=30180004,1,%2030173079", "", "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, http.StatusOK)
+	var xa []struct {
+		SourceID string `json:"sourceId"`
+		Title    string `json:"title"`
+	}
+	is.NoErr(json.NewDecoder(w.Body).Decode(&xa))
+	is.Equal(len(xa), 2) // expected the missing id to be left out
+	is.Equal(xa[0].SourceID, "30180004")
+	is.Equal(xa[1].SourceID, "30173079")
+
+	w = userRequest(t, srvConfig, articlesDS, nil, "GET", "/articles?ids=1", "", "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(strings.TrimSpace(w.Body.String()), "[]")
+
+	w = userRequest(t, srvConfig, articlesDS, nil, "GET", "/articles", "", "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, http.StatusBadRequest)
+
+	var ids []string
+	for i := 0; i <= datastore.MaxArticleIDs; i++ {
+		ids = append(ids, strconv.Itoa(i+1))
+	}
+	w = userRequest(t, srvConfig, articlesDS, nil, "GET", "/articles?ids="+strings.Join(ids, ","), "", "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, http.StatusBadRequest)
+	w = userRequest(t, srvConfig, articlesDS, nil, "GET", "/articles?ids="+strings.Repeat("30180004,", datastore.MaxArticleIDs+1), "", "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, http.StatusBadRequest) // expected duplicates to count towards the cap
+}
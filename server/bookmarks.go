@@ -0,0 +1,151 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mikedonnici/rtcl-api/datastore"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// bookmark is the response for a single bookmark. A bookmark that is done but has not been logged comes with a log
+// pre-filled from it, which can be saved with POST /user/bookmarks/{id}/log.
+type bookmark struct {
+	datastore.Bookmark
+	Log *datastore.Log `json:"log,omitempty"`
+}
+
+// newBookmark returns the response for the bookmark, with a log if one is offered
+func (s *server) newBookmark(b datastore.Bookmark) bookmark {
+	res := bookmark{Bookmark: b}
+	if b.Status == datastore.BookmarkDone && !b.LogID.Valid() {
+		l := b.Log(s.now())
+		res.Log = &l
+	}
+	return res
+}
+
+// bookmarksHandler responds with the user's bookmarks, optionally filtered by the status and tag query params. Each
+// has the same shape as from bookmarkHandler.
+func (s *server) bookmarksHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		xb, err := s.store.BookmarksByUserID(r.Context().Value("userID").(string), q.Get("status"), q.Get("tag"))
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		res := make([]bookmark, len(xb))
+		for i, b := range xb {
+			res[i] = s.newBookmark(b)
+		}
+		respondJSON(w, http.StatusOK, res, nil)
+	}
+}
+
+// addBookmarkHandler bookmarks an article and responds with the bookmark
+func (s *server) addBookmarkHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b := datastore.Bookmark{}
+		err := json.NewDecoder(r.Body).Decode(&b)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, nil, err)
+			return
+		}
+
+		b, err = s.store.AddBookmark(r.Context().Value("userID").(string), b)
+		if err != nil {
+			respondBookmarkError(w, err)
+			return
+		}
+		respondJSON(w, http.StatusCreated, s.newBookmark(b), nil)
+	}
+}
+
+// bookmarkHandler responds with one of the user's bookmarks
+func (s *server) bookmarkHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, err := s.store.BookmarkByID(r.Context().Value("userID").(string), mux.Vars(r)["id"])
+		if err != nil {
+			respondBookmarkError(w, err)
+			return
+		}
+		respondJSON(w, http.StatusOK, s.newBookmark(b), nil)
+	}
+}
+
+// updateBookmarkHandler replaces the status, tags and priority of a bookmark
+func (s *server) updateBookmarkHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if !bson.IsObjectIdHex(id) {
+			respondBookmarkError(w, datastore.ErrNotFound)
+			return
+		}
+		b := datastore.Bookmark{}
+		err := json.NewDecoder(r.Body).Decode(&b)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, nil, err)
+			return
+		}
+		b.ID = bson.ObjectIdHex(id)
+
+		b, err = s.store.UpdateBookmark(r.Context().Value("userID").(string), b)
+		if err != nil {
+			respondBookmarkError(w, err)
+			return
+		}
+		respondJSON(w, http.StatusOK, s.newBookmark(b), nil)
+	}
+}
+
+// removeBookmarkHandler deletes a bookmark
+func (s *server) removeBookmarkHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := s.store.RemoveBookmark(r.Context().Value("userID").(string), mux.Vars(r)["id"])
+		if err != nil {
+			respondBookmarkError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// logBookmarkHandler saves a log pre-filled from the bookmark, which is marked done, and responds with the log. The
+// body is optional, and can set the date, minutes and comment of the log.
+func (s *server) logBookmarkHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		l := datastore.Log{}
+		err := json.NewDecoder(r.Body).Decode(&l)
+		if err != nil && err != io.EOF {
+			respondJSON(w, http.StatusBadRequest, nil, err)
+			return
+		}
+
+		nl, err := s.store.LogBookmark(r.Context().Value("userID").(string), mux.Vars(r)["id"], l)
+		if err != nil {
+			respondBookmarkError(w, err)
+			return
+		}
+		respondJSON(w, http.StatusCreated, nl, nil)
+	}
+}
+
+// respondBookmarkError responds with the status for an error from the bookmark methods
+func respondBookmarkError(w http.ResponseWriter, err error) {
+	if _, ok := err.(*datastore.BookmarkError); ok {
+		respondJSON(w, http.StatusBadRequest, nil, err)
+		return
+	}
+	switch err {
+	case datastore.ErrNotFound:
+		respondJSON(w, http.StatusNotFound, nil, errors.New("bookmark not found"))
+	case datastore.ErrBookmarkExists, datastore.ErrBookmarkLogged:
+		respondJSON(w, http.StatusConflict, nil, err)
+	default:
+		respondJSON(w, http.StatusInternalServerError, nil, err)
+	}
+}
@@ -0,0 +1,195 @@
+package server_test
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/mikedonnici/rtcl-api/datastore"
+	"github.com/mikedonnici/rtcl-api/server"
+	"github.com/mikedonnici/rtcl-api/testdata"
+)
+
+var bookmarksDS *datastore.Datastore
+
+// bookmarksNow is the server clock for the bookmark tests. It is stopped, rather than set to a fixed date, as the
+// tokens are checked against it.
+var bookmarksNow = time.Now().UTC().Truncate(time.Second)
+
+// TestBookmarks runs the bookmark tests against their own in-memory datastore
+func TestBookmarks(t *testing.T) {
+
+	var err error
+
+	bookmarksDS, err = testdata.NewMemoryStore()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	t.Run("bookmarks", func(t *testing.T) {
+		t.Run("testBookmarks", testBookmarks)
+		t.Run("testBookmarkDone", testBookmarkDone)
+		t.Run("testBookmarkOwner", testBookmarkOwner)
+	})
+}
+
+// bookmarksClock returns bookmarksNow, and is the clock of the servers and tokens in the bookmark tests
+func bookmarksClock() time.Time {
+	return bookmarksNow
+}
+
+func testBookmarks(t *testing.T) {
+	is := is.New(t)
+	const uid = "5b3bcd72463cd6029e04de1a"
+
+	w := userRequest(t, srvConfig, bookmarksDS, bookmarksClock, "POST", "/user/bookmarks", `{"pmid": "30180002", "tags": ["HCM"], "priority": 2}`, uid)
+	is.Equal(w.Code, http.StatusCreated)
+	var b map[string]interface{}
+	is.NoErr(json.NewDecoder(w.Body).Decode(&b))
+	is.Equal(b["pmid"], "30180002")
+	is.Equal(b["status"], "to-read")
+	is.Equal(b["priority"], float64(2))
+	is.Equal(b["tags"], []interface{}{"hcm"})
+	a := b["article"].(map[string]interface{})
+	is.Equal(a["sourceNameAbbrev"], "Circulation") // expected a snapshot of the stored article
+	_, ok := b["log"]
+	is.True(!ok) // expected no log to be offered for a bookmark that is not done
+	id := b["id"].(string)
+
+	w = userRequest(t, srvConfig, bookmarksDS, bookmarksClock, "POST", "/user/bookmarks", `{"pmid": "30180002"}`, uid)
+	is.Equal(w.Code, http.StatusConflict) // expected the same article not to be bookmarked twice
+	w = userRequest(t, srvConfig, bookmarksDS, bookmarksClock, "POST", "/user/bookmarks", `{"pmid": "30180003", "status": "skimmed"}`, uid)
+	is.Equal(w.Code, http.StatusBadRequest)
+	w = userRequest(t, srvConfig, bookmarksDS, bookmarksClock, "POST", "/user/bookmarks", `{"pmid": "1"}`, uid)
+	is.Equal(w.Code, http.StatusBadRequest) // expected a title for an article that is not stored
+	w = userRequest(t, srvConfig, bookmarksDS, bookmarksClock, "POST", "/user/bookmarks", `{"pmid": "1", "article": {"title": "Elsewhere"}}`, uid)
+	is.Equal(w.Code, http.StatusCreated)
+	w = userRequest(t, srvConfig, bookmarksDS, bookmarksClock, "POST", "/user/bookmarks", `{"pmid": "30180003", "status": "reading"}`, uid)
+	is.Equal(w.Code, http.StatusCreated)
+
+	w = userRequest(t, srvConfig, bookmarksDS, bookmarksClock, "GET", "/user/bookmarks", "", uid)
+	is.Equal(w.Code, http.StatusOK)
+	var xb []datastore.Bookmark
+	is.NoErr(json.NewDecoder(w.Body).Decode(&xb))
+	is.Equal(len(xb), 3)
+	is.Equal(xb[0].PMID, "30180002") // expected the highest priority first
+
+	w = userRequest(t, srvConfig, bookmarksDS, bookmarksClock, "GET", "/user/bookmarks?status=reading", "", uid)
+	is.NoErr(json.NewDecoder(w.Body).Decode(&xb))
+	is.Equal(len(xb), 1)
+	is.Equal(xb[0].PMID, "30180003")
+	w = userRequest(t, srvConfig, bookmarksDS, bookmarksClock, "GET", "/user/bookmarks?tag=hcm", "", uid)
+	is.NoErr(json.NewDecoder(w.Body).Decode(&xb))
+	is.Equal(len(xb), 1)
+	is.Equal(xb[0].ID.Hex(), id)
+
+	w = userRequest(t, srvConfig, bookmarksDS, bookmarksClock, "GET", "/user/bookmarks/"+id, "", uid)
+	is.Equal(w.Code, http.StatusOK)
+	w = userRequest(t, srvConfig, bookmarksDS, bookmarksClock, "PUT", "/user/bookmarks/"+id, `{"status": "reading", "tags": ["hcm", "athletes"], "priority": 1}`, uid)
+	is.Equal(w.Code, http.StatusOK)
+	var ub datastore.Bookmark
+	is.NoErr(json.NewDecoder(w.Body).Decode(&ub))
+	is.Equal(ub.Status, datastore.BookmarkReading)
+	is.Equal(ub.Tags, []string{"hcm", "athletes"})
+	is.Equal(ub.Priority, 1)
+	w = userRequest(t, srvConfig, bookmarksDS, bookmarksClock, "PUT", "/user/bookmarks/"+id, `{"priority": 9}`, uid)
+	is.Equal(w.Code, http.StatusBadRequest)
+
+	w = userRequest(t, srvConfig, bookmarksDS, bookmarksClock, "DELETE", "/user/bookmarks/"+id, "", uid)
+	is.Equal(w.Code, http.StatusNoContent)
+	w = userRequest(t, srvConfig, bookmarksDS, bookmarksClock, "GET", "/user/bookmarks/"+id, "", uid)
+	is.Equal(w.Code, http.StatusNotFound)
+	w = userRequest(t, srvConfig, bookmarksDS, bookmarksClock, "PUT", "/user/bookmarks/bad", `{}`, uid)
+	is.Equal(w.Code, http.StatusNotFound)
+
+	r := httptest.NewRequest("GET", "/user/bookmarks", nil)
+	w = httptest.NewRecorder()
+	server.NewServer(srvConfig, bookmarksDS).ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusUnauthorized) // expected a token to be required
+}
+
+// testBookmarkDone tests that a bookmark marked done offers a log, which can then be saved
+func testBookmarkDone(t *testing.T) {
+	is := is.New(t)
+	const uid = "5b3bcd72463cd6029e04de1c"
+
+	w := userRequest(t, srvConfig, bookmarksDS, bookmarksClock, "POST", "/user/bookmarks", `{"pmid": "30180001"}`, uid)
+	is.Equal(w.Code, http.StatusCreated)
+	var b datastore.Bookmark
+	is.NoErr(json.NewDecoder(w.Body).Decode(&b))
+	id := b.ID.Hex()
+
+	w = userRequest(t, srvConfig, bookmarksDS, bookmarksClock, "PUT", "/user/bookmarks/"+id, `{"status": "done"}`, uid)
+	is.Equal(w.Code, http.StatusOK)
+	var res struct {
+		Status string        `json:"status"`
+		Done   time.Time     `json:"done"`
+		Log    datastore.Log `json:"log"`
+	}
+	is.NoErr(json.NewDecoder(w.Body).Decode(&res))
+	is.Equal(res.Status, "done")
+	is.True(res.Done.Equal(bookmarksNow))
+	is.Equal(res.Log.PMID, "30180001") // expected a log pre-filled from the bookmark
+	is.Equal(res.Log.Date, bookmarksNow.Format("2006-01-02"))
+	is.Equal(res.Log.Source, b.Article.Source())
+	is.Equal(res.Log.Title, b.Article.Title)
+	is.True(!res.Log.ID.Valid()) // expected the offered log not to be saved
+
+	w = userRequest(t, srvConfig, bookmarksDS, bookmarksClock, "GET", "/user/bookmarks?status=done", "", uid)
+	is.Equal(w.Code, http.StatusOK)
+	var xres []struct {
+		ID  string        `json:"id"`
+		Log datastore.Log `json:"log"`
+	}
+	is.NoErr(json.NewDecoder(w.Body).Decode(&xres))
+	is.Equal(len(xres), 1)
+	is.Equal(xres[0].ID, id)
+	is.Equal(xres[0].Log.PMID, "30180001") // expected the list to offer the log too
+
+	xl, err := bookmarksDS.LogsByUserID(uid)
+	is.NoErr(err)
+	logs := len(xl)
+
+	w = userRequest(t, srvConfig, bookmarksDS, bookmarksClock, "POST", "/user/bookmarks/"+id+"/log", `{"minutes": 20, "comment": "Read it"}`, uid)
+	is.Equal(w.Code, http.StatusCreated)
+	var l datastore.Log
+	is.NoErr(json.NewDecoder(w.Body).Decode(&l))
+	is.True(l.ID.Valid())
+	is.Equal(l.PMID, "30180001")
+	is.Equal(l.Minutes, 20)
+	is.Equal(l.Comment, "Read it")
+	xl, err = bookmarksDS.LogsByUserID(uid)
+	is.NoErr(err)
+	is.Equal(len(xl), logs+1) // expected the log to be saved
+
+	w = userRequest(t, srvConfig, bookmarksDS, bookmarksClock, "GET", "/user/bookmarks/"+id, "", uid)
+	var logged map[string]interface{}
+	is.NoErr(json.NewDecoder(w.Body).Decode(&logged))
+	is.Equal(logged["logId"], l.ID.Hex())
+	_, ok := logged["log"]
+	is.True(!ok) // expected no log to be offered once it has been logged
+	w = userRequest(t, srvConfig, bookmarksDS, bookmarksClock, "POST", "/user/bookmarks/"+id+"/log", "", uid)
+	is.Equal(w.Code, http.StatusConflict)
+}
+
+// testBookmarkOwner tests that a user cannot see or change another user's bookmarks
+func testBookmarkOwner(t *testing.T) {
+	is := is.New(t)
+	xb, err := bookmarksDS.BookmarksByUserID("5b3bcd72463cd6029e04de1c", "", "")
+	is.NoErr(err)
+	id := xb[0].ID.Hex()
+
+	const other = "5b3bcd72463cd6029e04de18"
+	w := userRequest(t, srvConfig, bookmarksDS, bookmarksClock, "GET", "/user/bookmarks/"+id, "", other)
+	is.Equal(w.Code, http.StatusNotFound)
+	w = userRequest(t, srvConfig, bookmarksDS, bookmarksClock, "PUT", "/user/bookmarks/"+id, `{"status": "to-read"}`, other)
+	is.Equal(w.Code, http.StatusNotFound)
+	w = userRequest(t, srvConfig, bookmarksDS, bookmarksClock, "POST", "/user/bookmarks/"+id+"/log", "", other)
+	is.Equal(w.Code, http.StatusNotFound)
+	w = userRequest(t, srvConfig, bookmarksDS, bookmarksClock, "DELETE", "/user/bookmarks/"+id, "", other)
+	is.Equal(w.Code, http.StatusNotFound)
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/mikedonnici/rtcl-api/datastore"
+)
+
+// mfaAuthHandler is the second step of /auth for a user with two-factor auth. The mfaToken returned by /auth is
+// exchanged, along with a code from the authenticator app or a recovery code, for an access token and refresh token.
+func (s *server) mfaAuthHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body := struct {
+			MFAToken string `json:"mfaToken"`
+			Code     string `json:"code"`
+		}{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, nil, err)
+			return
+		}
+
+		a, err := s.store.CheckActionToken(body.MFAToken, datastore.ActionMFA, s.config.Token.SigningKey)
+		if err != nil {
+			respondJSON(w, http.StatusUnauthorized, nil, err)
+			return
+		}
+
+		ip := s.clientIP(r)
+		wait := s.ipThrottle.attempt(ip, "mfa:"+a.UserID.Hex())
+		if wait > 0 {
+			respondTooManyRequests(w, wait)
+			return
+		}
+
+		u, err := s.store.MFAAuth(a.UserID.Hex(), body.Code)
+		if lockout, ok := err.(*datastore.LockoutError); ok {
+			respondTooManyRequests(w, lockout.RetryAfter)
+			return
+		}
+		if err == datastore.ErrAccountDisabled {
+			respondJSON(w, http.StatusForbidden, nil, err)
+			return
+		}
+		if err == datastore.ErrMFACodeInvalid {
+			respondJSON(w, http.StatusUnauthorized, nil, err)
+			return
+		}
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		s.ipThrottle.succeed(ip, "mfa:"+a.UserID.Hex())
+
+		// the mfa token can only be exchanged once
+		err = s.store.ConsumeActionToken(a)
+		if err == datastore.ErrActionTokenUsed {
+			respondJSON(w, http.StatusUnauthorized, nil, err)
+			return
+		}
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+
+		rt, err := u.RefreshToken(s.config.Token.refreshTTL())
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		s.respondTokens(w, u, rt)
+	}
+}
+
+// mfaEnrollHandler generates a TOTP secret for the user and responds with the secret and the otpauth URI, for the
+// client to show as a QR code. Two-factor auth is not enabled until a code is posted to /user/mfa/confirm.
+func (s *server) mfaEnrollHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := s.store.UserByID(r.Context().Value("userID").(string))
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+
+		secret, uri, err := u.EnrollTOTP(s.config.Token.Issuer)
+		if err == datastore.ErrMFAAlreadyEnabled {
+			respondJSON(w, http.StatusConflict, nil, err)
+			return
+		}
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		respondJSON(w, http.StatusOK, map[string]string{"secret": secret, "uri": uri}, nil)
+	}
+}
+
+// mfaConfirmHandler enables two-factor auth with the first code from the authenticator app, and responds with the
+// recovery codes. This is the only time the recovery codes are shown.
+func (s *server) mfaConfirmHandler() http.HandlerFunc {
+	return s.mfaCodeHandler(func(u *datastore.User, code string) (interface{}, error) {
+		codes, err := u.ConfirmTOTP(code)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]string{"recoveryCodes": codes}, nil
+	})
+}
+
+// mfaDisableHandler turns off two-factor auth. A current code is required so that a stolen access token cannot be
+// used to turn it off.
+func (s *server) mfaDisableHandler() http.HandlerFunc {
+	return s.mfaCodeHandler(func(u *datastore.User, code string) (interface{}, error) {
+		err := u.CheckMFA(code)
+		if err != nil {
+			return nil, err
+		}
+		return nil, u.DisableMFA()
+	})
+}
+
+// mfaCodeHandler returns a handler that decodes a code from the request body and passes it to fn with the user in
+// the request context. It responds with the value returned by fn, or 204 if it is nil. Wrong codes count towards the
+// login lockout, so a stolen access token cannot be used to guess them.
+func (s *server) mfaCodeHandler(fn func(u *datastore.User, code string) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body := struct {
+			Code string `json:"code"`
+		}{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, nil, err)
+			return
+		}
+		if body.Code == "" {
+			respondJSON(w, http.StatusBadRequest, nil, errors.New("code is missing"))
+			return
+		}
+
+		u, err := s.store.UserByID(r.Context().Value("userID").(string))
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+
+		now := s.now()
+		wait := u.LoginRetryAfter(now)
+		if wait > 0 {
+			respondTooManyRequests(w, wait)
+			return
+		}
+
+		data, err := fn(u, body.Code)
+		switch err {
+		case nil:
+		case datastore.ErrMFACodeInvalid:
+			err = u.RecordFailedLogin(now)
+			if err != nil {
+				respondJSON(w, http.StatusInternalServerError, nil, err)
+				return
+			}
+			respondJSON(w, http.StatusBadRequest, nil, datastore.ErrMFACodeInvalid)
+			return
+		case datastore.ErrMFANotEnrolled:
+			respondJSON(w, http.StatusBadRequest, nil, err)
+			return
+		case datastore.ErrMFAAlreadyEnabled:
+			respondJSON(w, http.StatusConflict, nil, err)
+			return
+		default:
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+
+		if data == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		respondJSON(w, http.StatusOK, data, nil)
+	}
+}
@@ -2,48 +2,86 @@ package server
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 
 	"context"
 	"github.com/mikedonnici/rtcl-api/datastore"
+	"gopkg.in/mgo.v2/bson"
 )
 
-func (s *server) requireValidToken(h http.HandlerFunc) http.HandlerFunc {
+// requireValidUserToken middleware gets the token from the Auth header and checks that it has not been revoked. The
+// token is decoded once, and passed down in the context along with the user id. Clients get a new access token from
+// /auth/refresh before this one expires.
+func (s *server) requireValidUserToken(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		err := s.ValidateAuthHeaderToken(r, "")
+
+		t, err := s.AuthHeaderToken(r)
 		if err != nil {
-			respondJSON(w, http.StatusUnauthorized, nil, err)
+			respondUnauthorized(w, err)
 			return
 		}
-		h(w, r)
-	}
-}
 
-// requireValidUserToken middleware gets the token from the Auth header
-func (s *server) requireValidUserToken(h http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+		// a correctly signed token must still be for a user
+		if !bson.IsObjectIdHex(t.Claims.ID) {
+			respondUnauthorized(w, datastore.ErrTokenMalformed)
+			return
+		}
 
-		t, err := s.AuthHeaderToken(r)
+		_, err = s.store.CheckToken(t)
+		if err == datastore.ErrTokenRevoked || err == datastore.ErrNotFound {
+			respondUnauthorized(w, datastore.ErrTokenRevoked)
+			return
+		}
 		if err != nil {
-			respondJSON(w, http.StatusUnauthorized, nil, err)
+			respondJSON(w, http.StatusInternalServerError, nil, err)
 			return
 		}
 
-		err = s.ValidateAuthHeaderToken(r, t.Claims.ID)
+		ctx := context.WithValue(r.Context(), "userID", t.Claims.ID)
+		ctx = context.WithValue(ctx, "token", t)
+		r = r.WithContext(ctx)
+		h(w, r)
+	}
+}
+
+// requireRole middleware requires a valid user token for a user with the specified role. The role is checked on the
+// stored user, rather than the token claim, so that a change of role takes effect immediately.
+func (s *server) requireRole(role string, h http.HandlerFunc) http.HandlerFunc {
+	return s.requireValidUserToken(func(w http.ResponseWriter, r *http.Request) {
+		u, err := s.store.UserByID(r.Context().Value("userID").(string))
 		if err != nil {
-			respondJSON(w, http.StatusUnauthorized, nil, err)
+			respondJSON(w, http.StatusUnauthorized, nil, errors.New("could not get user id from token"))
+			return
+		}
+		if !u.HasRole(role) {
+			respondJSON(w, http.StatusForbidden, nil, errors.New("requires role: "+role))
 			return
 		}
+		h(w, r)
+	})
+}
 
-		freshToken, err := s.store.FreshUserToken(t.Claims.ID, s.config.Token.Issuer, s.config.Token.SigningKey, s.config.Token.HoursTTL)
+// requireClientKey middleware requires the X-API-Key header to be the key of a registered client app with the
+// specified scope.
+func (s *server) requireClientKey(scope string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := s.store.ClientByKey(r.Header.Get("X-API-Key"))
+		if err == datastore.ErrClientKeyInvalid {
+			respondJSON(w, http.StatusUnauthorized, nil, errors.New("a valid X-API-Key header is required"))
+			return
+		}
 		if err != nil {
 			respondJSON(w, http.StatusInternalServerError, nil, err)
 			return
 		}
+		if !c.HasScope(scope) {
+			respondJSON(w, http.StatusForbidden, nil, errors.New("client key requires scope: "+scope))
+			return
+		}
 
-		w.Header().Add("fresh-token", freshToken)
-		ctx := context.WithValue(r.Context(), "userID", t.Claims.ID)
+		ctx := context.WithValue(r.Context(), "clientID", c.ID.Hex())
 		r = r.WithContext(ctx)
 		h(w, r)
 	}
@@ -74,9 +112,23 @@ func (s *server) AuthHeaderToken(r *http.Request) (datastore.Token, error) {
 
 	xs := strings.Fields(r.Header.Get("Authorization"))
 	if len(xs) < 2 || xs[0] != "Bearer" {
-		return t, errors.New("authorization header should be: Bearer [jwt]")
+		return t, errNoToken
 	}
 	ts := strings.TrimSpace(xs[1])
 
-	return datastore.DecodeToken(ts, s.config.Token.SigningKey)
+	return s.validator.Decode(ts)
+}
+
+// errNoToken is returned by AuthHeaderToken when the request does not have a bearer token
+var errNoToken = errors.New("authorization header should be: Bearer [jwt]")
+
+// respondUnauthorized responds 401 with a WWW-Authenticate header as described in RFC 6750. A request without a
+// token just gets the auth scheme, otherwise the header says why the token was rejected.
+func respondUnauthorized(w http.ResponseWriter, err error) {
+	challenge := `Bearer realm="rtcl"`
+	if err != errNoToken {
+		challenge += fmt.Sprintf(`, error="invalid_token", error_description="%s"`, err)
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	respondJSON(w, http.StatusUnauthorized, nil, err)
 }
@@ -111,3 +111,54 @@ func testTokens(tokenConfig server.TokenConfig, claims map[string]interface{}) [
 
 	return xtt
 }
+
+// TestUnauthorizedChallenge checks the WWW-Authenticate header that says why a token was rejected
+func TestUnauthorizedChallenge(t *testing.T) {
+	is := is.New(t)
+	cfg := serverConfig
+	cfg.Token.Audiences = []string{"rtcl-web"}
+	s := server.NewServer(cfg, nil)
+
+	r := httptest.NewRequest("GET", "/user", nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	is.Equal(w.Code, 401)                                               // expected 401 without a token
+	is.Equal(w.Header().Get("WWW-Authenticate"), `Bearer realm="rtcl"`) // no error without a token
+
+	iat := time.Now().Add(-2 * time.Hour)
+	tk, err := datastore.NewToken(cfg.Token.Issuer, cfg.Token.SigningKey, 1).SetTimes(iat).Audience("rtcl-web").Encode()
+	is.NoErr(err) // error creating expired token
+	r = httptest.NewRequest("GET", "/user", nil)
+	r.Header.Set("Authorization", "Bearer "+tk.String())
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	is.Equal(w.Code, 401) // expected 401 for an expired token
+	is.Equal(w.Header().Get("WWW-Authenticate"),
+		`Bearer realm="rtcl", error="invalid_token", error_description="token has expired"`)
+
+	for _, id := range []string{"", "notAnObjectId"} {
+		tk, err = datastore.NewToken(cfg.Token.Issuer, cfg.Token.SigningKey, 1).Audience("rtcl-web").
+			CustomClaims(map[string]interface{}{"id": id}).Encode()
+		is.NoErr(err) // error creating token
+		r = httptest.NewRequest("GET", "/user", nil)
+		r.Header.Set("Authorization", "Bearer "+tk.String())
+		w = httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		is.Equal(w.Code, 401) // expected 401 for a token without a valid user id
+		is.Equal(w.Header().Get("WWW-Authenticate"),
+			`Bearer realm="rtcl", error="invalid_token", error_description="token is malformed"`)
+	}
+
+	tk, err = datastore.NewToken(cfg.Token.Issuer, cfg.Token.SigningKey, 1).Audience("rtcl-admin").Encode()
+	is.NoErr(err) // error creating token
+	r = httptest.NewRequest("GET", "/user", nil)
+	r.Header.Set("Authorization", "Bearer "+tk.String())
+	_, err = s.AuthHeaderToken(r)
+	is.Equal(err, datastore.ErrTokenAudience) // token for another audience should be rejected
+
+	tk, err = datastore.NewToken("someone else", cfg.Token.SigningKey, 1).Audience("rtcl-web").Encode()
+	is.NoErr(err) // error creating token
+	r.Header.Set("Authorization", "Bearer "+tk.String())
+	_, err = s.AuthHeaderToken(r)
+	is.Equal(err, datastore.ErrTokenIssuer) // token from another issuer should be rejected
+}
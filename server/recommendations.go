@@ -0,0 +1,43 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/mikedonnici/rtcl-api/datastore"
+)
+
+// recommendation is an article recommended for the user, with its score and the reasons for it
+type recommendation struct {
+	Article article  `json:"article"`
+	Score   float64  `json:"score"`
+	Reasons []string `json:"reasons"`
+}
+
+// recommendationsHandler responds with articles recommended for the user from their logs and saved searches, best
+// first. The limit param sets how many, up to datastore.MaxRecommendations.
+func (s *server) recommendationsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var limit int
+		if v := r.URL.Query().Get("limit"); v != "" {
+			var err error
+			limit, err = strconv.Atoi(v)
+			if err != nil || limit < 1 || limit > datastore.MaxRecommendations {
+				respondJSON(w, http.StatusBadRequest, nil, errors.New("limit must be a number from 1 to 100"))
+				return
+			}
+		}
+
+		xr, err := s.store.Recommendations(r.Context().Value("userID").(string), limit)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		res := make([]recommendation, len(xr))
+		for i, rec := range xr {
+			res[i] = recommendation{Article: newArticle(rec.Article), Score: rec.Score, Reasons: rec.Reasons}
+		}
+		respondJSON(w, http.StatusOK, res, nil)
+	}
+}
@@ -0,0 +1,81 @@
+package server_test
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/mikedonnici/rtcl-api/datastore"
+	"github.com/mikedonnici/rtcl-api/server"
+	"github.com/mikedonnici/rtcl-api/testdata"
+)
+
+var recommendationsDS *datastore.Datastore
+
+// TestRecommendations runs the recommendation tests against their own in-memory datastore. The clock is set to a week
+// after the last of br's logs.
+func TestRecommendations(t *testing.T) {
+
+	var err error
+
+	recommendationsDS, err = testdata.NewMemoryStore()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	recommendationsDS.Now = func() time.Time { return time.Date(2018, 12, 10, 0, 0, 0, 0, time.UTC) }
+
+	t.Run("recommendations", func(t *testing.T) {
+		t.Run("testRecommendations", testRecommendations)
+		t.Run("testRecommendationsLimit", testRecommendationsLimit)
+	})
+}
+
+func testRecommendations(t *testing.T) {
+	is := is.New(t)
+	w := userRequest(t, srvConfig, recommendationsDS, recommendationsDS.Now, "GET", "/user/recommendations", "", "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, http.StatusOK)
+	var xr []struct {
+		Article struct {
+			SourceID  string `json:"sourceId"`
+			Published string `json:"published"`
+		} `json:"article"`
+		Score   float64  `json:"score"`
+		Reasons []string `json:"reasons"`
+	}
+	is.NoErr(json.NewDecoder(w.Body).Decode(&xr))
+	is.Equal(len(xr), 3)
+	is.Equal(xr[0].Article.SourceID, "30180001")
+	is.Equal(xr[0].Article.Published, "2018-09-10T00:00:00Z")
+	is.Equal(xr[0].Reasons, []string{"category:cardiology", "keyword:Zhang L", "journal:Atherosclerosis"})
+	is.True(xr[0].Score > xr[1].Score)
+	for _, r := range xr {
+		is.True(r.Article.SourceID != "30173671") // expected logged articles to be left out
+	}
+
+	w = userRequest(t, srvConfig, recommendationsDS, recommendationsDS.Now, "GET", "/user/recommendations", "", "5b3bcd72463cd6029e04de1a")
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(w.Body.String(), "[]") // expected an empty list for a user with no history
+
+	r := httptest.NewRequest("GET", "/user/recommendations", nil)
+	w = httptest.NewRecorder()
+	server.NewServer(srvConfig, recommendationsDS).ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusUnauthorized) // expected a token to be required
+}
+
+func testRecommendationsLimit(t *testing.T) {
+	is := is.New(t)
+	w := userRequest(t, srvConfig, recommendationsDS, recommendationsDS.Now, "GET", "/user/recommendations?limit=1", "", "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, http.StatusOK)
+	var xr []map[string]interface{}
+	is.NoErr(json.NewDecoder(w.Body).Decode(&xr))
+	is.Equal(len(xr), 1)
+
+	for _, v := range []string{"0", "101", "ten"} {
+		w = userRequest(t, srvConfig, recommendationsDS, recommendationsDS.Now, "GET", "/user/recommendations?limit="+v, "", "5b3bcd72463cd6029e04de18")
+		is.Equal(w.Code, http.StatusBadRequest)
+	}
+}
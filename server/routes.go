@@ -12,11 +12,11 @@ import (
 	"github.com/mikedonnici/pubmed"
 	"github.com/mikedonnici/rtcl-api/datastore"
 	"github.com/mikedonnici/rtcl-api/emailer"
-	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 	"io"
 	"log"
 	"net/http"
+	"strings"
 )
 
 func (s *server) routes() {
@@ -25,22 +25,73 @@ func (s *server) routes() {
 	s.router.HandleFunc("/", s.indexHandler()).Methods("GET")
 	s.router.HandleFunc("/r/{pmid}", s.redirectHandler()).Methods("GET")
 	s.router.HandleFunc("/favicon.ico", s.faviconHandler()).Methods("GET")
+	s.router.HandleFunc("/.well-known/jwks.json", s.jwksHandler()).Methods("GET")
 	s.router.HandleFunc("/auth", s.authHandler()).Methods("POST")
+	s.router.HandleFunc("/auth/magic-link", s.magicLinkHandler()).Methods("POST")
+	s.router.HandleFunc("/auth/mfa", s.mfaAuthHandler()).Methods("POST")
+	s.router.HandleFunc("/auth/refresh", s.refreshHandler()).Methods("POST")
+	s.router.HandleFunc("/auth/logout", s.requireValidUserToken(s.logoutHandler())).Methods("POST")
 
-	// these should all require an app client key
-	s.router.HandleFunc("/users", s.addUserHandler()).Methods("POST")
-	s.router.HandleFunc("/users/{id}", s.userByIDHandler()).Methods("GET")
-	s.router.HandleFunc("/users/{id}/notifications/{notification}", s.userNotificationHandler()).Methods("POST")
+	// Client key middleware
+	s.router.HandleFunc("/users", s.requireClientKey(datastore.ScopeUsersCreate, s.addUserHandler())).Methods("POST")
+	s.router.HandleFunc("/users/{id}", s.requireClientKey(datastore.ScopeUsersRead, s.userByIDHandler())).Methods("GET")
+	s.router.HandleFunc("/users/{id}/notifications/{notification}", s.requireClientKey(datastore.ScopeUsersNotify, s.userNotificationHandler())).Methods("POST")
+
+	// these are opened from emailed links, so are protected by the action token rather than a client key
 	s.router.HandleFunc("/users/{id}/confirm/{key}", s.userConfirmationHandler()).Methods("GET")
+	s.router.HandleFunc("/users/{id}/reset/{key}", s.resetKeyHandler()).Methods("GET")
+	s.router.HandleFunc("/users/{id}/reset/{key}", s.resetPasswordHandler()).Methods("POST")
+	s.router.HandleFunc("/users/{id}/email/{key}", s.emailChangeHandler()).Methods("GET")
+	s.router.HandleFunc("/users/{id}/unsubscribe/{key}", s.unsubscribeHandler()).Methods("GET")
+	s.router.HandleFunc("/users/{id}/login/{key}", s.magicLoginHandler()).Methods("POST")
 
 	// Auth Middleware
+	s.router.HandleFunc("/search", s.requireValidUserToken(s.articleSearchHandler())).Methods("GET")
+	s.router.HandleFunc("/articles", s.requireValidUserToken(s.articlesHandler())).Methods("GET")
+	s.router.HandleFunc("/articles/{pmid}", s.requireValidUserToken(s.articleHandler())).Methods("GET")
 	s.router.HandleFunc("/user", s.requireValidUserToken(s.userByTokenHandler())).Methods("GET")
 	s.router.HandleFunc("/user", s.requireValidUserToken(s.updateUserHandler())).Methods("PUT")
+	s.router.HandleFunc("/user", s.requireValidUserToken(s.deleteUserHandler())).Methods("DELETE")
+	s.router.HandleFunc("/user/restore", s.requireValidUserToken(s.restoreUserHandler())).Methods("POST")
+	s.router.HandleFunc("/user/export", s.requireValidUserToken(s.exportUserHandler())).Methods("GET")
 	s.router.HandleFunc("/user/search", s.requireValidUserToken(s.saveSearchHandler())).Methods("POST")
 	s.router.HandleFunc("/user/search", s.requireValidUserToken(s.deleteSearchHandler())).Methods("DELETE")
+	s.router.HandleFunc("/user/searches", s.requireValidUserToken(s.searchesHandler())).Methods("GET")
+	s.router.HandleFunc("/user/searches", s.requireValidUserToken(s.addSearchHandler())).Methods("POST")
+	s.router.HandleFunc("/user/searches/{id}", s.requireValidUserToken(s.searchHandler())).Methods("GET")
+	s.router.HandleFunc("/user/searches/{id}", s.requireValidUserToken(s.updateSearchHandler())).Methods("PUT")
+	s.router.HandleFunc("/user/searches/{id}", s.requireValidUserToken(s.removeSearchHandler())).Methods("DELETE")
+	s.router.HandleFunc("/user/searches/{id}/shares", s.requireValidUserToken(s.searchSharesHandler())).Methods("GET")
+	s.router.HandleFunc("/user/searches/{id}/shares", s.requireValidUserToken(s.shareSearchHandler())).Methods("POST")
+	s.router.HandleFunc("/user/searches/{id}/shares/{shareId}", s.requireValidUserToken(s.revokeShareHandler())).Methods("DELETE")
+	s.router.HandleFunc("/user/searches/{id}/fork", s.requireValidUserToken(s.forkSearchHandler())).Methods("POST")
+	s.router.HandleFunc("/user/shared", s.requireValidUserToken(s.sharedWithMeHandler())).Methods("GET")
+	s.router.HandleFunc("/shared/{shareId}", s.requireValidUserToken(s.sharedSearchHandler())).Methods("GET")
+	s.router.HandleFunc("/shared/{shareId}/subscribe", s.requireValidUserToken(s.subscribeHandler())).Methods("POST")
+	s.router.HandleFunc("/user/recommendations", s.requireValidUserToken(s.recommendationsHandler())).Methods("GET")
+	s.router.HandleFunc("/user/bookmarks", s.requireValidUserToken(s.bookmarksHandler())).Methods("GET")
+	s.router.HandleFunc("/user/bookmarks", s.requireValidUserToken(s.addBookmarkHandler())).Methods("POST")
+	s.router.HandleFunc("/user/bookmarks/{id}", s.requireValidUserToken(s.bookmarkHandler())).Methods("GET")
+	s.router.HandleFunc("/user/bookmarks/{id}", s.requireValidUserToken(s.updateBookmarkHandler())).Methods("PUT")
+	s.router.HandleFunc("/user/bookmarks/{id}", s.requireValidUserToken(s.removeBookmarkHandler())).Methods("DELETE")
+	s.router.HandleFunc("/user/bookmarks/{id}/log", s.requireValidUserToken(s.logBookmarkHandler())).Methods("POST")
 	s.router.HandleFunc("/user/log", s.requireValidUserToken(s.saveLogHandler())).Methods("POST")
 	s.router.HandleFunc("/user/logs", s.requireValidUserToken(s.userLogsHandler())).Methods("GET")
 	s.router.HandleFunc("/user/log/{id}", s.requireValidUserToken(s.deleteLogHandler())).Methods("DELETE")
+	s.router.HandleFunc("/user/mfa", s.requireValidUserToken(s.mfaEnrollHandler())).Methods("POST")
+	s.router.HandleFunc("/user/mfa/confirm", s.requireValidUserToken(s.mfaConfirmHandler())).Methods("POST")
+	s.router.HandleFunc("/user/mfa", s.requireValidUserToken(s.mfaDisableHandler())).Methods("DELETE")
+
+	// Admin
+	s.router.HandleFunc("/admin/users", s.requireRole(datastore.RoleAdmin, s.adminUsersHandler())).Methods("GET")
+	s.router.HandleFunc("/admin/users/{id}", s.requireRole(datastore.RoleAdmin, s.userByIDHandler())).Methods("GET")
+	s.router.HandleFunc("/admin/users/{id}", s.requireRole(datastore.RoleAdmin, s.adminDeleteUserHandler())).Methods("DELETE")
+	s.router.HandleFunc("/admin/users/{id}/lock", s.requireRole(datastore.RoleAdmin, s.adminLockUserHandler())).Methods("POST")
+	s.router.HandleFunc("/admin/users/{id}/unlock", s.requireRole(datastore.RoleAdmin, s.adminUnlockUserHandler())).Methods("POST")
+	s.router.HandleFunc("/admin/users/{id}/reset", s.requireRole(datastore.RoleAdmin, s.adminResetUserHandler())).Methods("POST")
+	s.router.HandleFunc("/admin/users/{id}/mfa", s.requireRole(datastore.RoleAdmin, s.adminDisableMFAHandler())).Methods("DELETE")
+	s.router.HandleFunc("/admin/users/{id}/role", s.requireRole(datastore.RoleAdmin, s.adminUserRoleHandler())).Methods("PUT")
+	s.router.HandleFunc("/admin/users/{id}/notifications/{notification}", s.requireRole(datastore.RoleAdmin, s.userNotificationHandler())).Methods("POST")
 }
 
 func (s *server) optionsHandler() http.HandlerFunc {
@@ -65,6 +116,12 @@ func (s *server) redirectHandler() http.HandlerFunc {
 			respondJSON(w, http.StatusBadRequest, nil, errors.New("no article id"))
 		}
 
+		// the stored copy saves a call to PubMed
+		if a, err := s.store.ArticleByPMID(pmid); err == nil && a.URL != "" {
+			http.Redirect(w, r, a.URL, http.StatusFound)
+			return
+		}
+
 		article, err := pubmed.ArticleByPMID(pmid)
 		if err != nil {
 			respondJSON(w, http.StatusNotFound, nil, err)
@@ -83,6 +140,14 @@ func (s *server) faviconHandler() http.HandlerFunc {
 	}
 }
 
+// jwksHandler publishes the public keys for verifying access tokens, so that other services do not need a secret
+func (s *server) jwksHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("cache-control", "public, max-age=300")
+		respondJSON(w, http.StatusOK, s.keyring.JWKS(), nil)
+	}
+}
+
 func (s *server) authHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		body := struct {
@@ -95,36 +160,242 @@ func (s *server) authHandler() http.HandlerFunc {
 			return
 		}
 
+		ip := s.clientIP(r)
+		account := strings.ToLower(strings.TrimSpace(body.Email))
+		wait := s.ipThrottle.attempt(ip, account)
+		if wait > 0 {
+			respondTooManyRequests(w, wait)
+			return
+		}
+
 		u, err := s.store.UserAuth(body.Email, body.Password)
+		if lockout, ok := err.(*datastore.LockoutError); ok {
+			respondTooManyRequests(w, lockout.RetryAfter)
+			return
+		}
+		if err == datastore.ErrAccountDisabled {
+			respondJSON(w, http.StatusForbidden, nil, err)
+			return
+		}
 		if err != nil {
 			respondJSON(w, http.StatusUnauthorized, nil, errors.New("could not authorize user"))
 			return
 		}
+		s.ipThrottle.succeed(ip, account)
+		s.respondLogin(w, u)
+	}
+}
 
-		t, err := u.Token(s.config.Token.Issuer, s.config.Token.SigningKey, s.config.Token.HoursTTL)
+// respondLogin completes the first step of a login, with a password or a magic link. A user with two-factor auth
+// gets an mfa token for the second step at /auth/mfa, otherwise the response is a new session.
+func (s *server) respondLogin(w http.ResponseWriter, u *datastore.User) {
+	if u.MFAEnabled {
+		tk, err := u.ActionToken(datastore.ActionMFA, s.config.Token.SigningKey)
 		if err != nil {
 			respondJSON(w, http.StatusInternalServerError, nil, err)
 			return
 		}
+		respondJSON(w, http.StatusOK, map[string]interface{}{"mfaRequired": true, "mfaToken": tk}, nil)
+		return
+	}
 
-		responseBody := map[string]string{
-			"token":  t.String(),
-			"userId": u.ID.Hex(),
+	rt, err := u.RefreshToken(s.config.Token.refreshTTL())
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, nil, err)
+		return
+	}
+	s.respondTokens(w, u, rt)
+}
+
+// magicLinkHandler emails a single use login link to the user with the posted email. It responds 202 whether or not
+// there is a user with the email, so that it cannot be used to find out who has an account, and is rate limited for
+// each email address.
+func (s *server) magicLinkHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body := struct {
+			Email string `json:"email"`
+		}{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, nil, err)
+			return
 		}
-		respondJSON(w, http.StatusOK, responseBody, nil)
+		email := strings.TrimSpace(body.Email)
+		if email == "" {
+			respondJSON(w, http.StatusBadRequest, nil, errors.New("email is missing"))
+			return
+		}
+
+		wait := s.magicLinks.allow(strings.ToLower(email))
+		if wait > 0 {
+			respondRateLimited(w, wait, errors.New("too many login links requested, please try again later"))
+			return
+		}
+
+		u, err := s.store.UserByEmail(email)
+		if err == datastore.ErrNotFound {
+			respondJSON(w, http.StatusAccepted, nil, nil)
+			return
+		}
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		if u.Disabled {
+			respondJSON(w, http.StatusAccepted, nil, nil)
+			return
+		}
+
+		tk, err := u.ActionToken(datastore.ActionMagicLink, s.config.Token.SigningKey)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		emailer.MagicLink(*u, tk)
+		log.Println(fmt.Sprintf("Send magic link to %s (%s)", u.Email, u.ID))
+		respondJSON(w, http.StatusAccepted, nil, nil)
+	}
+}
+
+// magicLoginHandler exchanges the magic-link token emailed by emailer.MagicLink for the same response as /auth, and
+// consumes the token so it cannot be used again. The account is unlocked as the user has proven they own the email
+// address.
+func (s *server) magicLoginHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		a, err := s.routeActionToken(r, datastore.ActionMagicLink)
+		if err != nil {
+			respondActionTokenError(w, err)
+			return
+		}
+
+		u, err := s.store.UserByID(a.UserID.Hex())
+		if err != nil {
+			respondNotFoundOrBadRequest(w, err)
+			return
+		}
+		if u.Disabled {
+			respondJSON(w, http.StatusForbidden, nil, datastore.ErrAccountDisabled)
+			return
+		}
+
+		err = s.store.ConsumeActionToken(a)
+		if err != nil {
+			respondActionTokenError(w, err)
+			return
+		}
+
+		err = u.Confirm() // the link proves the email, as for a confirmation
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		err = u.ClearLoginFailures()
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		s.respondLogin(w, u)
+	}
+}
+
+// refreshHandler exchanges a refresh token for a new access token and refresh token. The refresh token can only be
+// used once - presenting it again revokes the session.
+func (s *server) refreshHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body := struct {
+			RefreshToken string `json:"refreshToken"`
+		}{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, nil, err)
+			return
+		}
+
+		u, rt, err := s.store.RotateRefreshToken(body.RefreshToken, s.config.Token.refreshTTL())
+		if err == datastore.ErrRefreshTokenInvalid || err == datastore.ErrRefreshTokenReused {
+			respondJSON(w, http.StatusUnauthorized, nil, err)
+			return
+		}
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		s.respondTokens(w, u, rt)
+	}
+}
+
+// logoutHandler revokes the access token passed down by requireValidUserToken and, if one is posted, the session
+// that the refresh token belongs to.
+func (s *server) logoutHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body := struct {
+			RefreshToken string `json:"refreshToken"`
+		}{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil && err != io.EOF { // body is optional
+			respondJSON(w, http.StatusBadRequest, nil, err)
+			return
+		}
+
+		t := r.Context().Value("token").(datastore.Token)
+		err = s.store.Logout(t, body.RefreshToken)
+		if err == datastore.ErrRefreshTokenInvalid {
+			respondJSON(w, http.StatusBadRequest, nil, err)
+			return
+		}
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// respondTokens responds with a new access token for the user, and the refresh token
+func (s *server) respondTokens(w http.ResponseWriter, u *datastore.User, refreshToken string) {
+	t, err := u.SignedToken(s.config.Token.Issuer, s.config.Token.audience(), s.keyring.Active(), s.config.Token.HoursTTL)
+	if err != nil {
+		respondJSON(w, http.StatusInternalServerError, nil, err)
 		return
 	}
+
+	responseBody := map[string]string{
+		"token":        t.String(),
+		"refreshToken": refreshToken,
+		"userId":       u.ID.Hex(),
+	}
+	respondJSON(w, http.StatusOK, responseBody, nil)
 }
 
+// addUserHandler adds a new user. Only the name, email, password and categories are taken from the body, and a
+// body with an id is rejected, so it cannot be used to change an existing user.
 func (s *server) addUserHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		u := s.store.NewUser()
-		err := json.NewDecoder(r.Body).Decode(&u)
+		var body struct {
+			ID         *string  `json:"id"`
+			FirstName  string   `json:"firstName"`
+			LastName   string   `json:"lastName"`
+			Email      string   `json:"email"`
+			Password   string   `json:"password"`
+			Categories []string `json:"categories"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&body)
 		if err != nil {
 			respondJSON(w, http.StatusBadRequest, nil, err)
 			return
 		}
+		if body.ID != nil {
+			respondJSON(w, http.StatusBadRequest, nil, errors.New("id cannot be set for a new user"))
+			return
+		}
 
+		u := s.store.NewUser()
+		u.FirstName = body.FirstName
+		u.LastName = body.LastName
+		u.Email = body.Email
+		u.Password = body.Password
+		u.Categories = body.Categories
 		err = u.Save()
 		if err != nil {
 			respondJSON(w, http.StatusConflict, nil, err)
@@ -146,6 +417,7 @@ func (s *server) userByIDHandler() http.HandlerFunc {
 		u, err := s.store.UserByID(id)
 		if err != nil {
 			respondNotFoundOrBadRequest(w, err)
+			return
 		}
 
 		u.Password = datastore.PasswordMask
@@ -189,11 +461,35 @@ func (s *server) updateUserHandler() http.HandlerFunc {
 		}
 
 		err = u.SavePartial(body)
+		if err == datastore.ErrEmailExists {
+			respondJSON(w, http.StatusConflict, nil, err)
+			return
+		}
+		if err == datastore.ErrEmailInvalid {
+			respondJSON(w, http.StatusBadRequest, nil, err)
+			return
+		}
+		if _, ok := err.(*datastore.ScheduleError); ok {
+			respondJSON(w, http.StatusBadRequest, nil, err)
+			return
+		}
 		if err != nil {
 			respondJSON(w, http.StatusInternalServerError, nil, err)
 			return
 		}
 
+		// a new email is confirmed from the new address, and the current address is told about the request
+		if _, ok := body["email"]; ok && u.PendingEmail != "" {
+			tk, err := u.EmailChangeToken(s.config.Token.SigningKey)
+			if err != nil {
+				respondJSON(w, http.StatusInternalServerError, nil, err)
+				return
+			}
+			emailer.ConfirmEmailChange(*u, tk)
+			emailer.EmailChangeNotice(*u)
+			log.Println(fmt.Sprintf("Send email change messages to %s and %s (%s)", u.PendingEmail, u.Email, u.ID))
+		}
+
 		u.Password = datastore.PasswordMask
 		respondJSON(w, http.StatusOK, u, err)
 	}
@@ -219,7 +515,7 @@ func (s *server) saveSearchHandler() http.HandlerFunc {
 
 		err = u.SaveSearch(s.Query)
 		if err != nil {
-			respondJSON(w, http.StatusConflict, nil, err)
+			respondSearchError(w, err)
 			return
 		}
 		u.Password = datastore.PasswordMask
@@ -348,44 +644,58 @@ func (s *server) userNotificationHandler() http.HandlerFunc {
 		u, err := s.store.UserByIDOrEmail(idOrEmail)
 		if err != nil {
 			respondNotFoundOrBadRequest(w, err)
+			return
 		}
 
 		switch notification {
 		case "welcome":
-			emailer.WelcomeUser(*u)
+			tk, err := u.ActionToken(datastore.ActionConfirmEmail, s.config.Token.SigningKey)
+			if err != nil {
+				respondJSON(w, http.StatusInternalServerError, nil, err)
+				return
+			}
+			emailer.WelcomeUser(*u, tk)
 			log.Println(fmt.Sprintf("Send %s message to %s (%s)", notification, u.Email, u.ID))
 			respondJSON(w, http.StatusAccepted, nil, nil)
 		case "reset":
-			emailer.ResetPassword(*u)
+			tk, err := u.ActionToken(datastore.ActionResetPassword, s.config.Token.SigningKey)
+			if err != nil {
+				respondJSON(w, http.StatusInternalServerError, nil, err)
+				return
+			}
+			emailer.ResetPassword(*u, tk)
 			log.Println(fmt.Sprintf("Send %s message to %s (%s)", notification, u.Email, u.ID))
 			respondJSON(w, http.StatusAccepted, nil, nil)
 		}
 	}
 }
 
+// userConfirmationHandler unlocks the user account with the confirm-email token emailed by emailer.WelcomeUser
 func (s *server) userConfirmationHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		id := mux.Vars(r)["id"]
-		key := mux.Vars(r)["key"]
 
-		u, err := s.store.UserByID(id)
-		if err == mgo.ErrNotFound {
-			respondJSON(w, http.StatusNotFound, nil, errors.New("user not found"))
+		a, err := s.routeActionToken(r, datastore.ActionConfirmEmail)
+		if err != nil {
+			respondActionTokenError(w, err)
 			return
 		}
+
+		u, err := s.store.UserByID(a.UserID.Hex())
 		if err != nil {
-			respondJSON(w, http.StatusBadRequest, nil, err)
+			respondNotFoundOrBadRequest(w, err)
 			return
 		}
-		if key != u.KeyGen() {
-			respondJSON(w, http.StatusBadRequest, nil, errors.New("invalid key"))
+
+		err = s.store.ConsumeActionToken(a)
+		if err != nil {
+			respondActionTokenError(w, err)
 			return
 		}
 
-		u.Locked = false
-		err = u.Save()
+		err = u.Confirm()
 		if err != nil {
 			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
 		}
 
 		u.Password = datastore.PasswordMask
@@ -393,8 +703,198 @@ func (s *server) userConfirmationHandler() http.HandlerFunc {
 	}
 }
 
+// unsubscribeHandler pauses the user's notifications with the unsubscribe token from the link in a notification
+// email, see emailer.Notification, and responds with the schedule
+func (s *server) unsubscribeHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		a, err := s.routeActionToken(r, datastore.ActionUnsubscribe)
+		if err != nil {
+			respondActionTokenError(w, err)
+			return
+		}
+
+		u, err := s.store.UserByID(a.UserID.Hex())
+		if err != nil {
+			respondNotFoundOrBadRequest(w, err)
+			return
+		}
+
+		err = s.store.ConsumeActionToken(a)
+		if err != nil {
+			respondActionTokenError(w, err)
+			return
+		}
+
+		err = u.Unsubscribe()
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		respondJSON(w, http.StatusOK, u.Schedule, nil)
+	}
+}
+
+// emailChangeHandler swaps the user's email for the pending one with the change-email token emailed by
+// emailer.ConfirmEmailChange
+func (s *server) emailChangeHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		a, err := s.routeActionToken(r, datastore.ActionChangeEmail)
+		if err != nil {
+			respondActionTokenError(w, err)
+			return
+		}
+
+		u, err := s.store.UserByID(a.UserID.Hex())
+		if err != nil {
+			respondNotFoundOrBadRequest(w, err)
+			return
+		}
+
+		// the link is for an earlier request that has been replaced or cancelled
+		if a.Data != u.PendingEmail {
+			respondActionTokenError(w, datastore.ErrActionTokenInvalid)
+			return
+		}
+
+		err = s.store.ConsumeActionToken(a)
+		if err != nil {
+			respondActionTokenError(w, err)
+			return
+		}
+
+		err = u.ConfirmEmailChange(a.Data)
+		if err == datastore.ErrEmailExists {
+			respondJSON(w, http.StatusConflict, nil, err)
+			return
+		}
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+
+		u.Password = datastore.PasswordMask
+		respondJSON(w, http.StatusOK, u, nil)
+	}
+}
+
+// resetKeyHandler checks a reset-password token, as emailed by emailer.ResetPassword, so that a client can show
+// the reset form or a clear error before the new password is submitted. The token is not consumed.
+func (s *server) resetKeyHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		a, err := s.routeActionToken(r, datastore.ActionResetPassword)
+		if err != nil {
+			respondActionTokenError(w, err)
+			return
+		}
+
+		u, err := s.store.UserByID(a.UserID.Hex())
+		if err != nil {
+			respondNotFoundOrBadRequest(w, err)
+			return
+		}
+
+		respondJSON(w, http.StatusOK, map[string]string{"userId": u.ID.Hex(), "email": u.Email}, nil)
+	}
+}
+
+// resetPasswordHandler sets a new password for the user if the reset-password token is valid, and consumes the
+// token so it cannot be used again. The account is unlocked as the user has proven they own the email address, and
+// any existing sessions are ended.
+func (s *server) resetPasswordHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		body := struct {
+			Password string `json:"password"`
+		}{}
+		err := json.NewDecoder(r.Body).Decode(&body)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, nil, err)
+			return
+		}
+		if len(body.Password) == 0 {
+			respondJSON(w, http.StatusBadRequest, nil, errors.New("password is missing"))
+			return
+		}
+
+		a, err := s.routeActionToken(r, datastore.ActionResetPassword)
+		if err != nil {
+			respondActionTokenError(w, err)
+			return
+		}
+
+		u, err := s.store.UserByID(a.UserID.Hex())
+		if err != nil {
+			respondNotFoundOrBadRequest(w, err)
+			return
+		}
+
+		err = s.store.ConsumeActionToken(a)
+		if err != nil {
+			respondActionTokenError(w, err)
+			return
+		}
+
+		err = u.SetPassword(body.Password)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		err = u.Confirm() // the link proves the email, as for a confirmation
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		err = u.ClearLoginFailures()
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		err = u.EndSessions()
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+
+		u.Password = datastore.PasswordMask
+		respondJSON(w, http.StatusOK, u, nil)
+	}
+}
+
+// routeActionToken checks the action token in the {key} route var, and that it was issued to the user in the {id}
+// route var.
+func (s *server) routeActionToken(r *http.Request, purpose string) (datastore.ActionToken, error) {
+	id := mux.Vars(r)["id"]
+	key := mux.Vars(r)["key"]
+
+	a, err := s.store.CheckActionToken(key, purpose, s.config.Token.SigningKey)
+	if err != nil {
+		return a, err
+	}
+	if a.UserID.Hex() != id {
+		return a, datastore.ErrActionTokenInvalid
+	}
+	return a, nil
+}
+
+// respondActionTokenError responds with a clear error for an action token that is expired, used or invalid
+func respondActionTokenError(w http.ResponseWriter, err error) {
+	switch err {
+	case datastore.ErrActionTokenExpired:
+		respondJSON(w, http.StatusGone, nil, errors.New("link has expired, please request a new one"))
+	case datastore.ErrActionTokenUsed:
+		respondJSON(w, http.StatusGone, nil, errors.New("link has already been used, please request a new one"))
+	case datastore.ErrActionTokenInvalid:
+		respondJSON(w, http.StatusBadRequest, nil, errors.New("invalid link"))
+	default:
+		respondJSON(w, http.StatusInternalServerError, nil, err)
+	}
+}
+
 func respondNotFoundOrBadRequest(w http.ResponseWriter, err error) {
-	if err == mgo.ErrNotFound {
+	if err == datastore.ErrNotFound {
 		respondJSON(w, http.StatusNotFound, nil, errors.New("user not found"))
 		return
 	}
@@ -409,11 +909,11 @@ func respondJSON(w http.ResponseWriter, status int, data interface{}, err error)
 	var body string
 	w.Header().Set("content-type", "application/json")
 
-	// explicitly asked to respond with the error
+	// explicitly asked to respond with the error, which is encoded as it may contain values from the request
 	if err != nil {
+		xb, _ := json.Marshal(map[string]string{"error": err.Error()})
 		w.WriteHeader(status)
-		body = fmt.Sprintf(`{"error": "%s"}`, err.Error())
-		io.WriteString(w, body)
+		io.WriteString(w, string(xb))
 		return
 	}
 
@@ -1,7 +1,12 @@
 package server_test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"gopkg.in/mgo.v2/bson"
 	"log"
 	"net/http"
@@ -13,13 +18,11 @@ import (
 	"fmt"
 	"github.com/matryer/is"
 	"github.com/mikedonnici/rtcl-api/datastore"
-	"github.com/mikedonnici/rtcl-api/datastore/mongo"
 	"github.com/mikedonnici/rtcl-api/server"
 	"github.com/mikedonnici/rtcl-api/testdata"
 )
 
-var testDB = testdata.New()
-var ds = datastore.New()
+var ds *datastore.Datastore
 
 var srvConfig = server.Config{
 	Port: "8888",
@@ -30,20 +33,39 @@ var srvConfig = server.Config{
 	},
 }
 
-// TestRoutes sets up test databases, connects a testDB to the database and starts a server with the datastore.
-// It then runs a group of route tests and tears down the test databases.
+// userRequest serves a request with a token for the user id, from a new server with the config and datastore. If
+// clock is not nil it is set as the server clock, and the token is issued at that time so that it is valid.
+func userRequest(t *testing.T, cfg server.Config, store *datastore.Datastore, clock func() time.Time, method, path, body, userID string) *httptest.ResponseRecorder {
+	u, err := store.UserByID(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk, err := u.Token(cfg.Token.Issuer, cfg.Token.SigningKey, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := server.NewServer(cfg, store)
+	if clock != nil {
+		srv.SetClock(clock)
+		tk, err = tk.SetTimes(clock()).Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+tk.String())
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	return w
+}
+
+// TestRoutes sets up an in-memory datastore with the test data, so no database server is required.
+// It then runs a group of route tests against servers using the datastore.
 func TestRoutes(t *testing.T) {
 
 	var err error
 
-	// install databases
-	err = setupDatabase()
-	if err != nil {
-		log.Fatalln(err)
-	}
-	defer teardownDatabase()
-
-	err = datastoreConnectMongoDB()
+	ds, err = testdata.NewMemoryStore()
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -53,38 +75,35 @@ func TestRoutes(t *testing.T) {
 		t.Run("testIndex", testIndex)
 		t.Run("testGetUser", testGetUser)
 		t.Run("testGetUserBadID", testGetUserBadID)
+		t.Run("testClientKey", testClientKey)
 		t.Run("testAddUser", testAddUser)
 		t.Run("testUpdateUser", testUpdateUser)
+		t.Run("testUpdateSchedule", testUpdateSchedule)
+		t.Run("testChangeEmail", testChangeEmail)
 		t.Run("testAddUserAlreadyExists", testAddUserAlreadyExists)
+		t.Run("testAddUserExistingID", testAddUserExistingID)
 		t.Run("testAddUserBadBody", testAddUserBadBody)
 		t.Run("testAuthUser", testAuthUser)
+		t.Run("testAuthThrottle", testAuthThrottle)
+		t.Run("testRefreshAndLogout", testRefreshAndLogout)
+		t.Run("testJWKS", testJWKS)
+		t.Run("testResetPassword", testResetPassword)
+		t.Run("testMagicLink", testMagicLink)
+		t.Run("testConfirmUser", testConfirmUser)
+		t.Run("testUnsubscribe", testUnsubscribe)
 		t.Run("testMe", testMe)
 		t.Run("testSaveSearch", testSaveSearch)
 		t.Run("testDeleteSearch", testDeleteSearch)
+		t.Run("testSearches", testSearches)
 		t.Run("testRedirect", testRedirect)
 		t.Run("testSaveLog", testSaveLog)
 		t.Run("testFetchUserLogs", testFetchUserLogs)
 		t.Run("testDeleteLog", testDeleteLog)
+		t.Run("testMFALogin", testMFALogin)
+		t.Run("testMFACodeLockout", testMFACodeLockout)
 	})
 }
 
-// setUpDatabase creates and populates test database
-func setupDatabase() error {
-	return testDB.SetupMongoDB()
-}
-
-// teardownDatabase cleans up the test databases
-func teardownDatabase() {
-	testDB.TearDownMongoDB()
-}
-
-// datastoreConnectMongoDB connects the datastore to the test Mongo database
-func datastoreConnectMongoDB() error {
-	var err error
-	ds.Mongo, err = mongo.NewConnection(testdata.MongoDSN, testDB.DBName, "test")
-	return err
-}
-
 func testIndex(t *testing.T) {
 	is := is.New(t)
 	r := httptest.NewRequest("GET", "/", nil)
@@ -97,6 +116,7 @@ func testIndex(t *testing.T) {
 func testGetUser(t *testing.T) {
 	is := is.New(t)
 	r := httptest.NewRequest("GET", "/users/5b3bcd72463cd6029e04de18", nil)
+	r.Header.Set("X-API-Key", testdata.ClientKey)
 	w := httptest.NewRecorder()
 	srv := server.NewServer(srvConfig, ds)
 	srv.ServeHTTP(w, r)
@@ -106,17 +126,55 @@ func testGetUser(t *testing.T) {
 func testGetUserBadID(t *testing.T) {
 	is := is.New(t)
 	r := httptest.NewRequest("GET", "/users/notarealid", nil)
+	r.Header.Set("X-API-Key", testdata.ClientKey)
 	w := httptest.NewRecorder()
 	srv := server.NewServer(srvConfig, ds)
 	srv.ServeHTTP(w, r)
 	is.Equal(w.Code, 400) // expected response 400 Bad Request
 }
 
+// testClientKey tests that the public user endpoints require a client key with the right scope
+func testClientKey(t *testing.T) {
+	is := is.New(t)
+	srv := server.NewServer(srvConfig, ds)
+
+	r := httptest.NewRequest("GET", "/users/5b3bcd72463cd6029e04de18", nil)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, 401) // expected 401 Unauthorized without a key
+
+	r = httptest.NewRequest("GET", "/users/5b3bcd72463cd6029e04de18", nil)
+	r.Header.Set("X-API-Key", "rtcl_notARealKey")
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, 401) // expected 401 Unauthorized with an unknown key
+
+	r = httptest.NewRequest("GET", "/users/5b3bcd72463cd6029e04de18", nil)
+	r.Header.Set("X-API-Key", testdata.ReadOnlyClientKey)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, 200) // expected 200 OK with the users:read scope
+
+	b := strings.NewReader(`{"firstName": "Scope", "lastName": "Test", "email": "scope@rtcl.io"}`)
+	r = httptest.NewRequest("POST", "/users", b)
+	r.Header.Set("X-API-Key", testdata.ReadOnlyClientKey)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, 403) // expected 403 Forbidden without the users:create scope
+
+	r = httptest.NewRequest("POST", "/users/5b3bcd72463cd6029e04de18/notifications/welcome", nil)
+	r.Header.Set("X-API-Key", testdata.ReadOnlyClientKey)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, 403) // expected 403 Forbidden without the users:notify scope
+}
+
 func testAddUser(t *testing.T) {
 	is := is.New(t)
 
 	b := strings.NewReader(`{"firstName": "Barry", "lastName": "Smith", "email": "bs@rtcl.io"}`)
 	r := httptest.NewRequest("POST", "/users", b)
+	r.Header.Set("X-API-Key", testdata.ClientKey)
 	w := httptest.NewRecorder()
 	srv := server.NewServer(srvConfig, ds)
 	srv.ServeHTTP(w, r)
@@ -155,21 +213,144 @@ func testUpdateUser(t *testing.T) {
 	is.Equal(w.Code, 200) // expected 200 ok
 }
 
+// testUpdateSchedule tests setting the notification schedule with PUT /user
+func testUpdateSchedule(t *testing.T) {
+	is := is.New(t)
+	srv := server.NewServer(srvConfig, ds)
+	u, err := ds.UserByID("5b3bcd72463cd6029e04de1c")
+	is.NoErr(err) // error fetching user record
+	tk, err := u.Token(srvConfig.Token.Issuer, srvConfig.Token.SigningKey, 1)
+	is.NoErr(err) // error generating token
+	put := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("PUT", "/user", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+tk.String())
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		return w
+	}
+
+	w := put(`{"schedule": {"frequency": "weekly", "weekday": "tuesday", "hour": 7, "timezone": "Australia/Perth"}}`)
+	is.Equal(w.Code, http.StatusOK) // expected 200 OK
+	var got datastore.User
+	is.NoErr(json.NewDecoder(w.Body).Decode(&got))
+	perth, _ := time.LoadLocation("Australia/Perth")
+	next := got.Notification.In(perth)
+	is.Equal(next.Weekday(), time.Tuesday) // expected a notification on a tuesday
+	is.Equal(next.Hour(), 7)               // expected a notification at 7am
+	is.True(next.After(time.Now()))        // expected a notification in the future
+
+	w = put(`{"schedule": {"frequency": "weekly", "weekday": "caturday"}}`)
+	is.Equal(w.Code, http.StatusBadRequest) // expected 400 Bad Request for an invalid schedule
+
+	// values from the request in the error message must not break the JSON
+	w = put(`{"schedule": {"frequency": "weekly", "weekday": "sat\", \"admin\": \"true"}}`)
+	is.Equal(w.Code, http.StatusBadRequest) // expected 400 Bad Request for an invalid schedule
+	var res map[string]string
+	is.NoErr(json.NewDecoder(w.Body).Decode(&res)) // error body should be valid JSON
+	is.Equal(len(res), 1)                          // expected only the error field
+	is.True(strings.Contains(res["error"], `"sat\", \"admin\": \"true"`))
+}
+
+// testChangeEmail tests that PUT /user holds a new email as pending, and the emailed link swaps it
+func testChangeEmail(t *testing.T) {
+	is := is.New(t)
+	srv := server.NewServer(srvConfig, ds)
+	const uid = "5b3bcd72463cd6029e04de1c"
+
+	u, err := ds.UserByID(uid)
+	is.NoErr(err) // error fetching user record
+	tk, err := u.Token(srvConfig.Token.Issuer, srvConfig.Token.SigningKey, 1)
+	is.NoErr(err) // error generating token
+	put := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("PUT", "/user", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+tk.String())
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		return w
+	}
+
+	w := put(`{"email": "br@rtcl.io"}`)
+	is.Equal(w.Code, http.StatusConflict) // expected 409 Conflict for the email of another user
+	w = put(`{"email": "Someone <new.dh@rtcl.io>"}`)
+	is.Equal(w.Code, http.StatusBadRequest) // expected 400 for an email that is not a bare address
+
+	w = put(`{"email": "new.dh@rtcl.io"}`)
+	is.Equal(w.Code, http.StatusOK) // expected 200 OK
+	u, err = ds.UserByID(uid)
+	is.NoErr(err)                              // error fetching user record
+	is.True(u.Email != "new.dh@rtcl.io")       // email should not change until confirmed
+	is.Equal(u.PendingEmail, "new.dh@rtcl.io") // expected pending email
+
+	key, err := u.EmailChangeToken(srvConfig.Token.SigningKey)
+	is.NoErr(err) // error generating change-email token
+
+	// a second request replaces the first, so the first link no longer works
+	w = put(`{"email": "newer.dh@rtcl.io"}`)
+	is.Equal(w.Code, http.StatusOK) // expected 200 OK
+	r := httptest.NewRequest("GET", "/users/"+uid+"/email/"+key, nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusBadRequest) // expected 400 Bad Request for a replaced link
+
+	u, err = ds.UserByID(uid)
+	is.NoErr(err) // error fetching user record
+	key, err = u.EmailChangeToken(srvConfig.Token.SigningKey)
+	is.NoErr(err) // error generating change-email token
+	r = httptest.NewRequest("GET", "/users/"+uid+"/email/"+key, nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusOK) // expected 200 OK
+	u, err = ds.UserByID(uid)
+	is.NoErr(err)                         // error fetching user record
+	is.Equal(u.Email, "newer.dh@rtcl.io") // email should be changed once confirmed
+
+	r = httptest.NewRequest("GET", "/users/"+uid+"/email/"+key, nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusGone) // expected 410 Gone for a used link
+
+	// put the email back for the other tests
+	is.NoErr(u.RequestEmailChange("dh@rtcl.io")) // error requesting email change
+	is.NoErr(u.ConfirmEmailChange("dh@rtcl.io")) // error restoring email
+}
+
 func testAddUserAlreadyExists(t *testing.T) {
 	is := is.New(t)
 	b := strings.NewReader(`{"firstName" :"Broderick", "lastName" : "Reynolds", "email" : "br@rtcl.io"}`)
 	r := httptest.NewRequest("POST", "/users", b)
+	r.Header.Set("X-API-Key", testdata.ClientKey)
 	w := httptest.NewRecorder()
 	srv := server.NewServer(srvConfig, ds)
 	srv.ServeHTTP(w, r)
 	is.Equal(w.Code, 409) // expected response 409 Conflict
 }
 
+// Tests that posting the id of an existing user does not change that user
+func testAddUserExistingID(t *testing.T) {
+	is := is.New(t)
+	before, err := ds.UserByID("5b3bcd72463cd6029e04de18")
+	is.NoErr(err)
+
+	b := strings.NewReader(`{"id": "5b3bcd72463cd6029e04de18", "firstName": "Mallory", "lastName": "Taker",
+		"email": "br@rtcl.io", "password": "$argon2id$v=19$m=65536,t=1,p=4$c2FsdA$aGFzaA", "mfaEnabled": false}`)
+	r := httptest.NewRequest("POST", "/users", b)
+	r.Header.Set("X-API-Key", testdata.ClientKey)
+	w := httptest.NewRecorder()
+	server.NewServer(srvConfig, ds).ServeHTTP(w, r)
+	is.Equal(w.Code, 400) // expected an id to be rejected
+
+	after, err := ds.UserByID("5b3bcd72463cd6029e04de18")
+	is.NoErr(err)
+	is.Equal(after.FirstName, before.FirstName) // expected the user not to change
+	is.Equal(after.Password, before.Password)
+}
+
 func testAddUserBadBody(t *testing.T) {
 	is := is.New(t)
 	// Body is malformed ... missing first "
 	b := strings.NewReader(`{firstName" :"Doogie"", "lastName" : "Jangles", "email" : "doogiej@rtcl.io"}`)
 	r := httptest.NewRequest("POST", "/users", b)
+	r.Header.Set("X-API-Key", testdata.ClientKey)
 	w := httptest.NewRecorder()
 	srv := server.NewServer(srvConfig, ds)
 	srv.ServeHTTP(w, r)
@@ -193,6 +374,328 @@ func testAuthUser(t *testing.T) {
 	is.True(len(strings.Split(body.JWT, ".")) == 3) // doesn't look like a token
 }
 
+// testRefreshAndLogout tests that the refresh token from /auth can be exchanged once at /auth/refresh, and that
+// /auth/logout revokes the access token and the session.
+func testRefreshAndLogout(t *testing.T) {
+	is := is.New(t)
+	srv := server.NewServer(srvConfig, ds)
+
+	type tokens struct {
+		JWT          string `json:"token"`
+		RefreshToken string `json:"refreshToken"`
+	}
+	post := func(path, body, jwt string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", path, strings.NewReader(body))
+		if jwt != "" {
+			r.Header.Set("Authorization", "Bearer "+jwt)
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		return w
+	}
+
+	w := post("/auth", `{"email": "br@rtcl.io", "password": "12345abcde"}`, "")
+	is.Equal(w.Code, 200) // expected 200 OK
+	var tk1 tokens
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &tk1)) // error decoding auth response
+	is.True(tk1.RefreshToken != "")                // expected a refresh token
+
+	w = post("/auth/refresh", fmt.Sprintf(`{"refreshToken": "%s"}`, tk1.RefreshToken), "")
+	is.Equal(w.Code, 200) // expected 200 OK
+	var tk2 tokens
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &tk2)) // error decoding refresh response
+	is.True(len(strings.Split(tk2.JWT, ".")) == 3) // doesn't look like a token
+	is.True(tk2.RefreshToken != tk1.RefreshToken)  // expected a new refresh token
+
+	w = post("/auth/refresh", fmt.Sprintf(`{"refreshToken": "%s"}`, tk1.RefreshToken), "")
+	is.Equal(w.Code, 401) // used refresh token should be rejected
+
+	// reuse revoked the session, so log in again
+	w = post("/auth", `{"email": "br@rtcl.io", "password": "12345abcde"}`, "")
+	is.Equal(w.Code, 200) // expected 200 OK
+	var tk3 tokens
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &tk3)) // error decoding auth response
+
+	w = post("/auth/logout", fmt.Sprintf(`{"refreshToken": "%s"}`, tk3.RefreshToken), tk3.JWT)
+	is.Equal(w.Code, 204) // expected 204 No Content
+
+	r := httptest.NewRequest("GET", "/user", nil)
+	r.Header.Set("Authorization", "Bearer "+tk3.JWT)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, 401) // access token should be revoked after logout
+
+	w = post("/auth/refresh", fmt.Sprintf(`{"refreshToken": "%s"}`, tk3.RefreshToken), "")
+	is.Equal(w.Code, 401) // refresh token should be revoked after logout
+}
+
+// testJWKS tests that access tokens are signed with the active key of a keyring, and the public key is published
+func testJWKS(t *testing.T) {
+	is := is.New(t)
+	ek, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	is.NoErr(err) // error generating key
+	b, err := x509.MarshalECPrivateKey(ek)
+	is.NoErr(err) // error encoding key
+	keys, err := datastore.ParsePrivateKeys(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}))
+	is.NoErr(err) // error parsing key
+
+	cfg := srvConfig
+	cfg.Token.Keyring = datastore.NewKeyring(keys[0], datastore.HMACKey(srvConfig.Token.SigningKey))
+	srv := server.NewServer(cfg, ds)
+
+	r := httptest.NewRequest("GET", "/.well-known/jwks.json", nil)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, 200) // expected 200 OK
+	var jwks datastore.JWKS
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &jwks)) // error decoding JWKS
+	is.Equal(len(jwks.Keys), 1)                     // expected only the EC public key
+	is.Equal(jwks.Keys[0].Kid, keys[0].ID)          // wrong kid
+
+	b2 := strings.NewReader(`{"email": "br@rtcl.io", "password": "12345abcde"}`)
+	r = httptest.NewRequest("POST", "/auth", b2)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, 200) // expected 200 OK
+	body := struct {
+		JWT string `json:"token"`
+	}{}
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &body)) // error decoding auth response
+	tk, err := datastore.DecodeSignedToken(body.JWT, datastore.NewKeyring(keys[0]))
+	is.NoErr(err)                                      // token should be signed with the active key
+	is.Equal(tk.Claims.ID, "5b3bcd72463cd6029e04de18") // wrong user id
+
+	// a token signed with the retired HMAC key is still accepted
+	u, err := ds.UserByID("5b3bcd72463cd6029e04de18")
+	is.NoErr(err) // error fetching user
+	old, err := u.Token(srvConfig.Token.Issuer, srvConfig.Token.SigningKey, 1)
+	is.NoErr(err) // error generating token
+	r = httptest.NewRequest("GET", "/user", nil)
+	r.Header.Set("Authorization", "Bearer "+old.String())
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, 200) // expected 200 OK for a token signed with a retired key
+}
+
+// testAuthThrottle tests account and IP throttling of failed auth attempts using a fake clock. It uses its own
+// datastore so lockouts do not affect other tests.
+func testAuthThrottle(t *testing.T) {
+	is := is.New(t)
+	tds, err := testdata.NewMemoryStore()
+	is.NoErr(err) // error creating datastore
+	srv := server.NewServer(srvConfig, tds)
+	now := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	srv.SetClock(func() time.Time { return now })
+
+	auth := func(email, password, ip string) *httptest.ResponseRecorder {
+		b := strings.NewReader(fmt.Sprintf(`{"email": "%s", "password": "%s"}`, email, password))
+		r := httptest.NewRequest("POST", "/auth", b)
+		r.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		return w
+	}
+
+	// account lockout
+	for i := 0; i < datastore.LoginFreeAttempts; i++ {
+		is.Equal(auth("br@rtcl.io", "wrong", "192.0.2.1").Code, http.StatusUnauthorized) // expected 401
+	}
+	is.Equal(auth("br@rtcl.io", "wrong", "192.0.2.1").Code, http.StatusUnauthorized) // failure that locks the account
+	w := auth("br@rtcl.io", "12345abcde", "192.0.2.2")
+	is.Equal(w.Code, http.StatusTooManyRequests)  // expected 429 for a locked account
+	is.Equal(w.Header().Get("Retry-After"), "60") // expected Retry-After of the base lockout
+	now = now.Add(time.Minute)
+	is.Equal(auth("br@rtcl.io", "12345abcde", "192.0.2.2").Code, http.StatusOK) // expected 200 after lockout
+
+	// ip throttling across many accounts
+	for i := 0; i < 20; i++ {
+		auth(fmt.Sprintf("nobody%d@rtcl.io", i), "wrong", "198.51.100.1")
+	}
+	w = auth("nobody@rtcl.io", "wrong", "198.51.100.1")
+	is.Equal(w.Code, http.StatusUnauthorized) // failure that locks the ip
+	w = auth("dh@rtcl.io", "12345abcde", "198.51.100.1")
+	is.Equal(w.Code, http.StatusTooManyRequests)  // expected 429 for a throttled ip
+	is.Equal(w.Header().Get("Retry-After"), "10") // expected Retry-After of the ip base lockout
+	now = now.Add(10 * time.Second)
+	is.Equal(auth("oj@rtcl.io", "12345abcde", "198.51.100.1").Code, http.StatusOK) // expected 200 after ip lockout
+
+	// logging in to one account does not reset the failures for the others
+	for i := 0; i < 19; i++ {
+		auth(fmt.Sprintf("nobody%d@rtcl.io", i), "wrong", "203.0.113.1")
+	}
+	is.Equal(auth("oj@rtcl.io", "12345abcde", "203.0.113.1").Code, http.StatusOK)
+	auth("nobody19@rtcl.io", "wrong", "203.0.113.1")
+	w = auth("nobody20@rtcl.io", "wrong", "203.0.113.1")
+	is.Equal(w.Code, http.StatusUnauthorized) // failure that locks the ip
+	w = auth("oj@rtcl.io", "12345abcde", "203.0.113.1")
+	is.Equal(w.Code, http.StatusTooManyRequests) // expected the earlier failures to count
+}
+
+// testResetPassword tests the password reset flow using the key that is emailed to the user
+func testResetPassword(t *testing.T) {
+	is := is.New(t)
+	srv := server.NewServer(srvConfig, ds)
+	const uid = "5b3bcd72463cd6029e04de1c" // locked in the test data
+
+	u, err := ds.UserByID(uid)
+	is.NoErr(err) // error fetching user record
+	key, err := u.ActionToken(datastore.ActionResetPassword, srvConfig.Token.SigningKey)
+	is.NoErr(err) // error generating reset token
+
+	// check the key
+	r := httptest.NewRequest("GET", "/users/"+uid+"/reset/"+key, nil)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusOK) // expected 200 OK for a valid key
+
+	r = httptest.NewRequest("GET", "/users/"+uid+"/reset/notavalidkey", nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusBadRequest) // expected 400 Bad Request for an invalid key
+
+	r = httptest.NewRequest("GET", "/users/5b3bcd72463cd6029e04de18/reset/"+key, nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusBadRequest) // expected 400 Bad Request for a key issued to a different user
+
+	// set the new password
+	b := strings.NewReader(`{"password": "aBrandNewPassword"}`)
+	r = httptest.NewRequest("POST", "/users/"+uid+"/reset/"+key, b)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusOK) // expected 200 OK for password reset
+
+	u, err = ds.UserByID(uid)
+	is.NoErr(err)      // error re-fetching user record
+	is.True(!u.Locked) // account should be unlocked after reset
+
+	// can auth with the new password
+	b = strings.NewReader(`{"email": "dh@rtcl.io", "password": "aBrandNewPassword"}`)
+	r = httptest.NewRequest("POST", "/auth", b)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusOK) // expected 200 OK for auth with new password
+
+	// the old key cannot be used again
+	b = strings.NewReader(`{"password": "anotherPassword"}`)
+	r = httptest.NewRequest("POST", "/users/"+uid+"/reset/"+key, b)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusGone) // expected 410 Gone for a used key
+}
+
+// testMagicLink tests that a magic link is exchanged once for an access token, and that requests are rate limited
+func testMagicLink(t *testing.T) {
+	is := is.New(t)
+	srv := server.NewServer(srvConfig, ds)
+	const uid = "5b3bcd72463cd6029e04de1a"
+
+	// the limit applies whether or not the email has an account, and there are no emails sent for this one
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest("POST", "/auth/magic-link", strings.NewReader(`{"email": "nobody@rtcl.io"}`))
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		is.Equal(w.Code, http.StatusAccepted) // expected 202 Accepted for an unknown email
+	}
+	r := httptest.NewRequest("POST", "/auth/magic-link", strings.NewReader(`{"email": "Nobody@rtcl.io"}`))
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusTooManyRequests) // expected 429 after too many requests for the email
+	is.True(w.Header().Get("Retry-After") != "") // expected a Retry-After header
+
+	u, err := ds.UserByID(uid)
+	is.NoErr(err) // error fetching user record
+	key, err := u.ActionToken(datastore.ActionMagicLink, srvConfig.Token.SigningKey)
+	is.NoErr(err) // error generating magic link token
+
+	r = httptest.NewRequest("POST", "/users/5b3bcd72463cd6029e04de18/login/"+key, nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusBadRequest) // expected 400 Bad Request for a key issued to a different user
+
+	r = httptest.NewRequest("POST", "/users/"+uid+"/login/"+key, nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusOK) // expected 200 OK
+	body := struct {
+		JWT          string `json:"token"`
+		RefreshToken string `json:"refreshToken"`
+	}{}
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &body)) // error decoding response
+	is.True(len(strings.Split(body.JWT, ".")) == 3) // doesn't look like a token
+	is.True(body.RefreshToken != "")                // expected a refresh token
+
+	r = httptest.NewRequest("POST", "/users/"+uid+"/login/"+key, nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusGone) // expected 410 Gone for a used link
+}
+
+// testConfirmUser tests unlocking a user account with the confirmation token emailed to a new user
+func testConfirmUser(t *testing.T) {
+	is := is.New(t)
+	srv := server.NewServer(srvConfig, ds)
+	const uid = "5b3bcd72463cd6029e04de1a" // locked in the test data
+
+	u, err := ds.UserByID(uid)
+	is.NoErr(err) // error fetching user record
+	key, err := u.ActionToken(datastore.ActionConfirmEmail, srvConfig.Token.SigningKey)
+	is.NoErr(err) // error generating confirmation token
+
+	// a reset token cannot be used to confirm
+	reset, err := u.ActionToken(datastore.ActionResetPassword, srvConfig.Token.SigningKey)
+	is.NoErr(err) // error generating reset token
+	r := httptest.NewRequest("GET", "/users/"+uid+"/confirm/"+reset, nil)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusBadRequest) // expected 400 Bad Request for a reset token
+
+	r = httptest.NewRequest("GET", "/users/"+uid+"/confirm/"+key, nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusOK) // expected 200 OK for confirmation
+
+	u, err = ds.UserByID(uid)
+	is.NoErr(err)      // error re-fetching user record
+	is.True(!u.Locked) // account should be unlocked after confirmation
+}
+
+// testUnsubscribe tests that the unsubscribe link from a notification email pauses the user's notifications
+func testUnsubscribe(t *testing.T) {
+	is := is.New(t)
+	srv := server.NewServer(srvConfig, ds)
+	const uid = "5b3bcd72463cd6029e04de1a"
+
+	u, err := ds.UserByID(uid)
+	is.NoErr(err) // error fetching user record
+	schedule := u.Schedule
+	key, err := u.ActionToken(datastore.ActionUnsubscribe, srvConfig.Token.SigningKey)
+	is.NoErr(err) // error generating unsubscribe token
+
+	r := httptest.NewRequest("GET", "/users/5b3bcd72463cd6029e04de18/unsubscribe/"+key, nil)
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusBadRequest) // expected 400 Bad Request for a key issued to a different user
+
+	r = httptest.NewRequest("GET", "/users/"+uid+"/unsubscribe/"+key, nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusOK) // expected 200 OK for unsubscribe
+
+	u, err = ds.UserByID(uid)
+	is.NoErr(err)                                                       // error re-fetching user record
+	is.True(u.Schedule.PausedUntil.Equal(datastore.PausedIndefinitely)) // expected notifications to be paused
+
+	r = httptest.NewRequest("GET", "/users/"+uid+"/unsubscribe/"+key, nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusGone) // expected 410 Gone for a used link
+
+	// put the schedule back for the other tests
+	u.Schedule = schedule
+	is.NoErr(ds.Users.Save(*u))
+}
+
 // testme test the user endpoint that fetches the logged in user profile using a token
 func testMe(t *testing.T) {
 	is := is.New(t)
@@ -242,6 +745,56 @@ func testSaveSearch(t *testing.T) {
 	is.True(len(u.Searches) == currentSearches+1)    // expect number of searches to increase by 1
 }
 
+// testSearches tests the saved search resources under /user/searches
+func testSearches(t *testing.T) {
+	is := is.New(t)
+	srv := server.NewServer(srvConfig, ds)
+	u, err := ds.UserByID("5b3bcd72463cd6029e04de1a")
+	is.NoErr(err) // error fetching user record
+	tk, err := u.Token(srvConfig.Token.Issuer, srvConfig.Token.SigningKey, 1)
+	is.NoErr(err) // error generating token
+	send := func(method, target, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+tk.String())
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		return w
+	}
+
+	w := send("POST", "/user/searches", `{"name": "Athletes", "query": "cardiomyopathy athletes", "categories": ["cardiology"]}`)
+	is.Equal(w.Code, http.StatusCreated) // expected 201 Created
+	var s datastore.Search
+	is.NoErr(json.NewDecoder(w.Body).Decode(&s))
+	is.True(s.ID.Valid()) // expected the search id
+	is.Equal(s.Name, "Athletes")
+
+	w = send("POST", "/user/searches", `{"query": "Cardiomyopathy Athletes"}`)
+	is.Equal(w.Code, http.StatusConflict) // expected 409 Conflict for a duplicate query
+	w = send("POST", "/user/searches", `{"query": "valid", "from": "last week"}`)
+	is.Equal(w.Code, http.StatusBadRequest) // expected 400 Bad Request for a bad date
+
+	w = send("PUT", "/user/searches/"+s.ID.Hex(), `{"name": "Athletes", "query": "cardiomyopathy athletes", "journals": ["Circulation"]}`)
+	is.Equal(w.Code, http.StatusOK) // expected 200 OK
+	w = send("GET", "/user/searches/"+s.ID.Hex(), "")
+	is.Equal(w.Code, http.StatusOK) // expected 200 OK
+	is.NoErr(json.NewDecoder(w.Body).Decode(&s))
+	is.Equal(s.Journals, []string{"Circulation"}) // expected the updated journals
+	is.Equal(len(s.Categories), 0)                // expected the categories to be replaced
+
+	w = send("GET", "/user/searches", "")
+	is.Equal(w.Code, http.StatusOK) // expected 200 OK
+	var xs []datastore.Search
+	is.NoErr(json.NewDecoder(w.Body).Decode(&xs))
+	is.True(len(xs) > 0) // expected a list of searches
+
+	w = send("DELETE", "/user/searches/"+s.ID.Hex(), "")
+	is.Equal(w.Code, http.StatusNoContent) // expected 204 No Content
+	w = send("GET", "/user/searches/"+s.ID.Hex(), "")
+	is.Equal(w.Code, http.StatusNotFound) // expected 404 Not Found after delete
+	w = send("PUT", "/user/searches/notanid", `{"query": "anything"}`)
+	is.Equal(w.Code, http.StatusNotFound) // expected 404 Not Found for a bad id
+}
+
 // testDeleteSearch tests the endpoint that removes a query from the user's list of saved searches
 func testDeleteSearch(t *testing.T) {
 	is := is.New(t)
@@ -291,6 +844,13 @@ func testRedirect(t *testing.T) {
 	w := httptest.NewRecorder()
 	srv.ServeHTTP(w, r)
 	is.Equal(w.Code, http.StatusFound) // expected 302 Found
+
+	// a stored article is redirected to its url without calling PubMed
+	r = httptest.NewRequest("GET", "/r/30173079", nil)
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusFound)
+	is.Equal(w.Header().Get("Location"), "https://doi.org/10.1016/j.atherosclerosis.2018.08.032")
 }
 
 // testSaveLog test the saving of a user reading log entry
@@ -389,3 +949,123 @@ func logError(e error) {
 		log.Println("TEST ERROR:", e)
 	}
 }
+
+// testMFALogin tests enrolling in two-factor auth, and that /auth then returns an mfa token that has to be exchanged
+// with a code at /auth/mfa
+func testMFALogin(t *testing.T) {
+	is := is.New(t)
+	srv := server.NewServer(srvConfig, ds)
+
+	u, err := ds.UserByID("5b3bcd72463cd6029e04de18")
+	is.NoErr(err) // error fetching user
+	tk, err := u.Token(srvConfig.Token.Issuer, srvConfig.Token.SigningKey, 1)
+	is.NoErr(err) // error generating token
+	request := func(method, path, body, jwt string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if jwt != "" {
+			r.Header.Set("Authorization", "Bearer "+jwt)
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		return w
+	}
+
+	w := request("POST", "/user/mfa", "", tk.String())
+	is.Equal(w.Code, 200) // expected 200 OK
+	var enroll struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &enroll))         // error decoding enroll response
+	is.True(strings.HasPrefix(enroll.URI, "otpauth://totp/")) // expected an otpauth uri
+
+	now := time.Now()
+	code, err := datastore.TOTPCode(enroll.Secret, now)
+	is.NoErr(err) // error generating code
+	w = request("POST", "/user/mfa/confirm", fmt.Sprintf(`{"code": "%s"}`, code), tk.String())
+	is.Equal(w.Code, 200) // expected 200 OK
+	var confirm struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &confirm)) // error decoding confirm response
+	is.Equal(len(confirm.RecoveryCodes), 10)           // expected recovery codes
+
+	w = request("POST", "/auth", `{"email": "br@rtcl.io", "password": "12345abcde"}`, "")
+	is.Equal(w.Code, 200) // expected 200 OK
+	var step1 struct {
+		MFARequired bool   `json:"mfaRequired"`
+		MFAToken    string `json:"mfaToken"`
+		JWT         string `json:"token"`
+	}
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &step1)) // error decoding auth response
+	is.True(step1.MFARequired)                       // expected mfa to be required
+	is.Equal(step1.JWT, "")                          // should not get an access token until the second step
+
+	w = request("POST", "/auth/mfa", fmt.Sprintf(`{"mfaToken": "%s", "code": "000000"}`, step1.MFAToken), "")
+	is.Equal(w.Code, 401) // wrong code should be rejected
+
+	// the code used to confirm cannot be used again, so use the one for the next step
+	code, err = datastore.TOTPCode(enroll.Secret, now.Add(30*time.Second))
+	is.NoErr(err) // error generating code
+	w = request("POST", "/auth/mfa", fmt.Sprintf(`{"mfaToken": "%s", "code": "%s"}`, step1.MFAToken, code), "")
+	is.Equal(w.Code, 200) // expected 200 OK
+	var step2 struct {
+		JWT string `json:"token"`
+	}
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &step2)) // error decoding mfa response
+	is.True(len(strings.Split(step2.JWT, ".")) == 3) // doesn't look like a token
+
+	w = request("POST", "/auth/mfa", fmt.Sprintf(`{"mfaToken": "%s", "code": "%s"}`, step1.MFAToken, confirm.RecoveryCodes[0]), "")
+	is.Equal(w.Code, 401) // mfa token should only be exchanged once
+
+	w = request("DELETE", "/user/mfa", fmt.Sprintf(`{"code": "%s"}`, confirm.RecoveryCodes[1]), step2.JWT)
+	is.Equal(w.Code, 204) // expected 204 No Content
+
+	w = request("POST", "/auth", `{"email": "br@rtcl.io", "password": "12345abcde"}`, "")
+	is.Equal(w.Code, 200)                            // expected 200 OK
+	is.NoErr(json.Unmarshal(w.Body.Bytes(), &step1)) // error decoding auth response
+	is.True(step1.JWT != "")                         // expected an access token once mfa is disabled
+}
+
+// testMFACodeLockout tests that wrong codes posted to turn off two-factor auth count towards the login lockout
+func testMFACodeLockout(t *testing.T) {
+	is := is.New(t)
+	srv := server.NewServer(srvConfig, ds)
+
+	u := ds.NewUser()
+	u.FirstName = "MFA"
+	u.LastName = "Lockout"
+	u.Email = "mfa.lockout@rtcl.io"
+	is.NoErr(u.Save()) // error adding user
+	secret, _, err := u.EnrollTOTP(srvConfig.Token.Issuer)
+	is.NoErr(err) // error enrolling
+	now := time.Now()
+	code, err := datastore.TOTPCode(secret, now)
+	is.NoErr(err) // error generating code
+	_, err = u.ConfirmTOTP(code)
+	is.NoErr(err) // error confirming
+	tk, err := u.Token(srvConfig.Token.Issuer, srvConfig.Token.SigningKey, 1)
+	is.NoErr(err) // error generating token
+
+	request := func(code string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("DELETE", "/user/mfa", strings.NewReader(fmt.Sprintf(`{"code": "%s"}`, code)))
+		r.Header.Set("Authorization", "Bearer "+tk.String())
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i <= datastore.LoginFreeAttempts; i++ {
+		w := request("000000")
+		is.Equal(w.Code, 400) // expected a wrong code to be rejected
+	}
+	code, err = datastore.TOTPCode(secret, now.Add(30*time.Second))
+	is.NoErr(err) // error generating code
+	w := request(code)
+	is.Equal(w.Code, 429) // expected the user to be locked out, even with the right code
+	is.True(w.Header().Get("Retry-After") != "")
+
+	u, err = ds.UserByID(u.ID.Hex())
+	is.NoErr(err)
+	is.True(u.MFAEnabled) // expected mfa to still be enabled
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mikedonnici/rtcl-api/query"
+	"github.com/mikedonnici/rtcl-api/search"
+)
+
+// dateFormat is the format of the from and to dates of a search
+const dateFormat = "2006-01-02"
+
+// errNoSearch is returned when the server was started without a search backend
+var errNoSearch = errors.New("search is not available")
+
+// searchResults is a page of articles that match a search
+type searchResults struct {
+	Query      string    `json:"query"`
+	Categories []string  `json:"categories"`
+	Page       int       `json:"page"`
+	Pages      int       `json:"pages"`
+	PerPage    int       `json:"perPage"`
+	Total      int       `json:"total"`
+	Articles   []article `json:"articles"`
+}
+
+// articleFromHit converts a search hit to an article, with its highlights
+func articleFromHit(h search.Hit) article {
+	a := newArticle(h.Article())
+	a.Highlight = &highlight{Title: h.Highlight.Title, Summary: h.Highlight.Summary}
+	return a
+}
+
+// articleSearchHandler searches the articles. The results are limited to the user's categories unless the category
+// param is set, which can be repeated or a comma-separated list.
+func (s *server) articleSearchHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.config.Search == nil {
+			respondJSON(w, http.StatusServiceUnavailable, nil, errNoSearch)
+			return
+		}
+		u, err := s.store.UserByID(r.Context().Value("userID").(string))
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		q, err := searchQuery(r)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, nil, err)
+			return
+		}
+		if len(q.Categories) == 0 {
+			q.Categories = u.Categories
+		}
+
+		res, err := s.config.Search.Search(q)
+		switch err.(type) {
+		case *query.SyntaxError, *query.TranslateError:
+			respondJSON(w, http.StatusBadRequest, nil, err)
+			return
+		}
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+
+		sr := searchResults{
+			Query:      q.Text,
+			Categories: q.Categories,
+			Page:       res.Page,
+			Pages:      res.NbPages,
+			PerPage:    res.HitsPerPage,
+			Total:      res.NbHits,
+			Articles:   []article{},
+		}
+		if sr.Categories == nil {
+			sr.Categories = []string{}
+		}
+		for _, h := range res.Hits {
+			sr.Articles = append(sr.Articles, articleFromHit(h))
+		}
+		respondJSON(w, http.StatusOK, sr, nil)
+	}
+}
+
+// searchQuery reads the query params of a search. The to date includes the whole day.
+func searchQuery(r *http.Request) (search.Query, error) {
+	v := r.URL.Query()
+	q := search.Query{Text: strings.TrimSpace(v.Get("q"))}
+	for _, c := range v["category"] {
+		for _, c := range strings.Split(c, ",") {
+			if strings.TrimSpace(c) != "" {
+				q.Categories = append(q.Categories, strings.TrimSpace(c))
+			}
+		}
+	}
+
+	var err error
+	if v.Get("from") != "" {
+		q.From, err = time.Parse(dateFormat, v.Get("from"))
+		if err != nil {
+			return q, errors.New("from must be a date in the format " + dateFormat)
+		}
+	}
+	if v.Get("to") != "" {
+		q.To, err = time.Parse(dateFormat, v.Get("to"))
+		if err != nil {
+			return q, errors.New("to must be a date in the format " + dateFormat)
+		}
+		q.To = q.To.Add(24*time.Hour - time.Second)
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && q.To.Before(q.From) {
+		return q, errors.New("to must not be before from")
+	}
+	if v.Get("page") != "" {
+		q.Page, err = strconv.Atoi(v.Get("page"))
+		if err != nil || q.Page < 0 || q.Page > search.MaxPage {
+			return q, fmt.Errorf("page must be a number from 0 to %d", search.MaxPage)
+		}
+	}
+	return q, nil
+}
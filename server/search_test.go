@@ -0,0 +1,253 @@
+package server_test
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matryer/is"
+	"github.com/mikedonnici/rtcl-api/datastore"
+	"github.com/mikedonnici/rtcl-api/query"
+	"github.com/mikedonnici/rtcl-api/search"
+	"github.com/mikedonnici/rtcl-api/server"
+	"github.com/mikedonnici/rtcl-api/testdata"
+)
+
+var searchDS *datastore.Datastore
+
+// searchDocs are the indexed articles for the search tests. User br is in cardiology and physiotherapy, and oj has
+// no categories.
+var searchDocs = []search.Document{
+	{ObjectID: "30001", Category: "cardiology", Title: "Heart failure in athletes", Keywords: []string{"Smith J"},
+		PubName: "The American journal of cardiology", PubNameAbbr: "Am J Cardiol", PubVolume: "122",
+		PubIssue: "2", PubPageRef: "206-212", PubTime: 1538352000, PubDate: "2018-10-01",
+		URL: "https://doi.org/10.1000/30001", Summary: "Heart failure is common in older athletes."},
+	{ObjectID: "30002", Category: "cardiology", Title: "Stent thrombosis", PubNameAbbr: "Circulation",
+		PubTime: 1538438400, PubDate: "2018-10-02", Summary: "The heart recovered."},
+	{ObjectID: "30003", Category: "dermatology", Title: "Melanoma and the heart", PubNameAbbr: "JAMA Dermatol",
+		PubTime: 1538524800, PubDate: "2018-10-03", Summary: "Screening."},
+	{ObjectID: "30004", Category: "physiotherapy", Title: "Rehabilitation", PubNameAbbr: "Physiotherapy",
+		PubTime: 1538611200, PubDate: "2018-10-04", Summary: "Exercise after heart surgery."},
+}
+
+// searchResults is the response of GET /search
+type searchResults struct {
+	Query      string   `json:"query"`
+	Categories []string `json:"categories"`
+	Page       int      `json:"page"`
+	Pages      int      `json:"pages"`
+	PerPage    int      `json:"perPage"`
+	Total      int      `json:"total"`
+	Articles   []struct {
+		SourceID         string   `json:"sourceId"`
+		Category         string   `json:"category"`
+		Published        string   `json:"published"`
+		Title            string   `json:"title"`
+		Keywords         []string `json:"keywords"`
+		URL              string   `json:"url"`
+		SourceName       string   `json:"sourceName"`
+		SourceNameAbbrev string   `json:"sourceNameAbbrev"`
+		SourceVolume     string   `json:"sourceVolume"`
+		SourceIssue      string   `json:"sourceIssue"`
+		SourcePages      string   `json:"sourcePages"`
+		SourcePubDate    string   `json:"sourcePubDate"`
+		Highlight        struct {
+			Title   string `json:"title"`
+			Summary string `json:"summary"`
+		} `json:"highlight"`
+	} `json:"articles"`
+}
+
+// TestSearch runs the article search tests against their own in-memory datastore and index
+func TestSearch(t *testing.T) {
+
+	var err error
+
+	searchDS, err = testdata.NewMemoryStore()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	t.Run("search", func(t *testing.T) {
+		t.Run("testArticleSearch", testArticleSearch)
+		t.Run("testArticleSearchParams", testArticleSearchParams)
+		t.Run("testArticleSearchBackend", testArticleSearchBackend)
+		t.Run("testArticleSearchUnavailable", testArticleSearchUnavailable)
+	})
+}
+
+// searchRequest serves a request with a token for the user id, with the index as the search backend
+func searchRequest(t *testing.T, searcher search.SearchIndex, path, userID string) *httptest.ResponseRecorder {
+	u, err := searchDS.UserByID(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk, err := u.Token(srvConfig.Token.Issuer, srvConfig.Token.SigningKey, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := srvConfig
+	cfg.Search = searcher
+	r := httptest.NewRequest("GET", path, nil)
+	r.Header.Set("Authorization", "Bearer "+tk.String())
+	w := httptest.NewRecorder()
+	server.NewServer(cfg, searchDS).ServeHTTP(w, r)
+	return w
+}
+
+func newSearchIndex(t *testing.T) *search.Index {
+	ix := search.NewIndex()
+	err := ix.Add(searchDocs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ix
+}
+
+// searchIDs returns the source ids of the articles in the response, in order
+func searchIDs(t *testing.T, w *httptest.ResponseRecorder) (searchResults, []string) {
+	var sr searchResults
+	err := json.NewDecoder(w.Body).Decode(&sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, a := range sr.Articles {
+		ids = append(ids, a.SourceID)
+	}
+	return sr, ids
+}
+
+func testArticleSearch(t *testing.T) {
+	is := is.New(t)
+	ix := newSearchIndex(t)
+
+	// br only sees their own categories
+	w := searchRequest(t, ix, "/search?q=heart", "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, http.StatusOK)
+	sr, ids := searchIDs(t, w)
+	is.Equal(ids, []string{"30001", "30004", "30002"})
+	is.Equal(sr.Categories, []string{"cardiology", "physiotherapy"})
+	is.Equal(sr.Total, 3)
+	is.Equal(sr.Pages, 1)
+
+	a := sr.Articles[0]
+	is.Equal(a.Published, "2018-10-01T00:00:00Z")
+	is.Equal(a.Category, "cardiology")
+	is.Equal(a.Keywords, []string{"Smith J"})
+	is.Equal(a.URL, "https://doi.org/10.1000/30001")
+	is.Equal(a.SourceName, "The American journal of cardiology")
+	is.Equal(a.SourceNameAbbrev, "Am J Cardiol")
+	is.Equal(a.SourceVolume, "122")
+	is.Equal(a.SourceIssue, "2")
+	is.Equal(a.SourcePages, "206-212")
+	is.Equal(a.SourcePubDate, "2018-10-01")
+	is.Equal(a.Highlight.Title, "<em>Heart</em> failure in athletes")
+	is.Equal(a.Highlight.Summary, "<em>Heart</em> failure is common in older athletes.")
+	is.Equal(sr.Articles[1].Keywords, []string{}) // expected an empty list rather than null
+
+	// oj has no categories so sees all of them
+	w = searchRequest(t, ix, "/search?q=heart", "5b3bcd72463cd6029e04de1a")
+	is.Equal(w.Code, http.StatusOK)
+	_, ids = searchIDs(t, w)
+	is.Equal(len(ids), 4)
+
+	// the category param replaces the user's categories
+	w = searchRequest(t, ix, "/search?q=heart&category=dermatology", "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, http.StatusOK)
+	_, ids = searchIDs(t, w)
+	is.Equal(ids, []string{"30003"})
+
+	w = searchRequest(t, ix, "/search?category=dermatology,physiotherapy", "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, http.StatusOK)
+	_, ids = searchIDs(t, w)
+	is.Equal(ids, []string{"30004", "30003"}) // expected newest first without a query
+
+	// the to date includes the whole day
+	w = searchRequest(t, ix, "/search?from=2018-10-02&to=2018-10-04", "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, http.StatusOK)
+	_, ids = searchIDs(t, w)
+	is.Equal(ids, []string{"30004", "30002"})
+
+	w = searchRequest(t, ix, "/search?q=nothing", "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, http.StatusOK)
+	sr, ids = searchIDs(t, w)
+	is.Equal(len(ids), 0)
+	is.True(sr.Articles != nil) // expected an empty list rather than null
+}
+
+func testArticleSearchParams(t *testing.T) {
+	is := is.New(t)
+	ix := search.NewIndex()
+	for i := 0; i < search.DefaultHitsPerPage+5; i++ {
+		d := searchDocs[0]
+		d.ObjectID = string(rune('a'+i/10)) + string(rune('0'+i%10))
+		ix.Add(d)
+	}
+
+	w := searchRequest(t, ix, "/search?q=heart", "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, http.StatusOK)
+	sr, ids := searchIDs(t, w)
+	is.Equal(len(ids), search.DefaultHitsPerPage)
+	is.Equal(sr.Total, search.DefaultHitsPerPage+5)
+	is.Equal(sr.Pages, 2)
+	is.Equal(sr.PerPage, search.DefaultHitsPerPage)
+
+	w = searchRequest(t, ix, "/search?q=heart&page=1", "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, http.StatusOK)
+	sr, ids = searchIDs(t, w)
+	is.Equal(len(ids), 5)
+	is.Equal(sr.Page, 1)
+
+	for _, q := range []string{
+		"q=(heart",
+		"from=yesterday",
+		"to=2018-13-01",
+		"from=2018-10-04&to=2018-10-01",
+		"page=-1",
+		"page=two",
+		"page=1001",
+		"page=461168601842738791",
+	} {
+		w = searchRequest(t, ix, "/search?"+q, "5b3bcd72463cd6029e04de18")
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("GET /search?%s status = %d, want 400", q, w.Code)
+		}
+	}
+}
+
+// testArticleSearchBackend tests the query sent to the backend, and its errors
+func testArticleSearchBackend(t *testing.T) {
+	is := is.New(t)
+	fake := search.NewFake()
+	is.NoErr(fake.Upsert(searchDocs...))
+
+	w := searchRequest(t, fake, "/search?q=heart&from=2018-10-02&to=2018-10-03&page=2", "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(len(fake.Queries), 1)
+	q := fake.Queries[0]
+	is.Equal(q.Text, "heart")
+	is.Equal(q.Categories, []string{"cardiology", "physiotherapy"})
+	is.Equal(q.From, time.Date(2018, 10, 2, 0, 0, 0, 0, time.UTC))
+	is.Equal(q.To, time.Date(2018, 10, 3, 23, 59, 59, 0, time.UTC))
+	is.Equal(q.Page, 2)
+
+	// a query that the backend cannot translate is a bad request
+	fake.Err = &query.TranslateError{Target: "Algolia", Reason: "NOT can only be used on a single journal or author"}
+	w = searchRequest(t, fake, "/search?q=heart", "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, http.StatusBadRequest)
+
+	fake.Err = errors.New("backend is down")
+	w = searchRequest(t, fake, "/search?q=heart", "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, http.StatusInternalServerError)
+}
+
+func testArticleSearchUnavailable(t *testing.T) {
+	is := is.New(t)
+	w := searchRequest(t, nil, "/search?q=heart", "5b3bcd72463cd6029e04de18")
+	is.Equal(w.Code, http.StatusServiceUnavailable)
+}
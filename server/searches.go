@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mikedonnici/rtcl-api/datastore"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// searchesHandler responds with the user's saved searches
+func (s *server) searchesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := s.store.UserByID(r.Context().Value("userID").(string))
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		xs, err := u.SavedSearches()
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		if xs == nil {
+			xs = []datastore.Search{}
+		}
+		respondJSON(w, http.StatusOK, xs, nil)
+	}
+}
+
+// addSearchHandler saves a new search, with its filters, and responds with it
+func (s *server) addSearchHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := s.store.UserByID(r.Context().Value("userID").(string))
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		search := datastore.Search{}
+		err = json.NewDecoder(r.Body).Decode(&search)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, nil, err)
+			return
+		}
+
+		search, err = u.AddSearch(search)
+		if err != nil {
+			respondSearchError(w, err)
+			return
+		}
+		respondJSON(w, http.StatusCreated, search, nil)
+	}
+}
+
+// searchHandler responds with one of the user's saved searches
+func (s *server) searchHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := s.store.UserByID(r.Context().Value("userID").(string))
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		search, err := u.SearchByID(mux.Vars(r)["id"])
+		if err != nil {
+			respondSearchError(w, err)
+			return
+		}
+		respondJSON(w, http.StatusOK, search, nil)
+	}
+}
+
+// updateSearchHandler replaces the name, query and filters of a saved search
+func (s *server) updateSearchHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := s.store.UserByID(r.Context().Value("userID").(string))
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		id := mux.Vars(r)["id"]
+		if !bson.IsObjectIdHex(id) {
+			respondSearchError(w, datastore.ErrNotFound)
+			return
+		}
+		search := datastore.Search{}
+		err = json.NewDecoder(r.Body).Decode(&search)
+		if err != nil {
+			respondJSON(w, http.StatusBadRequest, nil, err)
+			return
+		}
+		search.ID = bson.ObjectIdHex(id)
+
+		search, err = u.UpdateSearch(search)
+		if err != nil {
+			respondSearchError(w, err)
+			return
+		}
+		respondJSON(w, http.StatusOK, search, nil)
+	}
+}
+
+// removeSearchHandler deletes a saved search
+func (s *server) removeSearchHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := s.store.UserByID(r.Context().Value("userID").(string))
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		err = u.RemoveSearch(mux.Vars(r)["id"])
+		if err != nil {
+			respondSearchError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// respondSearchError responds with the status for an error from the saved search and share methods
+func respondSearchError(w http.ResponseWriter, err error) {
+	if _, ok := err.(*datastore.SearchError); ok {
+		respondJSON(w, http.StatusBadRequest, nil, err)
+		return
+	}
+	switch err {
+	case datastore.ErrNotFound:
+		respondJSON(w, http.StatusNotFound, nil, errors.New("search not found"))
+	case datastore.ErrSearchExists, datastore.ErrSearchLinked:
+		respondJSON(w, http.StatusConflict, nil, err)
+	case datastore.ErrShareOwner:
+		respondJSON(w, http.StatusBadRequest, nil, err)
+	default:
+		respondJSON(w, http.StatusInternalServerError, nil, err)
+	}
+}
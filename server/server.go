@@ -2,29 +2,61 @@ package server
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/mikedonnici/rtcl-api/datastore"
+	"github.com/mikedonnici/rtcl-api/search"
 	"github.com/rs/cors"
 )
 
 type server struct {
-	config Config
-	port   string
-	router *mux.Router
-	store  *datastore.Datastore
+	config     Config
+	port       string
+	router     *mux.Router
+	store      *datastore.Datastore
+	keyring    *datastore.Keyring
+	validator  *datastore.TokenValidator
+	now        func() time.Time
+	ipThrottle *ipThrottle
+	magicLinks *rateLimiter // magic link requests for each email address
+	shareMails *rateLimiter // searches shared by email for each user
 }
 
 type Config struct {
-	Port  string
-	Token TokenConfig
+	Port          string
+	Token         TokenConfig
+	TrustProxy    bool               // use X-Forwarded-For for the client IP, eg behind the Heroku router
+	DeletionGrace time.Duration      // how long before a deleted account is purged, zero to delete straight away
+	Search        search.SearchIndex // article search backend, GET /search responds 503 if not set
 }
 
 // tokenConfig configures the tokens issued by the server
 type TokenConfig struct {
-	Issuer     string
-	SigningKey string
-	HoursTTL   int
+	Issuer          string
+	SigningKey      string             // HMAC secret, for action tokens and access tokens if there is no Keyring
+	Keyring         *datastore.Keyring // keys for access tokens, the active key signs new tokens
+	HoursTTL        int                // access tokens, keep this short as refresh tokens are used to stay logged in
+	RefreshHoursTTL int                // refresh tokens, datastore.RefreshTokenTTL if not set
+	Audiences       []string           // accepted aud claims, the first is set on new tokens
+	Algorithms      []string           // accepted signing algorithms, defaults to those of the keys in the Keyring
+	Leeway          time.Duration      // allowance for clock skew between servers
+}
+
+// audience returns the aud claim for new tokens
+func (tc TokenConfig) audience() string {
+	if len(tc.Audiences) == 0 {
+		return ""
+	}
+	return tc.Audiences[0]
+}
+
+// refreshTTL returns the lifetime of refresh tokens
+func (tc TokenConfig) refreshTTL() time.Duration {
+	if tc.RefreshHoursTTL < 1 {
+		return datastore.RefreshTokenTTL
+	}
+	return time.Duration(tc.RefreshHoursTTL) * time.Hour
 }
 
 // NewServer returns a pointer to an initialised server with a connected datastore
@@ -33,11 +65,36 @@ func NewServer(cfg Config, store *datastore.Datastore) *server {
 		config: cfg,
 		store:  store,
 		router: mux.NewRouter(),
+		now:    time.Now,
 	}
+	s.keyring = cfg.Token.Keyring
+	if s.keyring == nil {
+		s.keyring = datastore.NewKeyring(datastore.HMACKey(cfg.Token.SigningKey))
+	}
+	s.validator = &datastore.TokenValidator{
+		Keyring:    s.keyring,
+		Issuer:     cfg.Token.Issuer,
+		Audiences:  cfg.Token.Audiences,
+		Algorithms: cfg.Token.Algorithms,
+		Leeway:     cfg.Token.Leeway,
+		Now:        func() time.Time { return s.now() },
+	}
+	s.ipThrottle = newIPThrottle(func() time.Time { return s.now() })
+	s.magicLinks = newRateLimiter(func() time.Time { return s.now() }, magicLinkLimit, magicLinkWindow)
+	s.shareMails = newRateLimiter(func() time.Time { return s.now() }, shareEmailLimit, shareEmailWindow)
 	s.routes()
 	return s
 }
 
+// SetClock replaces the clock used for time-based rules, such as auth throttling, in the server and its datastore.
+// It is intended for tests.
+func (s *server) SetClock(now func() time.Time) {
+	s.now = now
+	if s.store != nil {
+		s.store.Now = now
+	}
+}
+
 // Start fires up the http server
 func (s *server) Start() error {
 
@@ -45,7 +102,7 @@ func (s *server) Start() error {
 	ch := cors.New(cors.Options{
 		AllowedOrigins: []string{"*"},
 		AllowedMethods: []string{"GET", "POST", "PUT", "OPTIONS", "DELETE"},
-		AllowedHeaders: []string{"Authorization", "Content-Type"},
+		AllowedHeaders: []string{"Authorization", "Content-Type", "X-API-Key"},
 	}).Handler(s.router)
 
 	return http.ListenAndServe(":"+s.config.Port, ch)
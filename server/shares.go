@@ -0,0 +1,220 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mikedonnici/rtcl-api/datastore"
+	"github.com/mikedonnici/rtcl-api/emailer"
+)
+
+// sharedSearch is a search shared with the user. Only the name, query and filters of the owner's search are shown,
+// not its id or run state.
+type sharedSearch struct {
+	ID         string    `json:"id"`
+	Owner      string    `json:"owner"`
+	Name       string    `json:"name"`
+	Query      string    `json:"query"`
+	Categories []string  `json:"categories"`
+	Journals   []string  `json:"journals"`
+	From       string    `json:"from"`
+	To         string    `json:"to"`
+	Updated    time.Time `json:"updated"`
+}
+
+// newSharedSearch returns the response for the share of the owner's search
+func newSharedSearch(sh datastore.Share, owner *datastore.User, s datastore.Search) sharedSearch {
+	return sharedSearch{
+		ID:         sh.ID,
+		Owner:      owner.FirstName + " " + owner.LastName,
+		Name:       s.Name,
+		Query:      s.Query,
+		Categories: s.Categories,
+		Journals:   s.Journals,
+		From:       s.From,
+		To:         s.To,
+		Updated:    s.Updated,
+	}
+}
+
+// searchSharesHandler responds with the shares of one of the user's saved searches
+func (s *server) searchSharesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := s.store.UserByID(r.Context().Value("userID").(string))
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		xs, err := u.SearchShares(mux.Vars(r)["id"])
+		if err != nil {
+			respondSearchError(w, err)
+			return
+		}
+		if xs == nil {
+			xs = []datastore.Share{}
+		}
+		respondJSON(w, http.StatusOK, xs, nil)
+	}
+}
+
+// shareSearchHandler shares one of the user's saved searches with the emails in the body, which are sent a link to
+// it, or as a link if there are none. It responds with the share, and its id is the link.
+func (s *server) shareSearchHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := s.store.UserByID(r.Context().Value("userID").(string))
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		var body struct {
+			Emails []string `json:"emails"`
+		}
+		err = json.NewDecoder(r.Body).Decode(&body)
+		if err != nil && err != io.EOF {
+			respondJSON(w, http.StatusBadRequest, nil, err)
+			return
+		}
+
+		sh, err := u.NewShare(mux.Vars(r)["id"], body.Emails)
+		if err != nil {
+			respondSearchError(w, err)
+			return
+		}
+
+		// only a valid share counts towards the limit on sharing by email
+		if len(sh.Emails) > 0 {
+			wait := s.shareMails.allow(u.ID.Hex())
+			if wait > 0 {
+				respondRateLimited(w, wait, errors.New("too many searches shared by email, please try again later"))
+				return
+			}
+		}
+
+		err = u.AddShare(sh)
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		if len(sh.Emails) > 0 {
+			search, _ := u.SearchByID(sh.SearchID.Hex())
+			for _, e := range sh.Emails {
+				emailer.SharedSearch(*u, search, e, sh.ID)
+			}
+			log.Printf("User %s shared search %s with %d colleagues", u.ID.Hex(), sh.SearchID.Hex(), len(sh.Emails))
+		}
+		respondJSON(w, http.StatusCreated, sh, nil)
+	}
+}
+
+// revokeShareHandler deletes a share of one of the user's saved searches
+func (s *server) revokeShareHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := s.store.UserByID(r.Context().Value("userID").(string))
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		vars := mux.Vars(r)
+		err = u.RevokeShare(vars["id"], vars["shareId"])
+		if err != nil {
+			respondSearchError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// forkSearchHandler unlinks the user's copy of a shared search so that they can change it
+func (s *server) forkSearchHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := s.store.UserByID(r.Context().Value("userID").(string))
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		search, err := u.ForkSearch(mux.Vars(r)["id"])
+		if err != nil {
+			respondSearchError(w, err)
+			return
+		}
+		respondJSON(w, http.StatusOK, search, nil)
+	}
+}
+
+// sharedWithMeHandler responds with the searches shared with the user's email
+func (s *server) sharedWithMeHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := s.store.UserByID(r.Context().Value("userID").(string))
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		xs, err := u.SharedWithMe()
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		res := []sharedSearch{}
+		for _, sh := range xs {
+			_, search, err := u.SharedSearch(sh.ID)
+			if err == datastore.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				respondJSON(w, http.StatusInternalServerError, nil, err)
+				return
+			}
+			owner, err := s.store.UserByID(sh.OwnerID.Hex())
+			if err != nil {
+				respondJSON(w, http.StatusInternalServerError, nil, err)
+				return
+			}
+			res = append(res, newSharedSearch(sh, owner, search))
+		}
+		respondJSON(w, http.StatusOK, res, nil)
+	}
+}
+
+// sharedSearchHandler responds with a shared search, if the user can open it
+func (s *server) sharedSearchHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := s.store.UserByID(r.Context().Value("userID").(string))
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		sh, search, err := u.SharedSearch(mux.Vars(r)["shareId"])
+		if err != nil {
+			respondSearchError(w, err)
+			return
+		}
+		owner, err := s.store.UserByID(sh.OwnerID.Hex())
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		respondJSON(w, http.StatusOK, newSharedSearch(sh, owner, search), nil)
+	}
+}
+
+// subscribeHandler adds a linked copy of a shared search to the user's searches, and responds with it
+func (s *server) subscribeHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		u, err := s.store.UserByID(r.Context().Value("userID").(string))
+		if err != nil {
+			respondJSON(w, http.StatusInternalServerError, nil, err)
+			return
+		}
+		search, err := u.Subscribe(mux.Vars(r)["shareId"])
+		if err != nil {
+			respondSearchError(w, err)
+			return
+		}
+		respondJSON(w, http.StatusCreated, search, nil)
+	}
+}
@@ -0,0 +1,277 @@
+package server_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/mikedonnici/rtcl-api/datastore"
+	"github.com/mikedonnici/rtcl-api/server"
+	"github.com/mikedonnici/rtcl-api/testdata"
+)
+
+var sharesDS *datastore.Datastore
+
+// The owner of the shared search is br, and the colleagues oj and dh
+const (
+	sharesOwner = "5b3bcd72463cd6029e04de18"
+	sharesOJ    = "5b3bcd72463cd6029e04de1a"
+	sharesDH    = "5b3bcd72463cd6029e04de1c"
+)
+
+// TestShares runs the shared search tests against their own in-memory datastore
+func TestShares(t *testing.T) {
+
+	var err error
+
+	sharesDS, err = testdata.NewMemoryStore()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	t.Run("shares", func(t *testing.T) {
+		t.Run("testShareSearchLink", testShareSearchLink)
+		t.Run("testShareSearchErrors", testShareSearchErrors)
+		t.Run("testShareSearchRateLimit", testShareSearchRateLimit)
+		t.Run("testSubscribeShare", testSubscribeShare)
+		t.Run("testSharedWithMe", testSharedWithMe)
+		t.Run("testForkSharedSearch", testForkSharedSearch)
+		t.Run("testRevokeSearchShare", testRevokeSearchShare)
+	})
+}
+
+// sharesSearchID returns the id of the owner's search with the query, adding it if needed
+func sharesSearchID(t *testing.T, q string) string {
+	u, err := sharesDS.UserByID(sharesOwner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range u.Searches {
+		if s.Query == q {
+			return s.ID.Hex()
+		}
+	}
+	s, err := u.AddSearch(datastore.Search{Name: "QAV", Query: q, Categories: []string{"cardiology"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.ID.Hex()
+}
+
+// sharesOf returns the shares of the owner's search
+func sharesOf(t *testing.T, searchID string) []datastore.Share {
+	w := userRequest(t, srvConfig, sharesDS, nil, "GET", "/user/searches/"+searchID+"/shares", "", sharesOwner)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var xs []datastore.Share
+	if err := json.NewDecoder(w.Body).Decode(&xs); err != nil {
+		t.Fatal(err)
+	}
+	return xs
+}
+
+func testShareSearchLink(t *testing.T) {
+	is := is.New(t)
+	id := sharesSearchID(t, "quadricuspid aortic valve")
+	is.Equal(len(sharesOf(t, id)), 0)
+
+	w := userRequest(t, srvConfig, sharesDS, nil, "POST", "/user/searches/"+id+"/shares", "", sharesOwner)
+	is.Equal(w.Code, http.StatusCreated)
+	var sh datastore.Share
+	is.NoErr(json.NewDecoder(w.Body).Decode(&sh))
+	is.True(sh.ID != "")
+	is.Equal(sh.SearchID.Hex(), id)
+
+	w = userRequest(t, srvConfig, sharesDS, nil, "GET", "/shared/"+sh.ID, "", sharesOJ)
+	is.Equal(w.Code, http.StatusOK) // anyone can open a link
+	var got map[string]interface{}
+	is.NoErr(json.NewDecoder(w.Body).Decode(&got))
+	is.Equal(got["id"], sh.ID)
+	is.Equal(got["query"], "quadricuspid aortic valve")
+	is.Equal(got["name"], "QAV")
+	_, ok := got["lastRun"]
+	is.True(!ok) // expected the owner's run state not to be shown
+
+	w = userRequest(t, srvConfig, sharesDS, nil, "GET", "/shared/nope", "", sharesOJ)
+	is.Equal(w.Code, http.StatusNotFound)
+	is.Equal(len(sharesOf(t, id)), 1)
+}
+
+func testShareSearchErrors(t *testing.T) {
+	is := is.New(t)
+	id := sharesSearchID(t, "quadricuspid aortic valve")
+
+	w := userRequest(t, srvConfig, sharesDS, nil, "POST", "/user/searches/"+id+"/shares", `{"emails": ["dh"]}`, sharesOwner)
+	is.Equal(w.Code, http.StatusBadRequest) // expected emails to be checked
+	w = userRequest(t, srvConfig, sharesDS, nil, "POST", "/user/searches/"+id+"/shares", `{"emails": `, sharesOwner)
+	is.Equal(w.Code, http.StatusBadRequest)
+	w = userRequest(t, srvConfig, sharesDS, nil, "POST", "/user/searches/"+id+"/shares", "", sharesOJ)
+	is.Equal(w.Code, http.StatusNotFound) // expected only the owner to share the search
+	w = userRequest(t, srvConfig, sharesDS, nil, "GET", "/user/searches/"+id+"/shares", "", sharesOJ)
+	is.Equal(w.Code, http.StatusNotFound)
+
+	r := httptest.NewRequest("GET", "/shared/"+sharesOf(t, id)[0].ID, nil)
+	w = httptest.NewRecorder()
+	server.NewServer(srvConfig, sharesDS).ServeHTTP(w, r)
+	is.Equal(w.Code, http.StatusUnauthorized) // expected a token to be required
+}
+
+// testShareSearchRateLimit tests that sharing by email is limited for each user, and that only valid shares count
+func testShareSearchRateLimit(t *testing.T) {
+	is := is.New(t)
+	id := sharesSearchID(t, "quadricuspid aortic valve")
+	u, err := sharesDS.UserByID(sharesOwner)
+	is.NoErr(err)
+	tk, err := u.Token(srvConfig.Token.Issuer, srvConfig.Token.SigningKey, 1)
+	is.NoErr(err)
+	srv := server.NewServer(srvConfig, sharesDS)
+	var shares []string
+	share := func(body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/user/searches/"+id+"/shares", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+tk.String())
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		if w.Code == http.StatusCreated {
+			var sh datastore.Share
+			is.NoErr(json.Unmarshal(w.Body.Bytes(), &sh))
+			shares = append(shares, sh.ID)
+		}
+		return w
+	}
+
+	var emails []string
+	for i := 0; i <= datastore.MaxShareEmails; i++ {
+		emails = append(emails, fmt.Sprintf(`"c%d@rtcl.io"`, i))
+	}
+	w := share(`{"emails": [` + strings.Join(emails, ",") + `]}`)
+	is.Equal(w.Code, http.StatusBadRequest) // expected the number of emails to be capped
+
+	for i := 0; i < 15; i++ {
+		w = share(`{"emails": ["nope"]}`)
+		is.Equal(w.Code, http.StatusBadRequest) // expected invalid shares not to count towards the limit
+	}
+
+	for {
+		w = share(`{"emails": ["c@rtcl.io"]}`)
+		if w.Code != http.StatusCreated {
+			break
+		}
+	}
+	is.Equal(w.Code, http.StatusTooManyRequests) // expected sharing by email to be rate limited
+	is.True(w.Header().Get("Retry-After") != "")
+	is.Equal(len(shares), 10)                    // expected the limit to be 10 shares by email
+	is.Equal(share("").Code, http.StatusCreated) // expected link shares not to be limited
+
+	for _, sh := range shares {
+		is.NoErr(u.RevokeShare(id, sh))
+	}
+}
+
+func testSubscribeShare(t *testing.T) {
+	is := is.New(t)
+	id := sharesSearchID(t, "quadricuspid aortic valve")
+	link := sharesOf(t, id)[0]
+
+	w := userRequest(t, srvConfig, sharesDS, nil, "POST", "/shared/"+link.ID+"/subscribe", "", sharesOJ)
+	is.Equal(w.Code, http.StatusCreated)
+	var s datastore.Search
+	is.NoErr(json.NewDecoder(w.Body).Decode(&s))
+	is.True(s.ID.Hex() != id) // expected a copy with its own id
+	is.Equal(s.Query, "quadricuspid aortic valve")
+	is.True(s.Link != nil)
+	is.Equal(s.Link.ShareID, link.ID)
+
+	w = userRequest(t, srvConfig, sharesDS, nil, "POST", "/shared/"+link.ID+"/subscribe", "", sharesOJ)
+	is.Equal(w.Code, http.StatusConflict) // expected not to subscribe twice
+	w = userRequest(t, srvConfig, sharesDS, nil, "POST", "/shared/"+link.ID+"/subscribe", "", sharesOwner)
+	is.Equal(w.Code, http.StatusBadRequest) // expected the owner not to subscribe
+
+	body := `{"name": "Mine", "query": "quadricuspid aortic valve"}`
+	w = userRequest(t, srvConfig, sharesDS, nil, "PUT", "/user/searches/"+s.ID.Hex(), body, sharesOJ)
+	is.Equal(w.Code, http.StatusConflict) // expected a linked copy not to be changed
+
+	body = `{"name": "Valves", "query": "quadricuspid aortic valve", "categories": ["cardiology"]}`
+	w = userRequest(t, srvConfig, sharesDS, nil, "PUT", "/user/searches/"+id, body, sharesOwner)
+	is.Equal(w.Code, http.StatusOK)
+	w = userRequest(t, srvConfig, sharesDS, nil, "GET", "/user/searches/"+s.ID.Hex(), "", sharesOJ)
+	is.Equal(w.Code, http.StatusOK)
+	is.NoErr(json.NewDecoder(w.Body).Decode(&s))
+	is.Equal(s.Name, "Valves") // expected the copy to follow the owner's update
+}
+
+func testSharedWithMe(t *testing.T) {
+	is := is.New(t)
+	id := sharesSearchID(t, "quadricuspid aortic valve")
+
+	w := userRequest(t, srvConfig, sharesDS, nil, "POST", "/user/searches/"+id+"/shares", `{"emails": ["DH@rtcl.io"]}`, sharesOwner)
+	is.Equal(w.Code, http.StatusCreated)
+	var sh datastore.Share
+	is.NoErr(json.NewDecoder(w.Body).Decode(&sh))
+	is.Equal(sh.Emails, []string{"dh@rtcl.io"})
+
+	w = userRequest(t, srvConfig, sharesDS, nil, "GET", "/user/shared", "", sharesDH)
+	is.Equal(w.Code, http.StatusOK)
+	var xs []map[string]interface{}
+	is.NoErr(json.NewDecoder(w.Body).Decode(&xs))
+	is.Equal(len(xs), 1)
+	is.Equal(xs[0]["id"], sh.ID)
+	is.Equal(xs[0]["name"], "Valves")
+
+	w = userRequest(t, srvConfig, sharesDS, nil, "GET", "/user/shared", "", sharesOJ)
+	is.Equal(w.Code, http.StatusOK)
+	is.Equal(w.Body.String(), "[]") // expected link shares not to be listed
+	w = userRequest(t, srvConfig, sharesDS, nil, "GET", "/shared/"+sh.ID, "", sharesOJ)
+	is.Equal(w.Code, http.StatusNotFound) // expected other users not to open a named share
+}
+
+func testForkSharedSearch(t *testing.T) {
+	is := is.New(t)
+	id := sharesSearchID(t, "quadricuspid aortic valve")
+	named := sharesOf(t, id)[1]
+
+	w := userRequest(t, srvConfig, sharesDS, nil, "POST", "/shared/"+named.ID+"/subscribe", "", sharesDH)
+	is.Equal(w.Code, http.StatusCreated)
+	var s datastore.Search
+	is.NoErr(json.NewDecoder(w.Body).Decode(&s))
+
+	w = userRequest(t, srvConfig, sharesDS, nil, "POST", "/user/searches/"+s.ID.Hex()+"/fork", "", sharesDH)
+	is.Equal(w.Code, http.StatusOK)
+	var f datastore.Search
+	is.NoErr(json.NewDecoder(w.Body).Decode(&f))
+	is.True(f.Link == nil)
+	is.Equal(f.ID, s.ID)
+
+	body := `{"name": "My valves", "query": "quadricuspid aortic valve"}`
+	w = userRequest(t, srvConfig, sharesDS, nil, "PUT", "/user/searches/"+s.ID.Hex(), body, sharesDH)
+	is.Equal(w.Code, http.StatusOK) // expected a fork to be changed
+
+	w = userRequest(t, srvConfig, sharesDS, nil, "POST", "/user/searches/"+s.ID.Hex()+"/fork", "", sharesDH)
+	is.Equal(w.Code, http.StatusBadRequest) // expected only linked copies to be forked
+}
+
+func testRevokeSearchShare(t *testing.T) {
+	is := is.New(t)
+	id := sharesSearchID(t, "quadricuspid aortic valve")
+	link := sharesOf(t, id)[0]
+
+	w := userRequest(t, srvConfig, sharesDS, nil, "DELETE", "/user/searches/"+id+"/shares/"+link.ID, "", sharesOJ)
+	is.Equal(w.Code, http.StatusNotFound) // expected only the owner to revoke
+	w = userRequest(t, srvConfig, sharesDS, nil, "DELETE", "/user/searches/"+id+"/shares/"+link.ID, "", sharesOwner)
+	is.Equal(w.Code, http.StatusNoContent)
+
+	w = userRequest(t, srvConfig, sharesDS, nil, "GET", "/shared/"+link.ID, "", sharesOJ)
+	is.Equal(w.Code, http.StatusNotFound) // expected a revoked share not to open
+	u, err := sharesDS.UserByID(sharesOJ)
+	is.NoErr(err)
+	is.True(u.SearchExists("quadricuspid aortic valve")) // expected the unlinked copy to be kept
+	for _, s := range u.Searches {
+		is.True(s.Link == nil)
+	}
+	is.Equal(len(sharesOf(t, id)), 1)
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mikedonnici/rtcl-api/datastore"
+)
+
+// Per-IP throttling policy for failed auth attempts. This is more lenient than the per-account lockout because
+// many users can share an IP, eg a hospital network, but stops one client trying passwords across many accounts.
+const (
+	ipFreeAttempts = 20
+	ipBaseLockout  = 10 * time.Second
+	ipMaxLockout   = time.Hour
+	ipForgetAfter  = 24 * time.Hour // failures are forgotten after this long without another failure
+)
+
+// Per-email limit on magic link requests, so that the endpoint cannot be used to flood someone's inbox
+const (
+	magicLinkLimit  = 3
+	magicLinkWindow = 15 * time.Minute
+)
+
+// Per-user limit on sharing searches by email, so that the endpoint cannot be used to send spam. Each share can
+// have up to datastore.MaxShareEmails emails.
+const (
+	shareEmailLimit  = 10
+	shareEmailWindow = time.Hour
+)
+
+// ipThrottle tracks failed auth attempts for each client IP, in memory
+type ipThrottle struct {
+	mu       sync.Mutex
+	now      func() time.Time
+	attempts map[string]*ipAttempts
+}
+
+type ipAttempts struct {
+	failures int
+	accounts map[string]int // failures for each account, which are cleared when it logs in
+	last     time.Time
+	lockout  time.Time
+}
+
+func newIPThrottle(now func() time.Time) *ipThrottle {
+	return &ipThrottle{
+		now:      now,
+		attempts: map[string]*ipAttempts{},
+	}
+}
+
+// attempt returns how long until the ip can try again if it is locked out. Otherwise it records the attempt to log
+// in to the account as a failure, which succeed clears, and returns zero. The check and the failure are recorded
+// together so that a burst of concurrent attempts cannot all get in before the first of them fails.
+func (t *ipThrottle) attempt(ip, account string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	t.forget(now)
+	a, ok := t.attempts[ip]
+	if ok && now.Before(a.lockout) {
+		return a.lockout.Sub(now)
+	}
+	if !ok {
+		a = &ipAttempts{accounts: map[string]int{}}
+		t.attempts[ip] = a
+	}
+	a.failures++
+	a.accounts[account]++
+	a.last = now
+	d := datastore.Backoff(a.failures, ipFreeAttempts, ipBaseLockout, ipMaxLockout)
+	if d > 0 {
+		a.lockout = now.Add(d)
+	}
+	return 0
+}
+
+// succeed clears the failed attempts from the ip for the account that logged in. The failures for other accounts
+// are kept, so that logging in to one account cannot be used to reset the count while trying others.
+func (t *ipThrottle) succeed(ip, account string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	a, ok := t.attempts[ip]
+	if !ok {
+		return
+	}
+	a.failures -= a.accounts[account]
+	delete(a.accounts, account)
+	if a.failures == 0 && !t.now().Before(a.lockout) {
+		delete(t.attempts, ip)
+	}
+}
+
+// forget removes ips that have not failed for a while, so the map does not grow forever
+func (t *ipThrottle) forget(now time.Time) {
+	for ip, a := range t.attempts {
+		if now.Sub(a.last) > ipForgetAfter && !now.Before(a.lockout) {
+			delete(t.attempts, ip)
+		}
+	}
+}
+
+// rateLimiter allows a number of events for each key in a rolling window, in memory
+type rateLimiter struct {
+	mu     sync.Mutex
+	now    func() time.Time
+	limit  int
+	window time.Duration
+	events map[string][]time.Time
+}
+
+func newRateLimiter(now func() time.Time, limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		now:    now,
+		limit:  limit,
+		window: window,
+		events: map[string][]time.Time{},
+	}
+}
+
+// allow records an event for the key if it is within the limit and returns zero, otherwise it returns how long
+// until the next event will be allowed
+func (l *rateLimiter) allow(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+
+	// drop events that are outside the window, for all keys so the map does not grow forever
+	for k, xt := range l.events {
+		var keep []time.Time
+		for _, t := range xt {
+			if now.Sub(t) < l.window {
+				keep = append(keep, t)
+			}
+		}
+		if len(keep) == 0 {
+			delete(l.events, k)
+			continue
+		}
+		l.events[k] = keep
+	}
+
+	xt := l.events[key]
+	if len(xt) >= l.limit {
+		return xt[0].Add(l.window).Sub(now)
+	}
+	l.events[key] = append(xt, now)
+	return 0
+}
+
+// clientIP returns the IP of the client making the request. The X-Forwarded-For header can be set by anyone, so
+// it is only used when the server is configured to trust a proxy, in which case the last (right-most) address is
+// the one added by the proxy.
+func (s *server) clientIP(r *http.Request) string {
+	if s.config.TrustProxy {
+		xs := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		ip := strings.TrimSpace(xs[len(xs)-1])
+		if ip != "" {
+			return ip
+		}
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// respondTooManyRequests responds with 429 and a Retry-After header in whole seconds
+func respondTooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	respondRateLimited(w, wait, errors.New("too many failed attempts, please try again later"))
+}
+
+// respondRateLimited responds with 429, a Retry-After header in whole seconds and the error
+func respondRateLimited(w http.ResponseWriter, wait time.Duration, err error) {
+	secs := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	respondJSON(w, http.StatusTooManyRequests, nil, err)
+}
@@ -0,0 +1,212 @@
+package testdata
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mikedonnici/rtcl-api/datastore"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Users returns the users from MONGO_USERS_DATA, ready to be inserted into any backend
+func Users() ([]datastore.User, error) {
+
+	var xu []struct {
+		ID           bson.ObjectId      `json:"_id"`
+		FirstName    string             `json:"firstName"`
+		LastName     string             `json:"lastName"`
+		Email        string             `json:"email"`
+		Password     string             `json:"password"`
+		Locked       bool               `json:"locked"`
+		Categories   []string           `json:"categories"`
+		Searches     []datastore.Search `json:"searches"`
+		Notification time.Time          `json:"notification"`
+	}
+	err := json.Unmarshal([]byte(MONGO_USERS_DATA), &xu)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unmarshal error")
+	}
+
+	var users []datastore.User
+	for _, u := range xu {
+		// Passwords are stored with the legacy SHA-256 hash so that upgrading to argon2id on login gets tested
+		salt := hash(u.ID.Hex() + os.Getenv("PASSWORD_SALT")) // empty if not present
+		users = append(users, datastore.User{
+			ID:           u.ID,
+			FirstName:    u.FirstName,
+			LastName:     u.LastName,
+			Email:        u.Email,
+			Password:     hash(u.Password + salt),
+			Locked:       u.Locked,
+			Categories:   u.Categories,
+			Searches:     u.Searches,
+			Notification: u.Notification,
+		})
+	}
+	return users, nil
+}
+
+// Logs returns the logs from MONGO_LOGS_DATA, ready to be inserted into any backend
+func Logs() ([]datastore.Log, error) {
+
+	var xl []struct {
+		ID      bson.ObjectId `json:"_id"`
+		UserID  bson.ObjectId `json:"user_id"`
+		Date    string        `json:"date"`
+		PMID    string        `json:"pmid"`
+		Minutes int           `json:"minutes"`
+		Title   string        `json:"title"`
+		Source  string        `json:"source"`
+		URL     string        `json:"url"`
+		Comment string        `json:"comment"`
+	}
+	err := json.Unmarshal([]byte(MONGO_LOGS_DATA), &xl)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unmarshal error")
+	}
+
+	var logs []datastore.Log
+	for _, l := range xl {
+		logs = append(logs, datastore.Log{
+			ID:      l.ID,
+			UserID:  l.UserID,
+			Date:    l.Date,
+			PMID:    l.PMID,
+			Minutes: l.Minutes,
+			Title:   l.Title,
+			Source:  l.Source,
+			URL:     l.URL,
+			Comment: l.Comment,
+		})
+	}
+	return logs, nil
+}
+
+// Articles returns the articles from MONGO_ARTICLES_DATA, ready to be inserted into any backend. The first four
+// are the articles in the logs of user br.
+func Articles() ([]datastore.Article, error) {
+
+	var xa []struct {
+		ID               string    `json:"_id"`
+		Category         string    `json:"category"`
+		Published        time.Time `json:"published"`
+		Title            string    `json:"title"`
+		Summary          string    `json:"summary"`
+		Keywords         []string  `json:"keywords"`
+		URL              string    `json:"url"`
+		SourceName       string    `json:"sourceName"`
+		SourceNameAbbrev string    `json:"sourceNameAbbrev"`
+		SourceVolume     string    `json:"sourceVolume"`
+		SourceIssue      string    `json:"sourceIssue"`
+		SourcePages      string    `json:"sourcePages"`
+		SourcePubDate    string    `json:"sourcePubDate"`
+	}
+	err := json.Unmarshal([]byte(MONGO_ARTICLES_DATA), &xa)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unmarshal error")
+	}
+
+	created := time.Date(2018, 9, 15, 0, 0, 0, 0, time.UTC)
+	var articles []datastore.Article
+	for _, a := range xa {
+		articles = append(articles, datastore.Article{
+			PMID:             a.ID,
+			Category:         a.Category,
+			Created:          created,
+			Updated:          created,
+			Published:        a.Published,
+			Title:            a.Title,
+			Summary:          a.Summary,
+			Keywords:         a.Keywords,
+			URL:              a.URL,
+			SourceName:       a.SourceName,
+			SourceNameAbbrev: a.SourceNameAbbrev,
+			SourceVolume:     a.SourceVolume,
+			SourceIssue:      a.SourceIssue,
+			SourcePages:      a.SourcePages,
+			SourcePubDate:    a.SourcePubDate,
+		})
+	}
+	return articles, nil
+}
+
+// Keys for the test client apps. ClientKey has every scope, ReadOnlyClientKey only has users:read.
+const (
+	ClientKey         = "rtcl_testClientKey"
+	ReadOnlyClientKey = "rtcl_testReadOnlyClientKey"
+)
+
+// Clients returns the test client apps, ready to be inserted into any backend
+func Clients() []datastore.Client {
+	return []datastore.Client{
+		{
+			ID:        bson.ObjectIdHex("5bbc2a6e463cd6029e04de30"),
+			Name:      "Test Client",
+			KeyHash:   datastore.ClientKeyHash(ClientKey),
+			KeyPrefix: ClientKey[:11],
+			Scopes:    datastore.Scopes,
+		},
+		{
+			ID:        bson.ObjectIdHex("5bbc2a6e463cd6029e04de31"),
+			Name:      "Test Read Only Client",
+			KeyHash:   datastore.ClientKeyHash(ReadOnlyClientKey),
+			KeyPrefix: ReadOnlyClientKey[:11],
+			Scopes:    []string{datastore.ScopeUsersRead},
+		},
+	}
+}
+
+// Populate adds the test data to the repositories of any Datastore
+func Populate(ds *datastore.Datastore) error {
+
+	xu, err := Users()
+	if err != nil {
+		return err
+	}
+	for _, u := range xu {
+		err = ds.Users.Save(u)
+		if err != nil {
+			return errors.Wrap(err, "Error saving user")
+		}
+	}
+
+	xl, err := Logs()
+	if err != nil {
+		return err
+	}
+	for _, l := range xl {
+		err = ds.Logs.Save(l)
+		if err != nil {
+			return errors.Wrap(err, "Error saving log")
+		}
+	}
+
+	xa, err := Articles()
+	if err != nil {
+		return err
+	}
+	err = ds.Articles.Upsert(xa...)
+	if err != nil {
+		return errors.Wrap(err, "Error saving articles")
+	}
+
+	for _, c := range Clients() {
+		err = ds.Clients.Save(c)
+		if err != nil {
+			return errors.Wrap(err, "Error saving client")
+		}
+	}
+
+	return nil
+}
+
+// Note this is a copy of the legacy hash function from the datastore package
+func hash(s string) string {
+	h := sha256.New()
+	h.Write([]byte(s))
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
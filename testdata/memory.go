@@ -0,0 +1,16 @@
+package testdata
+
+import (
+	"github.com/mikedonnici/rtcl-api/datastore"
+)
+
+// NewMemoryStore returns an in-memory Datastore populated with the test data. No database server is required
+// so it suits tests that are not about the storage backend itself.
+func NewMemoryStore() (*datastore.Datastore, error) {
+	ds := datastore.NewMemoryStore()
+	err := Populate(ds)
+	if err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
@@ -78,4 +78,113 @@ const MONGO_LOGS_DATA = `[
 	"url": "https://doi.org/10.1016/j.yjmcc.2018.08.023",
 	"comment": "lorem ipsum..."
   }
-]`
\ No newline at end of file
+]`
+const MONGO_ARTICLES_COLLECTION = "articles"
+const MONGO_ARTICLES_DATA = `[
+  {
+	"_id": "30173671",
+	"category": "cardiology",
+	"published": "2018-09-03T00:00:00Z",
+	"title": "Assessment of longitudinal distribution of subclinical atherosclerosis in femoral arteries by three-dimensional cardiovascular magnetic resonance vessel wall imaging",
+	"summary": "Subclinical atherosclerosis of the femoral arteries was assessed with vessel wall imaging.",
+	"keywords": ["Zhang L", "Li D", "Wang J"],
+	"url": "https://doi.org/10.1186/s12968-018-0482-7",
+	"sourceName": "Journal of cardiovascular magnetic resonance",
+	"sourceNameAbbrev": "J Cardiovasc Magn Reson",
+	"sourceVolume": "20",
+	"sourceIssue": "1",
+	"sourcePages": "60",
+	"sourcePubDate": "2018-09-03"
+  },
+  {
+	"_id": "30173079",
+	"category": "cardiology",
+	"published": "2018-08-27T00:00:00Z",
+	"title": "Direct observation of cargo transfer from HDL particles to the plasma membrane",
+	"summary": "HDL particles transfer cholesterol cargo to the plasma membrane of cells.",
+	"keywords": ["Plochberger B", "Röhrl C", "Zhang L"],
+	"url": "https://doi.org/10.1016/j.atherosclerosis.2018.08.032",
+	"sourceName": "Atherosclerosis",
+	"sourceNameAbbrev": "Atherosclerosis",
+	"sourceVolume": "277",
+	"sourcePages": "53-59",
+	"sourcePubDate": "2018-08-27"
+  },
+  {
+	"_id": "30171974",
+	"category": "cardiology",
+	"published": "2018-08-29T00:00:00Z",
+	"title": "Surviving Refractory Out-of-Hospital Ventricular Fibrillation Cardiac Arrest: Critical Care and Extracorporeal Membrane Oxygenation Management",
+	"summary": "Patients with refractory cardiac arrest were treated with extracorporeal membrane oxygenation.",
+	"keywords": ["Bartos JA", "Yannopoulos D"],
+	"url": "https://doi.org/10.1016/j.resuscitation.2018.08.030",
+	"sourceName": "Resuscitation",
+	"sourceNameAbbrev": "Resuscitation",
+	"sourcePubDate": "2018-08-29"
+  },
+  {
+	"_id": "30170119",
+	"category": "cardiology",
+	"published": "2018-08-28T00:00:00Z",
+	"title": "Variable cardiac myosin binding protein-C expression in the myofilaments due to MYBPC3 mutations in hypertrophic cardiomyopathy",
+	"summary": "MYBPC3 mutations in hypertrophic cardiomyopathy lead to variable protein expression.",
+	"keywords": ["Parbhudayal RY", "van der Velden J"],
+	"url": "https://doi.org/10.1016/j.yjmcc.2018.08.023",
+	"sourceName": "Journal of molecular and cellular cardiology",
+	"sourceNameAbbrev": "J Mol Cell Cardiol",
+	"sourcePubDate": "2018-08-28"
+  },
+  {
+	"_id": "30180001",
+	"category": "cardiology",
+	"published": "2018-09-10T00:00:00Z",
+	"title": "HDL cholesterol and subclinical atherosclerosis in young adults",
+	"summary": "Low HDL cholesterol was associated with subclinical atherosclerosis.",
+	"keywords": ["Zhang L", "Smith J"],
+	"url": "https://doi.org/10.1016/j.atherosclerosis.2018.09.001",
+	"sourceName": "Atherosclerosis",
+	"sourceNameAbbrev": "Atherosclerosis",
+	"sourceVolume": "278",
+	"sourcePages": "1-8",
+	"sourcePubDate": "2018-09-10"
+  },
+  {
+	"_id": "30180002",
+	"category": "cardiology",
+	"published": "2018-09-11T00:00:00Z",
+	"title": "Long-term outcomes of septal myectomy in hypertrophic cardiomyopathy",
+	"summary": "Septal myectomy improved survival in obstructive hypertrophic cardiomyopathy.",
+	"keywords": ["Nguyen A", "Schaff HV"],
+	"url": "https://doi.org/10.1161/CIRCULATIONAHA.118.000002",
+	"sourceName": "Circulation",
+	"sourceNameAbbrev": "Circulation",
+	"sourceVolume": "138",
+	"sourceIssue": "11",
+	"sourcePages": "1100-1110",
+	"sourcePubDate": "2018-09-11"
+  },
+  {
+	"_id": "30180003",
+	"category": "physiotherapy",
+	"published": "2018-09-12T00:00:00Z",
+	"title": "Exercise rehabilitation after out-of-hospital cardiac arrest",
+	"summary": "A supervised exercise program improved function after cardiac arrest.",
+	"keywords": ["Jones A"],
+	"url": "https://doi.org/10.1016/j.jphys.2018.09.003",
+	"sourceName": "Journal of physiotherapy",
+	"sourceNameAbbrev": "J Physiother",
+	"sourcePubDate": "2018-09-12"
+  },
+  {
+	"_id": "30180004",
+	"category": "dermatology",
+	"published": "2018-09-13T00:00:00Z",
+	"title": "Melanoma screening in primary care",
+	"summary": "Screening for melanoma in primary care found thinner tumours.",
+	"keywords": ["Brown K"],
+	"url": "https://doi.org/10.1001/jamadermatol.2018.0004",
+	"sourceName": "JAMA dermatology",
+	"sourceNameAbbrev": "JAMA Dermatol",
+	"sourcePubDate": "2018-09-13"
+  }
+]`
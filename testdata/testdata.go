@@ -1,15 +1,12 @@
 package testdata
 
 import (
-	"crypto/sha256"
-	"encoding/json"
 	"fmt"
 	"github.com/hashicorp/go-uuid"
 	"github.com/mikedonnici/rtcl-api/datastore"
+	"github.com/mikedonnici/rtcl-api/datastore/mongo"
 	"github.com/pkg/errors"
 	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
-	"os"
 	"time"
 )
 
@@ -33,6 +30,17 @@ func New() *TestStore {
 	return &t
 }
 
+// MongoAvailable returns true if a Mongo server can be reached at MongoDSN. Tests that run against every backend
+// use this to skip Mongo on machines without a database server.
+func MongoAvailable() bool {
+	s, err := mgo.DialWithTimeout(MongoDSN, time.Second)
+	if err != nil {
+		return false
+	}
+	s.Close()
+	return true
+}
+
 // SetupMongoDB connects to the test database and populates a collection
 func (t *TestStore) SetupMongoDB() error {
 
@@ -58,31 +66,21 @@ func (t *TestStore) SetupMongoDB() error {
 		return err
 	}
 
+	err = t.articleData()
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
 // usersData adds data to the users collection
 func (t *TestStore) usersData() error {
-
-	var xu []struct {
-		ID           bson.ObjectId      `json:"_id" bson:"_id"`
-		FirstName    string             `json:"firstName" bson:"firstName"`
-		LastName     string             `json:"lastName" bson:"lastName"`
-		Email        string             `json:"email" bson:"email"`
-		Password     string             `json:"password" bson:"password"`
-		Locked       bool               `json:"locked" bson:"locked"`
-		Categories   []string           `json:"categories" bson:"categories"`
-		Searches     []datastore.Search `json:"searches" bson:"searches"`
-		Notification time.Time          `json:"notification" bson:"notification"`
-	}
-	err := json.Unmarshal([]byte(MONGO_USERS_DATA), &xu)
+	xu, err := Users()
 	if err != nil {
-		return errors.Wrap(err, "Unmarshal error")
+		return err
 	}
-
 	for _, u := range xu {
-		salt := hash(u.ID.Hex() + os.Getenv("PASSWORD_SALT")) // empty if not present
-		u.Password = hash(u.Password + salt)
 		err = t.MongoDBSession.DB(t.DBName).C(MONGO_USERS_COLLECTION).Insert(u)
 		if err != nil {
 			return errors.Wrap(err, "Error inserting user into mongo")
@@ -93,23 +91,10 @@ func (t *TestStore) usersData() error {
 
 // logData adds data to the log collection
 func (t *TestStore) logData() error {
-
-	var xl []struct {
-		ID      bson.ObjectId `json:"_id" bson:"_id"`
-		UserID  bson.ObjectId `json:"user_id" bson:"user_id"`
-		Date    string        `json:"date" bson:"date"`
-		PMID    string        `json:"pmid" bson:"pmid"`
-		Minutes int           `json:"minutes" bson:"minutes"`
-		Title   string        `json:"title" bson:"title"`
-		Source  string        `json:"source" bson:"source"`
-		URL     string        `json:"url" bson:"url"`
-		Comment string        `json:"comment"" bson:"comment"`
-	}
-	err := json.Unmarshal([]byte(MONGO_LOGS_DATA), &xl)
+	xl, err := Logs()
 	if err != nil {
-		return errors.Wrap(err, "Unmarshal error")
+		return err
 	}
-
 	for _, l := range xl {
 		err = t.MongoDBSession.DB(t.DBName).C(MONGO_LOGS_COLLECTION).Insert(l)
 		if err != nil {
@@ -119,6 +104,15 @@ func (t *TestStore) logData() error {
 	return nil
 }
 
+// Datastore returns a Mongo backed Datastore connected to the test database
+func (t *TestStore) Datastore() (*datastore.Datastore, error) {
+	c, err := mongo.NewConnection(MongoDSN, t.DBName, "test")
+	if err != nil {
+		return nil, err
+	}
+	return datastore.NewMongoStore(c), nil
+}
+
 func (t *TestStore) TearDownMongoDB() error {
 	err := t.MongoDBSession.DB(t.DBName).DropDatabase()
 	if err != nil {
@@ -127,9 +121,17 @@ func (t *TestStore) TearDownMongoDB() error {
 	return nil
 }
 
-// Note this is a copy of the hash function from the datastore package
-func hash(s string) string {
-	h := sha256.New()
-	h.Write([]byte(s))
-	return fmt.Sprintf("%x", h.Sum(nil))
+// articleData adds data to the articles collection
+func (t *TestStore) articleData() error {
+	xa, err := Articles()
+	if err != nil {
+		return err
+	}
+	for _, a := range xa {
+		err = t.MongoDBSession.DB(t.DBName).C(MONGO_ARTICLES_COLLECTION).Insert(a)
+		if err != nil {
+			return errors.Wrap(err, "Error inserting article into mongo")
+		}
+	}
+	return nil
 }